@@ -0,0 +1,137 @@
+import { DatabaseManager } from "../database/DatabaseManager";
+import { IAlert } from "../database/schemas/alert";
+import { IComputedDynamicData, IMachine } from "../database/schemas/machine";
+import { Time } from "../types";
+import type { WebhookDispatcher } from "./webhookDispatcher.class";
+import { alertBreached, alertMetricValue, AlertPayload, deliverAlert } from "../utils/alerts";
+import { Logger } from "../utils/logger";
+import { metrics } from "../utils/metrics";
+
+// Graphed to see whether the webhooks of the users are working
+const fired = metrics.counter("xornet_alerts_fired_total", "How many alerts were sent to their webhook", ["result"]);
+
+type AlertMachine = Pick<IMachine, "uuid" | "name">;
+
+/**
+ * Checks the stats coming in from the reporters against the alert rules of their machine, the stats are queued
+ * and checked on the next tick so ingesting them never waits for the database or a webhook
+ */
+export class AlertEvaluator {
+  // How long the rules of a machine are cached, rules changed on another shard are picked up after this
+  public static RULES_TTL = Time.Minute;
+
+  private rules = new Map<string, { rules: IAlert[]; loaded_at: number }>();
+  // When each rule started breaking its threshold
+  private breaching = new Map<string, number>();
+  // Only the latest stats of each machine are checked if they come in faster than they're evaluated
+  private pending = new Map<string, { machine: AlertMachine; stats: IComputedDynamicData }>();
+  private scheduled = false;
+
+  /**
+   * @param webhooks Where the webhooks of the owners subscribed to alert.fired are told about the alerts
+   */
+  public constructor(
+    private db: DatabaseManager,
+    private deliver = deliverAlert,
+    private webhooks?: Pick<WebhookDispatcher, "emit">
+  ) {}
+
+  /**
+   * Queues the stats of a machine to be checked against its rules
+   */
+  public observe(machine: AlertMachine, stats: IComputedDynamicData) {
+    this.pending.set(machine.uuid, { machine: { uuid: machine.uuid, name: machine.name }, stats });
+    if (this.scheduled) return;
+    this.scheduled = true;
+    setImmediate(() => this.flush());
+  }
+
+  /**
+   * Drops the cached rules of a machine so changes on this shard apply right away
+   */
+  public invalidate(machine_uuid: string) {
+    this.rules.delete(machine_uuid);
+  }
+
+  private async flush() {
+    this.scheduled = false;
+    const batch = [...this.pending.values()];
+    this.pending.clear();
+    await Promise.all(
+      batch.map(({ machine, stats }) =>
+        this.evaluate(machine, stats).catch((error) => Logger.error(`Failed to evaluate the alerts of ${machine.uuid}`, error))
+      )
+    );
+  }
+
+  private async rulesOf(machine_uuid: string, now: number) {
+    const cached = this.rules.get(machine_uuid);
+    if (cached && now - cached.loaded_at < AlertEvaluator.RULES_TTL) return cached.rules;
+    const rules = (await this.db.find_alerts(machine_uuid)).filter((rule) => rule.metric !== "offline");
+    this.rules.set(machine_uuid, { rules, loaded_at: now });
+    return rules;
+  }
+
+  /**
+   * Checks the stats of a machine against its rules and fires the ones that broke their threshold for long enough
+   * @param machine The machine the stats are from
+   * @param stats The stats it reported
+   * @param now When the stats came in
+   * @tested
+   */
+  public async evaluate(machine: AlertMachine, stats: IComputedDynamicData, now = stats.timestamp) {
+    const rules = await this.rulesOf(machine.uuid, now);
+    await Promise.all(
+      rules.map(async (rule) => {
+        const value = alertMetricValue(stats, rule.metric);
+        if (value === undefined || !alertBreached(rule.operator, rule.threshold!, value)) {
+          this.breaching.delete(rule.uuid);
+          return;
+        }
+        const since = this.breaching.get(rule.uuid) ?? now;
+        this.breaching.set(rule.uuid, since);
+        if (now - since >= rule.duration) await this.fire(rule, machine, value, now, now - rule.cooldown);
+      })
+    );
+  }
+
+  /**
+   * Fires the offline rules of the machines that have been gone for long enough, once per time they go offline
+   * @param now The time to check against
+   */
+  public async evaluateOffline(now = Date.now()) {
+    const due = await this.db.find_due_offline_alerts(now);
+    await Promise.all(
+      due.map(({ rule, machine }) =>
+        // Firing before it was last seen means it was for an earlier time it went offline
+        this.fire(rule, machine, now - machine.last_seen!, now, Math.min(now - rule.cooldown, machine.last_seen!))
+      )
+    );
+  }
+
+  /**
+   * Notifies the target of a rule unless it fired too recently
+   * @param fired_before The rule only fires if it last fired before this
+   */
+  private async fire(rule: IAlert, machine: AlertMachine, observed: number, now: number, fired_before: number) {
+    if (rule.last_fired_at !== undefined && rule.last_fired_at >= fired_before) return;
+    if (!(await this.db.claim_alert(rule.uuid, now, fired_before))) return;
+    rule.last_fired_at = now;
+
+    const { uuid, metric, operator, threshold, duration } = rule;
+    const payload: AlertPayload = {
+      machine: { uuid: machine.uuid, name: machine.name },
+      rule: { uuid, metric, operator, threshold, duration },
+      observed,
+      fired_at: now,
+    };
+    this.webhooks?.emit("alert.fired", [machine.uuid], { alert: { rule: payload.rule, observed, fired_at: now } });
+    await this.deliver(rule.target, payload).then(
+      () => fired.inc({ result: "ok" }),
+      (error) => {
+        fired.inc({ result: "failed" });
+        Logger.warn(`Failed to deliver alert ${rule.uuid} of ${machine.uuid}: ${error?.message ?? error}`);
+      }
+    );
+  }
+}
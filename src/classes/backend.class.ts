@@ -3,25 +3,57 @@ import express, { Express } from "express";
 import fs from "fs";
 import http from "http";
 import https from "https";
+import { Socket } from "net";
 import { DatabaseManager } from "../database/DatabaseManager";
-import { checkEnvironmentVariables } from "../logic";
-import cors from "../middleware/cors";
-import log from "../middleware/log";
+import type { Config } from "../config";
+import { init_compression } from "../middleware/compression";
+import { init_context } from "../middleware/context";
+import { init_cors } from "../middleware/cors";
+import { init_security_headers } from "../middleware/security";
+import { init_timeout } from "../middleware/timeout";
+import { proxy_hops } from "../middleware/ratelimit";
+import { init_json_body } from "../middleware/validate";
+import { init_request_log } from "../middleware/log";
+import metrics from "../middleware/metrics";
+import { redisPublisher, redisSubscriber } from "../redis";
 import { V1 } from "../routes/v1/v1";
+import { Time } from "../types";
+import { ErrorCode, errorHandler, sendError } from "../utils/errors";
 import { Logger } from "../utils/logger";
+import { createMailer } from "../utils/mailer";
+import { UPLOADS_ROUTE } from "../utils/uploads";
 import { WebsocketManager } from "./websocketManager.class";
-import compression from "compression";
 
 export class Backend {
-  public express: Express = express().use(compression()).use(cors).use(log).use(express.json()).use(new V1(this.db).router);
-  public port = process.env.PORT!;
-  public verbose = process.env.VERBOSE!;
-  public secure = process.env.SECURE! === "true";
+  /**
+   * How long in-flight requests get to finish when shutting down before they're aborted
+   */
+  public static SHUTDOWN_DEADLINE = 10 * Time.Second;
+
+  // Aborts the signal of every in-flight request once the shutdown deadline passes
+  private shutdownController = new AbortController();
+  // How many requests each keep-alive socket is serving, the idle ones are closed right away when shutting down
+  private sockets = new Map<Socket, number>();
+  private shuttingDown = false;
+
+  public express: Express = express()
+    .use(init_request_log())
+    .use(init_context(this.shutdownController.signal))
+    .use(init_timeout(this.config.request_timeout))
+    .use(init_compression(this.config.compression))
+    .use(init_security_headers(this.config.mode === "production"))
+    .use(init_cors(this.config.cors_origins))
+    .use(metrics)
+    .use(init_json_body(this.config.limits.json_body))
+    .use(UPLOADS_ROUTE, express.static(this.config.uploads.dir));
+  public port = this.config.port;
+  public verbose = this.config.verbose;
+  public secure = this.config.secure;
   public server: http.Server | https.Server;
   public websocketManager: WebsocketManager;
 
-  private constructor(public db: DatabaseManager) {
-    checkEnvironmentVariables(["JWT_SECRET", "PORT", "SECURE", "VERBOSE"]);
+  private constructor(public db: DatabaseManager, private config: Config) {
+    proxy_hops.trusted = config.trusted_proxy_hops;
     this.server = this.secure
       ? https.createServer(
           {
@@ -31,12 +63,36 @@ export class Backend {
           this.express
         )
       : http.createServer(this.express);
-    this.websocketManager = new WebsocketManager(this.server, this.db);
+    this.server.on("connection", (socket: Socket) => {
+      this.sockets.set(socket, 0);
+      socket.once("close", () => this.sockets.delete(socket));
+    });
+    this.server.on("request", (req: http.IncomingMessage, res: http.ServerResponse) => {
+      const socket = req.socket as Socket;
+      this.sockets.set(socket, (this.sockets.get(socket) ?? 0) + 1);
+      res.once("close", () => {
+        const requests = (this.sockets.get(socket) ?? 1) - 1;
+        this.sockets.set(socket, requests);
+        if (this.shuttingDown && !requests) socket.destroy();
+      });
+    });
+    // Upgraded sockets belong to the websocket manager which closes them itself
+    this.server.on("upgrade", (req: http.IncomingMessage) => this.sockets.delete(req.socket as Socket));
+    this.websocketManager = new WebsocketManager(this.server, this.db, config);
+    const mailer = createMailer(config.smtp, config.mode === "production");
+    this.express
+      .use(new V1(this.db, this.websocketManager, mailer, config).router)
+      .use((_, res) => sendError(res, 404, ErrorCode.RouteNotFound))
+      .use(errorHandler);
   }
 
-  public static async create() {
-    const db = await DatabaseManager.new();
-    const server = new this(db);
+  /**
+   * Connects to the database and starts listening
+   * @param config The config loaded on startup
+   */
+  public static async create(config: Config) {
+    const db = await DatabaseManager.new(config);
+    const server = new this(db, config);
     server.listen();
     return server;
   }
@@ -46,7 +102,41 @@ export class Backend {
       this.port,
       () =>
         this.verbose &&
-        Logger.info(`Started on port ${chalk.blue(`http${this.secure ? "s" : ""}://127.0.0.1:${this.port.toString()}`)}`)
+        Logger.info(`Started on port ${chalk.blue(`http${this.secure ? "s" : ""}://127.0.0.1:${this.port}`)}`)
     );
   }
+
+  /**
+   * Stops accepting connections and waits for the in-flight requests to finish, once the deadline passes
+   * they're aborted and their sockets destroyed, then the database and redis connections are closed
+   * @param deadline How long to wait for in-flight requests in milliseconds
+   */
+  public async shutdown(deadline = Backend.SHUTDOWN_DEADLINE) {
+    const start = Date.now();
+    this.shuttingDown = true;
+
+    Logger.info("Shutdown: closing the http server");
+    const closed = new Promise<void>((resolve) => this.server.close(() => resolve()));
+    this.sockets.forEach((requests, socket) => !requests && socket.destroy());
+
+    Logger.info("Shutdown: closing websockets");
+    await this.websocketManager.close();
+
+    Logger.info(`Shutdown: draining ${this.sockets.size} connections`);
+    const timeout = setTimeout(() => {
+      Logger.warn(`Shutdown: aborting ${this.sockets.size} connections that didn't finish in time`);
+      this.shutdownController.abort();
+      this.sockets.forEach((_, socket) => socket.destroy());
+    }, deadline);
+    await closed;
+    clearTimeout(timeout);
+
+    Logger.info("Shutdown: disconnecting MongoDB");
+    await this.db.disconnect();
+
+    Logger.info("Shutdown: disconnecting redis");
+    await Promise.allSettled([redisPublisher.quit(), redisSubscriber.quit()]);
+
+    Logger.info(`Shutdown: done in ${Date.now() - start}ms`);
+  }
 }
@@ -0,0 +1,160 @@
+import { Time } from "../types";
+import { Logger } from "../utils/logger";
+import { metrics } from "../utils/metrics";
+
+const requests = metrics.counter("xornet_cache_requests_total", "How many cached reads were hits or misses", [
+  "kind",
+  "result",
+]);
+
+// How long a cached read is served for unless CACHE_TTL is set, 0s turns the cache off
+export const CACHE_TTL = 10 * Time.Second;
+
+/**
+ * What's cached, the values are keyed by the uuid of the document they were made from
+ */
+export type CacheKind = "user" | "machine" | "datacenter";
+
+/**
+ * Who a cached value was made for, a value is only ever read back with the scope it was stored with
+ * so what's cached for a viewer or a share link can't end up in a public response
+ */
+export type CacheScope = "public" | `viewer:${string}` | `share:${string}`;
+
+/**
+ * Where the cache keeps its values, anything shared like redis can implement this so every shard
+ * sees the same values and the invalidations of the others
+ */
+export interface CacheStore {
+  /**
+   * Gets a value, undefined when it isn't cached or expired
+   * @param entity The kind and uuid of the document it was made from
+   * @param scope Who it was made for
+   */
+  get(entity: string, scope: CacheScope): Promise<unknown | undefined>;
+  set(entity: string, scope: CacheScope, value: unknown, ttl: number): Promise<void>;
+  /**
+   * Drops the values of some documents in every scope
+   * @param kind What the documents are
+   * @param entities The documents, every document of the kind when it's missing
+   */
+  invalidate(kind: CacheKind, entities?: string[]): Promise<void>;
+}
+
+/**
+ * Keeps the values in memory serialized the same way a shared store would have to,
+ * only correct when there's a single instance of the backend since the others keep serving theirs until they expire
+ */
+export class MemoryCacheStore implements CacheStore {
+  public entities = new Map<string, Map<CacheScope, { json: string; expires_at: number }>>();
+  private sweeper: NodeJS.Timer;
+
+  public constructor(sweep_interval = Time.Minute) {
+    this.sweeper = setInterval(() => this.sweep(Date.now()), sweep_interval);
+    this.sweeper.unref();
+  }
+
+  public async get(entity: string, scope: CacheScope) {
+    const cached = this.entities.get(entity)?.get(scope);
+    if (!cached || cached.expires_at <= Date.now()) return undefined;
+    // Parsed on every read so no caller can change what the others get
+    return JSON.parse(cached.json);
+  }
+
+  public async set(entity: string, scope: CacheScope, value: unknown, ttl: number) {
+    let scopes = this.entities.get(entity);
+    if (!scopes) this.entities.set(entity, (scopes = new Map()));
+    scopes.set(scope, { json: JSON.stringify(value), expires_at: Date.now() + ttl });
+  }
+
+  public async invalidate(kind: CacheKind, entities?: string[]) {
+    if (entities) return entities.forEach((entity) => this.entities.delete(entity));
+    for (const entity of this.entities.keys()) entity.startsWith(`${kind}:`) && this.entities.delete(entity);
+  }
+
+  /**
+   * Removes the values that expired since they're never served again
+   */
+  public sweep(now: number) {
+    for (const [entity, scopes] of this.entities.entries()) {
+      for (const [scope, cached] of scopes.entries()) cached.expires_at <= now && scopes.delete(scope);
+      scopes.size || this.entities.delete(entity);
+    }
+  }
+
+  public stop() {
+    clearInterval(this.sweeper);
+  }
+}
+
+/**
+ * A read that's waiting on the database, invalidating its document while it's waiting means what it read may be
+ * from before the write so it isn't cached
+ */
+interface PendingLoad {
+  kind: CacheKind;
+  entity: string;
+  stale: boolean;
+  promise: Promise<unknown>;
+}
+
+/**
+ * Caches the reads that are made over and over again for a short time, they're dropped as soon as the documents
+ * they were made from are written to so the TTL is only how stale the other shards can be
+ */
+export class Cache {
+  private pending = new Map<string, PendingLoad>();
+
+  /**
+   * @param store Where the values are kept
+   * @param ttl How long a value is served for in milliseconds, nothing is cached when it's 0
+   */
+  public constructor(public store: CacheStore = new MemoryCacheStore(), public ttl = CACHE_TTL) {}
+
+  /**
+   * Gets a value from the cache or makes it, reads of the same value at the same time share the same load
+   * @param kind What the value is made from
+   * @param uuid The uuid of the document it's made from
+   * @param scope Who it's for, it's only served to the same scope again
+   * @param load Makes the value when it isn't cached, it must only have what the scope is allowed to see
+   * @tested
+   */
+  public async wrap<T>(kind: CacheKind, uuid: string, scope: CacheScope, load: () => Promise<T>): Promise<T> {
+    if (this.ttl <= 0) return load();
+    const entity = `${kind}:${uuid}`;
+    const cached = await this.store.get(entity, scope);
+    requests.inc({ kind, result: cached === undefined ? "miss" : "hit" });
+    if (cached !== undefined) return cached as T;
+
+    const key = `${entity}\u0000${scope}`;
+    const existing = this.pending.get(key);
+    if (existing) return existing.promise as Promise<T>;
+    const pending: PendingLoad = { kind, entity, stale: false, promise: load() };
+    this.pending.set(key, pending);
+    try {
+      const value = await pending.promise;
+      if (!pending.stale) await this.store.set(entity, scope, value, this.ttl);
+      return value as T;
+    } finally {
+      this.pending.get(key) === pending && this.pending.delete(key);
+    }
+  }
+
+  /**
+   * Drops the values made from some documents, the loads still waiting on them aren't cached when they finish
+   * @param kind What the documents are
+   * @param uuids The uuids of the documents, every document of the kind when it's missing
+   * @tested
+   */
+  public async invalidate(kind: CacheKind, uuids?: string[]) {
+    const entities = uuids?.map((uuid) => `${kind}:${uuid}`);
+    for (const pending of this.pending.values())
+      if (pending.kind === kind && (!entities || entities.includes(pending.entity))) pending.stale = true;
+    await this.store
+      .invalidate(kind, entities)
+      .catch((error) => Logger.error(`Failed to invalidate the cached ${kind}s`, error));
+  }
+}
+
+// The DatabaseManager sets its TTL from the config
+export const cache = new Cache();
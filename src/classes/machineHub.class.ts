@@ -0,0 +1,108 @@
+import { Emitter } from "mitt";
+import { MittEvent } from "../utils/mitt";
+
+/**
+ * Whatever a client is connected through, a websocket or an SSE stream
+ */
+export interface HubConnection<T extends MittEvent> {
+  emit: Emitter<T>["emit"];
+  onClose: (callback: () => void) => void;
+}
+
+/**
+ * A client that is subscribed to the updates of some machines
+ */
+interface HubClient<T extends MittEvent> {
+  connection: HubConnection<T>;
+  userUuid: string;
+  machines: Set<string>;
+}
+
+/**
+ * Fans out machine updates to only the clients that are subscribed to that machine
+ */
+export class MachineHub<T extends MittEvent> {
+  private clients = new Map<HubConnection<T>, HubClient<T>>();
+  private subscriptions = new Map<string, Set<HubClient<T>>>();
+
+  /**
+   * Registers a client and subscribes it to the given machines,
+   * the client gets unregistered automatically when its socket closes
+   * @param connection The websocket or stream of the client
+   * @param userUuid The uuid of the user the client is logged in as
+   * @param machineUuids The machines the client should receive updates of
+   */
+  public register(connection: HubConnection<T>, userUuid: string, machineUuids: string[]) {
+    this.unregister(connection);
+    const client: HubClient<T> = { connection, userUuid, machines: new Set() };
+    this.clients.set(connection, client);
+    machineUuids.forEach((uuid) => this.subscribe(connection, uuid));
+    connection.onClose(() => this.unregister(connection));
+  }
+
+  /**
+   * Removes a client and all of its subscriptions
+   */
+  public unregister(connection: HubConnection<T>) {
+    const client = this.clients.get(connection);
+    if (!client) return;
+    client.machines.forEach((uuid) => this.unsubscribe(connection, uuid));
+    this.clients.delete(connection);
+  }
+
+  public subscribe(connection: HubConnection<T>, machineUuid: string) {
+    const client = this.clients.get(connection);
+    if (!client) return;
+    client.machines.add(machineUuid);
+    if (!this.subscriptions.has(machineUuid)) this.subscriptions.set(machineUuid, new Set());
+    this.subscriptions.get(machineUuid)!.add(client);
+  }
+
+  public unsubscribe(connection: HubConnection<T>, machineUuid: string) {
+    const client = this.clients.get(connection);
+    if (!client) return;
+    client.machines.delete(machineUuid);
+    const subscribers = this.subscriptions.get(machineUuid);
+    subscribers?.delete(client);
+    if (subscribers?.size === 0) this.subscriptions.delete(machineUuid);
+  }
+
+  /**
+   * Subscribes every client of a user to a machine, used when a user gets a new machine
+   */
+  public subscribeUser(userUuid: string, machineUuid: string) {
+    this.clients.forEach((client) => client.userUuid === userUuid && this.subscribe(client.connection, machineUuid));
+  }
+
+  /**
+   * Unsubscribes every client of a user from a machine, used when a user loses access to a machine
+   */
+  public unsubscribeUser(userUuid: string, machineUuid: string) {
+    this.clients.forEach((client) => client.userUuid === userUuid && this.unsubscribe(client.connection, machineUuid));
+  }
+
+  /**
+   * Unsubscribes every client from a machine, used when a machine is deleted
+   */
+  public unsubscribeMachine(machineUuid: string) {
+    this.subscriptions.get(machineUuid)?.forEach((client) => this.unsubscribe(client.connection, machineUuid));
+  }
+
+  /**
+   * Sends an event to every client subscribed to a machine, slow clients get their oldest frames dropped
+   * by their connection so they can't hold up everyone else
+   * @param machineUuid The machine the event is about
+   * @param event The name of the event
+   * @param data The data to send
+   */
+  public publish(machineUuid: string, event: keyof T, data: T[keyof T]) {
+    this.subscriptions.get(machineUuid)?.forEach((client) => client.connection.emit(event, data));
+  }
+
+  /**
+   * The amount of clients currently registered
+   */
+  public get size() {
+    return this.clients.size;
+  }
+}
@@ -0,0 +1,103 @@
+/**
+ * The hits of a key in the current window and the one before it
+ */
+export interface RateLimitWindow {
+  current: number;
+  previous: number;
+}
+
+/**
+ * Where the limiter keeps its counters, anything shared like redis can implement this
+ * so every shard sees the same limits
+ */
+export interface RateLimitStore {
+  /**
+   * Adds a hit to a key
+   * @param key The client being limited
+   * @param windowStart When the current window started
+   * @param window How long a window is in milliseconds
+   */
+  hit(key: string, windowStart: number, window: number): Promise<RateLimitWindow>;
+  reset(key: string): Promise<void>;
+}
+
+/**
+ * Keeps the counters in memory, only correct when there's a single instance of the backend
+ */
+export class MemoryRateLimitStore implements RateLimitStore {
+  public windows = new Map<string, RateLimitWindow & { start: number }>();
+  private sweeper: NodeJS.Timer;
+
+  public constructor(window: number) {
+    this.sweeper = setInterval(() => this.sweep(Date.now(), window), window);
+    this.sweeper.unref();
+  }
+
+  public async hit(key: string, windowStart: number, window: number) {
+    let entry = this.windows.get(key);
+    if (!entry || entry.start < windowStart - window) entry = { start: windowStart, current: 0, previous: 0 };
+    // Roll over into a new window, the old current becomes the previous one
+    else if (entry.start < windowStart) entry = { start: windowStart, current: 0, previous: entry.current };
+    entry.current++;
+    this.windows.set(key, entry);
+    return { current: entry.current, previous: entry.previous };
+  }
+
+  public async reset(key: string) {
+    this.windows.delete(key);
+  }
+
+  /**
+   * Removes the keys that haven't been hit in the last two windows since they don't affect anything anymore
+   */
+  public sweep(now: number, window: number) {
+    for (const [key, entry] of this.windows.entries()) {
+      if (entry.start < now - 2 * window) this.windows.delete(key);
+    }
+  }
+
+  public stop() {
+    clearInterval(this.sweeper);
+  }
+}
+
+/**
+ * A sliding window limiter, the hits of the previous window are weighted by how much of it
+ * still overlaps the last `window` milliseconds so there's no burst allowed at the edge of a window
+ */
+export class RateLimiter {
+  /**
+   * @param limit How many requests a key can make in a window
+   * @param window How long a window is in milliseconds
+   * @param store Where the counters are kept
+   */
+  public constructor(
+    public limit: number,
+    public window: number,
+    public store: RateLimitStore = new MemoryRateLimitStore(window)
+  ) {}
+
+  /**
+   * Counts a request of a key
+   * @returns whether the request is allowed, how many requests are left, when the window resets
+   * and how many milliseconds until the key can make a request again
+   */
+  public async consume(key: string, now = Date.now()) {
+    const windowStart = now - (now % this.window);
+    const reset = windowStart + this.window;
+    const { current, previous } = await this.store.hit(key, windowStart, this.window);
+    const overlap = 1 - (now - windowStart) / this.window;
+    const count = previous * overlap + current;
+
+    const allowed = count <= this.limit;
+    const remaining = Math.max(0, Math.floor(this.limit - count));
+    // How long until enough of the previous window slides out, if that's not enough then the next window
+    const slideOut = previous ? ((count - this.limit) * this.window) / previous : Infinity;
+    const retryAfter = allowed ? 0 : Math.ceil(Math.min(reset - now, slideOut));
+    return { allowed, remaining, reset, retryAfter };
+  }
+
+  public reset(key: string) {
+    return this.store.reset(key);
+  }
+}
@@ -0,0 +1,150 @@
+import axios from "axios";
+import { DatabaseManager } from "../database/DatabaseManager";
+import { IWebhook, sign_webhook, WebhookEvent } from "../database/schemas/webhook";
+import { IWebhookDelivery, WebhookData } from "../database/schemas/webhookDelivery";
+import { Time } from "../types";
+import { Logger } from "../utils/logger";
+import { metrics } from "../utils/metrics";
+
+// Graphed to see whether the webhooks of the users are working
+const delivered = metrics.counter("xornet_webhook_deliveries_total", "How many webhook deliveries were attempted", [
+  "result",
+]);
+
+// Receivers that take longer than this to answer are retried later
+const WEBHOOK_TIMEOUT = 10 * Time.Second;
+
+/**
+ * Sends a delivery to its webhook, anything but a 2xx is a failure
+ */
+export const postWebhook = async (webhook: Pick<IWebhook, "url" | "secret">, delivery: IWebhookDelivery) => {
+  await axios.post(webhook.url, delivery.body, {
+    timeout: WEBHOOK_TIMEOUT,
+    // Redirects could point the request at something on our own network
+    maxRedirects: 0,
+    headers: {
+      "content-type": "application/json",
+      "user-agent": "Xornet-Webhooks",
+      "x-xornet-event": delivery.event,
+      "x-xornet-delivery": delivery.uuid,
+      "x-xornet-signature": sign_webhook(webhook.secret, delivery.body),
+    },
+  });
+};
+
+/**
+ * Sends the events of the machines to the webhooks of their owners. The events are queued and written on the
+ * next tick so emitting them never waits for the database, and a pool of workers sends what's written so a slow
+ * receiver never holds up a request or the websockets. The deliveries are in the database so the workers of
+ * every shard share them and the retries survive a restart
+ */
+export class WebhookDispatcher {
+  // How many deliveries this shard sends at the same time
+  public static WORKERS = 4;
+  // How often the idle workers look for retries that came due, new events wake them up right away
+  public static POLL_INTERVAL = 5 * Time.Second;
+
+  private pending: { event: WebhookEvent; machine_uuids: string[]; data?: WebhookData }[] = [];
+  private scheduled = false;
+  private running = false;
+  private workers: Promise<void>[] = [];
+  private sleeping = new Set<() => void>();
+
+  public constructor(private db: DatabaseManager, private post = postWebhook) {}
+
+  /**
+   * Queues an event of some machines for the webhooks of their owners that are subscribed to it
+   * @param data What else the event is about, like the rule of an alert
+   */
+  public emit(event: WebhookEvent, machine_uuids: string[], data?: WebhookData) {
+    if (!machine_uuids.length) return;
+    this.pending.push({ event, machine_uuids, data });
+    if (this.scheduled) return;
+    this.scheduled = true;
+    setImmediate(() => this.flush());
+  }
+
+  /**
+   * Wakes up the idle workers so a delivery that was just written is sent right away
+   */
+  public wake() {
+    this.sleeping.forEach((wake) => wake());
+  }
+
+  public start() {
+    if (this.running) return;
+    this.running = true;
+    this.workers = Array.from({ length: WebhookDispatcher.WORKERS }, () => this.work());
+  }
+
+  /**
+   * Stops the workers once they're done with what they're sending, what's left is sent by the other shards
+   * or after the restart
+   */
+  public async stop() {
+    this.running = false;
+    this.wake();
+    await Promise.all(this.workers);
+  }
+
+  private async flush() {
+    this.scheduled = false;
+    const batch = this.pending;
+    this.pending = [];
+    const now = Date.now();
+    await Promise.all(
+      batch.map(({ event, machine_uuids, data }) =>
+        this.db
+          .queue_webhook_deliveries(event, machine_uuids, now, data)
+          .catch((error) => Logger.error(`Failed to queue the ${event} webhooks`, error))
+      )
+    );
+    this.wake();
+  }
+
+  private sleep() {
+    return new Promise<void>((resolve) => {
+      const wake = () => {
+        clearTimeout(timer);
+        this.sleeping.delete(wake);
+        resolve();
+      };
+      const timer = setTimeout(wake, WebhookDispatcher.POLL_INTERVAL);
+      timer.unref();
+      this.sleeping.add(wake);
+    });
+  }
+
+  private async work() {
+    while (this.running) {
+      const delivery = await this.db.claim_webhook_delivery(Date.now()).catch((error) => {
+        Logger.error("Failed to look for webhook deliveries", error);
+        return null;
+      });
+      if (!delivery) await this.sleep();
+      else await this.attempt(delivery);
+    }
+  }
+
+  /**
+   * Sends a delivery the worker claimed, it's retried later if it fails
+   * @tested
+   */
+  public async attempt(delivery: IWebhookDelivery, now = Date.now()) {
+    try {
+      const webhook = await this.db.find_delivery_webhook(delivery);
+      // Deleted since the event, its deliveries go with it
+      if (!webhook) return await this.db.drop_webhook_delivery(delivery);
+      const failed = await this.post(webhook, delivery).then(
+        () => undefined,
+        (error) => String(error?.response?.status ?? error?.message ?? error)
+      );
+      delivered.inc({ result: failed ? "failed" : "ok" });
+      failed
+        ? await this.db.fail_webhook_delivery(delivery, failed, now)
+        : await this.db.complete_webhook_delivery(delivery);
+    } catch (error) {
+      Logger.error(`Failed to record the attempt of webhook delivery ${delivery.uuid}`, error);
+    }
+  }
+}
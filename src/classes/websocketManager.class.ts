@@ -1,25 +1,85 @@
 import http from "http";
+import { Document } from "mongoose";
+import type { Config } from "../config";
 import { DatabaseManager } from "../database/DatabaseManager";
-import { ISafeMachine, IStaticData, IMachine, IDynamicData, INetwork, MachineStatus } from "../database/schemas/machine";
-import { isVirtualInterface } from "../logic";
+import {
+  ISafeMachine,
+  IStaticData,
+  IMachine,
+  IDynamicData,
+  IComputedDynamicData,
+  MachineStatus,
+  MachineStatusChange,
+} from "../database/schemas/machine";
+import { IMachineEvent } from "../database/schemas/machineEvent";
+import { IPublicStats, IShareLink, public_stats } from "../database/schemas/shareLink";
+import { computeDynamicData } from "../logic";
 import { redisSubscriber, redisPublisher } from "../redis";
 import { MittEvent } from "../utils/mitt";
-import { newWebSocketHandler, WebsocketConnection } from "../utils/ws";
+import { FrameEncoding, newWebSocketHandler, WebsocketConnection } from "../utils/ws";
+import {
+  DEFAULT_REPORTER_PROTOCOL,
+  negotiateReporterProtocol,
+  ReporterProtocol,
+  ReporterProtocolRejection,
+  requestedReporterProtocol,
+} from "../utils/reporterProtocol";
+import { SseConnection } from "../utils/sse";
+import { Time } from "../types";
+import { Logger } from "../utils/logger";
+import { metrics } from "../utils/metrics";
+import { MachineHub } from "./machineHub.class";
+import { AlertEvaluator } from "./alertEvaluator.class";
+import { deliverAlert } from "../utils/alerts";
+import { WebhookDispatcher } from "./webhookDispatcher.class";
+import { Validators } from "../validators";
+import { client_ip } from "../middleware/ratelimit";
+import { loadGeoIp, MaxMindReader, resolveNetwork } from "../utils/geoip";
 
+// Graphed as a rate to see how many stats every shard is writing
+const ingested = metrics.counter("xornet_stats_ingested_total", "How many stats the reporters sent were stored", ["result"]);
+// Graphed to see how many reporters are still on the first protocol
+const connected = metrics.counter("xornet_reporter_connections_total", "Which protocols the reporters connect with", [
+  "version",
+  "encoding",
+]);
+
+/**
+ * The frames clients send on /ws/machines, every frame is {"e": event, "d": data}
+ */
 export interface ClientToBackendEvents extends MittEvent {
+  // Subscribes to every machine the user can see and answers with a snapshot of them
   login: { auth_token: string };
+  // Subscribes to more machines and answers with a snapshot of the ones the user can see
+  subscribe: { machines: string[] };
+  unsubscribe: { machines: string[] };
   close: {};
 }
 
+/**
+ * The frames clients get on /ws/machines
+ */
 export interface BackendToClientEvents extends MittEvent {
   heartbeat: {};
-  "dynamic-data": { machines: ISafeMachine[] };
+  // The latest stats of the machines right after subscribing so the dashboard isn't empty until they report
+  snapshot: { machines: MachineSnapshot };
+  // An update with new stats whenever a subscribed machine reports
+  "dynamic-data": IComputedDynamicData;
   "machine-added": { machine: ISafeMachine };
   "machine-disconnected": { machine: ISafeMachine };
+  "machine-status": MachineStatusChange;
+  // The machine was deleted, no more frames of it follow
+  "machine-removed": { uuid: string };
+  shutdown: {};
 }
 
+/**
+ * The frames reporters send on /reporter, MessagePack ones are binary frames of the same {"e": event, "d": data}
+ */
 export interface ReporterToBackendEvents extends MittEvent {
   close: {};
+  // Picks the protocol when it wasn't in the query of the url, it has to come before the frames that use it
+  protocol: { version: number; encoding?: FrameEncoding };
   login: { auth_token: string };
   "static-data": IStaticData;
   "dynamic-data": IDynamicData;
@@ -28,12 +88,58 @@ export interface ReporterToBackendEvents extends MittEvent {
 
 export interface BackendToReporterEvents extends MittEvent {
   ping: {};
+  "protocol-accepted": ReporterProtocol;
+  // Sent right before the socket is closed with UNSUPPORTED_PROTOCOL_CLOSE_CODE
+  "protocol-rejected": ReporterProtocolRejection;
+}
+
+/**
+ * The events the public streams of share links get, only what public_stats lets through
+ */
+export interface PublicStreamEvents extends MittEvent {
+  stats: IPublicStats;
+}
+
+/**
+ * The latest stats of some machines keyed by their uuid, machines that never reported aren't in it
+ */
+export type MachineSnapshot = { [uuid: string]: IComputedDynamicData };
+
+/**
+ * A user gaining or losing access to some machines
+ */
+interface AccessChange {
+  user_uuid: string;
+  machine_uuids: string[];
+  granted: boolean;
 }
 
 /**
  * Welcome to the troll-zone :trollface:
  */
 export class WebsocketManager {
+  public static INVALID_TOKEN_CLOSE_CODE = 4001;
+  public static UNSUPPORTED_PROTOCOL_CLOSE_CODE = 4002;
+  public static REPORTER_IDLE_TIMEOUT = 10 * Time.Second;
+
+  /**
+   * The latest dynamic data of every online machine keyed by the machine uuid
+   */
+  public latestStats = new Map<string, IComputedDynamicData>();
+
+  /**
+   * Routes the machine updates to only the clients that have access to that machine
+   */
+  public clientHub = new MachineHub<ClientToBackendEvents>();
+
+  /**
+   * Routes the machine updates to the public streams of their share links, they only get the public stats
+   */
+  public publicHub = new MachineHub<PublicStreamEvents>();
+
+  // The public streams of every share link on this shard so revoking a link can end them
+  private shareStreams = new Map<string, Set<SseConnection<PublicStreamEvents>>>();
+
   public userConnections: {
     [userID: string]: WebsocketConnection<ClientToBackendEvents>;
   } = {};
@@ -47,6 +153,40 @@ export class WebsocketManager {
     // this.pingReporters();
   }, 1000);
 
+  // Only the first shard sweeps so the machines aren't marked offline by every shard at once
+  public offlineSweeper =
+    !this.config.shard || this.config.shard === "1"
+      ? setInterval(() => this.markOfflineMachines(), this.config.machines.offline_interval)
+      : undefined;
+
+  /**
+   * Sends the events of the machines to the webhooks of their owners, every shard runs workers
+   */
+  public webhooks = new WebhookDispatcher(this.db);
+
+  /**
+   * Checks the stats this shard ingests against the alert rules of their machines
+   */
+  public alerts = new AlertEvaluator(this.db, deliverAlert, this.webhooks);
+
+  // The stats that are still being written so shutting down can wait for them
+  private pendingIngests = new Set<Promise<unknown>>();
+
+  /**
+   * Stops the heartbeat, tells the clients we're going away and closes every socket of this shard
+   * so they reconnect to another one, then waits for the stats that are still being written
+   */
+  public async close() {
+    clearInterval(this.heartbeat);
+    clearInterval(this.offlineSweeper!);
+    await this.webhooks.stop();
+    this.broadcastClients("shutdown");
+    [...Object.values(this.userConnections), ...Object.values(this.reporterConnections)].forEach((connection) =>
+      connection.socket.close(1001, "server shutting down")
+    );
+    await Promise.allSettled([...this.pendingIngests]);
+  }
+
   /**
    * Sends an event to all the clients or to a specified list of clients by their uuid
    * @param event The name of the event
@@ -69,90 +209,383 @@ export class WebsocketManager {
     Object.values(this.reporterConnections).forEach((reporter) => reporter.emit("ping", { timestamp: Date.now() }));
   }
 
-  constructor(server: http.Server, public db: DatabaseManager) {
+  /**
+   * Gets the latest stats of some machines, the ones this shard got from their reporter are fresher than the stored ones
+   * @param machines The machines a client subscribed to
+   * @tested
+   */
+  public snapshot(machines: Pick<IMachine, "uuid" | "dynamic_data">[]) {
+    const snapshot: MachineSnapshot = {};
+    machines.forEach(({ uuid, dynamic_data }) => {
+      const stats = this.latestStats.get(uuid) ?? dynamic_data;
+      if (stats) snapshot[uuid] = stats;
+    });
+    return snapshot;
+  }
+
+  /**
+   * Stores the latest stats of a machine and broadcasts them to the clients of this shard
+   * @param data The computed dynamic data of the machine
+   */
+  public handleDynamicData(data: IComputedDynamicData) {
+    this.latestStats.set(data.uuid, data);
+    this.clientHub.publish(data.uuid, "dynamic-data", data);
+    this.publicHub.publish(data.uuid, "stats", public_stats(data));
+  }
+
+  /**
+   * Computes the totals of a machine's dynamic data, stores it as the latest snapshot,
+   * appends it to the machine's history and passes it to the clients of every shard,
+   * the processes are only stored with the disks since they'd make every snapshot and broadcast much bigger
+   * @param machine The machine the data is from
+   * @param data The dynamic data the reporter sent
+   * @param ping The latency between the reporter and the backend
+   * @returns the computed dynamic data
+   */
+  public async ingestDynamicData(machine: IMachine, data: IDynamicData, ping: number = 0) {
+    const { processes, ...stats } = data;
+    const computedData = computeDynamicData(machine.uuid, stats, ping);
+    machine.last_update = computedData.timestamp;
+    const writes = Promise.all([
+      this.db.update_machine_stats(machine.uuid, computedData),
+      this.db.insert_stat_point(computedData),
+      this.db.update_machine_details(machine.uuid, data, computedData.timestamp),
+    ]);
+    this.pendingIngests.add(writes);
+    writes.catch(() => {}).then(() => this.pendingIngests.delete(writes));
+    const [previousStatus] = await writes.catch((error) => {
+      ingested.inc({ result: "failed" });
+      return Promise.reject(error);
+    });
+    ingested.inc({ result: "ok" });
+    this.alerts.observe(machine, computedData);
+    if (previousStatus === MachineStatus.Offline) {
+      await this.publishStatus({ uuid: machine.uuid, status: "online" });
+      this.webhooks.emit("machine.online", [machine.uuid]);
+    }
+
+    // Pass to redis to all the other servers in the network
+    this.sharded
+      ? redisPublisher.publish("dynamic-data", JSON.stringify(computedData))
+      : this.handleDynamicData(computedData);
+    return computedData;
+  }
+
+  /**
+   * Marks the machines that stopped reporting as offline, tells the clients of every shard and fires the offline alerts
+   */
+  public async markOfflineMachines() {
+    const uuids = await this.db.mark_offline_machines().catch((error) => {
+      Logger.error("Failed to mark the machines that stopped reporting as offline", error);
+      return [];
+    });
+    await Promise.all(uuids.map((uuid) => this.publishStatus({ uuid, status: "offline" })));
+    this.webhooks.emit("machine.offline", uuids);
+    // The sweeper only runs on the first shard so offline alerts fire once
+    await this.alerts.evaluateOffline().catch((error) => Logger.error("Failed to evaluate the offline alerts", error));
+  }
+
+  /**
+   * Passes a machine going online or offline to the clients of every shard
+   */
+  public async publishStatus(change: MachineStatusChange) {
+    this.sharded
+      ? await redisPublisher.publish("machine-status", JSON.stringify(change))
+      : this.handleMachineStatus(change);
+  }
+
+  /**
+   * Tells the clients of this shard that have access to the machine that it went online or offline
+   */
+  public handleMachineStatus(change: MachineStatusChange) {
+    this.clientHub.publish(change.uuid, "machine-status", change);
+  }
+
+  /**
+   * Geolocates the IP a reporter connected from and stores it on its machine, skipped if it's the same IP as last time
+   * @param machine The machine the reporter logged in as
+   * @param ip The IP the reporter connected from
+   */
+  public async resolveMachineNetwork(machine: IMachine, ip: string) {
+    if (machine.network?.ip === ip) return;
+    const network = await resolveNetwork(ip, this.geoip);
+    await this.db.update_machine_network(machine.uuid, network);
+    machine.network = network;
+  }
+
+  /**
+   * Subscribes the clients of the owner of a newly added machine to it
+   * @param machine The machine that was added
+   */
+  public handleMachineAdded(machine: ISafeMachine) {
+    this.clientHub.subscribeUser(machine.owner_uuid, machine.uuid);
+    this.clientHub.publish(machine.uuid, "machine-added", machine);
+  }
+
+  /**
+   * Disconnects the reporter of a machine on every shard, used when its token stops being valid
+   * @param uuid The uuid of the machine
+   */
+  public async revokeMachine(uuid: string) {
+    this.sharded ? await redisPublisher.publish("machine-revoked", uuid) : this.handleMachineRevoked(uuid);
+  }
+
+  /**
+   * Disconnects the reporter of a machine if it's connected to this shard
+   * @param uuid The uuid of the machine
+   */
+  public handleMachineRevoked(uuid: string) {
+    this.reporterConnections[uuid]?.socket.close(WebsocketManager.INVALID_TOKEN_CLOSE_CODE, "access token revoked");
+  }
+
+  /**
+   * Tells the clients subscribed to a deleted machine on every shard it's gone and disconnects its reporter,
+   * the webhooks of its owner are told once from here
+   * @param uuid The uuid of the machine
+   */
+  public async removeMachine(uuid: string) {
+    this.webhooks.emit("machine.deleted", [uuid]);
+    this.sharded ? await redisPublisher.publish("machine-removed", uuid) : this.handleMachineRemoved(uuid);
+  }
+
+  /**
+   * Tells the clients on this shard a machine is gone and stops sending them its frames
+   * @tested
+   */
+  public handleMachineRemoved(uuid: string) {
+    this.clientHub.publish(uuid, "machine-removed", { uuid });
+    this.clientHub.unsubscribeMachine(uuid);
+    this.handleMachineRevoked(uuid);
+  }
+
+  /**
+   * Keeps track of the public stream of a share link so it's ended when the link is revoked or expires
+   * @param link The link the stream is for
+   * @param stream The stream of the link
+   * @tested
+   */
+  public watchShare(link: Pick<IShareLink, "uuid" | "expires_at">, stream: SseConnection<PublicStreamEvents>) {
+    const streams = this.shareStreams.get(link.uuid) ?? new Set();
+    this.shareStreams.set(link.uuid, streams.add(stream));
+    // Timers can't wait longer than about 24 days, the client reconnects and gets the rest of the time then
+    const left = link.expires_at && Math.min(link.expires_at.getTime() - Date.now(), 2 ** 31 - 1);
+    const expiry = left !== undefined ? setTimeout(() => stream.close(), left) : undefined;
+    stream.onClose(() => {
+      expiry && clearTimeout(expiry);
+      streams.delete(stream);
+      streams.size || this.shareStreams.delete(link.uuid);
+    });
+  }
+
+  /**
+   * Ends the public streams of some share links on every shard, used when they're revoked
+   * @param uuids The uuids of the links
+   */
+  public async revokeShares(uuids: string[]) {
+    if (!uuids.length) return;
+    this.sharded
+      ? await redisPublisher.publish("shares-revoked", JSON.stringify(uuids))
+      : this.handleSharesRevoked(uuids);
+  }
+
+  /**
+   * Ends the public streams of some share links on this shard
+   */
+  public handleSharesRevoked(uuids: string[]) {
+    uuids.forEach((uuid) => this.shareStreams.get(uuid)?.forEach((stream) => stream.close()));
+  }
+
+  /**
+   * Subscribes or unsubscribes the clients of a user on every shard to some machines
+   * @param user_uuid The uuid of the user whose access changed
+   * @param machine_uuids The machines they gained or lost access to
+   * @param granted Whether they gained access
+   */
+  public async setAccess(user_uuid: string, machine_uuids: string[], granted: boolean) {
+    if (!machine_uuids.length) return;
+    const change: AccessChange = { user_uuid, machine_uuids, granted };
+    this.sharded
+      ? await redisPublisher.publish("access-changed", JSON.stringify(change))
+      : this.handleAccessChanged(change);
+  }
+
+  /**
+   * Subscribes or unsubscribes the clients of a user on this shard, losing access cuts the feed right away
+   */
+  public handleAccessChanged({ user_uuid, machine_uuids, granted }: AccessChange) {
+    machine_uuids.forEach((uuid) =>
+      granted ? this.clientHub.subscribeUser(user_uuid, uuid) : this.clientHub.unsubscribeUser(user_uuid, uuid)
+    );
+  }
+
+  // Whether there are other shards the events have to go to through redis
+  private get sharded() {
+    return this.config.shard !== undefined;
+  }
+
+  constructor(
+    server: http.Server,
+    public db: DatabaseManager,
+    private config: Config,
+    public geoip: MaxMindReader | undefined = loadGeoIp(config.geoip_database)
+  ) {
+    metrics.gauge("xornet_websocket_connections", "How many websockets are connected to this shard", ["type"], (gauge) => {
+      gauge.set({ type: "reporter" }, Object.keys(this.reporterConnections).length);
+      gauge.set({ type: "client" }, this.clientHub.size);
+    });
+
     // Whenever we get dynamic data from any other server pass it to the rest of the servers
     // Broadcast to all clients of this shard
-    redisSubscriber.subscribe("dynamic-data", (message) => this.broadcastClients("dynamic-data", JSON.parse(message)));
-    redisSubscriber.subscribe("machine-added", (message) => this.broadcastClients("machine-added", JSON.parse(message)));
+    redisSubscriber.subscribe("dynamic-data", (message) => this.handleDynamicData(JSON.parse(message)));
+    redisSubscriber.subscribe("machine-added", (message) => this.handleMachineAdded(JSON.parse(message)));
+    redisSubscriber.subscribe("machine-revoked", (uuid) => this.handleMachineRevoked(uuid));
+    redisSubscriber.subscribe("machine-removed", (uuid) => this.handleMachineRemoved(uuid));
+    redisSubscriber.subscribe("machine-status", (message) => this.handleMachineStatus(JSON.parse(message)));
+    redisSubscriber.subscribe("access-changed", (message) => this.handleAccessChanged(JSON.parse(message)));
+    redisSubscriber.subscribe("shares-revoked", (message) => this.handleSharesRevoked(JSON.parse(message)));
+    this.webhooks.start();
 
-    const userSockets = newWebSocketHandler<ClientToBackendEvents>(server, "/client");
+    const userSockets = newWebSocketHandler<ClientToBackendEvents>(
+      server,
+      config.websocket_idle_timeout,
+      "/client",
+      "/ws/machines"
+    );
 
     userSockets.on("connection", (socket) => {
       let session_uuid = "";
+      let user_uuid = "";
 
       socket.on("login", async (data) => {
-        const user = await this.db.login_user_websocket(data.auth_token);
-        if (!user) return socket.socket.close();
-        session_uuid = `${user.uuid}-${Date.now()}`;
-        this.userConnections[session_uuid] = socket;
+        try {
+          const user = await this.db.login_user_websocket(data?.auth_token);
+          const machines = await this.db.find_accessible_machines(user.uuid);
+          user_uuid = user.uuid;
+          session_uuid = `${user.uuid}-${Date.now()}`;
+          this.userConnections[session_uuid] = socket;
+          this.clientHub.register(socket, user.uuid, machines.map((machine) => machine.uuid));
+          socket.emit("snapshot", { machines: this.snapshot(machines) });
+        } catch (error) {
+          socket.socket.close(WebsocketManager.INVALID_TOKEN_CLOSE_CODE, "invalid authentication token");
+        }
+      });
+
+      // Clients can subscribe to more machines later on but only to the ones they have access to
+      socket.on("subscribe", async (data) => {
+        if (!user_uuid || !Array.isArray(data?.machines)) return;
+        const uuids = data.machines.filter((uuid) => Validators.validate_uuid(uuid));
+        const machines = await this.db.find_accessible_machines(user_uuid, uuids).catch(() => []);
+        machines.forEach((machine) => this.clientHub.subscribe(socket, machine.uuid));
+        socket.emit("snapshot", { machines: this.snapshot(machines) });
+      });
+
+      socket.on("unsubscribe", (data) => {
+        if (!Array.isArray(data?.machines)) return;
+        data.machines.forEach((uuid) => this.clientHub.unsubscribe(socket, uuid));
       });
 
       socket.on("close", () => delete this.userConnections[session_uuid]);
     });
 
-    const reporterSockets = newWebSocketHandler<ReporterToBackendEvents>(server, "/reporter");
+    const reporterSockets = newWebSocketHandler<ReporterToBackendEvents>(
+      server,
+      config.websocket_idle_timeout,
+      "/reporter",
+      "/machines/@reporter"
+    );
 
     reporterSockets.on("connection", async (socket) => {
       let machine: IMachine | undefined = undefined;
+      // Kept as a promise so disconnecting before it's stored still closes it
+      let connection: Promise<(IMachineEvent & Document) | undefined> | undefined = undefined;
       let ping: number = 0;
-      // let usersThatHaveAccess: string[] = [];
+      let idleTimer: NodeJS.Timeout | undefined = undefined;
+      let protocol: ReporterProtocol | undefined = undefined;
 
-      socket.on("close", async () => {
-        if (machine) {
-          machine.status = MachineStatus.Offline;
-          const updatedMachine = await machine.save();
+      const use = (picked: ReporterProtocol) => {
+        protocol = picked;
+        socket.encoding = picked.encoding;
+        connected.inc({ version: String(picked.version), encoding: picked.encoding });
+      };
 
-          // Tell the clients that this machine is offline :trollcrazy:
-          for (const user_uuid of [updatedMachine.owner_uuid, ...updatedMachine.access]) {
-            Object.entries(this.userConnections).forEach(([session_uuid, user]) => {
-              // we check if it startswith the id because after the uuid they have the timestamp
-              // that tells the clients apart, that way we emit to all the clients that have the same user uuid
-              session_uuid.startsWith(user_uuid) && user.emit("machine-disconnected", updatedMachine);
-            });
-          }
+      const negotiate = (requested: { version?: unknown; encoding?: unknown }) => {
+        if (protocol) return;
+        const negotiated = negotiateReporterProtocol(requested);
+        if (negotiated.rejection) {
+          socket.emit("protocol-rejected", negotiated.rejection);
+          return socket.socket.close(WebsocketManager.UNSUPPORTED_PROTOCOL_CLOSE_CODE, "unsupported protocol");
         }
-      });
+        use(negotiated.protocol);
+        socket.emit("protocol-accepted", negotiated.protocol);
+      };
+      const requested = requestedReporterProtocol(socket.request.url ?? "/");
+      if (requested) negotiate(requested);
+      socket.on("protocol", (data) => negotiate(data ?? {}));
 
-      socket.on("login", async (data) => {
+      // If a reporter stops sending frames the connection is most likely dead so we drop it
+      const resetIdleTimer = () => {
+        clearTimeout(idleTimer!);
+        idleTimer = setTimeout(() => socket.socket.terminate(), WebsocketManager.REPORTER_IDLE_TIMEOUT);
+      };
+
+      const login = async (auth_token: string) => {
         try {
-          machine = await this.db.login_machine(data.auth_token);
+          machine = await this.db.login_machine(auth_token);
           this.reporterConnections[machine.uuid] = socket;
-          // // Find the machine in the database
-          // const machineInDatabase = await machines.findOne({ uuid: machineUUID }).catch();
-          // // TODO: Make this disconnect the socket
-          // if (!machineInDatabase) return;
-          // usersThatHaveAccess = [machineInDatabase.owner_uuid, ...machineInDatabase.access];
+          resetIdleTimer();
+          const uuid = machine.uuid;
+          connection ??= this.db.open_machine_event(uuid).catch((error) => {
+            Logger.error(`Failed to record that ${uuid} connected`, error);
+            return undefined;
+          });
+          // The reverse DNS can take a while so the reporter doesn't wait for it
+          this.resolveMachineNetwork(machine, client_ip(socket.request)).catch((error) =>
+            Logger.error("Failed to resolve the network of a machine", error)
+          );
         } catch (error) {
-          socket.socket.close();
+          socket.socket.close(WebsocketManager.INVALID_TOKEN_CLOSE_CODE, "invalid access token");
+        }
+      };
+
+      socket.on("close", async () => {
+        clearTimeout(idleTimer!);
+        connection
+          ?.then((event) => event && this.db.close_machine_event(event))
+          .catch((error) => Logger.error("Failed to record that a machine disconnected", error));
+        if (machine) {
+          delete this.reporterConnections[machine.uuid];
+          this.latestStats.delete(machine.uuid);
+          machine.status = MachineStatus.Offline;
+          // The machine is gone if it was deleted while connected
+          const updatedMachine = await machine.save().catch(() => null);
+          if (!updatedMachine) return;
+
+          // Tell the clients that this machine is offline :trollcrazy:
+          this.clientHub.publish(updatedMachine.uuid, "machine-disconnected", updatedMachine);
         }
       });
 
+      // Reporters can authenticate with the Authorization header instead of sending a login frame
+      const authorization = socket.request.headers.authorization;
+      if (authorization) login(authorization.replace("Bearer ", "").trim());
+
+      socket.on("login", async (data) => login(data?.auth_token));
+
       socket.on("pong", ({ timestamp }) => (ping = Date.now() - timestamp));
 
       socket.on("static-data", (data) => machine?.update_static_data(data));
 
       socket.on("dynamic-data", (data) => {
-        if (!machine) return socket.socket.close();
-        machine.last_update = Date.now();
-        machine.save();
-
-        const computedData = {
-          ...data,
-          ping,
-          uuid: machine!.uuid,
-          // Computed values
-          cau: ~~(data.cpu.usage.reduce((a, b) => a + b, 0) / data.cpu.usage.length),
-          cas: ~~(data.cpu.freq.reduce((a, b) => a + b, 0) / data.cpu.usage.length),
-          td: data.network.reduce((a, b) => (!isVirtualInterface(b) ? a + b.rx : a), 0) / 1000 / 1000,
-          tu: data.network.reduce((a, b) => (!isVirtualInterface(b) ? a + b.tx : a), 0) / 1000 / 1000,
-          tvd: data.network.reduce((a, b) => (isVirtualInterface(b) ? a + b.rx : a), 0) / 1000 / 1000,
-          tvu: data.network.reduce((a, b) => (isVirtualInterface(b) ? a + b.tx : a), 0) / 1000 / 1000,
-        };
-
-        // Pass to redis to all the other servers in the network
-        process.env.SHARD_ID
-          ? redisPublisher.publish("dynamic-data", JSON.stringify(computedData))
-          : this.broadcastClients("dynamic-data", computedData);
+        if (!machine) return socket.socket.close(WebsocketManager.INVALID_TOKEN_CLOSE_CODE, "not logged in");
+        // Reporters that didn't ask for a protocol before their stats are the ones from before there was more than one
+        if (!protocol) use(DEFAULT_REPORTER_PROTOCOL);
+        // Drop frames that don't match the schema instead of killing the connection
+        if (!Validators.validate_dynamic_data(data)) {
+          socket.malformedFrames++;
+          return;
+        }
+        resetIdleTimer();
+        this.ingestDynamicData(machine, data, ping).catch((error) => Logger.error("Failed to ingest dynamic data", error));
       });
     });
   }
@@ -0,0 +1,325 @@
+import { parseDuration } from "./logic";
+import { parse_cors_origins } from "./middleware/cors";
+import { JSON_BODY_LIMIT } from "./middleware/validate";
+import { TRUSTED_PROXY_HOPS } from "./middleware/ratelimit";
+import { CACHE_TTL } from "./classes/cache.class";
+import { ALERT_COOLDOWN } from "./database/schemas/alert";
+import { MACHINE_OFFLINE_INTERVAL, MACHINE_OFFLINE_THRESHOLD } from "./database/schemas/machine";
+import { MACHINE_EVENTS_RETENTION, UPTIME_MERGE_GAP } from "./database/schemas/machineEvent";
+import { SESSION_EXPIRATION } from "./database/schemas/session";
+import { STATS_RAW_RETENTION, STATS_ROLLUP_RETENTION } from "./database/schemas/stats";
+import { PROFILE_IMAGE_LIMIT, UPLOAD_LIMIT, UPLOADS_DIR } from "./utils/uploads";
+import { WEBSOCKET_IDLE_TIMEOUT } from "./utils/ws";
+import { LogLevel, parseLogLevel } from "./utils/logger";
+import type { SmtpConfig } from "./utils/mailer";
+import type { S3Config } from "./utils/s3";
+
+// The variables the backend can't start without
+const REQUIRED_VARIABLES = ["JWT_SECRET", "PORT", "SECURE", "VERBOSE", "DB_PROTOCOL", "DB_HOST", "DB_NAME", "APP_NAME", "MODE"];
+
+/**
+ * Everything the backend reads from the environment on startup, it's loaded once and passed down
+ * so nothing deeper has to read process.env
+ */
+export interface Config {
+  mode: string; // production or development
+  port: number;
+  secure: boolean; // Whether to serve https with key.pem and cert.pem
+  verbose: boolean;
+  log_level: LogLevel;
+  shard?: string; // Missing when this is the only process, the events of every shard go through redis otherwise
+  commit: string; // The commit the build came from, shown in /healthz
+  trusted_proxy_hops: number; // How many proxies append to X-Forwarded-For in front of us
+  cors_origins: string[]; // "*" allows every origin
+  compression: boolean; // Off when a proxy in front already compresses the responses
+  request_timeout: number; // How long a request has to be answered in before it fails with a 504
+  legacy_routes?: boolean; // Whether the API is also served without /v1 with a Deprecation header, on unless it's false
+  migrate_only: boolean; // Runs the migrations and exits instead of serving, for running them before a rollout
+  jwt: JwtConfig;
+  bcrypt_rounds: number; // How expensive hashing a password is
+  admin_email?: string; // The user made an admin on startup so a new instance has someone to manage it
+  stats_purge_interval?: number; // How often to delete the expired stats by hand, off when the TTL indexes can be relied on
+  stats_retention: StatsRetentionConfig;
+  machines: MachinesConfig;
+  alert_cooldown: number; // How long alerts wait before firing again unless their rule has its own cooldown
+  cache_ttl: number; // How long public profiles and shared machines are cached for, 0 turns the cache off
+  websocket_idle_timeout: number; // How long a websocket can go without answering a ping before it's terminated
+  metrics_token?: string; // The bearer token /metrics is protected with, public when missing
+  geoip_database?: string; // The MaxMind database machines are geolocated with, only reverse DNS when missing
+  database: DatabaseConfig;
+  limits: LimitsConfig;
+  smtp?: SmtpConfig; // Missing when emails should only be logged
+  uploads: UploadsConfig;
+  s3?: S3Config; // Missing when uploads are stored on the disk
+  email_links: EmailLinksConfig;
+}
+
+export interface JwtConfig {
+  secret: string;
+  expiration: string; // How long access tokens last like 15m
+  refresh_expiration: number; // How long a session lasts without being refreshed in milliseconds
+}
+
+/**
+ * How long the stats are kept in milliseconds
+ */
+export interface StatsRetentionConfig {
+  raw: number; // Older ranges are served from the hourly rollups
+  rollups: number;
+}
+
+/**
+ * How the backend keeps track of whether the machines are online in milliseconds
+ */
+export interface MachinesConfig {
+  offline_threshold: number; // How long a machine can go without reporting before it's offline
+  offline_interval: number; // How often the machines that stopped reporting are marked as offline
+  events_retention: number; // How long the connections of reporters are kept for the uptime
+  uptime_merge_gap: number; // Reconnects faster than this don't count as downtime
+}
+
+/**
+ * Where the uploads are stored when there's no bucket
+ */
+export interface UploadsConfig {
+  dir: string;
+  public_url: string; // What the urls of the uploads start with before /uploads, empty for relative urls
+}
+
+/**
+ * How big the bodies of requests can be in bytes
+ */
+export interface LimitsConfig {
+  json_body: number;
+  upload: number; // Anything uploaded
+  profile_image: number; // Avatars and banners
+}
+
+/**
+ * The pages of the frontend the links in emails point to, they post the token in the link back to the API
+ */
+export interface EmailLinksConfig {
+  verification: string; // Posts it to /users/@verify
+  password_reset: string; // Posts it to /password/reset
+}
+
+export interface DatabaseConfig {
+  url: string;
+  app_name: string; // What the connections show up as in mongo
+  connect_timeout: number; // How long to keep trying to reach mongo on startup
+  query_timeout: number; // How long a query can run before the request fails with a 504
+  slow_query: number; // How long a query can run before it's logged as slow
+}
+
+/**
+ * What's wrong with the environment, every problem is listed at once so the .env can be fixed in one go
+ */
+export class ConfigError extends Error {
+  public constructor(public problems: string[]) {
+    super(`Invalid environment, please fix the .env:\n${problems.map((problem) => `  - ${problem}`).join("\n")}`);
+  }
+}
+
+/**
+ * Reads the config from the environment
+ * @param env The environment to read, process.env unless testing
+ * @throws ConfigError listing every variable that's missing or invalid
+ * @tested
+ */
+export const loadConfig = (env: NodeJS.ProcessEnv = process.env): Config => {
+  const problems = REQUIRED_VARIABLES.filter((variable) => !env[variable]).map((variable) => `${variable} is missing`);
+  const production = env.MODE === "production";
+
+  const port = Number(env.PORT);
+  if (env.PORT && !(Number.isInteger(port) && port > 0 && port < 65536)) problems.push(`PORT ${env.PORT} isn't a port`);
+
+  // Production has to list them, development allows every origin when there aren't any
+  const cors_origins = parse_cors_origins(env.CORS_ORIGINS, production);
+  if (production && !cors_origins.length) problems.push("CORS_ORIGINS is missing, production has to list the origins");
+
+  // Development hashes as fast as bcrypt allows so signing up test users doesn't take forever
+  const bcrypt_rounds = env.BCRYPT_ROUNDS ? Number(env.BCRYPT_ROUNDS) : env.MODE === "development" ? 1 : 10;
+  if (!Number.isInteger(bcrypt_rounds) || bcrypt_rounds < 1 || bcrypt_rounds > 31)
+    problems.push(`BCRYPT_ROUNDS ${env.BCRYPT_ROUNDS} isn't between 1 and 31`);
+
+  if (env.COMPRESSION && !["on", "off"].includes(env.COMPRESSION))
+    problems.push(`COMPRESSION ${env.COMPRESSION} has to be on or off`);
+
+  const connect_timeout = parseDuration(env.DB_CONNECT_TIMEOUT || "30s");
+  if (Number.isNaN(connect_timeout)) problems.push(`DB_CONNECT_TIMEOUT ${env.DB_CONNECT_TIMEOUT} isn't a duration like 30s`);
+  const query_timeout = parseDuration(env.DB_QUERY_TIMEOUT || "5s");
+  if (!(query_timeout > 0)) problems.push(`DB_QUERY_TIMEOUT ${env.DB_QUERY_TIMEOUT} isn't a duration like 5s`);
+  const request_timeout = parseDuration(env.REQUEST_TIMEOUT || "15s");
+  if (!(request_timeout > 0)) problems.push(`REQUEST_TIMEOUT ${env.REQUEST_TIMEOUT} isn't a duration like 15s`);
+  const slow_query = parseDuration(env.DB_SLOW_QUERY || "250ms");
+  if (Number.isNaN(slow_query)) problems.push(`DB_SLOW_QUERY ${env.DB_SLOW_QUERY} isn't a duration like 250ms`);
+
+  const stats_purge_interval = env.STATS_PURGE_INTERVAL ? parseDuration(env.STATS_PURGE_INTERVAL) : undefined;
+  if (Number.isNaN(stats_purge_interval))
+    problems.push(`STATS_PURGE_INTERVAL ${env.STATS_PURGE_INTERVAL} isn't a duration like 1h`);
+
+  const refresh_expiration = env.SESSION_EXPIRATION ? parseDuration(env.SESSION_EXPIRATION) : SESSION_EXPIRATION;
+  if (Number.isNaN(refresh_expiration)) problems.push(`SESSION_EXPIRATION ${env.SESSION_EXPIRATION} isn't a duration like 30d`);
+
+  const duration = (variable: string, fallback: number, example: string) => {
+    const value = env[variable] ? parseDuration(env[variable]!) : fallback;
+    if (!(value > 0)) problems.push(`${variable} ${env[variable]} isn't a duration like ${example}`);
+    return value;
+  };
+  const stats_retention = {
+    raw: duration("STATS_RAW_RETENTION", STATS_RAW_RETENTION, "24h"),
+    rollups: duration("STATS_ROLLUP_RETENTION", STATS_ROLLUP_RETENTION, "30d"),
+  };
+  const machines = {
+    offline_threshold: duration("MACHINE_OFFLINE_THRESHOLD", MACHINE_OFFLINE_THRESHOLD, "60s"),
+    offline_interval: duration("MACHINE_OFFLINE_INTERVAL", MACHINE_OFFLINE_INTERVAL, "30s"),
+    events_retention: duration("MACHINE_EVENTS_RETENTION", MACHINE_EVENTS_RETENTION, "90d"),
+    uptime_merge_gap: duration("UPTIME_MERGE_GAP", UPTIME_MERGE_GAP, "15s"),
+  };
+  const alert_cooldown = duration("ALERT_COOLDOWN", ALERT_COOLDOWN, "15m");
+  const websocket_idle_timeout = duration("WEBSOCKET_IDLE_TIMEOUT", WEBSOCKET_IDLE_TIMEOUT, "30s");
+  // 0s is allowed since it turns the cache off
+  const cache_ttl = env.CACHE_TTL ? parseDuration(env.CACHE_TTL) : CACHE_TTL;
+  if (Number.isNaN(cache_ttl)) problems.push(`CACHE_TTL ${env.CACHE_TTL} isn't a duration like 10s`);
+
+  const trusted_proxy_hops = env.TRUSTED_PROXY_HOPS ? Number(env.TRUSTED_PROXY_HOPS) : TRUSTED_PROXY_HOPS;
+  if (!Number.isInteger(trusted_proxy_hops) || trusted_proxy_hops < 0)
+    problems.push(`TRUSTED_PROXY_HOPS ${env.TRUSTED_PROXY_HOPS} isn't a number of proxies`);
+
+  const bytes = (variable: string, fallback: number) => {
+    const value = env[variable] ? Number(env[variable]) : fallback;
+    if (!Number.isInteger(value) || value < 1) problems.push(`${variable} ${env[variable]} isn't a size in bytes`);
+    return value;
+  };
+  const limits = {
+    json_body: bytes("JSON_BODY_LIMIT", JSON_BODY_LIMIT),
+    upload: bytes("UPLOAD_LIMIT", UPLOAD_LIMIT),
+    profile_image: bytes("PROFILE_IMAGE_LIMIT", PROFILE_IMAGE_LIMIT),
+  };
+
+  const link = (variable: string, fallback: string) => {
+    const value = env[variable] || fallback;
+    if (!/^https?:$/.test(parseUrl(value)?.protocol ?? "")) problems.push(`${variable} ${value} isn't an http or https url`);
+    return value;
+  };
+  const email_links = {
+    verification: link("VERIFICATION_URL", "https://xornet.cloud/verify"),
+    password_reset: link("PASSWORD_RESET_URL", "https://xornet.cloud/reset-password"),
+  };
+
+  const uploads = {
+    dir: env.UPLOADS_DIR || UPLOADS_DIR,
+    public_url: env.PUBLIC_URL ? link("PUBLIC_URL", "").replace(/\/$/, "") : "",
+  };
+
+  // The rest of the bucket is only checked when there is one
+  const s3 = ((bucket?: string): S3Config | undefined => {
+    if (!bucket) return;
+    const endpoint = link("S3_ENDPOINT", "https://s3.amazonaws.com").replace(/\/$/, "");
+    for (const variable of ["S3_ACCESS_KEY_ID", "S3_SECRET_ACCESS_KEY"]) {
+      if (!env[variable]) problems.push(`${variable} is missing, S3_BUCKET needs it`);
+    }
+    return {
+      endpoint,
+      bucket,
+      region: env.S3_REGION || "us-east-1",
+      access_key_id: env.S3_ACCESS_KEY_ID || "",
+      secret_access_key: env.S3_SECRET_ACCESS_KEY || "",
+      public_url: link("S3_PUBLIC_URL", `${endpoint}/${bucket}`).replace(/\/$/, ""),
+    };
+  })(env.S3_BUCKET);
+
+  if (problems.length) throw new ConfigError(problems);
+
+  const { DB_PROTOCOL, DB_USERNAME, DB_PASSWORD, DB_HOST, DB_NAME } = env;
+  return {
+    mode: env.MODE!,
+    port,
+    secure: env.SECURE === "true",
+    verbose: env.VERBOSE === "true",
+    log_level: parseLogLevel(env.LOG_LEVEL),
+    shard: env.SHARD_ID || undefined,
+    commit: env.COMMIT_HASH || "unknown",
+    trusted_proxy_hops,
+    cors_origins,
+    compression: env.COMPRESSION !== "off",
+    request_timeout,
+    legacy_routes: env.LEGACY_ROUTES !== "off",
+    migrate_only: env.MIGRATE_ONLY === "true",
+    jwt: { secret: env.JWT_SECRET!, expiration: env.JWT_EXPIRATION || "15m", refresh_expiration },
+    bcrypt_rounds,
+    admin_email: env.ADMIN_EMAIL || undefined,
+    stats_purge_interval,
+    stats_retention,
+    machines,
+    alert_cooldown,
+    cache_ttl,
+    websocket_idle_timeout,
+    metrics_token: env.METRICS_TOKEN || undefined,
+    geoip_database: env.GEOIP_DATABASE || undefined,
+    database: {
+      url: `${DB_PROTOCOL}://${DB_USERNAME ? `${DB_USERNAME}:${DB_PASSWORD}@` : ""}${DB_HOST}/${DB_NAME}`,
+      app_name: env.APP_NAME!,
+      connect_timeout,
+      query_timeout,
+      slow_query,
+    },
+    limits,
+    uploads,
+    smtp: env.SMTP_HOST
+      ? {
+          host: env.SMTP_HOST,
+          port: parseInt(env.SMTP_PORT || "587"),
+          secure: env.SMTP_SECURE === "true",
+          user: env.SMTP_USER || undefined,
+          password: env.SMTP_PASSWORD || undefined,
+          from: env.SMTP_FROM || "Xornet <noreply@xornet.cloud>",
+        }
+      : undefined,
+    s3,
+    email_links,
+  };
+};
+
+const parseUrl = (url: string) => {
+  try {
+    return new URL(url);
+  } catch {
+    return;
+  }
+};
+
+/**
+ * Reads flags like --port 7000, --db-host=localhost or --secure into the variables they stand for,
+ * so they can be passed to loadConfig on top of the environment
+ * @param argv The arguments after the script
+ * @tested
+ */
+export const parseFlags = (argv: string[]): NodeJS.ProcessEnv => {
+  const flags: NodeJS.ProcessEnv = {};
+  for (let i = 0; i < argv.length; i++) {
+    const flag = /^--([a-z0-9-]+)(?:=(.*))?$/i.exec(argv[i]);
+    if (!flag) continue;
+    const variable = flag[1].replace(/-/g, "_").toUpperCase();
+    // A flag without a value is a boolean like --secure
+    if (flag[2] !== undefined) flags[variable] = flag[2];
+    else if (argv[i + 1] !== undefined && !argv[i + 1].startsWith("--")) flags[variable] = argv[++i];
+    else flags[variable] = "true";
+  }
+  return flags;
+};
+
+const REDACTED = "[redacted]";
+
+/**
+ * Copies the config without the secrets so it can be logged
+ * @tested
+ */
+export const redactConfig = (config: Config): Config => ({
+  ...config,
+  jwt: { ...config.jwt, secret: REDACTED },
+  database: { ...config.database, url: config.database.url.replace(/\/\/[^/@]*@/, `//${REDACTED}@`) },
+  metrics_token: config.metrics_token && REDACTED,
+  smtp: config.smtp && { ...config.smtp, password: config.smtp.password && REDACTED },
+  s3: config.s3 && { ...config.s3, secret_access_key: REDACTED },
+});
@@ -1,15 +1,131 @@
+import bcrypt from "bcryptjs";
 import chalk from "chalk";
+import crypto from "crypto";
 import jwt from "jsonwebtoken";
-import { MongoServerError } from "mongodb";
 import mongoose, { Model } from "mongoose";
 import { v4 as uuidv4 } from "uuid";
-import { checkEnvironmentVariables, randomHexColor } from "../logic";
-import { Logger } from "../utils/logger";
+import { cache } from "../classes/cache.class";
+import type { Config } from "../config";
+import {
+  computeUptime,
+  escapeRegex,
+  MAX_STATS_POINTS,
+  normalizeEmail,
+  normalizeUsername,
+  Pagination,
+  parseDuration,
+  randomHexColor,
+  StatsRange,
+} from "../logic";
+import { ErrorCode, MAX_TIME_EXPIRED } from "../utils/errors";
+import { IMachineNetwork } from "../utils/geoip";
+import { Logger, ScopedLogger } from "../utils/logger";
+import { deleteUpload } from "../utils/uploads";
+import { Time } from "../types";
 import { Validators } from "../validators";
-import { CreateMachineInput, IMachine, IStaticData, machines, machineSchema, MachineStatus } from "./schemas/machine";
-import { IUser, UserAuthResult, UserPasswordUpdateInput, users, userSchema, UserSignupInput } from "./schemas/user";
+import { MigrationRunner } from "./migrations";
+import { query_limits } from "./middleware/metrics";
+import { password_hashing } from "./middleware/preSave";
+import { WITH_DELETED } from "./middleware/softDelete";
+import {
+  CreateMachineInput,
+  IComputedDynamicData,
+  IDynamicData,
+  IMachine,
+  IMachineSummary,
+  IStaticData,
+  MACHINE_DELETION_GRACE,
+  machines,
+  machineSchema,
+  MachineStatus,
+  MachineUpdate,
+  offline_detection,
+} from "./schemas/machine";
+import {
+  ACCOUNT_DELETION_GRACE,
+  AdminUsersQuery,
+  IFriendList,
+  ISafeUser,
+  IUser,
+  PASSWORD_RESET_EXPIRATION,
+  PROFILE_VISIBILITY_FIELDS,
+  sign_verification_token,
+  UserAuthResult,
+  UserPasswordUpdateInput,
+  UserProfileUpdate,
+  users,
+  userSchema,
+  UserSignupInput,
+  UserTokenPayload,
+  verify_verification_token,
+} from "./schemas/user";
 import type { IncomingHttpHeaders } from "http";
+import { IMachineDetails, machine_details, machineDetails } from "./schemas/machineDetails";
+import { IDEMPOTENCY_PENDING_TIMEOUT, IIdempotencyKey, idempotencyKeys } from "./schemas/idempotencyKey";
+import { IMachineEvent, machineEvents } from "./schemas/machineEvent";
+import { alerts, CreateAlertInput, IAlert, MAX_ALERTS } from "./schemas/alert";
+import {
+  API_TOKEN_TOUCH_INTERVAL,
+  API_TOKEN_VISIBLE_LENGTH,
+  apiTokens,
+  generate_api_token,
+  hash_api_token,
+  IApiToken,
+  IApiTokenInput,
+  MAX_API_TOKENS,
+} from "./schemas/apiToken";
+import { AuditAction, AuditLogQuery, auditLogs, IAuditLog, MAX_EXPORT_AUDIT_ENTRIES } from "./schemas/auditLog";
+import { datacenters, DatacenterUpdate, ICreateDatacenterInput, IDatacenter } from "./schemas/datacenter";
 import { ICreateLabelInput, ILabel, labels } from "./schemas/label";
+import {
+  generate_share_token,
+  IPublicMachine,
+  IShareLink,
+  IShareLinkInput,
+  MAX_SHARE_LINKS,
+  public_machine,
+  shareLinks,
+} from "./schemas/shareLink";
+import {
+  generate_webhook_secret,
+  IWebhook,
+  IWebhookInput,
+  MAX_WEBHOOK_FAILURES,
+  MAX_WEBHOOKS,
+  WebhookEvent,
+  webhooks,
+} from "./schemas/webhook";
+import {
+  IWebhookDelivery,
+  WEBHOOK_LEASE,
+  WEBHOOK_RETRY_WINDOW,
+  webhook_retry_delay,
+  webhookDeliveries,
+  WebhookData,
+  WebhookPayload,
+} from "./schemas/webhookDelivery";
+import { generate_signup_key, ISignupKey, MAX_SIGNUP_KEYS, SIGNUP_KEY_EXPIRATION, signupKeys } from "./schemas/signupKey";
+import {
+  format_refresh_token,
+  generate_refresh_secret,
+  hash_refresh_secret,
+  ISession,
+  ISessionDevice,
+  parse_refresh_token,
+  sessions,
+} from "./schemas/session";
+import {
+  IStatHistoryPoint,
+  IStatMetricPoint,
+  IStatPoint,
+  IStatRollup,
+  IStatValues,
+  MAX_EXPORT_POINTS,
+  STAT_FIELDS,
+  statRollups,
+  stats,
+  STATS_ROLLUP_RESOLUTION,
+} from "./schemas/stats";
 
 export interface IBaseDocument {
   uuid: string; // The unique identifier of the document
@@ -17,6 +133,29 @@ export interface IBaseDocument {
   updated_at: number; // The time the document was last updated
 }
 
+/**
+ * An index the backend makes sure exists on startup
+ */
+export interface RequiredIndex {
+  collection:
+    | "users"
+    | "machines"
+    | "stats"
+    | "stat_rollups"
+    | "sessions"
+    | "signup_keys"
+    | "share_links"
+    | "machine_details"
+    | "api_tokens"
+    | "idempotency_keys"
+    | "webhooks"
+    | "webhook_deliveries"
+    | "machine_events";
+  key: { [field: string]: 1 };
+  unique?: boolean;
+  expire_after?: number; // Makes it a TTL index that deletes documents this many seconds after the date in the key
+}
+
 /**
  * Database handler class
  * @class DatabaseManager
@@ -25,45 +164,92 @@ export class DatabaseManager {
   public users: Model<IUser> = users;
   public machines: Model<IMachine> = machines;
   public labels: Model<ILabel> = labels;
-  private app_name = process.env.APP_NAME!;
+  public datacenters: Model<IDatacenter> = datacenters;
+  public stats: Model<IStatPoint> = stats;
+  public stat_rollups: Model<IStatRollup> = statRollups;
+  public machine_events: Model<IMachineEvent> = machineEvents;
+  public machine_details: Model<IMachineDetails> = machineDetails;
+  public alerts: Model<IAlert> = alerts;
+  public sessions: Model<ISession> = sessions;
+  public signup_keys: Model<ISignupKey> = signupKeys;
+  public share_links: Model<IShareLink> = shareLinks;
+  public audit_logs: Model<IAuditLog> = auditLogs;
+  public api_tokens: Model<IApiToken> = apiTokens;
+  public idempotency_keys: Model<IIdempotencyKey> = idempotencyKeys;
+  public webhooks: Model<IWebhook> = webhooks;
+  public webhook_deliveries: Model<IWebhookDelivery> = webhookDeliveries;
+  private cleanup_interval?: NodeJS.Timer;
+  private rollup_interval?: NodeJS.Timer;
+  private purge_interval?: NodeJS.Timer;
 
-  private constructor() {
-    this.check_process_variables();
-    this.connect_database();
+  // How long mongo gets to run a query before it gives up on it by itself, it's DB_QUERY_TIMEOUT
+  public static get QUERY_TIMEOUT() {
+    return query_limits.timeout;
   }
 
-  private check_process_variables() {
-    checkEnvironmentVariables(["DB_PROTOCOL", "DB_HOST", "DB_NAME", "APP_NAME", "MODE"]);
+  // The shard the reporters of this process connect to
+  private get shard() {
+    return this.config.shard || "solo";
   }
 
-  /**
-   * Creates a new database manager
-   * @returns The new database manager
-   */
-  public static async new(): Promise<DatabaseManager> {
-    const self = new this();
-    return self;
+  // Only the first shard runs the jobs that would clash if every shard ran them at once
+  private get leads_shards() {
+    return !this.config.shard || this.config.shard === "1";
+  }
+
+  // How long each connection attempt waits for mongo to answer, the driver would keep trying for 30s otherwise
+  private static CONNECT_ATTEMPT_TIMEOUT = 5 * Time.Second;
+
+  private constructor(private config: Config) {
+    password_hashing.rounds = config.bcrypt_rounds;
+    query_limits.timeout = config.database.query_timeout;
+    query_limits.slow = config.database.slow_query;
+    offline_detection.threshold = config.machines.offline_threshold;
+    cache.ttl = config.cache_ttl;
   }
 
   /**
-   * Creates the URL string for the database
-   * @returns The URL for the database
+   * Creates a new database manager once it's connected
+   * @param config The config of the backend
+   * @returns The new database manager
    */
-  private construct_database_url() {
-    const { DB_PROTOCOL, DB_USERNAME, DB_PASSWORD, DB_HOST, DB_NAME } = process.env;
-    return `${DB_PROTOCOL}://${DB_USERNAME ? `${DB_USERNAME}:${DB_PASSWORD}@` : ""}${DB_HOST}/${DB_NAME}`;
+  public static async new(config: Config): Promise<DatabaseManager> {
+    const self = new this(config);
+    await self.connect_database();
+    return self;
   }
 
   /**
-   * Connects to the MongoDB
+   * Connects to the MongoDB, the process exits if it can't be reached in time
    */
   public async connect_database() {
-    const DB_URL = this.construct_database_url();
-    Logger.info(`Connecting to ${chalk.blue(DB_URL)}`);
+    const { url, app_name, connect_timeout } = this.config.database;
+    Logger.info(`Connecting to ${chalk.blue(url)}`);
     try {
-      await mongoose.connect(DB_URL, { appName: this.app_name });
+      // The backend usually boots faster than mongo in docker-compose so it keeps trying for a while
+      await DatabaseManager.connect_with_backoff(url, { appName: app_name }, connect_timeout);
       Logger.info(chalk.green("MongoDB Connected"));
-      this.cleanup_database().then(() => setInterval(() => this.cleanup_database(), 1000 * 60 * 60 * 24));
+      // Nothing can rely on the indexes and the shape of the documents until the migrations ran
+      await new MigrationRunner(this).run().catch((error) => {
+        Logger.error("Failed to run the migrations", error);
+        process.exit(1);
+      });
+      // Before any reporter connects so only the events this shard left open when it went down are closed
+      await this.close_dangling_machine_events().catch((error) =>
+        Logger.error("Failed to close the machine events left open by the last run", error)
+      );
+      const { admin_email } = this.config;
+      if (admin_email)
+        await this.bootstrap_admin(admin_email).catch((error) => Logger.error(`Failed to make ${admin_email} an admin`, error));
+      this.cleanup_database().then(() => (this.cleanup_interval = setInterval(() => this.cleanup_database(), Time.Day)));
+      this.rollup_interval = setInterval(() => this.run_stats_rollup(), STATS_ROLLUP_RESOLUTION);
+      // On every startup instead of in a migration since the retention can change between them
+      await this.ensure_indexes(this.retention_indexes).catch((error) =>
+        Logger.error("Failed to update how long the stats and machine events are kept", error)
+      );
+      const { stats_purge_interval } = this.config;
+      if (stats_purge_interval)
+        this.purge_interval = setInterval(() => this.purge_expired_stats(), stats_purge_interval);
       return;
     } catch (reason) {
       Logger.error("MongoDB failed to connect, reason: ", reason);
@@ -71,10 +257,185 @@ export class DatabaseManager {
     }
   }
 
+  /**
+   * Connects, runs the migrations that didn't run yet and disconnects, for running them out of band with --migrate-only
+   * @param config The config of the backend
+   * @returns The ids of the migrations that ran
+   */
+  public static async migrate(config: Config) {
+    const self = new this(config);
+    const { url, app_name, connect_timeout } = config.database;
+    await DatabaseManager.connect_with_backoff(url, { appName: app_name }, connect_timeout);
+    try {
+      return await new MigrationRunner(self).run();
+    } finally {
+      await mongoose.disconnect();
+    }
+  }
+
+  /**
+   * Connects to mongo and pings it, retrying with exponential backoff as long as the next attempt fits in the timeout
+   * @param url The URL of the database
+   * @param options The options to connect with
+   * @param timeout How long to keep trying for
+   * @param delay How long to wait after the first failed attempt, doubles after every one after it
+   * @returns how many attempts it took or rejects with the error of the last one
+   * @tested
+   */
+  public static async connect_with_backoff(
+    url: string,
+    options: mongoose.ConnectOptions = {},
+    timeout = 30 * Time.Second,
+    delay = 500
+  ) {
+    const deadline = Date.now() + timeout;
+    for (let attempt = 1; ; attempt++) {
+      try {
+        const serverSelectionTimeoutMS = Math.max(Math.min(DatabaseManager.CONNECT_ATTEMPT_TIMEOUT, deadline - Date.now()), 1);
+        await mongoose.connect(url, { serverSelectionTimeoutMS, ...options });
+        await mongoose.connection.db.admin().ping();
+        return attempt;
+      } catch (error: any) {
+        await mongoose.disconnect().catch(() => {});
+        const wait = delay * 2 ** (attempt - 1);
+        if (Date.now() + wait >= deadline) {
+          Logger.warn(`MongoDB connection attempt ${attempt} failed, giving up`);
+          throw error;
+        }
+        Logger.warn(`MongoDB connection attempt ${attempt} failed, retrying in ${wait}ms: ${error?.message ?? error}`);
+        await new Promise((resolve) => setTimeout(resolve, wait));
+      }
+    }
+  }
+
+  /**
+   * Closes the connection after the queries that are still running finish
+   */
+  public async disconnect() {
+    clearInterval(this.cleanup_interval!);
+    clearInterval(this.rollup_interval!);
+    clearInterval(this.purge_interval!);
+    await this.flush_audit_logs();
+    await mongoose.disconnect();
+    Logger.info("MongoDB disconnected");
+  }
+
+  /**
+   * Runs a query unless the signal already aborted and stops waiting for it as soon as it aborts,
+   * the driver can't cancel a query that was sent so maxTimeMS makes mongo give up on it by itself
+   * @param query The query to run
+   * @param signal The signal of the request the query is for
+   * @tested
+   */
+  public static abortable = <R>(query: mongoose.Query<R, any> | mongoose.Aggregate<R>, signal?: AbortSignal): Promise<R> => {
+    if (signal?.aborted) return Promise.reject(ErrorCode.RequestAborted);
+    const promise = (
+      query instanceof mongoose.Aggregate
+        ? query.option({ maxTimeMS: DatabaseManager.QUERY_TIMEOUT })
+        : query.maxTimeMS(DatabaseManager.QUERY_TIMEOUT)
+    ).exec();
+    // The driver can wait on a busy pool or a dead connection for longer than maxTimeMS so it's given up on here too
+    return new Promise<R>((resolve, reject) => {
+      const timer = setTimeout(() => reject(ErrorCode.QueryTimeout), DatabaseManager.QUERY_TIMEOUT);
+      const abort = () => (clearTimeout(timer), reject(ErrorCode.RequestAborted));
+      signal?.addEventListener("abort", abort, { once: true });
+      promise
+        // Mongo gave up on it by itself
+        .then(resolve, (error) => reject(error?.code === MAX_TIME_EXPIRED ? ErrorCode.QueryTimeout : error))
+        .then(() => (clearTimeout(timer), signal?.removeEventListener("abort", abort)));
+    });
+  };
+
+  // The indexes the lookups by uuid, username, email and owner can't do without, the schemas declare them
+  // too but mongoose builds those in the background and only says it failed in an event nobody listens to,
+  // the first migration creates them and the indexes added after it get a migration of their own
+  public static REQUIRED_INDEXES: RequiredIndex[] = [
+    { collection: "users", key: { uuid: 1 }, unique: true },
+    { collection: "users", key: { username: 1 }, unique: true },
+    { collection: "users", key: { email: 1 }, unique: true },
+    { collection: "machines", key: { owner_uuid: 1 } },
+  ];
+
+  // The TTL indexes that delete the stats and machine events once they're older than their retention, the schemas
+  // declare them too but mongoose can't change the retention of an index that already exists so these replace it
+  private get retention_indexes(): RequiredIndex[] {
+    const { raw, rollups } = this.config.stats_retention;
+    return [
+      { collection: "stats", key: { timestamp: 1 }, expire_after: raw / Time.Second },
+      { collection: "stat_rollups", key: { timestamp: 1 }, expire_after: rollups / Time.Second },
+      {
+        collection: "machine_events",
+        key: { disconnected_at: 1 },
+        expire_after: this.config.machines.events_retention / Time.Second,
+      },
+    ];
+  }
+
+  /**
+   * Creates the indexes that are missing, creating one that already exists does nothing so this is safe to run
+   * more than once, an index that can't be created like a unique one over duplicates is logged
+   * @param required The indexes to create, the TTL indexes that expire after something else are changed
+   * @returns The indexes that were created or changed, the ones that were already there and the ones that couldn't be
+   * @tested
+   */
+  public async ensure_indexes(required = DatabaseManager.REQUIRED_INDEXES) {
+    const created: string[] = [];
+    const updated: string[] = [];
+    const present: string[] = [];
+    const failed: string[] = [];
+    for (const { collection, key, unique = false, expire_after } of required) {
+      const native = this[collection].collection;
+      const name = `${collection}.${Object.keys(key).join("_")}`;
+      // Listing the indexes of a collection that doesn't exist yet fails
+      const indexes: { key: object; unique?: boolean; expireAfterSeconds?: number }[] = await native.indexes().catch(() => []);
+      const same = (index: { key: object; unique?: boolean; expireAfterSeconds?: number }) =>
+        JSON.stringify(index.key) === JSON.stringify(key) &&
+        !!index.unique === unique &&
+        index.expireAfterSeconds === expire_after;
+      if (indexes.some(same)) {
+        present.push(name);
+        continue;
+      }
+      // A TTL index can be changed in place instead of being dropped and built again
+      const stale =
+        expire_after !== undefined &&
+        indexes.some((index) => index.expireAfterSeconds !== undefined && same({ ...index, expireAfterSeconds: expire_after }));
+      if (stale) {
+        await native.conn.db
+          .command({ collMod: native.collectionName, index: { keyPattern: key, expireAfterSeconds: expire_after } })
+          .then(() => updated.push(name))
+          .catch((error) => {
+            failed.push(name);
+            Logger.error(`Failed to change when the index ${chalk.blue(name)} expires documents`, error);
+          });
+        continue;
+      }
+      await native
+        .createIndex(key, { unique, ...(expire_after !== undefined && { expireAfterSeconds: expire_after }) })
+        .then(() => created.push(name))
+        .catch((error) => {
+          failed.push(name);
+          Logger.error(`Failed to create the index ${chalk.blue(name)}`, error);
+        });
+    }
+    created.length && Logger.info(`Created the indexes ${chalk.blue(created.join(", "))}`);
+    updated.length && Logger.info(`Changed when the indexes ${chalk.blue(updated.join(", "))} expire documents`);
+    present.length && Logger.info(`The indexes ${chalk.blue(present.join(", "))} were already there`);
+    return { created, updated, present, failed };
+  }
+
+  /**
+   * Checks that the database is connected and answering
+   */
+  public async ping() {
+    if (mongoose.connection.readyState !== mongoose.ConnectionStates.connected) return Promise.reject("database.disconnected");
+    return mongoose.connection.db.admin().ping();
+  }
+
   private async cleanup_database(): Promise<void> {
     // If it's in production only and this isn't the first shard then return
     // to avoid parallel cleanup
-    if (process.env.SHARD_ID && process.env.SHARD_ID !== "1") return;
+    if (!this.leads_shards) return;
 
     Logger.info(`Database cleanup started...`);
     const machines = await this.machines.find({});
@@ -87,20 +448,27 @@ export class DatabaseManager {
         Logger.info(`Deleted machine ${chalk.blue(machine.uuid)} because it hasn't been updated in 30 days`);
         continue;
       }
-
-      if (machine.status === MachineStatus.Online && machine.last_update < Date.now() - 1000 * 10) {
-        machine.status = MachineStatus.Offline;
-        Logger.info(`Marked machine ${chalk.blue(machine.uuid)} as offline because it hasn't been updated in 10 seconds`);
-        promises.push(machine.save());
-      }
     }
 
     await Promise.allSettled(promises);
+    await this.purge_deleted_users();
+    await this.purge_deleted_machines();
+    // Catches the history of machines deleted above or whose delete failed halfway, the history of
+    // soft deleted machines is kept until they're purged so restoring them brings it back
+    const existing = () => this.machines.distinct("uuid").setOptions(WITH_DELETED);
+    const { deletedCount } = await this.stats.deleteMany({ machine_uuid: { $nin: await existing() } });
+    deletedCount && Logger.info(`Deleted ${chalk.blue(deletedCount)} stat points of machines that don't exist anymore`);
+    await this.machine_events.deleteMany({ machine_uuid: { $nin: await existing() } });
+    await this.machine_details.deleteMany({ machine_uuid: { $nin: await existing() } });
+    await this.alerts.deleteMany({ machine_uuid: { $nin: await existing() } });
+    await this.share_links.deleteMany({ machine_uuid: { $nin: await existing() } });
     Logger.info(chalk.green("Database check complete"));
   }
 
-  // pro-gramer move right here
-  private generate_access_token = () => `${uuidv4()}${uuidv4()}${uuidv4()}${uuidv4()}`.replace(/-/g, "");
+  // A hash to compare against when a user isn't found so failed logins take the same time
+  private dummy_hash = bcrypt.hash(uuidv4(), this.config.bcrypt_rounds);
+
+  private generate_access_token = () => crypto.randomBytes(20).toString("hex");
 
   public async new_label(input: ICreateLabelInput) {
     const color = input.color || randomHexColor();
@@ -122,6 +490,38 @@ export class DatabaseManager {
     });
   }
 
+  public async new_datacenter(input: ICreateDatacenterInput) {
+    return this.datacenters.create({ name: input.name, logo: input.logo, owner_uuid: input.owner_uuid });
+  }
+
+  /**
+   * Updates a datacenter of a user
+   * @param uuid The uuid of the datacenter
+   * @param owner_uuid The uuid of the owner, datacenters of other users are treated as missing
+   * @param update The fields to update or the machines/members to add or remove
+   * @returns The updated datacenter
+   */
+  public async update_datacenter(uuid: string, owner_uuid: string, update: mongoose.UpdateQuery<IDatacenter>) {
+    const datacenter = await this.datacenters.findOneAndUpdate(
+      { uuid, owner_uuid },
+      { ...update, $set: { ...update.$set, updated_at: Date.now() } },
+      { new: true }
+    );
+    return datacenter ?? Promise.reject(ErrorCode.DatacenterNotFound);
+  }
+
+  public update_datacenter_profile = (uuid: string, owner_uuid: string, update: DatacenterUpdate) =>
+    this.update_datacenter(uuid, owner_uuid, { $set: update });
+
+  /**
+   * Deletes a datacenter of a user, the machines in it aren't touched
+   * @returns The deleted datacenter so its members can lose access
+   */
+  public async delete_datacenter(uuid: string, owner_uuid: string) {
+    const datacenter = await this.datacenters.findOneAndDelete({ uuid, owner_uuid });
+    return datacenter ?? Promise.reject(ErrorCode.DatacenterNotFound);
+  }
+
   /**
    *
    * Creates a new machine in the database
@@ -141,94 +541,2166 @@ export class DatabaseManager {
     });
   }
 
+  /**
+   * Creates a key a reporter can sign up with to be bound to the user
+   * @param owner_uuid The uuid of the user the machine will belong to
+   */
+  public async new_signup_key(owner_uuid: string) {
+    const outstanding = await this.signup_keys.countDocuments({ owner_uuid, expires_at: { $gt: new Date() } });
+    if (outstanding >= MAX_SIGNUP_KEYS) return Promise.reject(ErrorCode.TooManyKeys);
+    return this.signup_keys.create({
+      key: generate_signup_key(),
+      owner_uuid,
+      expires_at: new Date(Date.now() + SIGNUP_KEY_EXPIRATION),
+    });
+  }
+
+  /**
+   * Finds the keys of a user that haven't expired yet, the newest first
+   * @param owner_uuid The uuid of the user
+   * @param signal The signal of the request the keys are for
+   */
+  public async find_signup_keys(owner_uuid: string, signal?: AbortSignal) {
+    return DatabaseManager.abortable(
+      this.signup_keys.find({ owner_uuid, expires_at: { $gt: new Date() } }).sort({ created_at: -1 }),
+      signal
+    );
+  }
+
+  /**
+   * Uses up a signup key, deleting it makes sure two reporters can't sign up with the same one
+   * @param key The key the reporter signed up with
+   * @returns The uuid of the user the key belongs to
+   */
+  public async consume_signup_key(key: string) {
+    const deleted = await this.signup_keys.findOneAndDelete({ key });
+    if (!deleted) return Promise.reject(ErrorCode.KeyInvalid);
+    if (deleted.expires_at.getTime() <= Date.now()) return Promise.reject(ErrorCode.KeyExpired);
+    return deleted.owner_uuid;
+  }
+
   /**
    * Creates a new user in the database
    */
-  public async new_user(form: UserSignupInput, headers: IncomingHttpHeaders) {
+  public async new_user(form: UserSignupInput, headers: IncomingHttpHeaders, device: ISessionDevice): Promise<UserAuthResult> {
+    if (!form || typeof form !== "object") return Promise.reject("invalid.body");
+    // Only pick the fields a user is allowed to sign up with so things like is_admin can't be injected
+    const { email, username, password } = form;
+
+    // The pre save middleware normalizes them too, they're only normalized here to find who already has them
+    if (typeof username === "string" && (await this.users.exists({ username_lower: normalizeUsername(username) })))
+      return Promise.reject(ErrorCode.UsernameExists);
+    if (typeof email === "string" && (await this.users.exists({ email: normalizeEmail(email) })))
+      return Promise.reject(ErrorCode.EmailExists);
+
     try {
-      const user = await this.users.create<UserSignupInput>(form);
-      return { user, token: await user.login(headers) };
-    } catch (error) {
-      if (error instanceof MongoServerError) {
-        switch (error.code) {
-          case 11000:
-            return Promise.reject("user.exists");
-        }
+      const user = await this.users.create<UserSignupInput>({ email, username, password });
+      return await this.start_session(user, headers, device);
+    } catch (error: any) {
+      // Mongoose ships its own mongodb driver so we can't rely on instanceof MongoServerError here
+      if (error?.code === 11000) {
+        const field = Object.keys(error.keyValue ?? {})[0];
+        return Promise.reject(field ? `${field}.exists` : "user.exists");
       }
-      return Promise.reject(error);
+      return Promise.reject(error.message ?? error);
     }
   }
 
   /**
-   * Attempts to login a user
+   * Attempts to login a user, every failure rejects with the same reason
+   * so the response doesn't leak whether the username or the password was wrong
    */
   public async login_user(
     { username, password }: { username: string; password: string },
-    headers: IncomingHttpHeaders
+    headers: IncomingHttpHeaders,
+    device: ISessionDevice,
+    logger: ScopedLogger = Logger
   ): Promise<UserAuthResult> {
-    if (!Validators.validate_password(password)) return Promise.reject("invalid.password");
-    if (!Validators.validate_username(username)) return Promise.reject("invalid.username");
+    if (typeof username !== "string" || typeof password !== "string") return Promise.reject(ErrorCode.InvalidCredentials);
 
-    const user = await this.find_user({ username });
+    const found = await this.users.findOne({ username_lower: normalizeUsername(username) });
+    // Users who deleted themselves can still log in during the grace period to cancel it
+    const user = found && (!found.deleted_at || found.is_deletion_cancellable()) ? found : null;
+
+    // Always run a bcrypt comparison even if the user doesn't exist so the timing doesn't reveal valid usernames
+    if (!user) {
+      await bcrypt.compare(password, await this.dummy_hash);
+      return Promise.reject(ErrorCode.InvalidCredentials);
+    }
 
-    if (user && (await user.compare_password(password))) {
-      return { user, token: await user.login(headers) };
+    // Usernames that don't exist aren't audited since nobody could look them up
+    if (!(await user.compare_password(password))) {
+      this.log_audit(user.uuid, "user.login_failed", user.uuid, { reason: ErrorCode.InvalidCredentials }, device);
+      return Promise.reject(ErrorCode.InvalidCredentials);
+    }
+    // Only said once the password is right so it doesn't tell anyone else the account exists
+    if (user.disabled_at) {
+      this.log_audit(user.uuid, "user.login_failed", user.uuid, { reason: ErrorCode.AccountDisabled }, device);
+      return Promise.reject(ErrorCode.AccountDisabled);
     }
 
-    return Promise.reject("invalid credentials");
+    if (user.deleted_at) {
+      user.deleted_at = undefined;
+      user.deleted_by = undefined;
+      await user.save();
+      logger.info(`User ${chalk.blue(user.uuid)} logged in and cancelled the deletion of their account`);
+    }
+    // Hashes made before the cost was raised are upgraded while the password is at hand so nobody has to reset it,
+    // the login goes through even if it fails since the old hash still works
+    if (bcrypt.getRounds(user.password) < this.config.bcrypt_rounds) {
+      const hash = await bcrypt.hash(password, this.config.bcrypt_rounds);
+      // Only replaces the hash that was checked so a password changed in the meantime stays
+      await this.users
+        .updateOne({ uuid: user.uuid, password: user.password }, { $set: { password: hash } })
+        .catch((error) => logger.warn(`Failed to rehash the password of ${chalk.blue(user.uuid)}: ${error}`));
+    }
+    const result = await this.start_session(user, headers, device);
+    this.log_audit(user.uuid, "user.login", user.uuid, {}, device);
+    return result;
   }
 
-  public async login_user_websocket(access_token: string) {
-    return jwt.verify(access_token, process.env.JWT_SECRET!) as IUser;
+  /**
+   * Marks a user as deleted instead of removing the document so it can be recovered,
+   * every session and API token of the user is revoked right away
+   * @param uuid The uuid of the user to delete
+   * @param deleted_by The uuid of whoever is deleting the user
+   * @param device Where the request came from, it goes on the audit entry
+   */
+  public async soft_delete_user(uuid: string, deleted_by: string, device?: ISessionDevice) {
+    const user = await this.users.findOneAndUpdate(DatabaseManager.not_deleted<IUser>({ uuid }), {
+      $set: { deleted_at: Date.now(), deleted_by },
+      $inc: { token_version: 1 },
+    });
+    if (!user) return Promise.reject(ErrorCode.UserNotFound);
+    await this.sessions.deleteMany({ user_uuid: uuid });
+    await this.signup_keys.deleteMany({ owner_uuid: uuid });
+    await this.api_tokens.deleteMany({ user_uuid: uuid });
+    await this.delete_webhooks({ user_uuid: uuid });
+    // Users deleting themselves aren't moderation
+    if (deleted_by !== uuid) this.log_audit(deleted_by, "user.delete", uuid, {}, device);
+    return user;
   }
 
-  public async login_machine(access_token: string) {
-    const machine = await this.machines.findOne({ access_token });
-    if (!machine) return Promise.reject("Invalid access token");
-    machine.status = MachineStatus.Online;
-    return machine.save();
+  /**
+   * Disables a user until an admin enables them again, every session of theirs is revoked right away
+   * and the tokens of their machines stop working while they're disabled
+   * @param uuid The uuid of the user to disable
+   * @param actor_uuid The uuid of the admin disabling them
+   * @param device Where the request came from, it goes on the audit entry
+   * @returns The disabled user
+   */
+  public async disable_user(uuid: string, actor_uuid: string, device?: ISessionDevice) {
+    const user = await this.users.findOneAndUpdate(
+      DatabaseManager.not_deleted<IUser>({ uuid }),
+      { $set: { disabled_at: Date.now() }, $inc: { token_version: 1 } },
+      { new: true }
+    );
+    if (!user) return Promise.reject(ErrorCode.UserNotFound);
+    await this.sessions.deleteMany({ user_uuid: uuid });
+    this.log_audit(actor_uuid, "user.disable", uuid, {}, device);
+    return user;
   }
 
   /**
-   * Deletes a user by the specified username and password
-   * @param username The username to search by
-   * @param password The password for validation
-   * @returns The deleted user
+   * Lets a disabled user log in again, they have to since their sessions were revoked
+   * @param uuid The uuid of the user to enable
+   * @param actor_uuid The uuid of the admin enabling them
+   * @param device Where the request came from, it goes on the audit entry
+   * @returns The enabled user
    */
-  public async delete_user({ username, password }: { username: string; password: string }) {
-    if (!Validators.validate_password(password)) return Promise.reject("invalid.password");
-    if (!Validators.validate_username(username)) return Promise.reject("invalid.username");
+  public async enable_user(uuid: string, actor_uuid: string, device?: ISessionDevice) {
+    const user = await this.users.findOneAndUpdate(
+      DatabaseManager.not_deleted<IUser>({ uuid }),
+      { $unset: { disabled_at: 1 } },
+      { new: true }
+    );
+    if (!user) return Promise.reject(ErrorCode.UserNotFound);
+    this.log_audit(actor_uuid, "user.enable", uuid, {}, device);
+    return user;
+  }
 
-    const user = await this.find_user({ username });
-    if (user && (await user.compare_password(password))) this.users.deleteOne({ username: username });
+  /**
+   * Purges a user right away instead of after the grace period, users who are already soft deleted included
+   * @param uuid The uuid of the user to purge
+   * @param actor_uuid The uuid of the admin purging them
+   * @param device Where the request came from, it goes on the audit entry
+   */
+  public async force_delete_user(uuid: string, actor_uuid: string, device?: ISessionDevice) {
+    const user = await this.users.findOne({ uuid });
+    if (!user) return Promise.reject(ErrorCode.UserNotFound);
+    await this.purge_user(user);
+    this.log_audit(actor_uuid, "user.purge", uuid, {}, device);
   }
 
-  private find_one = async <T>(collection: "machine" | "user" | "label", filter?: mongoose.FilterQuery<T>): Promise<T> => {
-    switch (collection) {
-      case "user":
-        return (await this.users.findOne(filter)) ?? Promise.reject(`${collection}.notFound`);
-      case "label":
-        return (await this.labels.findOne(filter)) ?? Promise.reject(`${collection}.notFound`);
-      case "machine":
-        return (await this.machines.findOne(filter)) ?? Promise.reject(`${collection}.notFound`);
+  /**
+   * Makes the user with the email from the config an admin, it's how a new instance gets its first admin
+   * since only admins can promote users, the email has to be verified so nobody can sign up with it first
+   * @param email The email of the user
+   */
+  public async bootstrap_admin(email: string) {
+    const user = await this.users.findOneAndUpdate(
+      DatabaseManager.not_deleted<IUser>({ email: normalizeEmail(email), email_verified: true, is_admin: { $ne: true } }),
+      { $set: { is_admin: true } }
+    );
+    user && Logger.info(`Made ${chalk.blue(user.username)} an admin because their email is the ADMIN_EMAIL`);
+  }
+
+  /**
+   * Schedules the account of a user for deletion, it's purged after the grace period unless they log in again
+   * @param uuid The uuid of the user
+   * @param password The password of the user, deleting an account needs it re-entered
+   * @returns When the account will be purged
+   */
+  public async request_user_deletion(uuid: string, password: string) {
+    const user = await this.find_user({ uuid });
+    if (!(await user.compare_password(password))) return Promise.reject(ErrorCode.InvalidPassword);
+    await this.soft_delete_user(uuid, uuid);
+    return Date.now() + ACCOUNT_DELETION_GRACE;
+  }
+
+  /**
+   * The filter of the users who deleted themselves and whose grace period is over
+   * @tested
+   */
+  public static purgeable_users_filter = (now = Date.now()) =>
+    ({
+      deleted_at: { $lte: now - ACCOUNT_DELETION_GRACE },
+      $expr: { $eq: ["$deleted_by", "$uuid"] },
+    } as mongoose.FilterQuery<IUser>);
+
+  /**
+   * Deletes a user for good along with everything they own, the user document goes last so a purge that
+   * gets interrupted halfway is picked up again by the next cleanup and every step is safe to repeat
+   * @param user The user to purge
+   */
+  public async purge_user(user: IUser) {
+    const { uuid } = user;
+    const machine_uuids: string[] = await this.machines.distinct("uuid", { owner_uuid: uuid }).setOptions(WITH_DELETED);
+    await this.stats.deleteMany({ machine_uuid: { $in: machine_uuids } });
+    await this.stat_rollups.deleteMany({ machine_uuid: { $in: machine_uuids } });
+    await this.machine_details.deleteMany({ machine_uuid: { $in: machine_uuids } });
+    await this.datacenters.updateMany({ machines: { $in: machine_uuids } }, { $pull: { machines: { $in: machine_uuids } } });
+    await this.machines.deleteMany({ owner_uuid: uuid });
+    await this.machines.updateMany({ access: uuid }, { $pull: { access: uuid } }).setOptions(WITH_DELETED);
+    await this.labels.deleteMany({ owner_uuid: uuid });
+    await this.datacenters.deleteMany({ owner_uuid: uuid });
+    await this.datacenters.updateMany({ members: uuid }, { $pull: { members: uuid } });
+    await this.users.updateMany({ "friends.uuid": uuid }, { $pull: { friends: { uuid } } });
+    await this.sessions.deleteMany({ user_uuid: uuid });
+    await this.signup_keys.deleteMany({ owner_uuid: uuid });
+    await this.api_tokens.deleteMany({ user_uuid: uuid });
+    await this.delete_webhooks({ user_uuid: uuid });
+    await deleteUpload(this.config, user.avatar);
+    await deleteUpload(this.config, user.banner);
+    await this.users.deleteOne({ uuid });
+  }
+
+  /**
+   * Purges the users whose grace period is over, one at a time so a failure only holds up that user
+   */
+  private async purge_deleted_users() {
+    const purgeable = await this.users.find(DatabaseManager.purgeable_users_filter());
+    for (const user of purgeable) {
+      await this.purge_user(user)
+        .then(() => Logger.info(`Purged user ${chalk.blue(user.uuid)} because their grace period is over`))
+        .catch((error) => Logger.error(`Failed to purge user ${user.uuid}, it's retried on the next cleanup`, error));
     }
+  }
+
+  // The audit entries waiting to be written, they're written together on the next tick
+  private audit_queue: Partial<IAuditLog>[] = [];
+  // The write that's running, the next one waits for it so disconnecting can wait for every one of them
+  private audit_writes = Promise.resolve();
+
+  /**
+   * Records a sensitive action on the audit log, it's only queued so the request isn't slowed down and
+   * a write that fails is logged since what it records already happened
+   * @param actor_uuid The uuid of the user that did it
+   * @param action What they did
+   * @param subject_uuid The uuid of what they did it to
+   * @param details Depends on the action
+   * @param device Where the request came from
+   * @tested
+   */
+  public log_audit(
+    actor_uuid: string,
+    action: AuditAction,
+    subject_uuid: string,
+    details: { [key: string]: unknown } = {},
+    device?: ISessionDevice
+  ) {
+    const now = Date.now();
+    this.audit_queue.push({
+      // insertMany doesn't run the save middleware that sets these on the other documents
+      uuid: uuidv4(),
+      created_at: now,
+      updated_at: now,
+      action,
+      actor_uuid,
+      subject_uuid,
+      details,
+      ip: device?.ip,
+      user_agent: device?.agent,
+    });
+    if (this.audit_queue.length === 1) setImmediate(() => this.flush_audit_logs());
+  }
+
+  /**
+   * Writes the audit entries that are queued in one go after the writes before them, disconnecting waits for it
+   * so the entries of the last requests aren't lost
+   * @tested
+   */
+  public flush_audit_logs() {
+    const entries = this.audit_queue.splice(0);
+    if (!entries.length) return this.audit_writes;
+    this.audit_writes = this.audit_writes.then(() =>
+      this.audit_logs.insertMany(entries, { ordered: false }).then(
+        () => undefined,
+        (error) => Logger.error(`Failed to write ${entries.length} audit entries`, error)
+      )
+    );
+    return this.audit_writes;
+  }
+
+  /**
+   * The filter of the audit log of a user, what they did and what was done to them
+   * @param uuid The uuid of the user
+   * @param query What to narrow it down to, everything by default
+   * @tested
+   */
+  public static audit_logs_filter = (uuid: string, { from, to, action }: AuditLogQuery = {}) => {
+    const filter: mongoose.FilterQuery<IAuditLog> = { $or: [{ actor_uuid: uuid }, { subject_uuid: uuid }] };
+    if (action !== undefined) filter.action = action;
+    if (from !== undefined || to !== undefined)
+      filter.created_at = {
+        ...(from !== undefined && { $gte: from }),
+        ...(to !== undefined && { $lte: to }),
+      };
+    return filter;
   };
 
-  private find = async <T>(collection: "machine" | "user" | "label", filter: mongoose.FilterQuery<T>): Promise<T[]> => {
-    switch (collection) {
-      case "user":
-        return (await this.users.find(filter)) ?? Promise.reject(`${collection}s.notFound`);
-      case "label":
-        return (await this.labels.find(filter)) ?? Promise.reject(`${collection}s.notFound`);
-      case "machine":
-        return (await this.machines.find(filter)) ?? Promise.reject(`${collection}s.notFound`);
-    }
+  /**
+   * Pages through the audit log of a user newest first, what they did and what was done to them
+   * @param uuid The uuid of the user
+   * @param pagination The page to get
+   * @param query What to narrow it down to
+   * @param signal The signal of the request the entries are for
+   */
+  public async find_audit_logs(uuid: string, { limit, skip }: Pagination, query: AuditLogQuery = {}, signal?: AbortSignal) {
+    const filter = DatabaseManager.audit_logs_filter(uuid, query);
+    const [entries, total] = await Promise.all([
+      DatabaseManager.abortable(this.audit_logs.find(filter).sort({ created_at: -1 }).skip(skip).limit(limit), signal),
+      DatabaseManager.abortable(this.audit_logs.countDocuments(filter), signal),
+    ]);
+    return { entries, total };
+  }
+
+  /**
+   * Flips the admin flag of a user, the last remaining admin can't be demoted
+   * so there's always someone who can manage the instance
+   * @param uuid The uuid of the user to promote or demote
+   * @param actor_uuid The uuid of the admin doing it
+   * @param device Where the request came from, it goes on the audit entry
+   * @returns The updated user
+   */
+  public async toggle_admin(uuid: string, actor_uuid: string, device?: ISessionDevice) {
+    const user = await this.find_user({ uuid });
+    if (user.is_admin && (await this.users.countDocuments(DatabaseManager.not_deleted<IUser>({ is_admin: true }))) <= 1)
+      return Promise.reject(ErrorCode.LastAdmin);
+    user.is_admin = !user.is_admin;
+    await user.save();
+    this.log_audit(actor_uuid, user.is_admin ? "user.promote" : "user.demote", uuid, {}, device);
+    return user;
+  }
+
+  /**
+   * The filter of the users an admin lists, the filters that aren't set match everyone
+   * @tested
+   */
+  public static admin_users_filter = ({ email_verified, disabled, created_after, created_before }: AdminUsersQuery) => {
+    const filter: mongoose.FilterQuery<IUser> = {};
+    if (email_verified !== undefined) filter.email_verified = email_verified;
+    if (disabled !== undefined) filter.disabled_at = disabled ? { $ne: null } : null;
+    if (created_after !== undefined || created_before !== undefined)
+      filter.created_at = {
+        ...(created_after !== undefined && { $gte: created_after }),
+        ...(created_before !== undefined && { $lt: created_before }),
+      };
+    return filter;
   };
 
-  public find_machine = (filter?: mongoose.FilterQuery<IMachine>) => this.find_one<IMachine>("machine", filter);
-  public find_user = (filter?: mongoose.FilterQuery<IUser>) => this.find_one<IUser>("user", filter);
-  public find_label = (filter?: mongoose.FilterQuery<ILabel>) => this.find_one<ILabel>("label", filter);
-  public find_machines = (filter: mongoose.FilterQuery<IMachine>) => this.find<IMachine>("machine", filter);
-  public find_users = (filter: mongoose.FilterQuery<IUser>) => this.find<IUser>("user", filter);
-  public find_labels = (filter: mongoose.FilterQuery<ILabel>) => this.find<ILabel>("label", filter);
+  // The most users a search can return
+  public static SEARCH_LIMIT = 20;
+
+  /**
+   * The filter used to search users, it's an anchored case sensitive regex on the lowercased
+   * username so mongo can walk the username_lower index instead of scanning the collection
+   * @param query What the username starts with
+   */
+  public static user_search_filter = (query: string) =>
+    DatabaseManager.not_deleted<IUser>({ username_lower: { $regex: `^${escapeRegex(query.toLowerCase())}` } });
+
+  /**
+   * Finds the users whose username starts with the query
+   * @param query What the username starts with
+   * @param limit The maximum amount of users to return
+   */
+  public async search_users(query: string, limit = DatabaseManager.SEARCH_LIMIT, signal?: AbortSignal) {
+    return DatabaseManager.abortable(
+      this.users
+        .find(DatabaseManager.user_search_filter(query))
+        .sort({ username_lower: 1 })
+        .limit(Math.min(limit, DatabaseManager.SEARCH_LIMIT)),
+      signal
+    );
+  }
+
+  /**
+   * Finds every user of a list of uuids in the order they were asked for, the ones that don't exist are left out
+   * @param uuids The uuids of the users
+   * @param signal The signal of the request the users are for
+   * @tested
+   */
+  public async find_users_by_uuids(uuids: string[], signal?: AbortSignal) {
+    const valid = [...new Set(uuids.filter((uuid) => Validators.validate_uuid(uuid)))];
+    if (!valid.length) return [];
+    const found = await DatabaseManager.abortable(
+      this.users.find(DatabaseManager.not_deleted<IUser>({ uuid: { $in: valid } })),
+      signal
+    );
+    // Mongo returns them in whatever order it finds them in
+    const order = new Map(valid.map((uuid, index) => [uuid, index]));
+    return found.sort((a, b) => order.get(a.uuid)! - order.get(b.uuid)!);
+  }
+
+  /**
+   * Sends a friend request, both users get a record of it so either of them can see or cancel it
+   * @param uuid The uuid of the user sending it
+   * @param friend_uuid The uuid of the user getting it
+   * @tested
+   */
+  public async request_friend(uuid: string, friend_uuid: string) {
+    if (uuid === friend_uuid) return Promise.reject(ErrorCode.InvalidFriend);
+    await this.find_user({ uuid: friend_uuid });
+    const created_at = Date.now();
+    // Only pushes when there's no record of the other user yet, friends already or a request either way
+    const { modifiedCount } = await this.users.updateOne(
+      { uuid, "friends.uuid": { $ne: friend_uuid } },
+      { $push: { friends: { uuid: friend_uuid, status: "pending", incoming: false, created_at } } }
+    );
+    if (!modifiedCount) return Promise.reject(ErrorCode.FriendExists);
+    await this.users.updateOne(
+      { uuid: friend_uuid, "friends.uuid": { $ne: uuid } },
+      { $push: { friends: { uuid, status: "pending", incoming: true, created_at } } }
+    );
+  }
+
+  /**
+   * Accepts a friend request the user got, the records of both users are accepted
+   * so neither of them is friends with someone who isn't friends with them
+   * @param uuid The uuid of the user who got the request
+   * @param friend_uuid The uuid of the user who sent it
+   * @tested
+   */
+  public async accept_friend(uuid: string, friend_uuid: string) {
+    const accepted = { "friends.$.status": "accepted", "friends.$.accepted_at": Date.now() };
+    const received = await this.users.updateOne(
+      { uuid, friends: { $elemMatch: { uuid: friend_uuid, status: "pending", incoming: true } } },
+      { $set: accepted }
+    );
+    if (!received.modifiedCount) return Promise.reject(ErrorCode.FriendNotFound);
+    const sent = await this.users.updateOne(
+      { uuid: friend_uuid, friends: { $elemMatch: { uuid, status: "pending", incoming: false } } },
+      { $set: accepted }
+    );
+    // The request was cancelled while it was being accepted
+    if (!sent.modifiedCount) {
+      await this.remove_friend(uuid, friend_uuid);
+      return Promise.reject(ErrorCode.FriendNotFound);
+    }
+  }
+
+  /**
+   * Unfriends a user or cancels or declines a request, from both sides
+   * @param uuid The uuid of the user removing the friend
+   * @param friend_uuid The uuid of the friend
+   * @tested
+   */
+  public async remove_friend(uuid: string, friend_uuid: string) {
+    // Nobody has a record of themselves so pulling both uuids from both users only pulls the other one
+    const { modifiedCount } = await this.users.updateMany(
+      { uuid: { $in: [uuid, friend_uuid] } },
+      { $pull: { friends: { uuid: { $in: [uuid, friend_uuid] } } } }
+    );
+    if (!modifiedCount) return Promise.reject(ErrorCode.FriendNotFound);
+  }
+
+  /**
+   * Lists the friends of a user apart from the requests they got and sent, friends that are deleted are left out
+   * @param user The user whose friends to list
+   * @param signal The signal of the request the friends are for
+   * @tested
+   */
+  public async find_friends(user: IUser, signal?: AbortSignal): Promise<IFriendList> {
+    const records = user.friends ?? [];
+    const found = await this.find_users_by_uuids(records.map((record) => record.uuid), signal);
+    const previews = new Map(found.map((friend) => [friend.uuid, friend.to_preview()]));
+    const list: IFriendList = { friends: [], incoming: [], outgoing: [] };
+    for (const record of records) {
+      const preview = previews.get(record.uuid);
+      if (!preview) continue;
+      if (record.status === "accepted") list.friends.push({ ...preview, since: record.accepted_at ?? record.created_at });
+      else list[record.incoming ? "incoming" : "outgoing"].push({ ...preview, requested_at: record.created_at });
+    }
+    return list;
+  }
+
+  /**
+   * The filter of a user at a version, users written before versions existed don't have one and are at 0
+   * @tested
+   */
+  public static at_version = (uuid: string, version: number) =>
+    DatabaseManager.not_deleted<IUser>({ uuid, version: version || { $in: [0, null] } });
+
+  /**
+   * Sets only the provided fields on a user, the update only applies to the user as it was read so
+   * two edits racing each other can't clobber one another, the one that loses rejects with version.conflict
+   * @param uuid The uuid of the user to update
+   * @param fields The fields to set
+   * @param version The version the client last saw, the update rejects with version.conflict if it's stale
+   * @returns The updated user
+   */
+  public async update_user(uuid: string, { email, ...fields }: UserProfileUpdate, version?: number) {
+    const current = await this.find_user({ uuid });
+    if (version !== undefined && version !== (current.version ?? 0)) return Promise.reject(ErrorCode.VersionConflict);
+    if (email !== undefined) fields.email = normalizeEmail(email);
+    const username_lower = fields.username && normalizeUsername(fields.username);
+    if (username_lower && (await this.users.exists({ username_lower, uuid: { $ne: uuid } })))
+      return Promise.reject(ErrorCode.UsernameExists);
+    if (fields.email && (await this.users.exists({ email: fields.email, uuid: { $ne: uuid } })))
+      return Promise.reject(ErrorCode.EmailExists);
+    // A new email has to be verified again and the tokens sent to the old one stop working
+    const email_changed = fields.email !== undefined && fields.email !== current.email;
+
+    const user = await this.users.findOneAndUpdate(
+      DatabaseManager.at_version(uuid, current.version ?? 0),
+      {
+        $set: { ...fields, ...(username_lower && { username_lower }), ...(email_changed && { email_verified: false }) },
+        ...(email_changed && { $unset: { verification_nonce: 1 } }),
+      },
+      { new: true, runValidators: true }
+    );
+    // Someone else wrote to the user between reading and updating it
+    return user ?? Promise.reject(ErrorCode.VersionConflict);
+  }
+
+  /**
+   * Stores a new password reset token for the user with an email, the tokens sent before it stop working
+   * @param email The email of the user
+   * @returns the user and the token to email them, undefined if no user has that email
+   */
+  public async request_password_reset(email: string): Promise<{ user: IUser; token: string } | undefined> {
+    const secret = generate_refresh_secret();
+    const filter = DatabaseManager.not_deleted<IUser>({ email: normalizeEmail(email) });
+    const user = await this.users.findOneAndUpdate(filter, {
+      $set: { password_reset: { hash: hash_refresh_secret(secret), expires_at: Date.now() + PASSWORD_RESET_EXPIRATION } },
+    });
+    // Reset tokens are formatted like refresh tokens but with the uuid of the user
+    return user ? { user, token: format_refresh_token(user.uuid, secret) } : undefined;
+  }
+
+  /**
+   * Sets a new password with a reset token and logs the user out everywhere
+   * @param token The token from the password reset email
+   * @param password The new password
+   * @param device Where the request came from, it goes on the audit entry
+   */
+  public async reset_password(token: string, password: string, device?: ISessionDevice): Promise<IUser> {
+    const parsed = parse_refresh_token(token);
+    if (!parsed) return Promise.reject(ErrorCode.TokenInvalid);
+
+    // Matching on the hash consumes the token so two resets with it race for it and only one of them wins
+    const user = await this.users.findOneAndUpdate(
+      DatabaseManager.not_deleted<IUser>({
+        uuid: parsed.session_uuid,
+        "password_reset.hash": hash_refresh_secret(parsed.secret),
+      }),
+      { $unset: { password_reset: 1 } }
+    );
+    if (!user) return Promise.reject(ErrorCode.TokenInvalid);
+    if ((user.password_reset?.expires_at ?? 0) <= Date.now()) return Promise.reject(ErrorCode.TokenExpired);
+
+    user.password = password;
+    user.password_reset = undefined;
+    user.token_version = (user.token_version ?? 0) + 1;
+    await user.save();
+    await this.sessions.deleteMany({ user_uuid: user.uuid });
+    this.log_audit(user.uuid, "user.password_reset", user.uuid, {}, device);
+    return user;
+  }
+
+  /**
+   * Signs a new token for the verification email of a user, the tokens sent before it stop working
+   * @param user The user to verify
+   * @returns the token to put in the verification email
+   */
+  public async new_email_verification(user: IUser): Promise<string> {
+    if (user.email_verified) return Promise.reject(ErrorCode.EmailAlreadyVerified);
+    const nonce = crypto.randomBytes(16).toString("hex");
+    await this.users.updateOne({ uuid: user.uuid }, { $set: { verification_nonce: nonce } });
+    user.verification_nonce = nonce;
+    return sign_verification_token({ uuid: user.uuid, email: user.email, nonce }, this.config.jwt.secret);
+  }
+
+  /**
+   * Marks the email of a user as verified, consuming the nonce makes every token single use
+   * @param token The token from the verification email
+   */
+  public async verify_email(token: string): Promise<IUser> {
+    const { uuid, email, nonce } = await verify_verification_token(token, this.config.jwt.secret);
+    const user = await this.users.findOneAndUpdate(
+      DatabaseManager.not_deleted<IUser>({ uuid, email, verification_nonce: nonce }),
+      { $set: { email_verified: true, updated_at: Date.now() }, $unset: { verification_nonce: 1 } },
+      { new: true }
+    );
+    return user ?? Promise.reject(ErrorCode.TokenInvalid);
+  }
+
+  /**
+   * Gets the user a websocket token belongs to
+   * @param access_token The token the client logged in with
+   */
+  public async login_user_websocket(access_token: string) {
+    const payload = jwt.verify(access_token, this.config.jwt.secret, { algorithms: ["HS256"] }) as UserTokenPayload;
+    const user = await this.find_user({ uuid: payload.uuid });
+    return user.is_token_current(payload) ? user : Promise.reject(ErrorCode.TokenRevoked);
+  }
+
+  /**
+   * Changes the password of a user and logs out all of their sessions
+   * @param uuid The uuid of the user
+   * @param old_password The password the user has now
+   * @param new_password The password to change to, it's hashed when saved
+   * @param device Where the request came from, it goes on the audit entry
+   * @returns The updated user
+   */
+  public async update_user_password(uuid: string, old_password: string, new_password: string, device?: ISessionDevice) {
+    const user = await this.find_user({ uuid });
+    if (!(await user.compare_password(old_password))) return Promise.reject(ErrorCode.InvalidPassword);
+    user.password = new_password;
+    user.token_version = (user.token_version ?? 0) + 1;
+    await user.save();
+    await this.sessions.deleteMany({ user_uuid: uuid });
+    this.log_audit(uuid, "user.password", uuid, {}, device);
+    return user;
+  }
+
+  /**
+   * Logs a user in on a device, the access token is short lived and the refresh token
+   * is what the client exchanges for new ones at /auth/@refresh
+   * @param user The user to log in
+   * @param headers The headers the login history is recorded from
+   * @param device Where the session is used from
+   */
+  public async start_session(user: IUser, headers: IncomingHttpHeaders, device: ISessionDevice): Promise<UserAuthResult> {
+    const secret = generate_refresh_secret();
+    const session = await this.sessions.create({
+      ...device,
+      user_uuid: user.uuid,
+      refresh_hash: hash_refresh_secret(secret),
+      last_used_at: Date.now(),
+      expires_at: new Date(Date.now() + this.config.jwt.refresh_expiration),
+    });
+    const token = await user.login(headers, this.config.jwt);
+    return { user, token, refresh_token: format_refresh_token(session.uuid, secret) };
+  }
+
+  /**
+   * Exchanges a refresh token for a new access token and rotates it, using a refresh token that was already
+   * rotated means it was stolen so the whole session is revoked along with the token the thief got for it
+   * @param refresh_token The refresh token the client got at login or its last refresh
+   * @param device Where the session is used from now
+   * @param logger The logger of the request the refresh is for
+   */
+  public async refresh_session(
+    refresh_token: string,
+    device: ISessionDevice,
+    logger: ScopedLogger = Logger
+  ): Promise<UserAuthResult> {
+    const parsed = parse_refresh_token(refresh_token);
+    if (!parsed) return Promise.reject(ErrorCode.TokenInvalid);
+
+    const session = await this.sessions.findOne({ uuid: parsed.session_uuid });
+    if (!session) return Promise.reject(ErrorCode.TokenInvalid);
+    if (session.expires_at.getTime() <= Date.now()) return Promise.reject(ErrorCode.TokenExpired);
+
+    const secret = generate_refresh_secret();
+    // Matching on the old hash makes two refreshes with the same token race for it and only one of them win
+    const rotated = await this.sessions.findOneAndUpdate(
+      { uuid: session.uuid, refresh_hash: hash_refresh_secret(parsed.secret) },
+      {
+        $set: {
+          ...device,
+          refresh_hash: hash_refresh_secret(secret),
+          last_used_at: Date.now(),
+          updated_at: Date.now(),
+          expires_at: new Date(Date.now() + this.config.jwt.refresh_expiration),
+        },
+      }
+    );
+
+    if (!rotated) {
+      logger.warn(`Refresh token of session ${chalk.blue(session.uuid)} was reused, revoking the session`);
+      await this.sessions.deleteOne({ uuid: session.uuid });
+      return Promise.reject(ErrorCode.TokenRevoked);
+    }
+
+    const user = await this.find_user({ uuid: session.user_uuid });
+    if (user.disabled_at) return Promise.reject(ErrorCode.AccountDisabled);
+    return { user, token: user.sign_token(this.config.jwt), refresh_token: format_refresh_token(session.uuid, secret) };
+  }
+
+  /**
+   * Finds the sessions of a user that haven't expired yet, the most recently used first
+   * @param user_uuid The uuid of the user
+   * @param signal The signal of the request the sessions are for
+   */
+  public async find_sessions(user_uuid: string, signal?: AbortSignal) {
+    return DatabaseManager.abortable(
+      this.sessions.find({ user_uuid, expires_at: { $gt: new Date() } }).sort({ last_used_at: -1 }),
+      signal
+    );
+  }
+
+  /**
+   * Revokes a session, its access tokens keep working until they expire
+   * @param uuid The uuid of the session
+   * @param user_uuid The uuid of the user, sessions of other users are treated as missing
+   */
+  public async delete_session(uuid: string, user_uuid: string) {
+    const { deletedCount } = await this.sessions.deleteOne({ uuid, user_uuid });
+    if (!deletedCount) return Promise.reject(ErrorCode.SessionNotFound);
+  }
+
+  /**
+   * Revokes every session of a user, the token version is bumped too so their access tokens stop working right away
+   * @param user_uuid The uuid of the user
+   * @returns How many sessions were revoked
+   */
+  public async delete_sessions(user_uuid: string) {
+    const { deletedCount } = await this.sessions.deleteMany({ user_uuid });
+    await this.users.updateOne({ uuid: user_uuid }, { $inc: { token_version: 1 } });
+    return deletedCount;
+  }
+
+  /**
+   * Stores the latest dynamic data of a machine and marks it as online
+   * @param uuid The uuid of the machine
+   * @param stats The computed dynamic data
+   * @returns the status the machine had before so coming back online can be announced
+   */
+  public async update_machine_stats(uuid: string, stats: IComputedDynamicData): Promise<MachineStatus | undefined> {
+    const previous = await this.machines.findOneAndUpdate(
+      { uuid },
+      {
+        $set: {
+          dynamic_data: stats,
+          last_update: stats.timestamp,
+          last_seen: stats.timestamp,
+          status: MachineStatus.Online,
+        },
+      },
+      { projection: { status: 1 } }
+    );
+    return previous?.status;
+  }
+
+  /**
+   * Stores where the reporter of a machine connects from
+   * @param uuid The uuid of the machine
+   * @param network The resolved network of the IP it connected from
+   */
+  public async update_machine_network(uuid: string, network: IMachineNetwork) {
+    await this.machines.updateOne({ uuid }, { $set: { network } });
+  }
+
+  /**
+   * Marks the machines that stopped reporting as offline
+   * @param threshold How long a machine can go without reporting
+   * @returns the uuids of the machines that went offline
+   */
+  public async mark_offline_machines(threshold = this.config.machines.offline_threshold): Promise<string[]> {
+    // Machines that never reported since last_seen was added don't have it yet
+    const filter = { status: { $ne: MachineStatus.Offline }, last_seen: { $not: { $gte: Date.now() - threshold } } };
+    const uuids: string[] = await this.machines.distinct("uuid", filter);
+    if (!uuids.length) return [];
+    await this.machines.updateMany({ ...filter, uuid: { $in: uuids } }, { $set: { status: MachineStatus.Offline } });
+    // Leaves out the machines that reported again between finding and updating them
+    return this.machines.distinct("uuid", { uuid: { $in: uuids }, status: MachineStatus.Offline });
+  }
+
+  /**
+   * The aggregation that counts the machines of a user and sums up what the online ones last reported,
+   * offline machines still have their last stats so they're left out of the usage
+   * @param owner_uuid The uuid of the user
+   * @param now The time to check whether the machines are online against
+   * @param threshold How long a machine can go without reporting
+   * @tested
+   */
+  public static user_dashboard_pipeline = (owner_uuid: string, now = Date.now(), threshold = offline_detection.threshold) =>
+    DatabaseManager.machine_summary_pipeline({ owner_uuid }, now, threshold);
+
+  /**
+   * The aggregation that counts some machines and sums up what the online ones last reported,
+   * the cores are of every machine since they're there whether it's online or not
+   * @param match Which machines to sum up
+   * @param now The time to check whether the machines are online against
+   * @param threshold How long a machine can go without reporting
+   * @tested
+   */
+  public static machine_summary_pipeline = (
+    match: mongoose.FilterQuery<IMachine>,
+    now = Date.now(),
+    threshold = offline_detection.threshold
+  ): mongoose.PipelineStage[] => {
+    // The same as machine_presence
+    const online = {
+      $and: [{ $ne: ["$status", MachineStatus.Offline] }, { $gt: [{ $ifNull: ["$last_seen", 0] }, now - threshold] }],
+    };
+    const when_online = (field: string) => ({ $cond: [online, `$dynamic_data.${field}`, null] });
+    return [
+      { $match: match },
+      {
+        $group: {
+          _id: null,
+          total: { $sum: 1 },
+          online: { $sum: { $cond: [online, 1, 0] } },
+          cores: { $sum: { $ifNull: ["$static_data.cpu_cores", 0] } },
+          // $avg and $sum skip the nulls of the offline machines
+          cpu: { $avg: when_online("cau") },
+          ram_used: { $sum: when_online("ram.used") },
+          ram_total: { $sum: when_online("ram.total") },
+          download: { $sum: when_online("td") },
+          upload: { $sum: when_online("tu") },
+        },
+      },
+      {
+        $project: {
+          _id: 0,
+          machines: { total: "$total", online: "$online", offline: { $subtract: ["$total", "$online"] } },
+          cores: "$cores",
+          cpu: "$cpu",
+          ram: { used: "$ram_used", total: "$ram_total" },
+          network: { download: "$download", upload: "$upload" },
+        },
+      },
+    ];
+  };
+
+  /**
+   * Sums up the machines of a user for their dashboard
+   * @param owner_uuid The uuid of the user
+   * @param signal The signal of the request the summary is for
+   */
+  public async get_user_dashboard(owner_uuid: string, signal?: AbortSignal): Promise<IMachineSummary> {
+    const pipeline = DatabaseManager.user_dashboard_pipeline(owner_uuid);
+    const [summary] = await DatabaseManager.abortable(this.machines.aggregate<IMachineSummary>(pipeline), signal);
+    // Users without machines don't have anything to group
+    return summary ?? DatabaseManager.EMPTY_SUMMARY;
+  }
+
+  // What the summary of no machines at all is, there's nothing for the aggregation to group
+  private static EMPTY_SUMMARY: IMachineSummary = {
+    machines: { total: 0, online: 0, offline: 0 },
+    cores: 0,
+    cpu: null,
+    ram: { used: 0, total: 0 },
+    network: { download: 0, upload: 0 },
+  };
+
+  /**
+   * Sums up the machines of a datacenter, its members can see it the same as its owner
+   * @param uuid The uuid of the datacenter
+   * @param user_uuid The uuid of who's asking, datacenters they aren't a member of are treated as missing
+   * @param signal The signal of the request the summary is for
+   * @tested
+   */
+  public async get_datacenter_summary(uuid: string, user_uuid: string, signal?: AbortSignal): Promise<IMachineSummary> {
+    const datacenter = await this.find_datacenter({ uuid, $or: [{ owner_uuid: user_uuid }, { members: user_uuid }] }, signal);
+    if (!datacenter.machines.length) return DatabaseManager.EMPTY_SUMMARY;
+    const pipeline = DatabaseManager.machine_summary_pipeline({ uuid: { $in: datacenter.machines } });
+    const [summary] = await DatabaseManager.abortable(this.machines.aggregate<IMachineSummary>(pipeline), signal);
+    return summary ?? DatabaseManager.EMPTY_SUMMARY;
+  }
+
+  /**
+   * Appends the dynamic data of a machine to its history
+   * @param stats The computed dynamic data
+   */
+  public async insert_stat_point(stats: IComputedDynamicData) {
+    return this.stats.create({
+      machine_uuid: stats.uuid,
+      timestamp: new Date(stats.timestamp),
+      cpu: stats.cau,
+      cpu_speed: stats.cas,
+      ram_used: stats.ram.used,
+      ram_total: stats.ram.total,
+      swap_used: stats.swap.used,
+      download: stats.td,
+      upload: stats.tu,
+      ping: stats.ping,
+      process_count: stats.process_count,
+    });
+  }
+
+  /**
+   * Replaces the latest disks and processes of a machine, there's only ever one document per machine
+   * @param machine_uuid The uuid of the machine
+   * @param data What the reporter sent
+   * @param timestamp When the backend received it
+   */
+  public async update_machine_details(machine_uuid: string, data: IDynamicData, timestamp: number) {
+    await this.machine_details.updateOne(
+      { machine_uuid },
+      { $set: { ...machine_details(data), updated_at: timestamp } },
+      { upsert: true }
+    );
+  }
+
+  /**
+   * Finds the latest disks and processes of a machine
+   * @returns Nothing when the machine didn't report since it was added
+   */
+  public find_machine_details = (machine_uuid: string, signal?: AbortSignal) =>
+    DatabaseManager.abortable(this.machine_details.findOne({ machine_uuid }), signal);
+
+  // The bucket a point falls in, buckets are aligned to the epoch so the same resolution always gives the same buckets
+  private static stats_bucket = (resolution: number) => {
+    const time = { $toLong: "$timestamp" };
+    return { $subtract: [time, { $mod: [time, resolution] }] };
+  };
+
+  private static stats_match = (machine_uuid: string, { from, to }: StatsRange) => ({
+    $match: { machine_uuid, timestamp: { $gte: new Date(from), $lt: new Date(to) } },
+  });
+
+  /**
+   * Picks where a range is read from, the raw points only go back as far as their retention
+   * so anything older comes from the hourly rollups at a resolution of at least an hour
+   * @param range The range and resolution that was asked for
+   * @param raw_retention How long the raw points are kept
+   * @returns the range with the resolution that will be used and whether it's read from the rollups
+   * @tested
+   */
+  public static stats_source = (range: StatsRange, raw_retention: number, now = Date.now()) => {
+    if (range.from >= now - raw_retention) return { range, rollups: false };
+    const resolution = Math.ceil(range.resolution / STATS_ROLLUP_RESOLUTION) * STATS_ROLLUP_RESOLUTION;
+    return { range: { ...range, resolution }, rollups: true };
+  };
+
+  /**
+   * The aggregation that groups the history of a machine into buckets of the resolution and averages them
+   * @param machine_uuid The uuid of the machine
+   * @param range The range and resolution of the history
+   * @param rollups Whether it runs on the rollups instead of the raw points
+   * @tested
+   */
+  public static stats_history_pipeline = (
+    machine_uuid: string,
+    range: StatsRange,
+    rollups = false
+  ): mongoose.PipelineStage[] => {
+    const accumulators: { [field: string]: object } = rollups ? { count: { $sum: "$count" } } : {};
+    const fields: { [field: string]: object | 1 } = {};
+    for (const field of STAT_FIELDS) {
+      accumulators[field] = rollups ? { $sum: `$values.${field}.sum` } : { $avg: `$${field}` };
+      fields[field] = rollups ? { $divide: [`$${field}`, "$count"] } : 1;
+    }
+    return [
+      DatabaseManager.stats_match(machine_uuid, range),
+      { $group: { _id: DatabaseManager.stats_bucket(range.resolution), ...accumulators } },
+      { $sort: { _id: 1 } },
+      { $limit: MAX_STATS_POINTS },
+      { $project: { _id: 0, timestamp: "$_id", ...fields } },
+    ];
+  };
+
+  /**
+   * The aggregation that groups a single metric of a machine into buckets of the resolution
+   * and gets the average, minimum and maximum of each one
+   * @param machine_uuid The uuid of the machine
+   * @param metric The metric to get
+   * @param range The range and resolution of the history
+   * @param rollups Whether it runs on the rollups instead of the raw points
+   * @tested
+   */
+  public static stats_metric_pipeline = (
+    machine_uuid: string,
+    metric: keyof IStatValues,
+    range: StatsRange,
+    rollups = false
+  ): mongoose.PipelineStage[] => {
+    const value = rollups ? `$values.${metric}` : `$${metric}`;
+    const accumulators = rollups
+      ? {
+          sum: { $sum: `${value}.sum` },
+          count: { $sum: "$count" },
+          min: { $min: `${value}.min` },
+          max: { $max: `${value}.max` },
+        }
+      : { avg: { $avg: value }, min: { $min: value }, max: { $max: value } };
+    return [
+      DatabaseManager.stats_match(machine_uuid, range),
+      { $group: { _id: DatabaseManager.stats_bucket(range.resolution), ...accumulators } },
+      { $sort: { _id: 1 } },
+      { $limit: MAX_STATS_POINTS },
+      { $project: { _id: 0, timestamp: "$_id", avg: rollups ? { $divide: ["$sum", "$count"] } : 1, min: 1, max: 1 } },
+    ];
+  };
+
+  /**
+   * The aggregation that rolls the raw points of a range up into hourly rollups, rolling up
+   * the same hour again replaces its rollup so it's safe to run over hours that were already done
+   * @param from The start of the first hour
+   * @param to The end of the last hour
+   * @param into The name of the rollups collection
+   * @tested
+   */
+  public static stats_rollup_pipeline = (from: number, to: number, into: string): mongoose.PipelineStage[] => {
+    const accumulators: { [field: string]: object } = { count: { $sum: 1 } };
+    const values: { [field: string]: object } = {};
+    for (const field of STAT_FIELDS) {
+      accumulators[`${field}_sum`] = { $sum: `$${field}` };
+      accumulators[`${field}_min`] = { $min: `$${field}` };
+      accumulators[`${field}_max`] = { $max: `$${field}` };
+      values[field] = { sum: `$${field}_sum`, min: `$${field}_min`, max: `$${field}_max` };
+    }
+    return [
+      { $match: { timestamp: { $gte: new Date(from), $lt: new Date(to) } } },
+      {
+        $group: {
+          _id: { machine_uuid: "$machine_uuid", timestamp: DatabaseManager.stats_bucket(STATS_ROLLUP_RESOLUTION) },
+          ...accumulators,
+        },
+      },
+      {
+        $project: {
+          _id: 0,
+          machine_uuid: "$_id.machine_uuid",
+          timestamp: { $toDate: "$_id.timestamp" },
+          count: 1,
+          values,
+        },
+      },
+      { $merge: { into, on: ["machine_uuid", "timestamp"], whenMatched: "replace", whenNotMatched: "insert" } },
+    ];
+  };
+
+  /**
+   * Rolls up every hour that ended since the last rollup, or since the oldest raw point that's still kept
+   * @param now The time to roll up to, the hour it's in isn't over yet so it's left for the next run
+   */
+  public async rollup_stats(now = Date.now()) {
+    const to = now - (now % STATS_ROLLUP_RESOLUTION);
+    const latest = await this.stat_rollups.findOne({}).sort({ timestamp: -1 });
+    // The latest hour is rolled up again in case points of it came in after it was rolled up
+    const from = Math.max(latest ? latest.timestamp.getTime() : 0, to - this.config.stats_retention.raw);
+    if (from >= to) return;
+    const pipeline = DatabaseManager.stats_rollup_pipeline(from, to, this.stat_rollups.collection.name);
+    await this.stats.aggregate(pipeline).exec();
+  }
+
+  /**
+   * Deletes the stats from before a time, what the TTL indexes do by themselves where they can be used
+   * @param before Only the points older than this are deleted
+   * @param rollups Whether to delete the hourly rollups instead of the raw points
+   * @returns How many were deleted
+   * @tested
+   */
+  public async purge_stats_before(before: Date, rollups = false) {
+    const model: Model<any> = rollups ? this.stat_rollups : this.stats;
+    const { deletedCount } = await model.deleteMany({ timestamp: { $lt: before } });
+    return deletedCount;
+  }
+
+  // The fallback for the TTL indexes, only one shard purges the same as the cleanup
+  private async purge_expired_stats(now = Date.now()) {
+    if (!this.leads_shards) return;
+    try {
+      const { stats_retention } = this.config;
+      const raw = await this.purge_stats_before(new Date(now - stats_retention.raw));
+      const rollups = await this.purge_stats_before(new Date(now - stats_retention.rollups), true);
+      raw + rollups && Logger.info(`Purged ${chalk.blue(raw)} expired stat points and ${chalk.blue(rollups)} rollups`);
+    } catch (error) {
+      Logger.error("Failed to purge the expired stats", error);
+    }
+  }
+
+  private async run_stats_rollup() {
+    // Only one shard rolls up, the same as the cleanup
+    if (!this.leads_shards) return;
+    await this.rollup_stats().catch((error) => Logger.error("Failed to roll up stats", error));
+  }
+
+  /**
+   * Gets the downsampled history of a machine
+   * @param machine_uuid The uuid of the machine
+   * @param range The range and resolution of the history
+   * @param signal The signal of the request the history is for
+   * @returns the points and the range they're for since the resolution can change
+   */
+  public async find_stats_history(machine_uuid: string, range: StatsRange, signal?: AbortSignal) {
+    const source = DatabaseManager.stats_source(range, this.config.stats_retention.raw);
+    const pipeline = DatabaseManager.stats_history_pipeline(machine_uuid, source.range, source.rollups);
+    const model: Model<any> = source.rollups ? this.stat_rollups : this.stats;
+    const points = await DatabaseManager.abortable(model.aggregate<IStatHistoryPoint>(pipeline), signal);
+    return { range: source.range, points };
+  }
+
+  /**
+   * Lines up the histories of some machines by their buckets so they can be drawn on the same chart,
+   * every bucket has every machine and the ones that didn't report in it are null
+   * @param histories The points of each machine, all of the same range and resolution so their buckets line up
+   * @tested
+   */
+  public static align_stats_histories = (histories: { [uuid: string]: IStatHistoryPoint[] }) => {
+    const uuids = Object.keys(histories);
+    const buckets = new Map<number, { [uuid: string]: IStatValues | null }>();
+    for (const uuid of uuids) {
+      for (const { timestamp, ...values } of histories[uuid]) {
+        let machines = buckets.get(timestamp);
+        if (!machines) buckets.set(timestamp, (machines = {}));
+        machines[uuid] = values;
+      }
+    }
+    return [...buckets.keys()]
+      .sort((a, b) => a - b)
+      .map((timestamp) => {
+        const machines = buckets.get(timestamp)!;
+        uuids.forEach((uuid) => (machines[uuid] ??= null));
+        return { timestamp, machines };
+      });
+  };
+
+  /**
+   * Gets the histories of some machines lined up by their buckets, they're read the same as find_stats_history
+   * @param machine_uuids The uuids of the machines, the caller has to have checked they can see them
+   * @param range The range and resolution of the histories
+   * @param signal The signal of the request the histories are for
+   * @returns the points and the range they're for since the resolution can change
+   */
+  public async find_stats_comparison(machine_uuids: string[], range: StatsRange, signal?: AbortSignal) {
+    // Picked once so every machine is read from the same collection with the same buckets
+    const source = DatabaseManager.stats_source(range, this.config.stats_retention.raw);
+    const model: Model<any> = source.rollups ? this.stat_rollups : this.stats;
+    const histories: { [uuid: string]: IStatHistoryPoint[] } = {};
+    await Promise.all(
+      machine_uuids.map(async (uuid) => {
+        const pipeline = DatabaseManager.stats_history_pipeline(uuid, source.range, source.rollups);
+        histories[uuid] = await DatabaseManager.abortable(model.aggregate<IStatHistoryPoint>(pipeline), signal);
+      })
+    );
+    return { range: source.range, points: DatabaseManager.align_stats_histories(histories) };
+  }
+
+  /**
+   * Gets the downsampled average, minimum and maximum of a single metric of a machine
+   * @param machine_uuid The uuid of the machine
+   * @param metric The metric to get
+   * @param range The range and resolution of the history
+   * @param signal The signal of the request the history is for
+   * @returns the points and the range they're for since the resolution can change
+   */
+  public async find_stats_metric(machine_uuid: string, metric: keyof IStatValues, range: StatsRange, signal?: AbortSignal) {
+    const source = DatabaseManager.stats_source(range, this.config.stats_retention.raw);
+    const pipeline = DatabaseManager.stats_metric_pipeline(machine_uuid, metric, source.range, source.rollups);
+    const model: Model<any> = source.rollups ? this.stat_rollups : this.stats;
+    const points = await DatabaseManager.abortable(model.aggregate<IStatMetricPoint>(pipeline), signal);
+    return { range: source.range, points };
+  }
+
+  /**
+   * Reads the points of a machine oldest first through a cursor so an export never holds more than a batch
+   * of them in memory, it has to be closed when it isn't read to the end
+   * @param machine_uuid The uuid of the machine
+   * @param range Where the points are from
+   * @param rollups Whether the hourly rollups are read instead of the raw points
+   * @param limit How many points are read at most
+   */
+  public export_stats(
+    machine_uuid: string,
+    { from, to }: Pick<StatsRange, "from" | "to">,
+    rollups = false,
+    limit = MAX_EXPORT_POINTS
+  ) {
+    const model: Model<any> = rollups ? this.stat_rollups : this.stats;
+    return model
+      .find({ machine_uuid, timestamp: { $gte: new Date(from), $lt: new Date(to) } }, { _id: 0, __v: 0, machine_uuid: 0 })
+      .sort({ timestamp: 1 })
+      .limit(limit)
+      .lean()
+      .cursor();
+  }
+
+  /**
+   * Gathers everything stored about a user for an export except the stats of their machines,
+   * those are read through export_stats since there can be too many to read at once
+   * @param user Who the export is for
+   * @param signal The signal of the request the export is for
+   */
+  public async find_user_export(user: IUser, signal?: AbortSignal) {
+    const { abortable, active_share_links } = DatabaseManager;
+    const [machines, labels, datacenters, alerts, share_links, signup_keys, api_tokens, sessions, friends, audit_log] =
+      await Promise.all([
+        this.find_machines_by_owner(user.uuid, signal),
+        this.find_labels({ owner_uuid: user.uuid }, signal),
+        this.find_datacenters({ $or: [{ owner_uuid: user.uuid }, { members: user.uuid }] }, signal),
+        abortable(this.alerts.find({ owner_uuid: user.uuid }).sort({ created_at: 1 }), signal),
+        abortable(this.share_links.find(active_share_links({ owner_uuid: user.uuid })).sort({ created_at: 1 }), signal),
+        this.find_signup_keys(user.uuid, signal),
+        this.find_api_tokens(user.uuid, signal),
+        this.find_sessions(user.uuid, signal),
+        this.find_friends(user, signal),
+        this.find_audit_logs(user.uuid, { limit: MAX_EXPORT_AUDIT_ENTRIES, skip: 0, page: 1 }, {}, signal),
+      ]);
+    return {
+      profile: { ...user.to_private(), login_history: user.login_history, friends, sessions },
+      machines,
+      labels,
+      datacenters,
+      alerts,
+      share_links,
+      signup_keys,
+      api_tokens,
+      audit_log: audit_log.entries,
+    };
+  }
+
+  /**
+   * Replaces the access token of a machine, the old token stops working immediately
+   * @param uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner of the machine
+   * @param device Where the request came from, it goes on the audit entry
+   * @returns The new access token
+   */
+  public async rotate_machine_token(uuid: string, owner_uuid: string, device?: ISessionDevice) {
+    const access_token = this.generate_access_token();
+    const machine = await this.machines.findOneAndUpdate({ uuid, owner_uuid }, { $set: { access_token } });
+    if (!machine) return this.not_owned(uuid, owner_uuid);
+    this.log_audit(owner_uuid, "machine.token", uuid, {}, device);
+    return access_token;
+  }
+
+  /**
+   * Rejects with why a user can't change a machine that isn't theirs, the users it's shared with
+   * already know it exists so they're forbidden, everyone else is told it doesn't exist
+   * @param uuid The uuid of the machine
+   * @param user_uuid The uuid of the user that tried to change it
+   * @tested
+   */
+  private async not_owned(uuid: string, user_uuid: string): Promise<never> {
+    const shared = await this.machines.exists({ uuid, access: user_uuid });
+    return Promise.reject(shared ? ErrorCode.Forbidden : ErrorCode.MachineNotFound);
+  }
+
+  /**
+   * Lets another user see a machine and its live stats without handing it over, they can't change anything on it
+   * @param uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, only they can share it
+   * @param user_uuid The uuid of the user to share it with
+   * @returns The updated machine
+   */
+  public async share_machine(uuid: string, owner_uuid: string, user_uuid: string) {
+    const user = await this.find_user({ uuid: user_uuid });
+    const update = { $addToSet: { access: user.uuid } };
+    const machine = await this.machines.findOneAndUpdate({ uuid, owner_uuid }, update, { new: true });
+    return machine ?? this.not_owned(uuid, owner_uuid);
+  }
+
+  /**
+   * Stops sharing a machine with a user
+   * @param uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, only they can unshare it
+   * @param user_uuid The uuid of the user it was shared with
+   * @returns The updated machine
+   */
+  public async unshare_machine(uuid: string, owner_uuid: string, user_uuid: string) {
+    const machine = await this.machines.findOneAndUpdate({ uuid, owner_uuid }, { $pull: { access: user_uuid } }, { new: true });
+    return machine ?? this.not_owned(uuid, owner_uuid);
+  }
+
+  /**
+   * Creates a link anyone can see the live stats of a machine through without logging in
+   * @param machine_uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, only they can share it publicly
+   * @param input How long the link works for and whether it shows the host of the machine
+   * @returns The new link
+   */
+  public async new_share_link(machine_uuid: string, owner_uuid: string, input: IShareLinkInput) {
+    const expires_in = input.expires_in === undefined ? undefined : parseDuration(input.expires_in);
+    if (expires_in !== undefined && (expires_in < Time.Minute || expires_in > Time.Year))
+      return Promise.reject("invalid.expires_in");
+    if (!(await this.machines.exists({ uuid: machine_uuid, owner_uuid }))) return this.not_owned(machine_uuid, owner_uuid);
+    const active = await this.share_links.countDocuments(DatabaseManager.active_share_links({ machine_uuid }));
+    if (active >= MAX_SHARE_LINKS) return Promise.reject(ErrorCode.TooManyShareLinks);
+    return this.share_links.create({
+      token: generate_share_token(),
+      machine_uuid,
+      owner_uuid,
+      expose_host: input.expose_host ?? false,
+      ...(expires_in !== undefined && { expires_at: new Date(Date.now() + expires_in) }),
+    });
+  }
+
+  /**
+   * The filter of the links that didn't expire yet, mongo only deletes the expired ones once a minute
+   * @tested
+   */
+  public static active_share_links = (filter: mongoose.FilterQuery<IShareLink> = {}, now = Date.now()) =>
+    ({
+      ...filter,
+      $or: [{ expires_at: { $exists: false } }, { expires_at: { $gt: new Date(now) } }],
+    } as mongoose.FilterQuery<IShareLink>);
+
+  /**
+   * Finds the links of a machine that still work, the newest first
+   * @param machine_uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, the links of other users' machines are treated as missing
+   * @param signal The signal of the request the links are for
+   */
+  public async find_share_links(machine_uuid: string, owner_uuid: string, signal?: AbortSignal) {
+    const filter = DatabaseManager.active_share_links({ machine_uuid, owner_uuid });
+    return DatabaseManager.abortable(this.share_links.find(filter).sort({ created_at: -1 }), signal);
+  }
+
+  /**
+   * Finds the link a public url is for
+   * @param token The token in the url
+   * @param signal The signal of the request the link is for
+   */
+  public async find_share_link(token: string, signal?: AbortSignal) {
+    const filter = DatabaseManager.active_share_links({ token });
+    const link = await DatabaseManager.abortable(this.share_links.findOne(filter), signal);
+    return link ?? Promise.reject(ErrorCode.ShareLinkNotFound);
+  }
+
+  /**
+   * Finds what a share link shows of its machine, it's cached for the link alone since links show different fields
+   * @param link The link, it has to be found again on every request so revoking it works right away
+   * @param signal The signal of the request the machine is for
+   * @returns The machine with the stats it had stored, the ones this shard got since are fresher
+   */
+  public find_shared_machine = (link: Pick<IShareLink, "uuid" | "machine_uuid" | "expose_host">, signal?: AbortSignal) =>
+    cache.wrap<IPublicMachine>("machine", link.machine_uuid, `share:${link.uuid}`, async () => {
+      const machine = await this.find_machine({ uuid: link.machine_uuid }, signal);
+      return public_machine(machine, link, machine.dynamic_data);
+    });
+
+  /**
+   * Revokes a link, it stops working right away
+   * @param uuid The uuid of the link
+   * @param machine_uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, the links of other users' machines are treated as missing
+   * @returns The revoked link
+   */
+  public async delete_share_link(uuid: string, machine_uuid: string, owner_uuid: string) {
+    const link = await this.share_links.findOneAndDelete({ uuid, machine_uuid, owner_uuid });
+    return link ?? Promise.reject(ErrorCode.ShareLinkNotFound);
+  }
+
+  /**
+   * Creates an API token for a user
+   * @param user_uuid The uuid of the user it acts as
+   * @param input Its name and what it's allowed to do
+   * @param device Where the request came from, it goes on the audit entry
+   * @returns The token and its secret, the secret can't be read back later since only its hash is stored
+   */
+  public async new_api_token(user_uuid: string, { name, scopes }: IApiTokenInput, device?: ISessionDevice) {
+    if ((await this.api_tokens.countDocuments({ user_uuid })) >= MAX_API_TOKENS)
+      return Promise.reject(ErrorCode.TooManyApiTokens);
+    const secret = generate_api_token();
+    const token = await this.api_tokens.create({
+      user_uuid,
+      name,
+      scopes,
+      prefix: secret.slice(0, API_TOKEN_VISIBLE_LENGTH),
+      hash: hash_api_token(secret),
+    });
+    this.log_audit(user_uuid, "api_token.create", user_uuid, { token_uuid: token.uuid, name, scopes }, device);
+    return { token, secret };
+  }
+
+  /**
+   * Finds the API tokens of a user, the newest first
+   */
+  public find_api_tokens = (user_uuid: string, signal?: AbortSignal) =>
+    DatabaseManager.abortable(this.api_tokens.find({ user_uuid }).sort({ created_at: -1 }), signal);
+
+  /**
+   * Finds the token a request was made with
+   * @param secret The token in the Authorization header
+   */
+  public async find_api_token(secret: string) {
+    const token = await this.api_tokens.findOne({ hash: hash_api_token(secret) });
+    return token ?? Promise.reject(ErrorCode.ApiTokenNotFound);
+  }
+
+  /**
+   * Remembers that a token was used without waiting for the write,
+   * it's only written once every API_TOKEN_TOUCH_INTERVAL so using a token doesn't cost a write every time
+   * @tested
+   */
+  public touch_api_token(token: Pick<IApiToken, "uuid" | "last_used_at">, now = Date.now()) {
+    if (token.last_used_at && now - token.last_used_at < API_TOKEN_TOUCH_INTERVAL) return;
+    this.api_tokens
+      .updateOne({ uuid: token.uuid }, { $set: { last_used_at: now } })
+      .catch((error) => Logger.error(`Failed to update when the API token ${chalk.blue(token.uuid)} was used`, error));
+  }
+
+  /**
+   * Revokes an API token, it stops working right away
+   * @param uuid The uuid of the token
+   * @param user_uuid The uuid of the user, the tokens of other users are treated as missing
+   * @param device Where the request came from, it goes on the audit entry
+   */
+  public async delete_api_token(uuid: string, user_uuid: string, device?: ISessionDevice) {
+    const token = await this.api_tokens.findOneAndDelete({ uuid, user_uuid });
+    if (!token) return Promise.reject(ErrorCode.ApiTokenNotFound);
+    this.log_audit(user_uuid, "api_token.revoke", user_uuid, { token_uuid: uuid, name: token.name }, device);
+    return token;
+  }
+
+  /**
+   * Registers a webhook for the events of the machines of a user
+   * @param user_uuid The uuid of the user
+   * @param input The validated url and events
+   * @param device Where the request came from, it goes on the audit entry
+   * @returns The webhook and its secret, the secret isn't sent back again after this
+   */
+  public async new_webhook(user_uuid: string, { url, events }: IWebhookInput, device?: ISessionDevice) {
+    if ((await this.webhooks.countDocuments({ user_uuid })) >= MAX_WEBHOOKS) return Promise.reject(ErrorCode.TooManyWebhooks);
+    const secret = generate_webhook_secret();
+    const webhook = await this.webhooks.create({ user_uuid, url, events, secret });
+    this.log_audit(user_uuid, "webhook.create", user_uuid, { webhook_uuid: webhook.uuid, url, events }, device);
+    return { webhook, secret };
+  }
+
+  /**
+   * Finds the webhooks of a user, the newest first
+   */
+  public find_webhooks = (user_uuid: string, signal?: AbortSignal) =>
+    DatabaseManager.abortable(this.webhooks.find({ user_uuid }).sort({ created_at: -1 }), signal);
+
+  /**
+   * Deletes a webhook, what was still to be sent to it is dropped
+   * @param uuid The uuid of the webhook
+   * @param user_uuid The uuid of the user, the webhooks of other users are treated as missing
+   * @param device Where the request came from, it goes on the audit entry
+   */
+  public async delete_webhook(uuid: string, user_uuid: string, device?: ISessionDevice) {
+    const webhook = await this.webhooks.findOneAndDelete({ uuid, user_uuid });
+    if (!webhook) return Promise.reject(ErrorCode.WebhookNotFound);
+    await this.webhook_deliveries.deleteMany({ webhook_uuid: uuid });
+    this.log_audit(user_uuid, "webhook.delete", user_uuid, { webhook_uuid: uuid, url: webhook.url }, device);
+    return webhook;
+  }
+
+  // Deletes the webhooks of a user that's being deleted along with what was still to be sent to them
+  private async delete_webhooks(filter: mongoose.FilterQuery<IWebhook>) {
+    const uuids = await this.webhooks.distinct("uuid", filter);
+    await this.webhook_deliveries.deleteMany({ webhook_uuid: { $in: uuids } });
+    await this.webhooks.deleteMany(filter);
+  }
+
+  /**
+   * Makes the deliveries of an event for the webhooks subscribed to it
+   * @param event What happened
+   * @param webhooks The webhooks to send it to
+   * @param data What happened to, the machine whose event it is
+   * @param now When it happened
+   */
+  private async queue_deliveries(event: WebhookEvent, webhooks: IWebhook[], data: WebhookData, now: number) {
+    const deliveries = webhooks.map((webhook) => {
+      const uuid = uuidv4();
+      const payload: WebhookPayload = { id: uuid, event, created_at: now, data };
+      const created_at = new Date(now);
+      const body = JSON.stringify(payload);
+      return { uuid, webhook_uuid: webhook.uuid, event, body, created_at, next_attempt_at: created_at };
+    });
+    return deliveries.length ? this.webhook_deliveries.insertMany(deliveries) : [];
+  }
+
+  /**
+   * Queues an event of some machines for the webhooks of their owners that are subscribed to it
+   * @param event What happened to the machines
+   * @param machine_uuids The uuids of the machines, the deleted ones too since their deletion is an event
+   * @param now When it happened
+   * @param data What else the event is about, the machine is added to it
+   * @returns how many deliveries were queued
+   * @tested
+   */
+  public async queue_webhook_deliveries(
+    event: WebhookEvent,
+    machine_uuids: string[],
+    now = Date.now(),
+    data: WebhookData = {}
+  ) {
+    const machines = await this.machines
+      .find({ uuid: { $in: machine_uuids } }, { uuid: 1, name: 1, owner_uuid: 1 })
+      .setOptions(WITH_DELETED);
+    const owners = [...new Set(machines.map((machine) => machine.owner_uuid))];
+    if (!owners.length) return 0;
+    const subscribed = await this.webhooks.find({ user_uuid: { $in: owners }, events: event, disabled_at: null });
+    const queued = await Promise.all(
+      machines.map((machine) => {
+        const targets = subscribed.filter((webhook) => webhook.user_uuid === machine.owner_uuid);
+        return this.queue_deliveries(event, targets, { ...data, machine: { uuid: machine.uuid, name: machine.name } }, now);
+      })
+    );
+    return queued.reduce((total, deliveries) => total + deliveries.length, 0);
+  }
+
+  /**
+   * Queues the test event for a webhook, it's sent even if the webhook is disabled so a test that succeeds
+   * can enable it again
+   * @param uuid The uuid of the webhook
+   * @param user_uuid The uuid of the user, the webhooks of other users are treated as missing
+   * @returns the delivery
+   */
+  public async queue_webhook_test(uuid: string, user_uuid: string) {
+    const webhook = await this.webhooks.findOne({ uuid, user_uuid });
+    if (!webhook) return Promise.reject(ErrorCode.WebhookNotFound);
+    const [delivery] = await this.queue_deliveries("webhook.test", [webhook], {}, Date.now());
+    return delivery;
+  }
+
+  /**
+   * Takes the delivery that's been due the longest for a worker, it's leased to it so no other one takes it
+   * until WEBHOOK_LEASE passes and the attempt counts even if the worker dies before it's sent
+   * @param now When the worker is looking
+   */
+  public claim_webhook_delivery = (now: number) =>
+    this.webhook_deliveries.findOneAndUpdate(
+      { next_attempt_at: { $lte: new Date(now) } },
+      { $set: { next_attempt_at: new Date(now + WEBHOOK_LEASE) }, $inc: { attempts: 1 } },
+      { sort: { next_attempt_at: 1 }, new: true }
+    );
+
+  /**
+   * Finds the webhook a delivery goes to, null when it was deleted since
+   */
+  public find_delivery_webhook = (delivery: Pick<IWebhookDelivery, "webhook_uuid">) =>
+    this.webhooks.findOne({ uuid: delivery.webhook_uuid });
+
+  public async drop_webhook_delivery(delivery: Pick<IWebhookDelivery, "uuid">) {
+    await this.webhook_deliveries.deleteOne({ uuid: delivery.uuid });
+  }
+
+  /**
+   * Records that a delivery was received, its webhook is working so it's enabled again if it was disabled
+   * @param delivery The delivery that was sent
+   */
+  public async complete_webhook_delivery(delivery: Pick<IWebhookDelivery, "uuid" | "webhook_uuid">) {
+    await this.drop_webhook_delivery(delivery);
+    await this.webhooks.updateOne({ uuid: delivery.webhook_uuid }, { $set: { failures: 0 }, $unset: { disabled_at: 1 } });
+  }
+
+  /**
+   * Records that a delivery failed, it's retried with an exponential backoff until WEBHOOK_RETRY_WINDOW after
+   * the event, after that it's given up on and its webhook is disabled once too many in a row were given up on
+   * @param delivery The delivery that failed
+   * @param error Why it failed, the status it was answered with if it was answered
+   * @param now When it failed
+   * @returns whether it's retried
+   * @tested
+   */
+  public async fail_webhook_delivery(delivery: IWebhookDelivery, error: string, now = Date.now()) {
+    const retry_at = now + webhook_retry_delay(delivery.attempts);
+    if (retry_at <= delivery.created_at.getTime() + WEBHOOK_RETRY_WINDOW) {
+      await this.webhook_deliveries.updateOne(
+        { uuid: delivery.uuid },
+        { $set: { next_attempt_at: new Date(retry_at), last_error: error } }
+      );
+      return true;
+    }
+    await this.drop_webhook_delivery(delivery);
+    const filter = { uuid: delivery.webhook_uuid };
+    const webhook = await this.webhooks.findOneAndUpdate(filter, { $inc: { failures: 1 } }, { new: true });
+    if (webhook && webhook.failures >= MAX_WEBHOOK_FAILURES && !webhook.disabled_at) {
+      await this.webhooks.updateOne({ uuid: webhook.uuid }, { $set: { disabled_at: now } });
+      Logger.warn(`Disabled webhook ${chalk.blue(webhook.uuid)} since its last ${webhook.failures} deliveries failed`);
+    }
+    return false;
+  }
+
+  /**
+   * Reserves an idempotency key for a request so a retry of it can't run at the same time as it
+   * @param key The hash of the key
+   * @param fingerprint The hash of the request
+   * @returns undefined when it was reserved, what it was already reserved with otherwise
+   * @tested
+   */
+  public async reserve_idempotency_key(key: string, fingerprint: string): Promise<IIdempotencyKey | undefined> {
+    try {
+      await this.idempotency_keys.create({ key, fingerprint, created_at: new Date() });
+      return undefined;
+    } catch (error: any) {
+      if (error?.code !== 11000) throw error;
+    }
+    const abandoned = await this.idempotency_keys.findOneAndUpdate(
+      { key, status: { $exists: false }, created_at: { $lt: new Date(Date.now() - IDEMPOTENCY_PENDING_TIMEOUT) } },
+      { $set: { fingerprint, created_at: new Date() } }
+    );
+    if (abandoned) return undefined;
+    // It can expire between the two
+    return (await this.idempotency_keys.findOne({ key })) ?? this.reserve_idempotency_key(key, fingerprint);
+  }
+
+  /**
+   * Keeps what the request of an idempotency key was answered with so its retries get the same
+   * @param key The hash of the key
+   * @param status The status it was answered with
+   * @param body The JSON it was answered with
+   */
+  public async complete_idempotency_key(key: string, status: number, body: string) {
+    await this.idempotency_keys.updateOne({ key }, { $set: { status, body } });
+  }
+
+  /**
+   * Lets an idempotency key be used again, for requests that failed without it being the client's fault
+   * @param key The hash of the key
+   */
+  public async release_idempotency_key(key: string) {
+    await this.idempotency_keys.deleteOne({ key, status: { $exists: false } });
+  }
+
+  /**
+   * Adds an alert rule to a machine
+   * @param machine_uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, machines of other users are treated as missing
+   * @param input The validated rule
+   * @returns The new rule
+   */
+  public async new_alert(machine_uuid: string, owner_uuid: string, input: CreateAlertInput) {
+    const duration = parseDuration(input.duration);
+    if (duration > Time.Day) return Promise.reject("invalid.duration");
+    const cooldown = input.cooldown === undefined ? this.config.alert_cooldown : parseDuration(input.cooldown);
+    if (input.cooldown !== undefined && cooldown < Time.Minute) return Promise.reject("invalid.cooldown");
+
+    await this.find_machine({ uuid: machine_uuid, owner_uuid });
+    if ((await this.alerts.countDocuments({ machine_uuid })) >= MAX_ALERTS) return Promise.reject(ErrorCode.TooManyAlerts);
+    const { metric, operator, threshold, target } = input;
+    return this.alerts.create({ machine_uuid, owner_uuid, metric, operator, threshold, duration, cooldown, target });
+  }
+
+  /**
+   * Finds the alert rules of a machine, the oldest first
+   * @param machine_uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, the rules of other users' machines are treated as missing
+   * @param signal The signal of the request the rules are for
+   */
+  public async find_alerts(machine_uuid: string, owner_uuid?: string, signal?: AbortSignal) {
+    const filter = owner_uuid === undefined ? { machine_uuid } : { machine_uuid, owner_uuid };
+    return DatabaseManager.abortable(this.alerts.find(filter).sort({ created_at: 1 }), signal);
+  }
+
+  /**
+   * Deletes an alert rule of a machine
+   * @param uuid The uuid of the rule
+   * @param machine_uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, the rules of other users' machines are treated as missing
+   */
+  public async delete_alert(uuid: string, machine_uuid: string, owner_uuid: string) {
+    const alert = await this.alerts.findOneAndDelete({ uuid, machine_uuid, owner_uuid });
+    return alert ?? Promise.reject(ErrorCode.AlertNotFound);
+  }
+
+  /**
+   * Marks an alert rule as fired unless it already fired since a point in time, atomic so
+   * two shards evaluating the same rule can't both notify
+   * @param uuid The uuid of the rule
+   * @param fired_at When it fires
+   * @param fired_before It's only claimed if it last fired before this
+   * @returns whether this call gets to notify
+   * @tested
+   */
+  public async claim_alert(uuid: string, fired_at: number, fired_before: number) {
+    const filter = { uuid, $or: [{ last_fired_at: { $exists: false } }, { last_fired_at: { $lt: fired_before } }] };
+    const { modifiedCount } = await this.alerts.updateOne(filter, { $set: { last_fired_at: fired_at } });
+    return modifiedCount > 0;
+  }
+
+  /**
+   * Finds the offline rules whose machine has been gone for longer than their duration
+   * @param now The time to check against
+   * @param threshold How long a machine can go without reporting before it's offline
+   * @returns every due rule along with the machine it's for
+   * @tested
+   */
+  public async find_due_offline_alerts(now = Date.now(), threshold = this.config.machines.offline_threshold) {
+    const rules = await this.alerts.find({ metric: "offline" });
+    if (!rules.length) return [];
+    const machines = await this.machines.find(
+      { uuid: { $in: rules.map((rule) => rule.machine_uuid) }, last_seen: { $lt: now - threshold } },
+      { uuid: 1, name: 1, last_seen: 1 }
+    );
+    const offline = new Map(machines.map((machine) => [machine.uuid, machine]));
+    return rules
+      .map((rule) => ({ rule, machine: offline.get(rule.machine_uuid)! }))
+      .filter(({ rule, machine }) => machine && now - machine.last_seen! >= rule.duration);
+  }
+
+  /**
+   * Renames a machine or changes its icon, only those are touched so the reporter's fields stay what it reported
+   * @param uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, machines of other users are treated as missing
+   * @param update The fields to change
+   * @returns The updated machine
+   * @tested
+   */
+  public async update_machine(uuid: string, owner_uuid: string, { name, icon }: MachineUpdate) {
+    const $set = { ...(name !== undefined && { name }), ...(icon !== undefined && { icon }) };
+    const machine = await this.machines.findOneAndUpdate({ uuid, owner_uuid }, { $set }, { new: true });
+    return machine ?? this.not_owned(uuid, owner_uuid);
+  }
+
+  /**
+   * Tags a machine, adding a tag it already has does nothing
+   * @param uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, machines of other users are treated as missing
+   * @param tag The tag to add
+   * @returns The updated machine
+   */
+  public async add_machine_tag(uuid: string, owner_uuid: string, tag: string) {
+    const machine = await this.machines.findOneAndUpdate({ uuid, owner_uuid }, { $addToSet: { tags: tag } }, { new: true });
+    return machine ?? this.not_owned(uuid, owner_uuid);
+  }
+
+  /**
+   * Takes a tag off a machine
+   * @param uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, machines of other users are treated as missing
+   * @param tag The tag to remove
+   * @returns The updated machine
+   */
+  public async remove_machine_tag(uuid: string, owner_uuid: string, tag: string) {
+    const machine = await this.machines.findOneAndUpdate({ uuid, owner_uuid }, { $pull: { tags: tag } }, { new: true });
+    return machine ?? this.not_owned(uuid, owner_uuid);
+  }
+
+  /**
+   * Hands a machine to another user, its token is rotated so the reporter of the previous owner stops working
+   * and everything of the previous owner on it goes, its labels, datacenters, alert rules and share links
+   * @param uuid The uuid of the machine
+   * @param owner_uuid The uuid of the current owner, anyone else is rejected with forbidden
+   * @param to_uuid The uuid of the user it goes to
+   * @param device Where the request came from, it goes on the audit entry
+   * @returns the machine after the transfer
+   * @tested
+   */
+  public async transfer_machine(uuid: string, owner_uuid: string, to_uuid: string, device?: ISessionDevice) {
+    const recipient = await this.find_user({ uuid: to_uuid });
+    // Only matches while it's still the caller's so two transfers at once can't both go through
+    const machine = await this.machines.findOneAndUpdate(
+      { uuid, owner_uuid },
+      { $set: { owner_uuid: recipient.uuid, access_token: this.generate_access_token(), labels: [] } },
+      { new: true }
+    );
+    if (!machine)
+      return Promise.reject((await this.machines.exists({ uuid })) ? ErrorCode.Forbidden : ErrorCode.MachineNotFound);
+
+    await Promise.all([
+      this.datacenters.updateMany({ machines: uuid }, { $pull: { machines: uuid } }).exec(),
+      this.alerts.deleteMany({ machine_uuid: uuid }).exec(),
+      this.share_links.deleteMany({ machine_uuid: uuid }).exec(),
+    ]);
+    this.log_audit(owner_uuid, "machine.transfer", uuid, { from: owner_uuid, to: recipient.uuid }, device);
+    return machine;
+  }
+
+  /**
+   * Soft deletes a machine, it's hidden from every query right away so its token stops working but it keeps
+   * its datacenters and history until it's purged in case the owner restores it
+   * @param uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, the users it's shared with are forbidden from deleting it
+   * @param device Where the request came from, it goes on the audit entry
+   * @returns When the machine is purged for good
+   */
+  public async delete_machine(uuid: string, owner_uuid: string, device?: ISessionDevice) {
+    const deleted_at = Date.now();
+    const machine = await this.machines.findOneAndUpdate({ uuid, owner_uuid }, { $set: { deleted_at } });
+    if (!machine) return this.not_owned(uuid, owner_uuid);
+    this.log_audit(owner_uuid, "machine.delete", uuid, { name: machine.name }, device);
+    return deleted_at + MACHINE_DELETION_GRACE;
+  }
+
+  /**
+   * Undoes the deletion of a machine as long as it hasn't been purged yet
+   * @param uuid The uuid of the machine
+   * @param owner_uuid The uuid of the owner, machines of other users are treated as missing
+   * @returns The restored machine
+   */
+  public async restore_machine(uuid: string, owner_uuid: string) {
+    const machine = await this.machines.findOneAndUpdate(
+      { uuid, owner_uuid, deleted_at: { $gt: Date.now() - MACHINE_DELETION_GRACE } },
+      { $unset: { deleted_at: 1 } },
+      { new: true }
+    );
+    return machine ?? Promise.reject(ErrorCode.MachineNotFound);
+  }
+
+  /**
+   * The filter of the soft deleted machines whose grace period is over
+   * @tested
+   */
+  public static purgeable_machines_filter = (now = Date.now()) =>
+    ({ deleted_at: { $lte: now - MACHINE_DELETION_GRACE } } as mongoose.FilterQuery<IMachine>);
+
+  /**
+   * Deletes a soft deleted machine for good along with its history, the machine goes last so a purge
+   * that gets interrupted halfway is picked up again by the next cleanup
+   * @param uuid The uuid of the machine
+   */
+  public async purge_machine(uuid: string) {
+    await this.datacenters.updateMany({ machines: uuid }, { $pull: { machines: uuid } });
+    await this.stats.deleteMany({ machine_uuid: uuid });
+    await this.stat_rollups.deleteMany({ machine_uuid: uuid });
+    await this.machine_events.deleteMany({ machine_uuid: uuid });
+    await this.machine_details.deleteMany({ machine_uuid: uuid });
+    await this.alerts.deleteMany({ machine_uuid: uuid });
+    await this.share_links.deleteMany({ machine_uuid: uuid });
+    await this.machines.deleteOne({ uuid });
+  }
+
+  /**
+   * Purges the machines whose grace period is over, one at a time so a failure only holds up that machine
+   */
+  private async purge_deleted_machines() {
+    const purgeable: string[] = await this.machines.distinct("uuid", DatabaseManager.purgeable_machines_filter());
+    for (const uuid of purgeable) {
+      await this.purge_machine(uuid)
+        .then(() => Logger.info(`Purged machine ${chalk.blue(uuid)} because its grace period is over`))
+        .catch((error) => Logger.error(`Failed to purge machine ${uuid}, it's retried on the next cleanup`, error));
+    }
+  }
+
+  /**
+   * Records that the reporter of a machine connected to this shard
+   * @param machine_uuid The uuid of the machine
+   * @returns the event to close when it disconnects
+   */
+  public async open_machine_event(machine_uuid: string) {
+    return this.machine_events.create({ machine_uuid, shard: this.shard, connected_at: new Date() });
+  }
+
+  /**
+   * Records that the reporter of a machine disconnected
+   * @param event The event that was opened when it connected
+   */
+  public async close_machine_event(event: IMachineEvent & mongoose.Document) {
+    await this.machine_events.updateOne(
+      { _id: event._id, disconnected_at: { $exists: false } },
+      { $set: { disconnected_at: new Date() } }
+    );
+  }
+
+  /**
+   * Closes the events of the reporters that were connected to this shard when it went down, they're closed when
+   * the machine last reported since that's the last time it's known to have been up
+   * @param shard The shard that started
+   * @returns how many events were closed
+   * @tested
+   */
+  public async close_dangling_machine_events(shard = this.shard) {
+    const open = await this.machine_events.find({ shard, disconnected_at: { $exists: false } });
+    if (!open.length) return 0;
+    const uuids = open.map((event) => event.machine_uuid);
+    const machines = await this.machines.find({ uuid: { $in: uuids } }, { uuid: 1, last_seen: 1 });
+    const last_seen = new Map(machines.map((machine) => [machine.uuid, machine.last_seen ?? 0]));
+    await Promise.all(
+      open.map((event) => {
+        const disconnected_at = new Date(Math.max(event.connected_at.getTime(), last_seen.get(event.machine_uuid) ?? 0));
+        const filter = { _id: event._id, disconnected_at: { $exists: false } };
+        return this.machine_events.updateOne(filter, { $set: { disconnected_at } });
+      })
+    );
+    return open.length;
+  }
+
+  /**
+   * Computes the uptime of a machine over the last days, counted from when it first connected if that's later
+   * so the time before it was set up isn't downtime
+   * @param machine_uuid The uuid of the machine
+   * @param days How many days back to go
+   * @param signal The signal of the request the uptime is for
+   * @returns the range, the uptime percentage or null if it never connected and the windows it was down
+   * @tested
+   */
+  public async find_machine_uptime(machine_uuid: string, days: number, signal?: AbortSignal, now = Date.now()) {
+    const first = await DatabaseManager.abortable(
+      this.machine_events.findOne({ machine_uuid }).sort({ connected_at: 1 }).lean(),
+      signal
+    );
+    const from = Math.max(now - days * Time.Day, first?.connected_at.getTime() ?? now);
+    const events = await DatabaseManager.abortable(
+      this.machine_events
+        .find({
+          machine_uuid,
+          connected_at: { $lt: new Date(now) },
+          $or: [{ disconnected_at: { $exists: false } }, { disconnected_at: { $gt: new Date(from) } }],
+        })
+        .lean(),
+      signal
+    );
+    const connections = events.map((event) => ({
+      connected_at: event.connected_at.getTime(),
+      disconnected_at: event.disconnected_at?.getTime(),
+    }));
+    return { from, to: now, ...computeUptime(connections, from, now, this.config.machines.uptime_merge_gap) };
+  }
+
+  /**
+   * Finds the machine a reporter token belongs to, the tokens of machines whose owner is disabled don't work
+   * @param access_token The token the reporter sent
+   */
+  public async find_machine_by_token(access_token: string) {
+    const machine = await this.find_one<IMachine>("machine", { access_token });
+    if (await this.users.exists({ uuid: machine.owner_uuid, disabled_at: { $ne: null } }))
+      return Promise.reject(ErrorCode.MachineNotFound);
+    return machine;
+  }
+
+  public async login_machine(access_token: string) {
+    const machine = await this.find_machine_by_token(access_token).catch(() => null);
+    if (!machine) return Promise.reject("Invalid access token");
+    machine.status = MachineStatus.Online;
+    return machine.save();
+  }
+
+  /**
+   * Deletes a user by the specified username and password
+   * @param username The username to search by
+   * @param password The password for validation
+   * @returns The deleted user
+   */
+  public async delete_user({ username, password }: { username: string; password: string }) {
+    if (typeof password !== "string") return Promise.reject("invalid.password");
+    if (typeof username !== "string") return Promise.reject("invalid.username");
+
+    const user = await this.find_user({ username_lower: normalizeUsername(username) });
+    if (user && (await user.compare_password(password))) this.users.deleteOne({ uuid: user.uuid });
+  }
+
+  /**
+   * Excludes the documents that were soft deleted from a filter
+   */
+  public static not_deleted = <T>(filter: mongoose.FilterQuery<T> = {}) =>
+    ({ deleted_at: null, ...filter } as mongoose.FilterQuery<T>);
+
+  // What responses need from a document whichever fields the client asked for, the ETags and whether a machine is online
+  private static ALWAYS_PROJECTED: { [collection: string]: string[] } = {
+    user: ["uuid", "updated_at"],
+    machine: ["uuid", "updated_at", "status", "last_seen"],
+  };
+
+  /**
+   * The projection that only reads the fields a client asked for from the database, undefined reads everything
+   * @param collection What's being read
+   * @param fields The fields the client asked for
+   * @tested
+   */
+  public static projection = (collection: "machine" | "user" | "label" | "datacenter", fields?: string[]) => {
+    if (!fields) return undefined;
+    const projection: { [field: string]: 1 } = {};
+    for (const field of [...(DatabaseManager.ALWAYS_PROJECTED[collection] ?? []), ...fields]) projection[field] = 1;
+    return projection;
+  };
+
+  private find_one = async <T>(
+    collection: "machine" | "user" | "label" | "datacenter",
+    filter?: mongoose.FilterQuery<T>,
+    signal?: AbortSignal,
+    fields?: string[]
+  ): Promise<T> => {
+    const { abortable, not_deleted } = DatabaseManager;
+    const projection = DatabaseManager.projection(collection, fields);
+    switch (collection) {
+      case "user":
+        return (
+          (await abortable(this.users.findOne(not_deleted(filter), projection), signal)) ??
+          Promise.reject(`${collection}.notFound`)
+        );
+      case "label":
+        return (await abortable(this.labels.findOne(filter), signal)) ?? Promise.reject(`${collection}.notFound`);
+      case "datacenter":
+        return (await abortable(this.datacenters.findOne(filter), signal)) ?? Promise.reject(`${collection}.notFound`);
+      case "machine":
+        return (
+          (await abortable(this.machines.findOne(filter, projection), signal)) ?? Promise.reject(`${collection}.notFound`)
+        );
+    }
+  };
+
+  private find = async <T>(
+    collection: "machine" | "user" | "label" | "datacenter",
+    filter: mongoose.FilterQuery<T>,
+    signal?: AbortSignal,
+    fields?: string[]
+  ): Promise<T[]> => {
+    const { abortable, not_deleted } = DatabaseManager;
+    const projection = DatabaseManager.projection(collection, fields);
+    switch (collection) {
+      case "user":
+        return (
+          (await abortable(this.users.find(not_deleted(filter), projection), signal)) ??
+          Promise.reject(`${collection}s.notFound`)
+        );
+      case "label":
+        return (await abortable(this.labels.find(filter), signal)) ?? Promise.reject(`${collection}s.notFound`);
+      case "datacenter":
+        return (await abortable(this.datacenters.find(filter), signal)) ?? Promise.reject(`${collection}s.notFound`);
+      case "machine":
+        return (
+          (await abortable(this.machines.find(filter, projection), signal)) ?? Promise.reject(`${collection}s.notFound`)
+        );
+    }
+  };
+
+  // Reads take the signal of the request they're for so they stop when the client goes away
+  // and the fields the client asked for so only those are read
+  public find_machine = (filter?: mongoose.FilterQuery<IMachine>, signal?: AbortSignal, fields?: string[]) =>
+    this.find_one<IMachine>("machine", filter, signal, fields);
+  public find_user = (filter?: mongoose.FilterQuery<IUser>, signal?: AbortSignal, fields?: string[]) =>
+    this.find_one<IUser>("user", filter, signal, fields);
+  /**
+   * Finds a user that another one is allowed to see, the ones who hid their profile from them look like they
+   * don't exist so a hidden profile can't be told apart from a missing one
+   * @param uuid The uuid of the user to find
+   * @param viewer_uuid The uuid of the user looking
+   * @tested
+   */
+  public async find_visible_user(uuid: string, viewer_uuid: string, signal?: AbortSignal, fields?: string[]) {
+    const user = await this.find_user({ uuid }, signal, fields);
+    return user.is_visible_to(viewer_uuid) ? user : Promise.reject(ErrorCode.UserNotFound);
+  }
+  // Profiles are looked at far more than they change so what anyone can see of them is cached, who can see them
+  // isn't since it depends on who's looking
+  public async find_public_user(uuid: string, viewer_uuid: string, signal?: AbortSignal) {
+    if (uuid !== viewer_uuid) await this.find_visible_user(uuid, viewer_uuid, signal, PROFILE_VISIBILITY_FIELDS);
+    return cache.wrap<ISafeUser>("user", uuid, "public", async () => (await this.find_user({ uuid }, signal)).to_public());
+  }
+  public find_label = (filter?: mongoose.FilterQuery<ILabel>, signal?: AbortSignal) =>
+    this.find_one<ILabel>("label", filter, signal);
+  public find_machines = (filter: mongoose.FilterQuery<IMachine>, signal?: AbortSignal, fields?: string[]) =>
+    this.find<IMachine>("machine", filter, signal, fields);
+  public find_users = (filter: mongoose.FilterQuery<IUser>, signal?: AbortSignal) =>
+    this.find<IUser>("user", filter, signal);
+  public find_labels = (filter: mongoose.FilterQuery<ILabel>, signal?: AbortSignal) =>
+    this.find<ILabel>("label", filter, signal);
+  public find_machines_by_owner = (owner_uuid: string, signal?: AbortSignal) =>
+    this.find<IMachine>("machine", { owner_uuid }, signal);
+  public find_datacenter = (filter?: mongoose.FilterQuery<IDatacenter>, signal?: AbortSignal) =>
+    this.find_one<IDatacenter>("datacenter", filter, signal);
+  public find_datacenters = (filter: mongoose.FilterQuery<IDatacenter>, signal?: AbortSignal) =>
+    this.find<IDatacenter>("datacenter", filter, signal);
+
+  /**
+   * The filter of the machines a user can see, the ones they own, the ones they were given access to
+   * and the ones in the datacenters they're a member of
+   * @param user_uuid The uuid of the user
+   * @param shared The uuids of the machines in the datacenters the user is a member of
+   * @param uuids Only look for these machines
+   * @tested
+   */
+  public static accessible_machines_filter = (user_uuid: string, shared: string[], uuids?: string[]) =>
+    ({
+      $or: [{ owner_uuid: user_uuid }, { access: user_uuid }, ...(shared.length ? [{ uuid: { $in: shared } }] : [])],
+      ...(uuids && { uuid: { $in: uuids } }),
+    } as mongoose.FilterQuery<IMachine>);
+
+  /**
+   * Finds the uuids of the machines in every datacenter a user is a member of
+   */
+  public async find_shared_machine_uuids(user_uuid: string, signal?: AbortSignal) {
+    const memberships = await this.find_datacenters({ members: user_uuid }, signal);
+    return [...new Set(memberships.reduce<string[]>((uuids, datacenter) => uuids.concat(datacenter.machines), []))];
+  }
+
+  public async find_accessible_machines(
+    user_uuid: string,
+    uuids?: string[],
+    signal?: AbortSignal,
+    filter: mongoose.FilterQuery<IMachine> = {},
+    fields?: string[]
+  ) {
+    const shared = await this.find_shared_machine_uuids(user_uuid, signal);
+    const accessible = DatabaseManager.accessible_machines_filter(user_uuid, shared, uuids);
+    return this.find_machines({ ...filter, ...accessible }, signal, fields);
+  }
+
+  /**
+   * Finds a page of users along with the total amount of users matching the filter
+   * @param filter The filter to search by
+   * @param pagination The page to find
+   * @param include_deleted Whether to include the users that were soft deleted
+   * @param signal The signal of the request the page is for
+   * @param fields The fields the client asked for, every field when undefined
+   */
+  public async find_users_paginated(
+    filter: mongoose.FilterQuery<IUser>,
+    { limit, skip, sort }: Pagination,
+    include_deleted: boolean = false,
+    signal?: AbortSignal,
+    fields?: string[]
+  ) {
+    if (!include_deleted) filter = DatabaseManager.not_deleted(filter);
+    const [users, total] = await Promise.all([
+      DatabaseManager.abortable(
+        this.users
+          .find(filter, DatabaseManager.projection("user", fields))
+          .sort(sort ?? {})
+          .skip(skip)
+          .limit(limit),
+        signal
+      ),
+      DatabaseManager.abortable(this.users.countDocuments(filter), signal),
+    ]);
+    return { users, total };
+  }
+
+  /**
+   * Finds the users created after a cursor, unlike skipping this stays fast on large collections
+   * and doesn't repeat or skip users when new ones sign up while paging
+   * @param after The uuid of the last user of the previous page, undefined for the first page
+   * @param limit How many users to find
+   * @param include_deleted Whether to include the users that were soft deleted
+   * @param signal The signal of the request the page is for
+   * @param fields The fields the client asked for, every field when undefined
+   * @returns the users and the cursor of the next page, null when this is the last page
+   * @tested
+   */
+  public async find_users_after(
+    after: string | undefined,
+    limit: number,
+    include_deleted = false,
+    signal?: AbortSignal,
+    fields?: string[]
+  ) {
+    let filter: mongoose.FilterQuery<IUser> = include_deleted ? {} : DatabaseManager.not_deleted<IUser>();
+    if (after) {
+      const cursor = await DatabaseManager.abortable(this.users.findOne({ uuid: after }, { _id: 1 }), signal);
+      if (!cursor) return Promise.reject(ErrorCode.InvalidCursor);
+      filter = { ...filter, _id: { $gt: cursor._id } };
+    }
+    // One more than asked for tells whether there's another page without counting
+    const found = await DatabaseManager.abortable(
+      this.users
+        .find(filter, DatabaseManager.projection("user", fields))
+        .sort({ _id: 1 })
+        .limit(limit + 1),
+      signal
+    );
+    const users = found.slice(0, limit);
+    return { users, next_cursor: found.length > limit ? users[users.length - 1].uuid : null };
+  }
 }
@@ -0,0 +1,46 @@
+import mongoose from "mongoose";
+import { cache, CacheKind } from "../../classes/cache.class";
+
+// The writes that don't go through save, the deletes too since a deleted document must stop being served
+const OPERATIONS = ["updateOne", "updateMany", "findOneAndUpdate", "deleteOne", "deleteMany", "findOneAndDelete"];
+
+// The other plugins stamp these on every write so they never change what's cached on their own
+const STAMPS = ["updated_at", "version"];
+
+// The top level fields an update writes, undefined when it's a pipeline that could write anything
+const updatedFields = (update: mongoose.UpdateQuery<unknown> | mongoose.UpdateWithAggregationPipeline | null) => {
+  if (!update || Array.isArray(update)) return undefined;
+  const paths = Object.entries(update).map(([key, value]) => (key.startsWith("$") ? Object.keys(value ?? {}) : [key]));
+  return ([] as string[]).concat(...paths).map((path) => path.split(".")[0]);
+};
+
+// The uuids a query filters by, undefined when it filters by something else and could match any document
+const filteredUuids = (filter: mongoose.FilterQuery<unknown>) => {
+  const uuid = filter.uuid;
+  if (typeof uuid === "string") return [uuid];
+  if (Array.isArray(uuid?.$in) && uuid.$in.every((value: unknown) => typeof value === "string")) return uuid.$in as string[];
+  return undefined;
+};
+
+/**
+ * Drops what's cached about the documents of a schema's model as soon as they're written to
+ * @param kind What the cache knows the documents as
+ * @param ignore The fields that change too often to invalidate on, what's cached is only as stale as the TTL on them
+ */
+export const cachePlugin = (kind: CacheKind, ignore: string[] = []) => (schema: mongoose.Schema) => {
+  const ignored = new Set([...STAMPS, ...ignore]);
+  // Whether the save changed anything has to be checked before it's saved since it's forgotten after
+  schema.pre("save", function (this: mongoose.Document & { uuid?: string }) {
+    this.$locals.invalidates = this.modifiedPaths().some((path) => !ignored.has(path.split(".")[0]));
+  });
+  schema.post("save", function (this: mongoose.Document & { uuid?: string }) {
+    this.$locals.invalidates && this.uuid && cache.invalidate(kind, [this.uuid]);
+  });
+  for (const operation of OPERATIONS) {
+    schema.post(operation as any, { document: false, query: true }, function (this: mongoose.Query<unknown, unknown>) {
+      const fields = updatedFields(this.getUpdate());
+      if (!operation.includes("delete") && fields?.every((field) => ignored.has(field))) return;
+      cache.invalidate(kind, filteredUuids(this.getFilter()));
+    });
+  }
+};
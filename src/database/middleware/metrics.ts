@@ -0,0 +1,64 @@
+import mongoose from "mongoose";
+import { Time } from "../../types";
+import { Logger } from "../../utils/logger";
+import { metrics } from "../../utils/metrics";
+
+const operations = metrics.counter("xornet_database_operations_total", "How many database operations ran", [
+  "model",
+  "operation",
+  "result",
+]);
+
+const OPERATIONS = [
+  "find",
+  "findOne",
+  "findOneAndUpdate",
+  "updateOne",
+  "updateMany",
+  "countDocuments",
+  "deleteOne",
+  "deleteMany",
+  "save",
+  "remove",
+];
+
+// How long mongo gets to run a query before it gives up on it and what's slow enough to log,
+// the database manager sets them from the config when it's created
+export const query_limits = { timeout: 5 * Time.Second, slow: 250 };
+
+// When each query or document started its operation, forgotten with it
+const started = new WeakMap<object, number>();
+
+// Queries have a model and documents have a constructor that is the model
+const modelName = (self: any) => self?.model?.modelName ?? self?.constructor?.modelName ?? "unknown";
+const collectionName = (self: any) => self?.mongooseCollection?.name ?? self?.collection?.name ?? modelName(self);
+
+const logSlow = (self: object, operation: string) => {
+  const start = started.get(self);
+  const duration = start === undefined ? 0 : Date.now() - start;
+  if (duration >= query_limits.slow)
+    Logger.warn(`Slow ${operation} on ${collectionName(self)} took ${duration}ms, the limit is ${query_limits.slow}ms`);
+};
+
+/**
+ * Counts every successful and failed operation of a schema's model and logs the slow ones,
+ * the queries that don't set a maxTimeMS of their own get the default one so none can hang forever
+ * @tested
+ */
+export const metricsPlugin = (schema: mongoose.Schema) => {
+  for (const operation of OPERATIONS) {
+    schema.pre(operation as any, function (this: any) {
+      started.set(this, Date.now());
+      if (this instanceof mongoose.Query && this.getOptions().maxTimeMS === undefined) this.maxTimeMS(query_limits.timeout);
+    });
+    schema.post(operation as any, function (this: any) {
+      operations.inc({ model: modelName(this), operation, result: "success" });
+      logSlow(this, operation);
+    });
+    schema.post(operation as any, function (this: any, error: any, _: any, next: (error?: any) => void) {
+      operations.inc({ model: modelName(this), operation, result: "failure" });
+      logSlow(this, operation);
+      next(error);
+    });
+  }
+};
@@ -1,6 +1,6 @@
 import bcrypt from "bcryptjs";
 import { v4 as uuidv4 } from "uuid";
-import { randomHexColor } from "../../logic";
+import { normalizeEmail, normalizeUsername, randomHexColor } from "../../logic";
 import { Validators } from "../../validators";
 import { IBaseDocument } from "../DatabaseManager";
 import { ILabel } from "../schemas/label";
@@ -20,15 +20,21 @@ export const preSaveMiddleware = async function <T extends IBaseDocument & PreSa
   return next();
 };
 
+// How many rounds passwords are hashed with, the database manager sets it from the config when it's created
+export const password_hashing = { rounds: 10 };
+
 export const userPreSaveMiddleware = async function <T extends IUser & PreSaveProps>(this: T, next: Function) {
+  if (this.isModified("email") && typeof this.email === "string") this.email = normalizeEmail(this.email);
   if (this.isNew) {
     if (!Validators.validate_email(this.email)) return next(new Error("invalid.email"));
     if (!Validators.validate_password(this.password)) return next(new Error("invalid.password"));
     if (!Validators.validate_username(this.username)) return next(new Error("invalid.username"));
   }
 
+  if (this.isModified("username")) this.username_lower = normalizeUsername(this.username);
+
   if (this.isModified("password")) {
-    const salt = await bcrypt.genSalt(process.env.MODE === "development" ? 1 : 10);
+    const salt = await bcrypt.genSalt(password_hashing.rounds);
     const hash = await bcrypt.hash(this.password, salt);
     this.password = hash;
   }
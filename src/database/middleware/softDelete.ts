@@ -0,0 +1,28 @@
+import mongoose from "mongoose";
+
+// Every query that reads or updates documents, deletes go through as they are since they're always on purpose
+const OPERATIONS = ["find", "findOne", "findOneAndUpdate", "updateOne", "updateMany", "countDocuments", "distinct"];
+
+/**
+ * The query options that make a query see the soft deleted documents too, like the cleanup looking for orphans
+ */
+export const WITH_DELETED = { with_deleted: true };
+
+/**
+ * Hides the documents of a schema's model that are soft deleted from every query, so a new query can't leak them
+ * by forgetting to filter them out, queries that filter by deleted_at themselves or run with WITH_DELETED are left alone
+ * @tested
+ */
+export const softDeletePlugin = (schema: mongoose.Schema) => {
+  for (const operation of OPERATIONS) {
+    schema.pre(operation as any, { document: false, query: true }, function (this: mongoose.Query<unknown, unknown>) {
+      if ((this.getOptions() as typeof WITH_DELETED).with_deleted || "deleted_at" in this.getFilter()) return;
+      this.where({ deleted_at: null });
+    });
+  }
+  schema.pre("aggregate", function (this: mongoose.Aggregate<unknown>) {
+    const [first] = this.pipeline() as any[];
+    if (first?.$match && "deleted_at" in first.$match) return;
+    this.pipeline().unshift({ $match: { deleted_at: null } });
+  });
+};
@@ -0,0 +1,17 @@
+import mongoose from "mongoose";
+
+// The writes that don't go through save so preSaveMiddleware never sees them
+const OPERATIONS = ["updateOne", "updateMany", "findOneAndUpdate"];
+
+/**
+ * Stamps updated_at on every update of a schema's model like save does, the ETags of the API depend on it
+ * changing on every write
+ */
+export const updatedAtPlugin = (schema: mongoose.Schema) => {
+  for (const operation of OPERATIONS) {
+    schema.pre(operation as any, { document: false, query: true }, function (this: mongoose.Query<unknown, unknown>) {
+      // Aggregation pipeline updates can't take a $set alongside them, only the migrations use them
+      if (!Array.isArray(this.getUpdate())) this.set("updated_at", Date.now());
+    });
+  }
+};
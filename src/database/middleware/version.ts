@@ -0,0 +1,22 @@
+import mongoose from "mongoose";
+
+// The writes that don't go through save
+const OPERATIONS = ["updateOne", "updateMany", "findOneAndUpdate"];
+
+/**
+ * Bumps the version of a schema's documents on every write so updates can be made conditional on the version
+ * the client last saw, the schema has to have a version field
+ */
+export const versionPlugin = (schema: mongoose.Schema) => {
+  schema.pre("save", function (this: mongoose.Document & { version?: number }) {
+    if (!this.isNew) this.version = (this.version ?? 0) + 1;
+  });
+  for (const operation of OPERATIONS) {
+    schema.pre(operation as any, { document: false, query: true }, function (this: mongoose.Query<unknown, unknown>) {
+      const update = this.getUpdate() as mongoose.UpdateQuery<unknown> | null;
+      // Aggregation pipeline updates can't take an $inc alongside them, only the migrations use them
+      if (!update || Array.isArray(update)) return;
+      this.setUpdate({ ...update, $inc: { ...update.$inc, version: 1 } });
+    });
+  }
+};
@@ -0,0 +1,225 @@
+import chalk from "chalk";
+import mongoose from "mongoose";
+import os from "os";
+import { Time } from "../types";
+import { Logger } from "../utils/logger";
+import type { DatabaseManager, RequiredIndex } from "./DatabaseManager";
+import { IDEMPOTENCY_KEY_TTL } from "./schemas/idempotencyKey";
+import { SIGNUP_KEY_GRACE } from "./schemas/signupKey";
+import { WEBHOOK_RETRY_WINDOW } from "./schemas/webhookDelivery";
+
+/**
+ * A change to the database that runs once, the first startup after it's added runs it and records it
+ */
+export interface Migration {
+  id: string; // How the runner knows it already ran so it must never change once released
+  description: string;
+  up: (db: DatabaseManager) => Promise<unknown>;
+}
+
+/**
+ * The documents of the migrations collection, every migration that ran and the lock of whoever is running them
+ */
+interface MigrationRecord {
+  _id: string;
+  description?: string;
+  applied_at?: Date;
+  owner?: string; // Which replica holds the lock
+  expires_at?: Date; // When a replica that died while holding the lock stops holding it
+}
+
+const LOCK_ID = "lock";
+// How long a replica holds the lock without showing signs of life, it's extended after every migration
+export const MIGRATION_LOCK_TTL = 5 * Time.Minute;
+// How long a replica waits for another one to finish migrating before it gives up starting
+export const MIGRATION_LOCK_TIMEOUT = 10 * Time.Minute;
+
+// Fails the migration when an index couldn't be created so it's retried on the next startup
+const create_indexes = (required?: RequiredIndex[]) => async (db: DatabaseManager) => {
+  const { failed } = await db.ensure_indexes(required);
+  if (failed.length) throw new Error(`Couldn't create the indexes ${failed.join(", ")}`);
+};
+
+// The same as normalizeEmail and normalizeUsername but in an aggregation so it runs in mongo
+const normalized = (field: string) => ({ $toLower: { $trim: { input: `$${field}` } } });
+
+/**
+ * Lowercases the emails of the users from before they were normalized and makes usernames unique regardless of case,
+ * the users whose emails or usernames only differ in case are reported instead of merged since only they know
+ * which of the accounts they still use, the migration fails until an admin sorted them out
+ * @tested
+ */
+export const normalize_identities = async (db: DatabaseManager) => {
+  const collisions = (field: string) =>
+    db.users.aggregate<{ _id: string; users: string[] }>([
+      { $group: { _id: normalized(field), users: { $push: "$uuid" }, count: { $sum: 1 } } },
+      { $match: { count: { $gt: 1 } } },
+    ]);
+  const [emails, usernames] = await Promise.all([collisions("email"), collisions("username")]);
+  // Lowercasing the emails of the users that collide would only make the unique index fail on every one of them
+  const colliding = ([] as string[]).concat(...emails.map(({ users }) => users));
+  await db.users.updateMany({ uuid: { $nin: colliding } }, [
+    { $set: { email: normalized("email"), username_lower: normalized("username") } },
+  ]);
+  for (const [field, found] of [["emails", emails], ["usernames", usernames]] as const)
+    for (const { _id, users } of found) Logger.error(`The users ${users.join(", ")} have ${field} that are all ${_id}`);
+  if (emails.length || usernames.length)
+    throw new Error(`${emails.length + usernames.length} emails or usernames are used by more than one user`);
+
+  // The index from before it was unique has the same name so it has to go first
+  await db.users.collection.dropIndex("username_lower_1").catch(() => {});
+  await create_indexes([{ collection: "users", key: { username_lower: 1 }, unique: true }])(db);
+};
+
+/**
+ * Every migration in the order they run, new ones go at the end
+ */
+export const MIGRATIONS: Migration[] = [
+  {
+    id: "0001-required-indexes",
+    description: "unique indexes on the uuids, usernames and emails of users and an index on the owners of machines",
+    up: create_indexes(),
+  },
+  {
+    id: "0002-stats-and-ttl-indexes",
+    description: "the stats of a machine by time and expiring sessions and signup keys",
+    up: create_indexes([
+      { collection: "stats", key: { machine_uuid: 1, timestamp: 1 } },
+      { collection: "sessions", key: { expires_at: 1 }, expire_after: 0 },
+      { collection: "signup_keys", key: { expires_at: 1 }, expire_after: SIGNUP_KEY_GRACE / Time.Second },
+    ]),
+  },
+  {
+    id: "0003-username-lower",
+    description: "lowercased usernames for the users created before searching existed",
+    up: (db) =>
+      db.users.updateMany({ username_lower: { $exists: false } }, [{ $set: { username_lower: { $toLower: "$username" } } }]),
+  },
+  {
+    id: "0004-email-verified",
+    description: "verified emails for the users who signed up before emails were verified so they keep their machines",
+    up: (db) => db.users.updateMany({ email_verified: { $exists: false } }, { $set: { email_verified: true } }),
+  },
+  {
+    id: "0005-share-links",
+    description: "unique share tokens and expiring share links",
+    up: create_indexes([
+      { collection: "share_links", key: { token: 1 }, unique: true },
+      { collection: "share_links", key: { expires_at: 1 }, expire_after: 0 },
+    ]),
+  },
+  {
+    id: "0006-machine-details",
+    description: "a unique index on the machines of the latest disks and processes so reports can't upsert twice",
+    up: create_indexes([{ collection: "machine_details", key: { machine_uuid: 1 }, unique: true }]),
+  },
+  {
+    id: "0007-api-tokens",
+    description: "unique hashes of API tokens so they're found by their hash and the tokens of a user",
+    up: create_indexes([
+      { collection: "api_tokens", key: { hash: 1 }, unique: true },
+      { collection: "api_tokens", key: { user_uuid: 1 } },
+    ]),
+  },
+  {
+    id: "0008-normalized-identities",
+    description: "lowercased emails and usernames that are unique regardless of case",
+    up: normalize_identities,
+  },
+  {
+    id: "0009-idempotency-keys",
+    description: "unique idempotency keys that expire an hour after they're used",
+    up: create_indexes([
+      { collection: "idempotency_keys", key: { key: 1 }, unique: true },
+      { collection: "idempotency_keys", key: { created_at: 1 }, expire_after: IDEMPOTENCY_KEY_TTL / Time.Second },
+    ]),
+  },
+  {
+    id: "0010-webhooks",
+    description: "the webhooks of a user and the deliveries the workers take by when they're due",
+    up: create_indexes([
+      { collection: "webhooks", key: { user_uuid: 1 } },
+      { collection: "webhook_deliveries", key: { uuid: 1 }, unique: true },
+      { collection: "webhook_deliveries", key: { next_attempt_at: 1 } },
+      { collection: "webhook_deliveries", key: { webhook_uuid: 1 } },
+      { collection: "webhook_deliveries", key: { created_at: 1 }, expire_after: (2 * WEBHOOK_RETRY_WINDOW) / Time.Second },
+    ]),
+  },
+];
+
+/**
+ * Runs the migrations that haven't run yet, replicas starting at the same time take turns through a lock
+ * document so every migration runs exactly once
+ */
+export class MigrationRunner {
+  /**
+   * @param db The database the migrations run on
+   * @param collection Where the migrations that ran and the lock are stored
+   * @param migrations What to run
+   * @param owner Who's running them, the lock shows which replica has it
+   * @param poll How long to wait between attempts at taking the lock
+   */
+  constructor(
+    private db: DatabaseManager,
+    private collection: mongoose.mongo.Collection<MigrationRecord> = mongoose.connection.collection("migrations"),
+    private migrations = MIGRATIONS,
+    private owner = `${os.hostname()}:${process.pid}`,
+    private poll = Time.Second
+  ) {}
+
+  /**
+   * Runs every migration that didn't run yet in order, a migration that fails isn't recorded and stops the rest
+   * @returns The ids of the migrations that ran
+   * @tested
+   */
+  public async run() {
+    await this.acquire();
+    try {
+      const records = await this.collection.find({ _id: { $ne: LOCK_ID } }).toArray();
+      const applied = new Set(records.map((record) => record._id));
+      const ran: string[] = [];
+      for (const migration of this.migrations) {
+        if (applied.has(migration.id)) continue;
+        const started = Date.now();
+        await migration.up(this.db);
+        await this.collection.insertOne({ _id: migration.id, description: migration.description, applied_at: new Date() });
+        Logger.info(`Ran the migration ${chalk.blue(migration.id)} in ${Date.now() - started}ms, ${migration.description}`);
+        ran.push(migration.id);
+        await this.extend();
+      }
+      Logger.info(ran.length ? `Ran ${chalk.blue(ran.length)} migrations` : "The database is up to date, no migrations to run");
+      return ran;
+    } finally {
+      await this.collection.deleteOne({ _id: LOCK_ID, owner: this.owner });
+    }
+  }
+
+  /**
+   * Takes the lock, it's taken over once it expired in case the replica that had it died while migrating
+   */
+  private async acquire() {
+    const deadline = Date.now() + MIGRATION_LOCK_TIMEOUT;
+    for (let attempt = 1; ; attempt++) {
+      try {
+        return await this.extend(true);
+      } catch (error: any) {
+        // The upsert collides with the lock of another replica
+        if (error?.code !== 11000) throw error;
+      }
+      if (Date.now() > deadline) throw new Error("Timed out waiting for another replica to finish migrating");
+      attempt === 1 && Logger.info("Waiting for another replica to finish migrating");
+      await new Promise((resolve) => setTimeout(resolve, this.poll));
+    }
+  }
+
+  // Pushes the expiry of the lock back, it's only created when it's free or has expired
+  private async extend(create = false) {
+    const now = new Date();
+    const expires_at = new Date(now.getTime() + MIGRATION_LOCK_TTL);
+    await this.collection.updateOne(
+      { _id: LOCK_ID, $or: [{ owner: this.owner }, { expires_at: { $lt: now } }] },
+      { $set: { owner: this.owner, expires_at } },
+      { upsert: create }
+    );
+  }
+}
@@ -0,0 +1,110 @@
+import mongoose from "mongoose";
+import { Time } from "../../types";
+import { ALERT_METRICS, ALERT_OPERATORS, ALERT_TARGETS, AlertMetric, AlertOperator, AlertTarget } from "../../utils/alerts";
+import { IBaseDocument } from "../DatabaseManager";
+import { preSaveMiddleware } from "../middleware/preSave";
+import { metricsPlugin } from "../middleware/metrics";
+import { updatedAtPlugin } from "../middleware/updatedAt";
+
+// How long a rule waits before it can fire again when it doesn't have its own cooldown, unless ALERT_COOLDOWN is set
+export const ALERT_COOLDOWN = 15 * Time.Minute;
+// How many rules a machine can have so a single machine can't flood the webhooks
+export const MAX_ALERTS = 20;
+
+/**
+ * A threshold on a metric of a machine that notifies a webhook when it's broken for long enough
+ */
+export const alertSchema = new mongoose.Schema<IAlert>({
+  uuid: {
+    type: String,
+    unique: true,
+    index: true,
+  },
+  created_at: {
+    type: Number,
+  },
+  updated_at: {
+    type: Number,
+  },
+  machine_uuid: {
+    type: String,
+    required: true,
+    index: true,
+  },
+  owner_uuid: {
+    type: String,
+    required: true,
+  },
+  metric: {
+    type: String,
+    enum: ALERT_METRICS,
+    required: true,
+  },
+  operator: {
+    type: String,
+    enum: ALERT_OPERATORS,
+    default: ">",
+  },
+  threshold: {
+    type: Number,
+  },
+  // How long in milliseconds the threshold has to stay broken, or the machine offline, before the rule fires
+  duration: {
+    type: Number,
+    default: 0,
+  },
+  // Filled in with the ALERT_COOLDOWN of the config when the rule doesn't have its own
+  cooldown: {
+    type: Number,
+    required: true,
+  },
+  target: {
+    type: { type: String, enum: ALERT_TARGETS, required: true },
+    url: { type: String, required: true },
+  },
+  last_fired_at: {
+    type: Number,
+  },
+});
+
+// The offline rules are looked up on their own by the sweeper
+alertSchema.index({ metric: 1 });
+
+alertSchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+  },
+});
+
+alertSchema.pre("save", preSaveMiddleware);
+alertSchema.plugin(metricsPlugin);
+alertSchema.plugin(updatedAtPlugin);
+
+export const alerts = mongoose.model<IAlert>("Alert", alertSchema);
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IAlert extends IBaseDocument {
+  machine_uuid: string; // The uuid of the machine the rule watches
+  owner_uuid: string; // The uuid of the user that owns the machine
+  metric: AlertMetric;
+  operator: AlertOperator;
+  threshold?: number; // Missing for offline rules
+  duration: number; // How long the threshold has to stay broken in milliseconds
+  cooldown: number; // How long the rule waits before it can fire again in milliseconds
+  target: AlertTarget;
+  last_fired_at?: number;
+}
+
+export interface CreateAlertInput {
+  metric: AlertMetric;
+  operator: AlertOperator;
+  threshold?: number;
+  duration: string; // Like 5m
+  cooldown?: string; // Like 1h
+  target: AlertTarget;
+}
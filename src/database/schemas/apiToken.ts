@@ -0,0 +1,105 @@
+import crypto from "crypto";
+import mongoose from "mongoose";
+import { Time } from "../../types";
+import type { ApiTokenScope } from "../../validators";
+import { IBaseDocument } from "../DatabaseManager";
+import { preSaveMiddleware } from "../middleware/preSave";
+import { metricsPlugin } from "../middleware/metrics";
+import { updatedAtPlugin } from "../middleware/updatedAt";
+
+// What every API token starts with so the auth middleware can tell them apart from JWTs
+export const API_TOKEN_PREFIX = "xor_";
+// How much of a token is kept in the clear so the user can tell their tokens apart
+export const API_TOKEN_VISIBLE_LENGTH = API_TOKEN_PREFIX.length + 8;
+// How many tokens a user can have so revoking them all stays manageable
+export const MAX_API_TOKENS = 20;
+// How often when a token was last used is written, scripts polling every second would write on every request otherwise
+export const API_TOKEN_TOUCH_INTERVAL = Time.Minute;
+
+/**
+ * A long lived token a user scripts against the API with, it can only use the routes of its scopes
+ * and only the hash of it is kept so a leaked database can't be used to call the API
+ */
+export const apiTokenSchema = new mongoose.Schema<IApiToken>({
+  uuid: {
+    type: String,
+    unique: true,
+    index: true,
+  },
+  created_at: {
+    type: Number,
+  },
+  updated_at: {
+    type: Number,
+  },
+  user_uuid: {
+    type: String,
+    required: true,
+    index: true,
+  },
+  name: {
+    type: String,
+    required: true,
+  },
+  prefix: {
+    type: String,
+    required: true,
+  },
+  hash: {
+    type: String,
+    unique: true,
+    required: true,
+  },
+  scopes: {
+    type: [String],
+    default: [],
+  },
+  last_used_at: {
+    type: Number,
+  },
+});
+
+apiTokenSchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+    delete ret.hash;
+  },
+});
+
+apiTokenSchema.pre("save", preSaveMiddleware);
+apiTokenSchema.plugin(metricsPlugin);
+apiTokenSchema.plugin(updatedAtPlugin);
+
+export const apiTokens = mongoose.model<IApiToken>("ApiToken", apiTokenSchema, "api_tokens");
+
+/**
+ * Creates the secret of a token, it's only ever shown to the user once
+ * @tested
+ */
+export const generate_api_token = () => `${API_TOKEN_PREFIX}${crypto.randomBytes(20).toString("hex")}`;
+
+/**
+ * Hashes a token, it's random enough that a fast hash is fine
+ * @tested
+ */
+export const hash_api_token = (token: string) => crypto.createHash("sha256").update(token).digest("hex");
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IApiToken extends IBaseDocument, mongoose.Document {
+  user_uuid: string; // Who the token acts as
+  name: string; // What the user calls it, like the script it's for
+  prefix: string; // The start of the token so the user can tell which one it is
+  hash: string; // The hash of the token
+  scopes: ApiTokenScope[]; // What the token can do
+  last_used_at?: number; // Roughly when the token was last used, it's only written once every API_TOKEN_TOUCH_INTERVAL
+}
+
+export interface IApiTokenInput {
+  name: string;
+  scopes: ApiTokenScope[];
+}
@@ -0,0 +1,112 @@
+import mongoose from "mongoose";
+import { IBaseDocument } from "../DatabaseManager";
+import { preSaveMiddleware } from "../middleware/preSave";
+import { metricsPlugin } from "../middleware/metrics";
+
+export const AUDIT_ACTIONS = [
+  "machine.transfer",
+  "machine.token",
+  "machine.delete",
+  // What users do to their own account
+  "user.login",
+  "user.login_failed",
+  "user.password",
+  "user.password_reset",
+  "api_token.create",
+  "api_token.revoke",
+  "webhook.create",
+  "webhook.delete",
+  // What admins do to other users
+  "user.promote",
+  "user.demote",
+  "user.disable",
+  "user.enable",
+  "user.delete",
+  "user.purge",
+] as const;
+
+export type AuditAction = typeof AUDIT_ACTIONS[number];
+
+// How many of the latest entries of a user go in their export, the older ones are what admins keep for themselves
+export const MAX_EXPORT_AUDIT_ENTRIES = 1000;
+
+/**
+ * Something a user did that has to be traceable later like handing a machine to someone else,
+ * entries are only ever added
+ */
+export const auditLogSchema = new mongoose.Schema<IAuditLog>({
+  uuid: {
+    type: String,
+    unique: true,
+    index: true,
+  },
+  created_at: {
+    type: Number,
+  },
+  updated_at: {
+    type: Number,
+  },
+  action: {
+    type: String,
+    enum: AUDIT_ACTIONS,
+    required: true,
+  },
+  actor_uuid: {
+    type: String,
+    required: true,
+  },
+  subject_uuid: {
+    type: String,
+    required: true,
+  },
+  details: {
+    type: mongoose.Schema.Types.Mixed,
+    default: {},
+  },
+  // Where the request that did it came from, the entries written by the backend itself don't have them
+  ip: {
+    type: String,
+  },
+  user_agent: {
+    type: String,
+  },
+});
+
+// The history of a machine or a user is looked up newest first
+auditLogSchema.index({ subject_uuid: 1, created_at: -1 });
+auditLogSchema.index({ actor_uuid: 1, created_at: -1 });
+
+auditLogSchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+  },
+});
+
+auditLogSchema.pre("save", preSaveMiddleware);
+auditLogSchema.plugin(metricsPlugin);
+
+export const auditLogs = mongoose.model<IAuditLog>("AuditLog", auditLogSchema, "audit_logs");
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IAuditLog extends IBaseDocument {
+  action: AuditAction;
+  actor_uuid: string; // The uuid of the user that did it
+  subject_uuid: string; // The uuid of what it was done to
+  details: { [key: string]: unknown }; // Depends on the action, a transfer has the owner it was from and to
+  ip?: string;
+  user_agent?: string;
+}
+
+/**
+ * What the audit log of a user is narrowed down to, what isn't set matches everything
+ */
+export interface AuditLogQuery {
+  from?: number; // Inclusive
+  to?: number; // Inclusive
+  action?: AuditAction;
+}
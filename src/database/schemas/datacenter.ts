@@ -0,0 +1,76 @@
+import mongoose from "mongoose";
+import { IBaseDocument } from "../DatabaseManager";
+import { preSaveMiddleware } from "../middleware/preSave";
+import { metricsPlugin } from "../middleware/metrics";
+import { updatedAtPlugin } from "../middleware/updatedAt";
+
+export const datacenterSchema = new mongoose.Schema<IDatacenter>({
+  uuid: {
+    type: String,
+    unique: true,
+    index: true,
+  },
+  created_at: {
+    type: Number,
+  },
+  updated_at: {
+    type: Number,
+  },
+  name: {
+    type: String,
+    required: true,
+  },
+  logo: {
+    type: String,
+    required: false,
+  },
+  owner_uuid: {
+    type: String,
+    required: true,
+    index: true,
+  },
+  // The uuids of the machines in the datacenter
+  machines: {
+    type: [String],
+    index: true,
+  },
+  // The uuids of the users that can see every machine in the datacenter
+  members: {
+    type: [String],
+    index: true,
+  },
+});
+
+datacenterSchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+  },
+});
+
+datacenterSchema.pre("save", preSaveMiddleware);
+datacenterSchema.plugin(metricsPlugin);
+datacenterSchema.plugin(updatedAtPlugin);
+
+export const datacenters = mongoose.model<IDatacenter>("Datacenter", datacenterSchema);
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IDatacenter extends IBaseDocument, mongoose.Document {
+  name: string;
+  logo?: string;
+  owner_uuid: string;
+  machines: string[];
+  members: string[];
+}
+
+export interface ICreateDatacenterInput {
+  name: string;
+  logo?: string;
+  owner_uuid: string;
+}
+
+export type DatacenterUpdate = Partial<Pick<IDatacenter, "name" | "logo">>;
@@ -0,0 +1,53 @@
+import mongoose from "mongoose";
+import { Time } from "../../types";
+import { metricsPlugin } from "../middleware/metrics";
+
+// Retries of flaky networks come within minutes, the responses of signups have tokens in them so they aren't kept longer
+export const IDEMPOTENCY_KEY_TTL = Time.Hour;
+// A key that's been waiting on its request for longer than a request can take was left behind by a crash
+export const IDEMPOTENCY_PENDING_TIMEOUT = Time.Minute;
+export const MAX_IDEMPOTENCY_KEY_LENGTH = 255;
+
+/**
+ * A request made with an Idempotency-Key header and what it was answered with, retrying it with the same key
+ * gets the same answer instead of doing it again
+ */
+export const idempotencyKeySchema = new mongoose.Schema<IIdempotencyKey>({
+  key: {
+    type: String,
+    required: true,
+    unique: true,
+  },
+  fingerprint: {
+    type: String,
+    required: true,
+  },
+  status: {
+    type: Number,
+  },
+  body: {
+    type: String,
+  },
+  created_at: {
+    type: Date,
+    required: true,
+  },
+});
+
+idempotencyKeySchema.index({ created_at: 1 }, { expireAfterSeconds: IDEMPOTENCY_KEY_TTL / Time.Second });
+
+idempotencyKeySchema.plugin(metricsPlugin);
+
+export const idempotencyKeys = mongoose.model<IIdempotencyKey>("IdempotencyKey", idempotencyKeySchema, "idempotency_keys");
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IIdempotencyKey extends mongoose.Document {
+  key: string; // The hash of the header and who sent it
+  fingerprint: string; // The hash of the request so the key can't be reused for a different one
+  status?: number; // Missing while the request is still running
+  body?: string; // The JSON it was answered with
+  created_at: Date;
+}
@@ -1,6 +1,8 @@
 import mongoose from "mongoose";
 import { IBaseDocument } from "../DatabaseManager";
 import { labelPreSaveMiddleware, preSaveMiddleware } from "../middleware/preSave";
+import { metricsPlugin } from "../middleware/metrics";
+import { updatedAtPlugin } from "../middleware/updatedAt";
 
 export const labelSchema = new mongoose.Schema<ILabel, mongoose.Model<ILabel>, ILabelMethods>({
   uuid: {
@@ -49,6 +51,8 @@ labelSchema.set("toJSON", {
 
 labelSchema.pre("save", preSaveMiddleware);
 labelSchema.pre("save", labelPreSaveMiddleware);
+labelSchema.plugin(metricsPlugin);
+labelSchema.plugin(updatedAtPlugin);
 
 export const labels = mongoose.model<ILabel>("Label", labelSchema);
 
@@ -1,6 +1,13 @@
 import mongoose from "mongoose";
 import { IBaseDocument } from "../DatabaseManager";
 import { preSaveMiddleware } from "../middleware/preSave";
+import { cachePlugin } from "../middleware/cache";
+import { metricsPlugin } from "../middleware/metrics";
+import { updatedAtPlugin } from "../middleware/updatedAt";
+import { softDeletePlugin } from "../middleware/softDelete";
+import { Time } from "../../types";
+import { IMachineNetwork } from "../../utils/geoip";
+import type { MachineIcon } from "../../validators";
 
 export enum MachineStatus {
   Offline,
@@ -8,6 +15,35 @@ export enum MachineStatus {
   Updating,
 }
 
+// How long a machine can go without reporting before it's shown as offline unless MACHINE_OFFLINE_THRESHOLD is set
+export const MACHINE_OFFLINE_THRESHOLD = Time.Minute;
+// What toJSON() shows the machines as online by, the DatabaseManager sets it from the config
+export const offline_detection = { threshold: MACHINE_OFFLINE_THRESHOLD };
+// How often the machines that stopped reporting are marked as offline unless MACHINE_OFFLINE_INTERVAL is set
+export const MACHINE_OFFLINE_INTERVAL = 30 * Time.Second;
+// How long a deleted machine can be restored for before it's purged along with its history
+export const MACHINE_DELETION_GRACE = 30 * Time.Day;
+// What ?fields= can pick from what toJSON sends, the access token, who has access and the IP never are
+export const MACHINE_FIELDS = [
+  "uuid",
+  "created_at",
+  "updated_at",
+  "owner_uuid",
+  "hardware_uuid",
+  "name",
+  "icon",
+  "labels",
+  "tags",
+  "description",
+  "status",
+  "last_update",
+  "last_seen",
+  "static_data",
+  "dynamic_data",
+  "network",
+  "deleted_at",
+];
+
 export const machineSchema = new mongoose.Schema<IMachine, mongoose.Model<IMachine>, IMachineMethods>({
   uuid: {
     type: String,
@@ -40,6 +76,10 @@ export const machineSchema = new mongoose.Schema<IMachine, mongoose.Model<IMachi
   last_update: {
     type: Number,
   },
+  // When the backend last got stats from the reporter
+  last_seen: {
+    type: Number,
+  },
   name: {
     type: String,
     required: true,
@@ -60,7 +100,16 @@ export const machineSchema = new mongoose.Schema<IMachine, mongoose.Model<IMachi
   labels: {
     type: [String],
   },
+  // Free form slugs the owner groups their machines with
+  tags: {
+    type: [String],
+    index: true,
+  },
   access: [String],
+  dynamic_data: {
+    type: mongoose.Schema.Types.Mixed,
+    required: false,
+  },
   static_data: {
     hostname: String,
     os_version: String,
@@ -76,6 +125,20 @@ export const machineSchema = new mongoose.Schema<IMachine, mongoose.Model<IMachi
     total_mem: Number,
     reporter_version: String,
   },
+  // When the owner deleted it, it's hidden from every query until it's restored or purged
+  deleted_at: {
+    type: Number,
+    index: true,
+  },
+  // Resolved from the IP the reporter connects from
+  network: {
+    ip: String,
+    country: String,
+    country_name: String,
+    region: String,
+    hostname: String,
+    resolved_at: Number,
+  },
 });
 
 machineSchema.set("toJSON", {
@@ -87,10 +150,18 @@ machineSchema.set("toJSON", {
     delete ret.access;
     ret.static_data?.public_ip && delete ret.static_data.public_ip;
     ret.static_data?.city && delete ret.static_data.city;
+    ret.network?.ip && delete ret.network.ip;
+    // Clients only see whether the machine is online, computed so it's right even before the sweeper catches up
+    ret.status = machine_presence(ret);
   },
 });
 
 machineSchema.pre("save", preSaveMiddleware);
+machineSchema.plugin(metricsPlugin);
+machineSchema.plugin(updatedAtPlugin);
+machineSchema.plugin(softDeletePlugin);
+// Every report of the stats writes these, they're live through the websockets anyway
+machineSchema.plugin(cachePlugin("machine", ["dynamic_data", "last_update", "last_seen", "status"]));
 
 /// ------------------------------------------------------------------------------
 /// ------- METHODS --------------------------------------------------------------
@@ -119,6 +190,20 @@ machineSchema.methods = {
 
 export const machines = mongoose.model<IMachine>("Machine", machineSchema);
 
+/**
+ * Whether a machine is online, machines that haven't reported within the threshold are offline
+ * @param machine The machine to check
+ * @param now The time to check against
+ * @param threshold How long a machine can go without reporting
+ * @tested
+ */
+export const machine_presence = (
+  machine: Pick<ISafeMachine, "status" | "last_seen">,
+  now = Date.now(),
+  threshold = offline_detection.threshold
+): MachinePresence =>
+  machine.status !== MachineStatus.Offline && (machine.last_seen ?? 0) > now - threshold ? "online" : "offline";
+
 /// ------------------------------------------------------------------------------
 /// ------- INTERFACES -----------------------------------------------------------
 /// ------------------------------------------------------------------------------
@@ -130,13 +215,43 @@ export interface ISafeMachine extends IBaseDocument {
   [key: string]: any;
   owner_uuid: string; // The uuid of the user that owns this machine
   hardware_uuid: string; // The generated uuid of the machine
-  name: string; // The hostname of the machine
+  name: string; // What the owner calls it, the hostname until they rename it
+  icon?: MachineIcon; // What the frontend shows it as
   labels: mongoose.Types.Array<string>; // The labels of the machine
+  tags: string[]; // The tags the owner grouped the machine with
   description?: string; // A description of the machine
   access: string[]; // The list of users that have access to this machine
   status: MachineStatus;
   last_update: number;
+  last_seen?: number; // When the backend last got stats from the reporter
   static_data: ISafeStaticData; // The static data of the machine
+  dynamic_data?: IComputedDynamicData; // The latest dynamic data the machine reported
+  network?: Omit<IMachineNetwork, "ip">; // Where the reporter connects from
+  deleted_at?: number; // When the owner deleted it
+}
+
+/**
+ * The status clients see in place of the stored one
+ */
+export type MachinePresence = "online" | "offline";
+
+/**
+ * A machine going online or offline
+ */
+export interface MachineStatusChange {
+  uuid: string;
+  status: MachinePresence;
+}
+
+/**
+ * The machines of a user summed up for their dashboard, the usage is only of the online machines
+ */
+export interface IMachineSummary {
+  machines: { total: number; online: number; offline: number };
+  cores: number; // The cores of every machine, online or not
+  cpu: number | null; // The average CPU usage, null when no machine is online
+  ram: { used: number; total: number };
+  network: { download: number; upload: number }; // The total throughput in megabytes
 }
 
 export interface IStaticData extends ISafeStaticData {
@@ -165,6 +280,7 @@ export interface ISafeStaticData {
 export interface IMachine extends ISafeMachine, IMachineMethods, mongoose.Document {
   access_token: string;	// The access token (password) of the machine (used for authentication)
   static_data: IStaticData; // This overrides the static data from the extended interface with the non-safe verison
+  network?: IMachineNetwork; // This overrides the network from the extended interface with the one that has the IP
 }
 
 export interface IDynamicData {
@@ -173,6 +289,7 @@ export interface IDynamicData {
   swap: ISwap;
   gpu?: IGPU;
   disks: IDisk[];
+  processes?: IProcess[]; // The processes of the machine, reporters from before they were reported leave them out
   process_count: number;
   temps?: ITemp[];
   network: INetwork[];
@@ -180,6 +297,21 @@ export interface IDynamicData {
   reporter_uptime: number;
 }
 
+/**
+ * The dynamic data after the backend stamped it and computed the totals
+ */
+export interface IComputedDynamicData extends IDynamicData {
+  uuid: string; // The uuid of the machine
+  ping: number; // The latency between the reporter and the backend
+  timestamp: number; // When the backend received the data
+  cau: number; // CPU average usage
+  cas: number; // CPU average speed
+  td: number; // Total download in megabytes
+  tu: number; // Total upload in megabytes
+  tvd: number; // Total virtual interface download in megabytes
+  tvu: number; // Total virtual interface upload in megabytes
+}
+
 export interface INetwork {
   [x: string]: any;
   n: string; // name
@@ -214,6 +346,13 @@ export interface IDisk {
   used: number;
 }
 
+export interface IProcess {
+  pid: number;
+  name: string;
+  cpu?: number; // How much of the CPU it's using in percent
+  ram?: number; // How much RAM it's using in bytes
+}
+
 export interface ITemp {
   label: string;
   value: number;
@@ -225,6 +364,9 @@ export interface MachineSignupInput {
   hostname: string;
 }
 
+// What the owner can change, everything else comes from the reporter
+export type MachineUpdate = Partial<Pick<ISafeMachine, "name" | "icon">>;
+
 export interface CreateMachineInput {
   hardware_uuid: string;
   owner_uuid: string;
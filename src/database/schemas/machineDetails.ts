@@ -0,0 +1,101 @@
+import mongoose from "mongoose";
+import { metricsPlugin } from "../middleware/metrics";
+import { IDisk, IDynamicData, IProcess } from "./machine";
+
+// How many processes are kept, the ones using the most CPU since those are the ones worth looking at
+export const MAX_PROCESSES = 20;
+export const MAX_PROCESS_NAME_LENGTH = 64;
+// Anything longer isn't a path a disk is mounted on
+export const MAX_DISK_FIELD_LENGTH = 256;
+
+/**
+ * The latest disks and processes a machine reported, there's one per machine that's replaced by every report
+ * since nobody needs the processes of an hour ago and they'd be most of the history
+ */
+export const machineDetailsSchema = new mongoose.Schema<IMachineDetails>({
+  machine_uuid: {
+    type: String,
+    required: true,
+    unique: true,
+  },
+  updated_at: {
+    type: Number,
+  },
+  disks: [
+    {
+      _id: false,
+      fs: String,
+      mount: String,
+      type: { type: String },
+      total: Number,
+      used: Number,
+    },
+  ],
+  processes: [
+    {
+      _id: false,
+      pid: Number,
+      name: String,
+      cpu: Number,
+      ram: Number,
+    },
+  ],
+});
+
+machineDetailsSchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+  },
+});
+
+machineDetailsSchema.plugin(metricsPlugin);
+
+export const machineDetails = mongoose.model<IMachineDetails>("MachineDetails", machineDetailsSchema, "machine_details");
+
+// The names come from whatever the processes called themselves so the control characters are taken out
+const sanitize = (value: unknown, length: number) =>
+  typeof value === "string"
+    ? value
+        .replace(/[\u0000-\u001f\u007f-\u009f]/g, "")
+        .trim()
+        .slice(0, length)
+    : "";
+
+/**
+ * What's kept of the disks and processes of a report, the processes using the most CPU first
+ * @param data What the reporter sent
+ * @returns Only what it sent, reporters from before the processes were reported leave them as they are
+ * @tested
+ */
+export const machine_details = ({ disks, processes }: Pick<IDynamicData, "disks" | "processes">) => ({
+  disks: disks.map(
+    (disk): IDisk => ({
+      fs: sanitize(disk.fs, MAX_DISK_FIELD_LENGTH),
+      mount: sanitize(disk.mount, MAX_DISK_FIELD_LENGTH),
+      type: sanitize(disk.type, MAX_DISK_FIELD_LENGTH),
+      total: disk.total,
+      used: disk.used,
+    })
+  ),
+  ...(processes && {
+    processes: [...processes]
+      .sort((a, b) => (b.cpu ?? 0) - (a.cpu ?? 0))
+      .slice(0, MAX_PROCESSES)
+      .map(
+        ({ pid, name, cpu, ram }): IProcess => ({ pid, name: sanitize(name, MAX_PROCESS_NAME_LENGTH), cpu, ram })
+      ),
+  }),
+});
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IMachineDetails extends mongoose.Document {
+  machine_uuid: string;
+  updated_at: number; // When the machine last reported them
+  disks: IDisk[];
+  processes?: IProcess[]; // Missing until the reporter of the machine reports them
+}
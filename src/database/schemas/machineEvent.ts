@@ -0,0 +1,69 @@
+import mongoose from "mongoose";
+import { Time } from "../../types";
+import { metricsPlugin } from "../middleware/metrics";
+
+// How long the connections of reporters are kept unless MACHINE_EVENTS_RETENTION is set,
+// the uptime can't be computed further back than this
+export const MACHINE_EVENTS_RETENTION = 90 * Time.Day;
+// Reconnects faster than this aren't counted as downtime so a flapping connection doesn't look like an outage,
+// unless UPTIME_MERGE_GAP is set
+export const UPTIME_MERGE_GAP = 15 * Time.Second;
+
+/**
+ * A reporter being connected to a shard, events without disconnected_at are still connected
+ */
+export const machineEventSchema = new mongoose.Schema<IMachineEvent>({
+  machine_uuid: {
+    type: String,
+    required: true,
+  },
+  // The shard the reporter connected to so a restarting shard only closes its own events
+  shard: {
+    type: String,
+    required: true,
+  },
+  connected_at: {
+    type: Date,
+    required: true,
+  },
+  disconnected_at: {
+    type: Date,
+  },
+});
+
+// Every uptime query is a range of a single machine
+machineEventSchema.index({ machine_uuid: 1, connected_at: 1 });
+machineEventSchema.index({ shard: 1, disconnected_at: 1 });
+// Open events don't have disconnected_at so they're never expired
+machineEventSchema.index({ disconnected_at: 1 }, { expireAfterSeconds: MACHINE_EVENTS_RETENTION / Time.Second });
+
+machineEventSchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+  },
+});
+
+machineEventSchema.plugin(metricsPlugin);
+
+export const machineEvents = mongoose.model<IMachineEvent>("MachineEvent", machineEventSchema, "machine_events");
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IMachineEvent {
+  machine_uuid: string; // The uuid of the machine whose reporter connected
+  shard: string; // The SHARD_ID of the shard it connected to
+  connected_at: Date;
+  disconnected_at?: Date; // When it disconnected, missing while it's still connected
+}
+
+/**
+ * A stretch of time a machine wasn't connected
+ */
+export interface DowntimeWindow {
+  from: number;
+  to: number;
+}
@@ -0,0 +1,115 @@
+import crypto from "crypto";
+import mongoose from "mongoose";
+import { Time } from "../../types";
+import { IBaseDocument } from "../DatabaseManager";
+import { preSaveMiddleware } from "../middleware/preSave";
+import { metricsPlugin } from "../middleware/metrics";
+import { updatedAtPlugin } from "../middleware/updatedAt";
+
+// How long a session lasts without being refreshed unless SESSION_EXPIRATION is set, every refresh pushes it back
+export const SESSION_EXPIRATION = Time.Month;
+
+/**
+ * A login of a user on a device, the refresh token is rotated on every use and only the hash
+ * of the current one is kept so a leaked database can't be used to refresh sessions
+ */
+export const sessionSchema = new mongoose.Schema<ISession>({
+  uuid: {
+    type: String,
+    unique: true,
+    index: true,
+  },
+  created_at: {
+    type: Number,
+  },
+  updated_at: {
+    type: Number,
+  },
+  user_uuid: {
+    type: String,
+    required: true,
+    index: true,
+  },
+  refresh_hash: {
+    type: String,
+    required: true,
+  },
+  agent: String,
+  ip: String,
+  last_used_at: {
+    type: Number,
+  },
+  expires_at: {
+    type: Date,
+    required: true,
+  },
+});
+
+// Mongo deletes the sessions by itself once they expire
+sessionSchema.index({ expires_at: 1 }, { expireAfterSeconds: 0 });
+
+sessionSchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+    delete ret.refresh_hash;
+  },
+});
+
+sessionSchema.pre("save", preSaveMiddleware);
+sessionSchema.plugin(metricsPlugin);
+sessionSchema.plugin(updatedAtPlugin);
+
+export const sessions = mongoose.model<ISession>("Session", sessionSchema);
+
+/**
+ * Creates the secret half of a refresh token
+ */
+export const generate_refresh_secret = () => crypto.randomBytes(32).toString("hex");
+
+/**
+ * Hashes the secret of a refresh token, it's random enough that a fast hash is fine
+ * @tested
+ */
+export const hash_refresh_secret = (secret: string) => crypto.createHash("sha256").update(secret).digest("hex");
+
+/**
+ * Refresh tokens are the uuid of their session and the secret joined by a dot
+ * so the session can be found even when the secret is an old one
+ * @tested
+ */
+export const format_refresh_token = (session_uuid: string, secret: string) => `${session_uuid}.${secret}`;
+
+/**
+ * Splits a refresh token back into the uuid of its session and its secret
+ * @returns undefined if the token isn't a refresh token
+ * @tested
+ */
+export const parse_refresh_token = (token: unknown) => {
+  if (typeof token !== "string") return;
+  const [session_uuid, secret, ...rest] = token.split(".");
+  if (!session_uuid || !secret || rest.length) return;
+  return { session_uuid, secret };
+};
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface ISession extends IBaseDocument, mongoose.Document {
+  user_uuid: string; // The user the session belongs to
+  refresh_hash: string; // The hash of the current refresh token
+  agent: string; // The user agent the session was last used from
+  ip: string; // The IP the session was last used from
+  last_used_at: number; // When the refresh token was last rotated
+  expires_at: Date; // When mongo deletes the session
+}
+
+/**
+ * Where a session is used from
+ */
+export interface ISessionDevice {
+  agent: string;
+  ip: string;
+}
@@ -0,0 +1,139 @@
+import crypto from "crypto";
+import mongoose from "mongoose";
+import { IBaseDocument } from "../DatabaseManager";
+import { preSaveMiddleware } from "../middleware/preSave";
+import { metricsPlugin } from "../middleware/metrics";
+import { updatedAtPlugin } from "../middleware/updatedAt";
+import { IComputedDynamicData, IMachine, IRAM, machine_presence, MachinePresence } from "./machine";
+
+// How many links a machine can have so revoking them all stays manageable
+export const MAX_SHARE_LINKS = 10;
+// Anything else in the path can't be a token so it's turned away before it costs a query
+export const SHARE_TOKEN_PATTERN = /^[0-9a-f]{40}$/;
+
+/**
+ * A token that lets anyone with it see the live stats of a single machine without logging in
+ */
+export const shareLinkSchema = new mongoose.Schema<IShareLink>({
+  uuid: {
+    type: String,
+    unique: true,
+    index: true,
+  },
+  created_at: {
+    type: Number,
+  },
+  updated_at: {
+    type: Number,
+  },
+  token: {
+    type: String,
+    unique: true,
+    required: true,
+  },
+  machine_uuid: {
+    type: String,
+    required: true,
+    index: true,
+  },
+  owner_uuid: {
+    type: String,
+    required: true,
+  },
+  // Links without one work until they're revoked
+  expires_at: {
+    type: Date,
+  },
+  // Whether the name, hostname and IP of the machine are shown too, the name is usually the hostname
+  expose_host: {
+    type: Boolean,
+    default: false,
+  },
+});
+
+// Mongo only deletes the expired links once a minute so they're also checked when they're used
+shareLinkSchema.index({ expires_at: 1 }, { expireAfterSeconds: 0 });
+
+shareLinkSchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+  },
+});
+
+shareLinkSchema.pre("save", preSaveMiddleware);
+shareLinkSchema.plugin(metricsPlugin);
+shareLinkSchema.plugin(updatedAtPlugin);
+
+export const shareLinks = mongoose.model<IShareLink>("ShareLink", shareLinkSchema);
+
+/**
+ * Creates the token that goes in the public url, it's as good as a password for the stats of the machine
+ * @tested
+ */
+export const generate_share_token = () => crypto.randomBytes(20).toString("hex");
+
+/**
+ * The only stats the public gets, nothing about the disks, processes or network interfaces of the machine
+ * @tested
+ */
+export const public_stats = ({ timestamp, cau, ram, host_uptime }: IComputedDynamicData): IPublicStats => ({
+  timestamp,
+  cau,
+  ram: { used: ram.used, total: ram.total },
+  host_uptime,
+});
+
+/**
+ * What a share link shows of a machine, its name, hostname and IP only when the owner opted into it
+ * @param machine The machine the link is for
+ * @param link The link it's seen through
+ * @param stats The latest stats of the machine
+ * @tested
+ */
+export const public_machine = (
+  machine: Pick<IMachine, "uuid" | "name" | "status" | "last_seen" | "static_data" | "network">,
+  link: Pick<IShareLink, "expose_host">,
+  stats?: IComputedDynamicData
+): IPublicMachine => ({
+  uuid: machine.uuid,
+  status: machine_presence(machine),
+  last_seen: machine.last_seen,
+  stats: stats && public_stats(stats),
+  ...(link.expose_host && { name: machine.name, hostname: machine.static_data?.hostname, ip: machine.network?.ip }),
+});
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IShareLink extends IBaseDocument, mongoose.Document {
+  token: string; // What goes in the public url
+  machine_uuid: string; // The machine it shows
+  owner_uuid: string; // Who created it, only they can revoke it
+  expires_at?: Date; // When it stops working
+  expose_host: boolean; // Whether the name, hostname and IP are shown
+}
+
+export interface IShareLinkInput {
+  expires_in?: string; // A duration like 30m or 7d
+  expose_host?: boolean;
+}
+
+export interface IPublicStats {
+  timestamp: number;
+  cau: number; // CPU average usage
+  ram: IRAM;
+  host_uptime: number;
+}
+
+export interface IPublicMachine {
+  uuid: string;
+  status: MachinePresence;
+  last_seen?: number;
+  stats?: IPublicStats;
+  name?: string; // The rest only when the owner opted into it
+  hostname?: string;
+  ip?: string;
+}
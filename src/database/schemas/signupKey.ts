@@ -0,0 +1,77 @@
+import mongoose from "mongoose";
+import { v4 as uuidv4 } from "uuid";
+import { Time } from "../../types";
+import { IBaseDocument } from "../DatabaseManager";
+import { preSaveMiddleware } from "../middleware/preSave";
+import { metricsPlugin } from "../middleware/metrics";
+import { updatedAtPlugin } from "../middleware/updatedAt";
+
+// How long a reporter has to claim a key
+export const SIGNUP_KEY_EXPIRATION = 5 * Time.Minute;
+// How many unused keys a user can have at once so the collection can't be flooded
+export const MAX_SIGNUP_KEYS = 5;
+// How long expired keys are kept around so using one says it expired instead of that it doesn't exist
+export const SIGNUP_KEY_GRACE = Time.Hour;
+
+/**
+ * A single use key a reporter signs up with to be bound to the user that generated it
+ */
+export const signupKeySchema = new mongoose.Schema<ISignupKey>({
+  uuid: {
+    type: String,
+    unique: true,
+    index: true,
+  },
+  created_at: {
+    type: Number,
+  },
+  updated_at: {
+    type: Number,
+  },
+  key: {
+    type: String,
+    unique: true,
+    required: true,
+  },
+  owner_uuid: {
+    type: String,
+    required: true,
+    index: true,
+  },
+  expires_at: {
+    type: Date,
+    required: true,
+  },
+});
+
+signupKeySchema.index({ expires_at: 1 }, { expireAfterSeconds: SIGNUP_KEY_GRACE / Time.Second });
+
+signupKeySchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+  },
+});
+
+signupKeySchema.pre("save", preSaveMiddleware);
+signupKeySchema.plugin(metricsPlugin);
+signupKeySchema.plugin(updatedAtPlugin);
+
+export const signupKeys = mongoose.model<ISignupKey>("SignupKey", signupKeySchema);
+
+/**
+ * Creates the key the user types into the reporter
+ * @tested
+ */
+export const generate_signup_key = () => uuidv4().replace(/-/g, "").toUpperCase();
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface ISignupKey extends IBaseDocument, mongoose.Document {
+  key: string; // What the reporter signs up with
+  owner_uuid: string; // The user the machine gets bound to
+  expires_at: Date; // When the key stops working
+}
@@ -0,0 +1,133 @@
+import mongoose from "mongoose";
+import { Time } from "../../types";
+import { metricsPlugin } from "../middleware/metrics";
+
+// How long the raw points are kept unless STATS_RAW_RETENTION is set, older ranges are served from the hourly rollups
+export const STATS_RAW_RETENTION = Time.Day;
+// How long the hourly rollups are kept unless STATS_ROLLUP_RETENTION is set
+export const STATS_ROLLUP_RETENTION = Time.Month;
+export const STATS_ROLLUP_RESOLUTION = Time.Hour;
+// How many points of a machine an export has, a day of raw points reported every second fits a few times over
+export const MAX_EXPORT_POINTS = 500_000;
+
+/**
+ * A single point of a machine's stats over time, only the totals are kept
+ * since the per core and per interface values aren't graphed
+ */
+export const statSchema = new mongoose.Schema<IStatPoint>({
+  machine_uuid: {
+    type: String,
+    required: true,
+  },
+  timestamp: {
+    type: Date,
+    required: true,
+  },
+  cpu: Number, // CPU average usage
+  cpu_speed: Number, // CPU average speed
+  ram_used: Number,
+  ram_total: Number,
+  swap_used: Number,
+  download: Number, // Total download in megabytes
+  upload: Number, // Total upload in megabytes
+  ping: Number,
+  process_count: Number,
+});
+
+// Every history query is a range of a single machine
+statSchema.index({ machine_uuid: 1, timestamp: 1 });
+// Mongo deletes the raw points by itself once they're older than the retention
+statSchema.index({ timestamp: 1 }, { expireAfterSeconds: STATS_RAW_RETENTION / Time.Second });
+
+statSchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+  },
+});
+
+statSchema.plugin(metricsPlugin);
+
+export const stats = mongoose.model<IStatPoint>("Stat", statSchema);
+
+/**
+ * An hour of a machine's stats, the sums are kept instead of the averages so
+ * rollups can be merged into coarser buckets without skewing them
+ */
+export const statRollupSchema = new mongoose.Schema<IStatRollup>({
+  machine_uuid: {
+    type: String,
+    required: true,
+  },
+  timestamp: {
+    type: Date,
+    required: true,
+  },
+  count: Number, // How many raw points went into the rollup
+  values: mongoose.Schema.Types.Mixed,
+});
+
+// Unique since rolling up the same hour again replaces it
+statRollupSchema.index({ machine_uuid: 1, timestamp: 1 }, { unique: true });
+statRollupSchema.index({ timestamp: 1 }, { expireAfterSeconds: STATS_ROLLUP_RETENTION / Time.Second });
+statRollupSchema.plugin(metricsPlugin);
+
+export const statRollups = mongoose.model<IStatRollup>("StatRollup", statRollupSchema);
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IStatValues {
+  cpu: number;
+  cpu_speed: number;
+  ram_used: number;
+  ram_total: number;
+  swap_used: number;
+  download: number;
+  upload: number;
+  ping: number;
+  process_count: number;
+}
+
+export interface IStatPoint extends IStatValues, mongoose.Document {
+  machine_uuid: string;
+  timestamp: Date;
+}
+
+export interface IStatRollup extends mongoose.Document {
+  machine_uuid: string;
+  timestamp: Date;
+  count: number;
+  values: { [field in keyof IStatValues]: { sum: number; min: number; max: number } };
+}
+
+/**
+ * A bucket of the history, the values are the averages of the points in it
+ */
+export interface IStatHistoryPoint extends IStatValues {
+  timestamp: number; // When the bucket starts
+}
+
+export const STAT_FIELDS: (keyof IStatValues)[] = [
+  "cpu",
+  "cpu_speed",
+  "ram_used",
+  "ram_total",
+  "swap_used",
+  "download",
+  "upload",
+  "ping",
+  "process_count",
+];
+
+/**
+ * A bucket of a single metric
+ */
+export interface IStatMetricPoint {
+  timestamp: number; // When the bucket starts
+  avg: number;
+  min: number;
+  max: number;
+}
@@ -2,11 +2,46 @@ import mongoose from "mongoose";
 import { IBaseDocument } from "../DatabaseManager";
 import { IMachine, machines } from "./machine";
 import express from "express";
-import { Validators } from "../../validators";
+import { ProfileVisibility, Validators } from "../../validators";
 import bcrypt from "bcryptjs";
 import { preSaveMiddleware, userPreSaveMiddleware } from "../middleware/preSave";
 import type { IncomingHttpHeaders } from "http";
-import jwt from "jsonwebtoken";
+import jwt, { TokenExpiredError } from "jsonwebtoken";
+import crypto from "crypto";
+import { cachePlugin } from "../middleware/cache";
+import { metricsPlugin } from "../middleware/metrics";
+import { updatedAtPlugin } from "../middleware/updatedAt";
+import { versionPlugin } from "../middleware/version";
+import type { JwtConfig } from "../../config";
+import type { IApiToken } from "./apiToken";
+import { Time } from "../../types";
+import { ErrorCode } from "../../utils/errors";
+
+// How long users have to change their mind after asking for their account to be deleted
+export const ACCOUNT_DELETION_GRACE = 7 * Time.Day;
+// How long the link in a verification email works
+export const EMAIL_VERIFICATION_EXPIRATION = Time.Day;
+// How long the link in a password reset email works
+export const PASSWORD_RESET_EXPIRATION = 30 * Time.Minute;
+// What ?fields= can pick from what to_public and to_private send
+export const PUBLIC_USER_FIELDS = [
+  "uuid",
+  "created_at",
+  "updated_at",
+  "avatar",
+  "banner",
+  "username",
+  "biography",
+  "location",
+  "is_admin",
+  "deleted_at",
+  "disabled_at",
+  "version",
+];
+export const PRIVATE_USER_FIELDS = [...PUBLIC_USER_FIELDS, "email", "email_verified", "profile_visibility"];
+export const FRIEND_STATUSES = ["pending", "accepted"] as const;
+// What checking whether someone can see a user needs to read of them
+export const PROFILE_VISIBILITY_FIELDS = ["profile_visibility", "friends"];
 
 export const userSchema = new mongoose.Schema<IUser, mongoose.Model<IUser>, IUserMethods>({
   uuid: {
@@ -27,6 +62,13 @@ export const userSchema = new mongoose.Schema<IUser, mongoose.Model<IUser>, IUse
     required: true,
     index: true,
   },
+  // Lowercased copy of the username so searches can use an index instead of a case insensitive regex,
+  // it's what's unique so nobody can sign up as someone else by changing the case of their username
+  username_lower: {
+    type: String,
+    unique: true,
+    index: true,
+  },
   is_admin: {
     type: Boolean,
     default: false,
@@ -41,22 +83,79 @@ export const userSchema = new mongoose.Schema<IUser, mongoose.Model<IUser>, IUse
   updated_at: {
     type: Number,
   },
+  // Always lowercased so the unique index is case insensitive
   email: {
     type: String,
     unique: true,
     required: true,
     index: true,
+    lowercase: true,
+    trim: true,
+  },
+  // Users can't bind machines until they've proven the email is theirs
+  email_verified: {
+    type: Boolean,
+    default: false,
+  },
+  // The nonce of the only verification token that still works, unset once the email is verified
+  verification_nonce: {
+    type: String,
   },
   password: {
     type: String,
     required: true,
   },
+  // Only the hash of the latest reset token is kept, asking for another one replaces it
+  password_reset: {
+    hash: String,
+    expires_at: Number,
+  },
   avatar: {
     type: String,
   },
   banner: {
     type: String,
   },
+  location: {
+    type: String,
+  },
+  deleted_at: {
+    type: Number,
+  },
+  // Who deleted the user, only users who deleted themselves can cancel it by logging in
+  deleted_by: {
+    type: String,
+  },
+  // When an admin disabled the user, they can't log in and the tokens of their machines stop working until it's unset
+  disabled_at: {
+    type: Number,
+  },
+  // Bumped to log out every session, tokens signed with an older version are rejected
+  token_version: {
+    type: Number,
+    default: 0,
+  },
+  // Both users of a friendship or a request have a record of the other, the one who got the request has it incoming
+  friends: [
+    {
+      _id: false,
+      uuid: String,
+      status: { type: String, enum: FRIEND_STATUSES },
+      incoming: Boolean,
+      created_at: Number,
+      accepted_at: Number,
+    },
+  ],
+  // Users who hide their profile look like they don't exist to the users it's hidden from
+  profile_visibility: {
+    type: String,
+    default: "public",
+  },
+  // Bumped on every write, profile updates can send the version they saw to fail instead of clobbering another edit
+  version: {
+    type: Number,
+    default: 0,
+  },
 });
 
 userSchema.set("toJSON", {
@@ -67,11 +166,22 @@ userSchema.set("toJSON", {
     delete ret.password;
     delete ret.email;
     delete ret.login_history;
+    delete ret.username_lower;
+    delete ret.token_version;
+    delete ret.deleted_by;
+    delete ret.email_verified;
+    delete ret.verification_nonce;
+    delete ret.password_reset;
+    delete ret.friends;
   },
 });
 
 userSchema.pre("save", preSaveMiddleware);
 userSchema.pre("save", userPreSaveMiddleware);
+userSchema.plugin(metricsPlugin);
+userSchema.plugin(updatedAtPlugin);
+userSchema.plugin(versionPlugin);
+userSchema.plugin(cachePlugin("user"));
 
 /// ------------------------------------------------------------------------------
 /// ------- METHODS --------------------------------------------------------------
@@ -79,6 +189,9 @@ userSchema.pre("save", userPreSaveMiddleware);
 
 export interface IUserMethods {
   compare_password: (a: string) => Promise<boolean>;
+  is_token_current: (payload: UserTokenPayload) => boolean;
+  is_deletion_cancellable: (now?: number) => boolean;
+  is_visible_to: (viewer_uuid: string) => boolean;
   update_avatar: (a: string) => Promise<IUser>;
   update_banner: (a: string) => Promise<IUser>;
   update_password: (a: UserPasswordUpdateInput) => Promise<IUser>;
@@ -86,20 +199,108 @@ export interface IUserMethods {
   update_username: (a: string) => Promise<IUser>;
   update_login_history: (headers: IncomingHttpHeaders) => Promise<IUser>;
   get_machines: (actual?: boolean) => Promise<IMachine[]>;
-  login: (headers: IncomingHttpHeaders) => Promise<string>;
+  login: (headers: IncomingHttpHeaders, config: JwtConfig) => Promise<string>;
+  sign_token: (config: JwtConfig) => string;
+  to_public: () => ISafeUser;
+  to_private: () => IPrivateUser;
+  to_preview: () => IUserPreview;
 }
 
 userSchema.methods = {
-  login: async function (this: IUser, headers: IncomingHttpHeaders): Promise<string> {
-    const token = jwt.sign({ username: this.username, uuid: this.uuid, password: this.password }, process.env.JWT_SECRET!);
+  /**
+   * Returns only the fields of the user that are safe to send to clients
+   */
+  to_public: function (this: IUser): ISafeUser {
+    return {
+      uuid: this.uuid,
+      created_at: this.created_at,
+      updated_at: this.updated_at,
+      avatar: this.avatar,
+      banner: this.banner,
+      username: this.username,
+      biography: this.biography,
+      location: this.location,
+      is_admin: this.is_admin,
+      deleted_at: this.deleted_at,
+      disabled_at: this.disabled_at,
+      version: this.version ?? 0,
+    };
+  },
+
+  /**
+   * Returns the fields only the user themselves gets to see on top of the public ones
+   */
+  to_private: function (this: IUser): IPrivateUser {
+    return {
+      ...this.to_public(),
+      email: this.email,
+      email_verified: !!this.email_verified,
+      profile_visibility: this.profile_visibility ?? "public",
+    };
+  },
+
+  /**
+   * Returns just enough of the user to show it in a list like search results
+   */
+  to_preview: function (this: IUser): IUserPreview {
+    return { uuid: this.uuid, username: this.username, avatar: this.avatar };
+  },
+
+  login: async function (this: IUser, headers: IncomingHttpHeaders, config: JwtConfig): Promise<string> {
+    const token = this.sign_token(config);
     this.update_login_history(headers);
     return token;
   },
 
+  /**
+   * Signs a short lived access token, sessions get new ones with their refresh token when it expires
+   */
+  sign_token: function (this: IUser, { secret, expiration }: JwtConfig): string {
+    const payload: UserTokenPayload = { username: this.username, uuid: this.uuid, token_version: this.token_version ?? 0 };
+    return jwt.sign(payload, secret, {
+      algorithm: "HS256",
+      expiresIn: expiration,
+    });
+  },
+
   compare_password: async function (this: IUser, candidatePassword: string): Promise<boolean> {
     return bcrypt.compare(candidatePassword, this.password).catch(() => false);
   },
 
+  /**
+   * Whether a token was signed after the last time the user's sessions were revoked
+   * @tested
+   */
+  is_token_current: function (this: IUser, payload: UserTokenPayload): boolean {
+    return (payload.token_version ?? 0) === (this.token_version ?? 0);
+  },
+
+  /**
+   * Whether the user asked for their account to be deleted and the grace period hasn't passed yet
+   * @tested
+   */
+  is_deletion_cancellable: function (this: IUser, now = Date.now()): boolean {
+    return !!this.deleted_at && this.deleted_by === this.uuid && this.deleted_at > now - ACCOUNT_DELETION_GRACE;
+  },
+
+  /**
+   * Whether a user can see the profile and the machines of this one, users who were there before the setting
+   * are public
+   * @param viewer_uuid The uuid of the user looking
+   * @tested
+   */
+  is_visible_to: function (this: IUser, viewer_uuid: string): boolean {
+    if (viewer_uuid === this.uuid) return true;
+    switch (this.profile_visibility ?? "public") {
+      case "public":
+        return true;
+      case "friends":
+        return (this.friends ?? []).some((friend) => friend.uuid === viewer_uuid && friend.status === "accepted");
+      case "private":
+        return false;
+    }
+  },
+
   update_login_history: async function (this: IUser, headers: IncomingHttpHeaders): Promise<IUser> {
     const ip = headers["cf-connecting-ip"] as string;
     if (!ip) return Promise.reject("invalid.ip");
@@ -126,19 +327,47 @@ userSchema.methods = {
   },
 
   update_password: async function (this: IUser, form: UserPasswordUpdateInput): Promise<IUser> {
-    if (!Validators.validate_password(form.current_password)) return Promise.reject("current.password.invalid");
+    if (typeof form.current_password !== "string") return Promise.reject("current.password.invalid");
     if (!Validators.validate_password(form.new_password)) return Promise.reject("new.password.invalid");
     if (!Validators.validate_password(form.new_password_repeat)) return Promise.reject("repeat.password.invalid");
     if (!(await this.compare_password(form.current_password))) return Promise.reject("password.invalid");
     if (form.new_password !== form.new_password_repeat) return Promise.reject("passwords.mismatch");
 
     this.password = form.new_password;
+    this.token_version = (this.token_version ?? 0) + 1;
     return this.save();
   },
 } as IUserMethods;
 
 export const users = mongoose.model<IUser>("User", userSchema);
 
+// Verification tokens are signed with their own key so they can never pass as access tokens
+const verification_secret = (secret: string) => crypto.createHmac("sha256", secret).update("email-verification").digest();
+
+/**
+ * Signs the token sent in a verification email
+ * @tested
+ */
+export const sign_verification_token = (payload: EmailVerificationPayload, secret: string) =>
+  jwt.sign(payload, verification_secret(secret), {
+    algorithm: "HS256",
+    expiresIn: EMAIL_VERIFICATION_EXPIRATION / Time.Second,
+  });
+
+/**
+ * Checks the signature and expiry of a verification token, rejects with token.expired or token.invalid
+ * @tested
+ */
+export const verify_verification_token = async (token: string, secret: string) => {
+  try {
+    const payload = jwt.verify(token, verification_secret(secret), { algorithms: ["HS256"] }) as EmailVerificationPayload;
+    if ([payload.uuid, payload.email, payload.nonce].every((field) => typeof field === "string")) return payload;
+  } catch (error) {
+    if (error instanceof TokenExpiredError) return Promise.reject(ErrorCode.TokenExpired);
+  }
+  return Promise.reject(ErrorCode.TokenInvalid);
+};
+
 /// ------------------------------------------------------------------------------
 /// ------- INTERFACES -----------------------------------------------------------
 /// ------------------------------------------------------------------------------
@@ -150,6 +379,56 @@ export interface IUser extends ISafeUser, IUserMethods, mongoose.Document {
   password: string; // The user's hashed password
   email: string; // The email of the user
   login_history: IUserLoginHistory[]; // The IPs of the user
+  username_lower: string; // The lowercased username used for searching
+  token_version: number; // Tokens signed with an older version are rejected
+  deleted_by?: string; // The uuid of whoever deleted the user
+  email_verified: boolean; // Whether the user clicked the link in the verification email
+  verification_nonce?: string; // Which verification token still works
+  password_reset?: IPasswordReset; // The reset token that still works
+  friends: IFriend[]; // The friends of the user and the requests they sent or got
+  profile_visibility: ProfileVisibility;
+}
+
+export type FriendStatus = typeof FRIEND_STATUSES[number];
+
+export interface IFriend {
+  uuid: string; // The uuid of the other user
+  status: FriendStatus;
+  incoming: boolean; // Whether the other user sent the request, only the user who got one can accept it
+  created_at: number; // When the request was sent
+  accepted_at?: number;
+}
+
+/**
+ * The friends of a user and the requests that haven't been accepted yet, as previews of the other users
+ */
+export interface IFriendList {
+  friends: (IUserPreview & { since: number })[];
+  incoming: (IUserPreview & { requested_at: number })[]; // Requests the user can accept
+  outgoing: (IUserPreview & { requested_at: number })[]; // Requests the user sent
+}
+
+export interface IPasswordReset {
+  hash: string; // The hash of the secret half of the token
+  expires_at: number; // When the token stops working
+}
+
+/**
+ * What the token in a verification email is signed with
+ */
+export interface EmailVerificationPayload {
+  uuid: string;
+  email: string; // The token stops working when the user changes their email
+  nonce: string; // Only the latest token works and only once
+}
+
+/**
+ * What the tokens of a user are signed with
+ */
+export interface UserTokenPayload {
+  username: string;
+  uuid: string;
+  token_version?: number; // Missing on tokens signed before token versions existed
 }
 
 export interface IUserLoginHistory {
@@ -167,9 +446,27 @@ export interface ISafeUser extends IBaseDocument {
   banner: string; // The avatar url of the user
   username: string; // The username of the user
   biography: string; // The biography of the user
+  location?: string; // Where the user is from
   is_admin: boolean; // Whether the user is an admin
+  deleted_at?: number; // When the user was soft deleted
+  disabled_at?: number; // When an admin disabled the user
+  version: number; // What updates have to send to only apply to the user as they saw it
 }
 
+/**
+ * The user object sent to the user themselves
+ */
+export interface IPrivateUser extends ISafeUser {
+  email: string; // The email of the user
+  email_verified: boolean; // The frontend asks the user to verify their email while this is false
+  profile_visibility: ProfileVisibility; // Who else can see their profile
+}
+
+/**
+ * The slimmed down user shown in search results
+ */
+export type IUserPreview = Pick<ISafeUser, "uuid" | "username" | "avatar">;
+
 export interface UserLoginInput {
   [key: string]: any;
   password: string; // The password of the user
@@ -184,6 +481,36 @@ export interface UserPasswordUpdateInput {
   new_password_repeat: string; // The new password of the user
 }
 
+/**
+ * The profile fields a user is allowed to change, anything that's undefined is left untouched
+ */
+export interface UserProfileUpdateInput {
+  username?: string;
+  email?: string;
+  bio?: string;
+  avatar?: string;
+  banner?: string;
+  location?: string;
+  profile_visibility?: ProfileVisibility;
+}
+
+/**
+ * The fields of the user document a profile update sets
+ */
+export type UserProfileUpdate = Partial<
+  Pick<IUser, "username" | "email" | "biography" | "avatar" | "banner" | "location" | "profile_visibility">
+>;
+
+/**
+ * What admins can filter the users they list by, the pagination params are parsed separately
+ */
+export interface AdminUsersQuery {
+  email_verified?: boolean;
+  disabled?: boolean;
+  created_after?: number; // Inclusive
+  created_before?: number; // Exclusive
+}
+
 /**
  * What the user signs up with
  */
@@ -193,9 +520,9 @@ export interface UserSignupInput extends UserLoginInput {
 }
 
 /**
- * The object the login/signup database statics return
+ * The object the login/signup/refresh database statics return
  */
-export type UserAuthResult = { user: IUser; token: string };
+export type UserAuthResult = { user: IUser; token: string; refresh_token: string };
 
 /**
  * Logged in requests that implement the user in the request
@@ -203,4 +530,5 @@ export type UserAuthResult = { user: IUser; token: string };
 export interface LoggedInRequest extends express.Request {
   params: any;
   user?: IUser;
+  api_token?: IApiToken; // The API token the request was made with, missing for requests made with a login
 }
@@ -0,0 +1,108 @@
+import crypto from "crypto";
+import mongoose from "mongoose";
+import { IBaseDocument } from "../DatabaseManager";
+import { preSaveMiddleware } from "../middleware/preSave";
+import { metricsPlugin } from "../middleware/metrics";
+import { updatedAtPlugin } from "../middleware/updatedAt";
+import type { WEBHOOK_EVENTS } from "../../validators";
+
+// What a webhook is sent, the test event is only ever sent when it's asked for
+export type WebhookEvent = typeof WEBHOOK_EVENTS[number] | "webhook.test";
+
+// How many webhooks a user can have so a single event can't turn into too many deliveries
+export const MAX_WEBHOOKS = 10;
+// How many deliveries in a row can fail every retry before the webhook is disabled
+export const MAX_WEBHOOK_FAILURES = 5;
+// What signatures start with so the algorithm can change without breaking the receivers that check it
+export const WEBHOOK_SIGNATURE_PREFIX = "sha256=";
+
+/**
+ * A url the events of the machines of a user are posted to, every body is signed with the secret of the webhook
+ * so the receiver can tell it came from us
+ */
+export const webhookSchema = new mongoose.Schema<IWebhook>({
+  uuid: {
+    type: String,
+    unique: true,
+    index: true,
+  },
+  created_at: {
+    type: Number,
+  },
+  updated_at: {
+    type: Number,
+  },
+  user_uuid: {
+    type: String,
+    required: true,
+    index: true,
+  },
+  url: {
+    type: String,
+    required: true,
+  },
+  events: {
+    type: [String],
+    default: [],
+  },
+  secret: {
+    type: String,
+    required: true,
+  },
+  // How many deliveries in a row failed every retry, a delivery that succeeds resets it
+  failures: {
+    type: Number,
+    default: 0,
+  },
+  disabled_at: {
+    type: Number,
+  },
+});
+
+webhookSchema.set("toJSON", {
+  virtuals: false,
+  transform: (doc: any, ret: any, options: any) => {
+    delete ret.__v;
+    delete ret._id;
+    delete ret.secret;
+  },
+});
+
+webhookSchema.pre("save", preSaveMiddleware);
+webhookSchema.plugin(metricsPlugin);
+webhookSchema.plugin(updatedAtPlugin);
+
+export const webhooks = mongoose.model<IWebhook>("Webhook", webhookSchema);
+
+/**
+ * Creates the secret the bodies of a webhook are signed with, it's only ever shown to the user once
+ * @tested
+ */
+export const generate_webhook_secret = () => `whsec_${crypto.randomBytes(24).toString("hex")}`;
+
+/**
+ * Signs the body of a delivery, the receivers compute the same over the raw body they got and compare
+ * @param secret The secret of the webhook
+ * @param body The exact body that's sent
+ * @tested
+ */
+export const sign_webhook = (secret: string, body: string) =>
+  `${WEBHOOK_SIGNATURE_PREFIX}${crypto.createHmac("sha256", secret).update(body).digest("hex")}`;
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IWebhook extends IBaseDocument, mongoose.Document {
+  user_uuid: string; // Whose machines it gets the events of
+  url: string;
+  events: WebhookEvent[]; // What it's subscribed to
+  secret: string; // What the bodies are signed with, it's never sent back after it's created
+  failures: number;
+  disabled_at?: number; // When it was disabled for failing too often, nothing is sent to it until a test succeeds
+}
+
+export interface IWebhookInput {
+  url: string;
+  events: WebhookEvent[];
+}
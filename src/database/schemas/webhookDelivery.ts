@@ -0,0 +1,106 @@
+import mongoose from "mongoose";
+import { Time } from "../../types";
+import { metricsPlugin } from "../middleware/metrics";
+import type { AlertPayload } from "../../utils/alerts";
+import { WebhookEvent } from "./webhook";
+
+// A delivery is retried for this long after the event, after that it counts as a failure of its webhook
+export const WEBHOOK_RETRY_WINDOW = Time.Hour;
+// How long the first retry waits, every retry after it waits twice as long as the one before
+export const WEBHOOK_RETRY_BASE = 30 * Time.Second;
+// How long a worker has a delivery for before another one can take it, well over how long the request can take
+export const WEBHOOK_LEASE = Time.Minute;
+
+/**
+ * An event on its way to a webhook, it's deleted once it's delivered or given up on so what's left is what's
+ * still to be sent and the workers of every shard take them from here
+ */
+export const webhookDeliverySchema = new mongoose.Schema<IWebhookDelivery>({
+  uuid: {
+    type: String,
+    required: true,
+    unique: true,
+  },
+  webhook_uuid: {
+    type: String,
+    required: true,
+    index: true,
+  },
+  event: {
+    type: String,
+    required: true,
+  },
+  // Serialized once so every retry sends the bytes the signature was made over
+  body: {
+    type: String,
+    required: true,
+  },
+  attempts: {
+    type: Number,
+    default: 0,
+  },
+  created_at: {
+    type: Date,
+    required: true,
+  },
+  next_attempt_at: {
+    type: Date,
+    required: true,
+  },
+  last_error: {
+    type: String,
+  },
+});
+
+// The workers take the ones that are due first
+webhookDeliverySchema.index({ next_attempt_at: 1 });
+// The worker that gives up on a delivery deletes it, this is for the ones left behind by a webhook that was deleted
+webhookDeliverySchema.index({ created_at: 1 }, { expireAfterSeconds: (2 * WEBHOOK_RETRY_WINDOW) / Time.Second });
+
+webhookDeliverySchema.plugin(metricsPlugin);
+
+export const webhookDeliveries = mongoose.model<IWebhookDelivery>(
+  "WebhookDelivery",
+  webhookDeliverySchema,
+  "webhook_deliveries"
+);
+
+/**
+ * How long to wait before retrying a delivery
+ * @param attempts How many times it was already tried
+ * @tested
+ */
+export const webhook_retry_delay = (attempts: number) => WEBHOOK_RETRY_BASE * 2 ** Math.max(0, attempts - 1);
+
+/// ------------------------------------------------------------------------------
+/// ------- INTERFACES -----------------------------------------------------------
+/// ------------------------------------------------------------------------------
+
+export interface IWebhookDelivery extends mongoose.Document {
+  uuid: string; // Sent along so the receivers can tell a retry from a new event
+  webhook_uuid: string;
+  event: WebhookEvent;
+  body: string;
+  attempts: number;
+  created_at: Date; // When the event happened, it's retried until WEBHOOK_RETRY_WINDOW after it
+  next_attempt_at: Date; // When it's tried next, pushed back by WEBHOOK_LEASE while a worker has it
+  last_error?: string;
+}
+
+/**
+ * What a webhook is sent
+ */
+export interface WebhookPayload {
+  id: string; // The uuid of the delivery
+  event: WebhookEvent;
+  created_at: number;
+  data: WebhookData;
+}
+
+/**
+ * What the event is about, the alerts have the rule that fired on top of the machine
+ */
+export interface WebhookData {
+  machine?: { uuid: string; name: string };
+  alert?: Omit<AlertPayload, "machine">;
+}
@@ -1,19 +1,46 @@
 require("dotenv").config();
 import { Backend } from "./classes/backend.class";
+import { DatabaseManager } from "./database/DatabaseManager";
+import { Config, ConfigError, loadConfig, parseFlags, redactConfig } from "./config";
 import chalk from "chalk";
 import os from "os";
 import "./redis";
+import { Logger } from "./utils/logger";
+
+// Fails fast so a bad .env is caught before anything connects, flags like --port 7000 override the .env
+const loadConfigOrExit = (): Config => {
+  try {
+    return loadConfig({ ...process.env, ...parseFlags(process.argv.slice(2)) });
+  } catch (error) {
+    if (!(error instanceof ConfigError)) throw error;
+    Logger.error(error.message);
+    process.exit(1);
+  }
+};
 
 async function main() {
+  const config = loadConfigOrExit();
+  Logger.level = config.log_level;
+  Logger.debug("Loaded the config", redactConfig(config));
+
+  if (config.migrate_only) {
+    return DatabaseManager.migrate(config).then(
+      () => process.exit(0),
+      (error) => {
+        Logger.error("Failed to run the migrations", error);
+        process.exit(1);
+      }
+    );
+  }
   console.clear();
 
   const hostname = `${chalk.cyan("hostname")}  ${chalk.reset(os.hostname())}`;
   const arch = `${chalk.cyan("arch")}      ${chalk.reset(os.arch())}`;
-  const secure = `${chalk.cyan("secure")}    ${chalk.reset(process.env.SECURE!)}`;
+  const secure = `${chalk.cyan("secure")}    ${chalk.reset(String(config.secure))}`;
   const mode = `${chalk.cyan("mode")}      ${
-    process.env.MODE! === "production" ? chalk.green("production") : chalk.blue("development")
+    config.mode === "production" ? chalk.green("production") : chalk.blue("development")
   }`;
-  const shard = process.env.SHARD_ID ? `${chalk.cyan("shard")} ${chalk.reset(process.env.SHARD_ID)}` : "";
+  const shard = config.shard ? `${chalk.cyan("shard")} ${chalk.reset(config.shard)}` : "";
 
   const logo = chalk.blue(`
  
@@ -25,8 +52,12 @@ async function main() {
 `);
 
   console.log(logo);
-  const backend = await Backend.create();
+  const backend = await Backend.create(config);
   process.on("uncaughtException", (err) => console.log(err.message));
+  // Docker sends SIGTERM on stop and SIGINT is ctrl+c, the second signal kills us without waiting
+  for (const signal of ["SIGINT", "SIGTERM"]) {
+    process.once(signal, () => backend.shutdown().then(() => process.exit(0), () => process.exit(1)));
+  }
 }
 
 main();
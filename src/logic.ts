@@ -1,10 +1,17 @@
-import chalk from "chalk";
 import osu from "node-os-utils";
 import os from "os";
-import { INetwork } from "./database/schemas/machine";
-import { Logger } from "./utils/logger";
+import { version } from "../package.json";
+import type { AuditAction, AuditLogQuery } from "./database/schemas/auditLog";
+import { IComputedDynamicData, IDynamicData, INetwork } from "./database/schemas/machine";
+import { DowntimeWindow } from "./database/schemas/machineEvent";
+import { Time } from "./types";
 
 export const VIRTUAL_INTERFACES = ["veth", "vcan", "vxlan", "docker0", "lo"];
+export const DEFAULT_PAGE_LIMIT = 50;
+export const MAX_PAGE_LIMIT = 100;
+export const MAX_STATS_RANGE = Time.Month;
+export const MAX_STATS_POINTS = 1000;
+const NDJSON_CHUNK_SIZE = 64 * 1024;
 
 /**
  * Gets the used/total heap in ram used
@@ -21,29 +28,71 @@ export const getProcessorUsage = async () => {
   return osu.cpu.usage();
 };
 
-export const getServerMetrics = async () => {
+export const getServerMetrics = async (shard?: string) => {
   return {
     memory: await getMemoryUsage(),
     processor: await getProcessorUsage(),
     uptime: process.uptime(),
-    shard: process.env.SHARD_ID! ? `${os.hostname().toLowerCase()}-${process.env.SHARD_ID!}` : "solo",
+    shard: shard ? `${os.hostname().toLowerCase()}-${shard}` : "solo",
   };
 };
 
-export const checkEnvironmentVariables = (variables: string[]) => {
-  for (let i = 0; i < variables.length; i++) {
-    const variableName = variables[i];
-    const variableValue = process.env[variableName];
+/**
+ * Tells the orchestrator the process is alive and which build is running
+ * @param commit The commit the build came from
+ */
+export const getHealth = (commit: string) => ({
+  status: "ok",
+  uptime: process.uptime(),
+  version,
+  commit,
+});
+
+/**
+ * Rejects if the promise doesn't settle in time
+ */
+export const withTimeout = <T>(promise: Promise<T>, ms: number) =>
+  new Promise<T>((resolve, reject) => {
+    const timer = setTimeout(() => reject(new Error(`timed out after ${ms}ms`)), ms);
+    promise.then(resolve, reject).then(() => clearTimeout(timer));
+  });
 
-    if (variableValue) {
-      Logger.info(`Process variable ${chalk.cyan(variableName)}: ${variableValue}`);
-    } else {
-      Logger.error(`Process variable ${variableName} is undefined, please fix the .env`);
-      process.exit(1);
+/**
+ * Calls a function until it resolves, waiting longer after each failure
+ * @param fn The function to call
+ * @param attempts How many times to call it before giving up
+ * @param delay How long to wait after the first failure, doubles after every one after it
+ * @returns what the function resolved with or rejects with the last error
+ * @tested
+ */
+export const retry = async <T>(fn: () => Promise<T>, attempts = 3, delay = 100): Promise<T> => {
+  for (let attempt = 1; ; attempt++) {
+    try {
+      return await fn();
+    } catch (error) {
+      if (attempt >= attempts) throw error;
+      await new Promise((resolve) => setTimeout(resolve, delay * 2 ** (attempt - 1)));
     }
   }
 };
 
+/**
+ * Runs every dependency check in parallel
+ * @param checks The name of each dependency and how to check it
+ * @param timeout How long each check gets before it counts as failed
+ * @returns whether every check passed and the result of each one
+ * @tested
+ */
+export const checkDependencies = async (checks: { [name: string]: () => Promise<unknown> }, timeout = 2 * Time.Second) => {
+  const names = Object.keys(checks);
+  const results = await Promise.allSettled(names.map((name) => withTimeout(checks[name](), timeout)));
+  const dependencies: { [name: string]: string } = {};
+  results.forEach((result, i) => {
+    dependencies[names[i]] = result.status === "fulfilled" ? "ok" : `${result.reason?.message ?? result.reason}`;
+  });
+  return { ready: results.every((result) => result.status === "fulfilled"), dependencies };
+};
+
 export const isVirtualInterface = (iface: INetwork): Boolean => {
   for (let i = 0; i < VIRTUAL_INTERFACES.length; i++) {
     const prefixName = VIRTUAL_INTERFACES[i];
@@ -52,6 +101,44 @@ export const isVirtualInterface = (iface: INetwork): Boolean => {
   return false;
 };
 
+/**
+ * Stamps a reporter's dynamic data and computes the totals the clients display
+ * @param uuid The uuid of the machine the data is from
+ * @param data The dynamic data the reporter sent
+ * @param ping The latency between the reporter and the backend
+ */
+export const computeDynamicData = (uuid: string, data: IDynamicData, ping: number): IComputedDynamicData => ({
+  ...data,
+  ping,
+  uuid,
+  timestamp: Date.now(),
+  // Computed values
+  cau: ~~(data.cpu.usage.reduce((a, b) => a + b, 0) / data.cpu.usage.length),
+  cas: ~~(data.cpu.freq.reduce((a, b) => a + b, 0) / data.cpu.usage.length),
+  td: data.network.reduce((a, b) => (!isVirtualInterface(b) ? a + b.rx : a), 0) / 1000 / 1000,
+  tu: data.network.reduce((a, b) => (!isVirtualInterface(b) ? a + b.tx : a), 0) / 1000 / 1000,
+  tvd: data.network.reduce((a, b) => (isVirtualInterface(b) ? a + b.rx : a), 0) / 1000 / 1000,
+  tvu: data.network.reduce((a, b) => (isVirtualInterface(b) ? a + b.tx : a), 0) / 1000 / 1000,
+});
+
+/**
+ * Escapes every character that has a meaning in a regex so user input can be matched literally
+ * @tested
+ */
+export const escapeRegex = (input: string) => input.replace(/[.*+?^${}()|[\]\\]/g, "\\$&");
+
+/**
+ * What an email is stored and looked up as, nobody means a different inbox by changing the case
+ * @tested
+ */
+export const normalizeEmail = (email: string) => email.trim().toLowerCase();
+
+/**
+ * What a username is unique and looked up by, the username itself keeps the case the user picked to show
+ * @tested
+ */
+export const normalizeUsername = (username: string) => username.trim().toLowerCase();
+
 export const randomHexColor = () => {
   let color = "#";
   for (let i = 0; i < 3; i++) {
@@ -59,3 +146,249 @@ export const randomHexColor = () => {
   }
   return color;
 };
+
+export interface Pagination {
+  limit: number;
+  skip: number;
+  page: number;
+  sort?: { [field: string]: 1 | -1 };
+  after?: string; // The uuid of the last document of the previous page, empty for the first page
+}
+
+const UUID = /^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$/i;
+
+/**
+ * Parses the ?page=, ?limit=, ?skip=, ?sort=, ?order= and ?after= query params of a paginated route,
+ * ?page= takes precedence over ?skip= when both are provided and ?after= takes precedence over both
+ * since cursor pages are found by the cursor instead of being counted from the start
+ * @param query The query of the request
+ * @param sortable The fields that are allowed to be sorted by
+ * @returns the parsed values or an error code if they're invalid
+ */
+export const parsePagination = (
+  query: { [key: string]: unknown },
+  sortable: string[] = []
+): { pagination?: Pagination; error?: string } => {
+  const parse = (value: unknown, fallback: number) => {
+    if (value === undefined || value === "") return fallback;
+    if (typeof value !== "string" || !/^\d+$/.test(value)) return NaN;
+    return parseInt(value);
+  };
+
+  const limit = parse(query.limit, DEFAULT_PAGE_LIMIT);
+  if (isNaN(limit) || limit < 1 || limit > MAX_PAGE_LIMIT) return { error: "invalid.limit" };
+
+  const page = parse(query.page, 0);
+  if (isNaN(page) || (query.page !== undefined && page < 1)) return { error: "invalid.page" };
+
+  let skip = parse(query.skip, 0);
+  if (isNaN(skip)) return { error: "invalid.skip" };
+  if (page) skip = (page - 1) * limit;
+
+  const pagination: Pagination = { limit, skip, page: Math.floor(skip / limit) + 1 };
+
+  if (query.sort !== undefined) {
+    if (typeof query.sort !== "string" || !sortable.includes(query.sort)) return { error: "invalid.sort" };
+    if (query.order !== undefined && query.order !== "asc" && query.order !== "desc") return { error: "invalid.order" };
+    pagination.sort = { [query.sort]: query.order === "desc" ? -1 : 1 };
+  }
+
+  if (query.after !== undefined) {
+    if (typeof query.after !== "string" || (query.after && !UUID.test(query.after))) return { error: "invalid.cursor" };
+    // Cursor pages always go in insertion order
+    if (pagination.sort) return { error: "invalid.sort" };
+    pagination.after = query.after;
+    pagination.skip = 0;
+    pagination.page = 1;
+  }
+
+  return { pagination };
+};
+
+/**
+ * Parses the ?fields= query param of a route that can respond with only some of the fields of what it sends,
+ * like ?fields=uuid,username,avatar
+ * @param value The ?fields= of the request
+ * @param selectable The fields that can be asked for, protected fields are never in these
+ * @returns the fields, undefined when every field should be sent, or the fields that can't be asked for
+ * @tested
+ */
+export const parseFields = (value: unknown, selectable: readonly string[]): { fields?: string[]; invalid?: string[] } => {
+  if (value === undefined) return {};
+  if (typeof value !== "string") return { invalid: [] };
+  const fields = [...new Set(value.split(",").map((field) => field.trim()))].filter(Boolean);
+  const invalid = fields.filter((field) => !selectable.includes(field));
+  return invalid.length || !fields.length ? { invalid } : { fields };
+};
+
+/**
+ * Copies only the fields of an object that were asked for
+ * @param object What would be sent
+ * @param fields The fields to keep, everything is kept when undefined
+ * @tested
+ */
+export const pickFields = <T extends object>(object: T, fields?: string[]): Partial<T> => {
+  if (!fields) return object;
+  const picked: Partial<T> = {};
+  for (const field of fields) if (field in object) picked[field as keyof T] = object[field as keyof T];
+  return picked;
+};
+
+export interface StatsRange {
+  from: number;
+  to: number;
+  resolution: number;
+}
+
+const RFC3339 = /^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})$/i;
+const DURATION_UNITS: { [unit: string]: number } = { ms: 1, s: Time.Second, m: Time.Minute, h: Time.Hour, d: Time.Day };
+
+/**
+ * Parses a duration like 250ms, 30s, 5m, 1h or 1d
+ * @returns the duration in milliseconds or NaN if it's invalid
+ * @tested
+ */
+export const parseDuration = (duration: string) => {
+  const match = /^(\d+)(ms|s|m|h|d)$/.exec(duration);
+  return match ? parseInt(match[1]) * DURATION_UNITS[match[2]] : NaN;
+};
+
+// Missing params are the fallback, anything that isn't RFC3339 is NaN
+const parseTime = (value: unknown, fallback: number) => {
+  if (value === undefined || value === "") return fallback;
+  return typeof value === "string" && RFC3339.test(value) ? Date.parse(value) : NaN;
+};
+
+/**
+ * Parses the ?from=, ?to= and ?resolution= query params of a stats history route,
+ * ?to= defaults to now, ?from= to an hour before it and ?resolution= (or ?interval=) to a minute
+ * @param query The query of the request
+ * @param now The time to default ?to= to
+ * @returns the parsed range or an error code if it's invalid
+ * @tested
+ */
+export const parseStatsRange = (
+  query: { [key: string]: unknown },
+  now = Date.now()
+): { range?: StatsRange; error?: string } => {
+  const to = parseTime(query.to, now);
+  if (isNaN(to)) return { error: "invalid.to" };
+  const from = parseTime(query.from, to - Time.Hour);
+  if (isNaN(from)) return { error: "invalid.from" };
+  if (from >= to || to - from > MAX_STATS_RANGE) return { error: "invalid.range" };
+
+  const value = query.resolution ?? query.interval;
+  const resolution = value === undefined ? Time.Minute : parseDuration(`${value}`);
+  if (isNaN(resolution) || resolution < Time.Second) return { error: "invalid.resolution" };
+  // Otherwise a month at 1s would be millions of buckets
+  if ((to - from) / resolution > MAX_STATS_POINTS) return { error: "invalid.resolution" };
+
+  return { range: { from, to, resolution } };
+};
+
+/**
+ * Parses the ?from= and ?to= query params of an export, it's everything up to now by default
+ * and unlike the history the range can be as long as the stats are kept
+ * @param query The query of the request
+ * @param now The time to default ?to= to
+ * @returns the parsed range or an error code if it's invalid
+ * @tested
+ */
+export const parseExportRange = (
+  query: { [key: string]: unknown },
+  now = Date.now()
+): { range?: Pick<StatsRange, "from" | "to">; error?: string } => {
+  const to = parseTime(query.to, now);
+  if (isNaN(to)) return { error: "invalid.to" };
+  const from = parseTime(query.from, 0);
+  if (isNaN(from)) return { error: "invalid.from" };
+  if (from >= to) return { error: "invalid.range" };
+  return { range: { from, to } };
+};
+
+/**
+ * Parses the ?from=, ?to= and ?type= query params of an audit log, the ones that aren't set don't narrow it down
+ * @param query The query of the request
+ * @param actions The types that can be asked for, passed in since the schemas import this file
+ * @returns the parsed query or an error code if it's invalid
+ * @tested
+ */
+export const parseAuditLogQuery = (
+  query: { [key: string]: unknown },
+  actions: readonly AuditAction[]
+): { audit?: AuditLogQuery; error?: string } => {
+  const audit: AuditLogQuery = {};
+  if (query.from !== undefined) {
+    audit.from = parseTime(query.from, NaN);
+    if (isNaN(audit.from)) return { error: "invalid.from" };
+  }
+  if (query.to !== undefined) {
+    audit.to = parseTime(query.to, NaN);
+    if (isNaN(audit.to)) return { error: "invalid.to" };
+  }
+  if (audit.from !== undefined && audit.to !== undefined && audit.from > audit.to) return { error: "invalid.range" };
+  if (query.type !== undefined) {
+    if (!actions.includes(query.type as AuditAction)) return { error: "invalid.type" };
+    audit.action = query.type as AuditAction;
+  }
+  return { audit };
+};
+
+/**
+ * Turns documents into newline delimited JSON in chunks of many lines so they're not written one at a time
+ * @param documents What to write, read as it's iterated
+ * @param limit How many are written at most
+ * @param written Counts how many were written and whether some were left out for going over the limit
+ * @tested
+ */
+export async function* ndjson(
+  documents: AsyncIterable<object>,
+  limit: number,
+  written = { count: 0, truncated: false }
+): AsyncGenerator<string> {
+  let chunk = "";
+  for await (const document of documents) {
+    if (written.count === limit) {
+      written.truncated = true;
+      break;
+    }
+    written.count++;
+    chunk += `${JSON.stringify(document)}\n`;
+    if (chunk.length < NDJSON_CHUNK_SIZE) continue;
+    yield chunk;
+    chunk = "";
+  }
+  if (chunk) yield chunk;
+}
+
+/**
+ * Computes how long a machine was up from when its reporter was connected, connections can overlap
+ * when a reporter reconnects to another shard before the old one noticed it was gone
+ * @param connections When the reporter connected and disconnected, the ones still connected don't have an end
+ * @param from Where the range starts
+ * @param to Where the range ends
+ * @param mergeGap Downtime shorter than this is the reporter reconnecting and doesn't count
+ * @returns the uptime percentage, null for an empty range, and the windows the machine was down in order
+ * @tested
+ */
+export const computeUptime = (
+  connections: { connected_at: number; disconnected_at?: number }[],
+  from: number,
+  to: number,
+  mergeGap: number
+): { uptime: number | null; downtime: DowntimeWindow[] } => {
+  const gaps: DowntimeWindow[] = [];
+  // Everything before the cursor is known to be either up or down
+  let cursor = from;
+  for (const { connected_at, disconnected_at = to } of [...connections].sort((a, b) => a.connected_at - b.connected_at)) {
+    if (cursor >= to) break;
+    if (connected_at > cursor) gaps.push({ from: cursor, to: Math.min(connected_at, to) });
+    cursor = Math.max(cursor, disconnected_at);
+  }
+  if (cursor < to) gaps.push({ from: cursor, to });
+
+  const downtime = gaps.filter((gap) => gap.to - gap.from >= mergeGap);
+  if (to <= from) return { uptime: null, downtime };
+  const down = downtime.reduce((total, gap) => total + gap.to - gap.from, 0);
+  return { uptime: Math.round(((to - from - down) / (to - from)) * 10000) / 100, downtime };
+};
@@ -1,9 +1,11 @@
 import { Response, NextFunction } from "express";
 import { LoggedInRequest } from "../database/schemas/user";
+import { get_user } from "./auth";
+import { ErrorCode, sendError } from "../utils/errors";
 
 /**
- * The middleware that checks if the user is logged in
+ * The middleware that checks if the user is an admin, has to come after the auth middleware
  */
 export const adminMiddleware = async (req: LoggedInRequest, res: Response, next: NextFunction) => {
-  req.user!.is_admin ? next() : res.status(403).send({ message: "you do not have permission to access this route" });
+  get_user(req).is_admin ? next() : sendError(res, 403, ErrorCode.Forbidden);
 };
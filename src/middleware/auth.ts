@@ -1,27 +1,75 @@
 import { Response, NextFunction } from "express";
-import jwt from "jsonwebtoken";
+import jwt, { TokenExpiredError } from "jsonwebtoken";
 import { DatabaseManager } from "../database/DatabaseManager";
-import { IUser, LoggedInRequest } from "../database/schemas/user";
+import { API_TOKEN_PREFIX } from "../database/schemas/apiToken";
+import { IUser, LoggedInRequest, UserTokenPayload } from "../database/schemas/user";
+import { ErrorCode, nullIfNotFound, sendError } from "../utils/errors";
+import type { ApiTokenScope } from "../validators";
 
 /**
  * The middleware that checks if the user is logged in
+ * @param db The database to look the user up in
+ * @param secret The secret the tokens are signed with
+ * @param scope What an API token needs to be allowed to use the route, API tokens are turned away without one
+ * @tested
  */
-export const init_auth = (db: DatabaseManager) => {
-  return async (req: LoggedInRequest, res: Response, next: NextFunction) => {
-    if (req.headers.authorization) {
-      try {
-        const { uuid, username, password } = jwt.verify(
-          req.headers.authorization.replace("Bearer ", "").trim(),
-          process.env.JWT_SECRET!
-        ) as IUser;
-        const user = await db.users.findOne({ uuid, username, password });
-        if (!user) return res.status(403).json({ message: "user not found" });
-        req.user = user;
-        return next();
-      } catch (error) {
-        return res.status(403).json({ message: "invalid authentication token" });
-      }
+export const init_auth = (db: DatabaseManager, secret: string, scope?: ApiTokenScope) => {
+  // API tokens act as their user without a password so the account being disabled has to stop them too
+  const api_token = async (req: LoggedInRequest, res: Response, next: NextFunction, value: string) => {
+    if (!scope) return sendError(res, 403, ErrorCode.TokenScope);
+    const token = await db.find_api_token(value).catch(nullIfNotFound(ErrorCode.ApiTokenNotFound));
+    if (!token) return sendError(res, 401, ErrorCode.TokenInvalid);
+    if (!token.scopes.includes(scope)) return sendError(res, 403, ErrorCode.TokenScope, `this API token needs ${scope}`);
+    const user = await db.users.findOne(DatabaseManager.not_deleted<IUser>({ uuid: token.user_uuid }));
+    if (!user) return sendError(res, 401, ErrorCode.UserNotFound);
+    if (user.disabled_at) return sendError(res, 403, ErrorCode.AccountDisabled);
+    db.touch_api_token(token);
+    req.user = user;
+    req.api_token = token;
+    return next();
+  };
+
+  const authenticate = async (req: LoggedInRequest, res: Response, next: NextFunction) => {
+    const header = req.headers.authorization;
+    if (!header) return sendError(res, 401, ErrorCode.AuthRequired);
+    if (!header.startsWith("Bearer ")) return sendError(res, 401, ErrorCode.AuthMalformed);
+    const token = header.replace("Bearer ", "").trim();
+    if (token.startsWith(API_TOKEN_PREFIX)) return api_token(req, res, next, token);
+
+    let payload: UserTokenPayload;
+    try {
+      payload = jwt.verify(token, secret, { algorithms: ["HS256"] }) as UserTokenPayload;
+    } catch (error) {
+      if (error instanceof TokenExpiredError) return sendError(res, 401, ErrorCode.TokenExpired);
+      return sendError(res, 401, ErrorCode.TokenInvalid);
     }
-    return res.status(403).json({ message: "authorization header not set" });
+
+    const user = await db.users.findOne(DatabaseManager.not_deleted<IUser>({ uuid: payload.uuid }));
+    if (!user) return sendError(res, 401, ErrorCode.UserNotFound);
+    // The password was changed since the token was signed
+    if (!user.is_token_current(payload)) return sendError(res, 401, ErrorCode.TokenRevoked);
+    req.user = user;
+    return next();
   };
+  // The database failing goes to the error handler instead of being answered like a wrong token
+  const middleware = (req: LoggedInRequest, res: Response, next: NextFunction) => authenticate(req, res, next).catch(next);
+  // Exposed so the OpenAPI spec can tell which routes need a user token and which ones API tokens can use
+  return Object.assign(middleware, { security: "user", scope });
+};
+
+/**
+ * Gets the user the auth middleware attached to the request
+ * @throws if the route isn't behind the auth middleware
+ */
+export const get_user = (req: LoggedInRequest): IUser => {
+  if (!req.user) throw new Error("get_user() called on a route without the auth middleware");
+  return req.user;
+};
+
+/**
+ * The middleware that only lets users who verified their email through, has to come after the auth middleware,
+ * unverified users can still do everything else so they can log in and ask for another email
+ */
+export const verifiedMiddleware = (req: LoggedInRequest, res: Response, next: NextFunction) => {
+  get_user(req).email_verified ? next() : sendError(res, 403, ErrorCode.EmailNotVerified);
 };
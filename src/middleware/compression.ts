@@ -0,0 +1,16 @@
+import compression from "compression";
+import { Request, Response, NextFunction } from "express";
+
+// Responses smaller than this barely shrink so they're not worth the CPU
+export const COMPRESSION_THRESHOLD = 1024;
+
+/**
+ * The middleware that compresses responses with whatever the Accept-Encoding of the client allows,
+ * websocket upgrades never reach express so they're not affected
+ * @param enabled Whether to compress at all, it's turned off when a proxy in front already does it
+ * @tested
+ */
+export const init_compression = (enabled: boolean) =>
+  enabled
+    ? compression({ threshold: COMPRESSION_THRESHOLD })
+    : (req: Request, res: Response, next: NextFunction) => next();
@@ -0,0 +1,25 @@
+import { Request, Response, NextFunction } from "express";
+
+/**
+ * The middleware that gives every request an AbortSignal, it aborts when the client disconnects before
+ * the response was sent or when the server gives up on in-flight requests while shutting down
+ * @param shutdown The signal that aborts when the server is shutting down
+ */
+export const init_context = (shutdown: AbortSignal) => {
+  return (req: Request, res: Response, next: NextFunction) => {
+    const controller = new AbortController();
+    const abort = () => controller.abort();
+    shutdown.addEventListener("abort", abort, { once: true });
+    res.once("close", () => {
+      shutdown.removeEventListener("abort", abort);
+      if (!res.writableFinished) abort();
+    });
+    res.locals.signal = controller.signal;
+    return next();
+  };
+};
+
+/**
+ * Gets the signal the context middleware attached to the response
+ */
+export const get_signal = (res: Response): AbortSignal | undefined => res.locals.signal;
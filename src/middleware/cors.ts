@@ -1,19 +1,54 @@
-import express, { NextFunction } from "express";
+import { Request, Response, NextFunction } from "express";
+import { Time } from "../types";
+import { ErrorCode, sendError } from "../utils/errors";
 
-export default async function (req: express.Request, res: express.Response, next: NextFunction) {
-  // Website you wish to allow to connect
-  res.setHeader("Access-Control-Allow-Origin", "*");
+const ALLOWED_METHODS = "GET, POST, OPTIONS, PUT, PATCH, DELETE";
+const ALLOWED_HEADERS = "X-Requested-With, Content-Type, Authorization, X-Machine-Token, X-Request-ID";
+// The frontend shows the request id in its error reports
+const EXPOSED_HEADERS = "X-Request-ID";
+// How long browsers can cache a preflight for, in seconds
+const PREFLIGHT_MAX_AGE = Time.Day / Time.Second;
 
-  // Request methods you wish to allow
-  res.setHeader("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE");
+/**
+ * Parses the comma separated list of allowed origins, development allows any origin when none are set
+ * while production doesn't allow any so a missing CORS_ORIGINS can't open the API up to every website
+ * @param value The comma separated origins like "https://xornet.cloud,https://dev.xornet.cloud"
+ * @param production Whether the backend is running in production
+ * @tested
+ */
+export const parse_cors_origins = (value = "", production = false) => {
+  const origins = value
+    .split(",")
+    .map((origin) => origin.trim().replace(/\/$/, ""))
+    .filter(Boolean);
+  return origins.length || production ? origins : ["*"];
+};
 
-  // Request headers you wish to allow
-  res.setHeader("Access-Control-Allow-Headers", "X-Requested-With,content-type,Authorization");
+/**
+ * The middleware that lets browsers on the allowed origins call the API, credentials are allowed
+ * so the origin of the request is echoed back instead of "*" which browsers reject along with credentials,
+ * preflights from other origins are rejected so the frontend gets a reason instead of a bare CORS failure
+ * @param origins The allowed origins, "*" allows all of them
+ * @tested
+ */
+export const init_cors = (origins: string[]) => {
+  const any = origins.includes("*");
+  return (req: Request, res: Response, next: NextFunction) => {
+    const origin = req.headers.origin;
+    const allowed = !!origin && (any || origins.includes(origin));
+    res.vary("Origin");
+    if (allowed) {
+      res.setHeader("Access-Control-Allow-Origin", origin!);
+      res.setHeader("Access-Control-Allow-Credentials", "true");
+      res.setHeader("Access-Control-Expose-Headers", EXPOSED_HEADERS);
+    }
 
-  // Set to true if you need the website to include cookies in the requests sent
-  // to the API (e.g. in case you use sessions)
-  res.setHeader("Access-Control-Allow-Credentials", "true");
-
-  // Pass to next layer of middleware
-  next();
-}
+    // Preflights are answered here for every route since no route handles OPTIONS
+    if (req.method !== "OPTIONS") return next();
+    if (origin && !allowed) return sendError(res, 403, ErrorCode.OriginForbidden);
+    res.setHeader("Access-Control-Allow-Methods", ALLOWED_METHODS);
+    res.setHeader("Access-Control-Allow-Headers", ALLOWED_HEADERS);
+    res.setHeader("Access-Control-Max-Age", PREFLIGHT_MAX_AGE);
+    res.status(204).end();
+  };
+};
@@ -0,0 +1,15 @@
+import { Request, Response, NextFunction } from "express";
+
+/**
+ * The middleware that marks responses as coming from a route that moved, clients can log the header to find
+ * what they still have to move and the Link tells them where the route is now
+ * @param prefix What the route moved under like /v1
+ * @tested
+ */
+export const init_deprecation = (prefix: string) => {
+  return (req: Request, res: Response, next: NextFunction) => {
+    res.setHeader("Deprecation", "true");
+    res.setHeader("Link", `<${prefix}${req.originalUrl}>; rel="successor-version"`);
+    next();
+  };
+};
@@ -0,0 +1,36 @@
+import crypto from "crypto";
+import { Request, Response } from "express";
+
+/**
+ * What a versioned ETag is made of, every write stamps updated_at so it changes with the document
+ */
+export interface Versioned {
+  uuid: string;
+  updated_at?: number;
+}
+
+/**
+ * The ETag of a response made of documents, built from when they were last updated instead of hashing the body
+ * @param documents The documents the response is made of, in the order they're sent
+ * @param extra Anything else the response depends on that isn't stored, like whether a machine is online
+ * @tested
+ */
+export const versioned_etag = (documents: Versioned[], extra: string[] = []) => {
+  const versions = documents.map((document) => `${document.uuid}:${document.updated_at ?? 0}`).concat(extra);
+  return `"${crypto.createHash("sha1").update(versions.join(",")).digest("hex")}"`;
+};
+
+/**
+ * Responds with 304 and no body when the If-None-Match of the request is the ETag, the body is only
+ * serialized when the client doesn't have it yet
+ * @param etag The ETag of what would be sent
+ * @param body Makes what's sent when the client's copy is stale
+ * @tested
+ */
+export const send_versioned = (req: Request, res: Response, etag: string, body: () => unknown) => {
+  res.setHeader("ETag", etag);
+  // Browsers keep the response but have to check it's still the same every time they use it
+  res.setHeader("Cache-Control", "private, no-cache");
+  if (req.fresh) return res.status(304).end();
+  return res.send(body());
+};
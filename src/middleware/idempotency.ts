@@ -0,0 +1,66 @@
+import crypto from "crypto";
+import { NextFunction, Response } from "express";
+import type { DatabaseManager } from "../database/DatabaseManager";
+import { MAX_IDEMPOTENCY_KEY_LENGTH } from "../database/schemas/idempotencyKey";
+import { LoggedInRequest } from "../database/schemas/user";
+import { ErrorCode, sendError } from "../utils/errors";
+import { get_logger } from "./log";
+
+const hash = (value: string) => crypto.createHash("sha256").update(value).digest("hex");
+
+/**
+ * The middleware that answers a request retried with the same Idempotency-Key header with what the first one
+ * was answered with instead of doing it again, requests without the header go through as they are.
+ * It has to come after the auth middleware on the routes that have it so the keys of different users can't meet
+ * @param db Where the keys and what they were answered with are kept
+ * @tested
+ */
+export const init_idempotency = (db: DatabaseManager) => {
+  const middleware = async (req: LoggedInRequest, res: Response, next: NextFunction) => {
+    const header = req.header("Idempotency-Key");
+    if (header === undefined) return next();
+    if (!header || header.length > MAX_IDEMPOTENCY_KEY_LENGTH) return sendError(res, 400, ErrorCode.InvalidIdempotencyKey);
+
+    // Only kept hashed since the body of a signup has the password in it
+    const key = hash(`${req.user?.uuid ?? ""}:${header}`);
+    const fingerprint = hash(JSON.stringify([req.method, req.route?.path, req.params, req.body]));
+    try {
+      const existing = await db.reserve_idempotency_key(key, fingerprint);
+      if (existing) {
+        if (existing.fingerprint !== fingerprint) return sendError(res, 422, ErrorCode.IdempotencyKeyReused);
+        if (existing.status === undefined) return sendError(res, 409, ErrorCode.IdempotencyKeyPending);
+        return res.status(existing.status).setHeader("Idempotent-Replayed", "true").type("json").send(existing.body);
+      }
+    } catch (error) {
+      return next(error);
+    }
+
+    const release = () =>
+      db.release_idempotency_key(key).catch((error) => get_logger(res).error("Failed to release an idempotency key", error));
+    let answered = false;
+    const json = res.json.bind(res);
+    res.json = (value: unknown) => {
+      answered = true;
+      // Answers that aren't the client's fault are left for the retry to try again
+      if (res.statusCode >= 500) {
+        release().then(() => json(value));
+        return res;
+      }
+      const body = JSON.stringify(value);
+      // Kept before it's sent so a retry that comes as soon as it's received already gets it
+      db.complete_idempotency_key(key, res.statusCode, body).then(
+        () => res.type("json").send(body),
+        (error) => {
+          get_logger(res).error("Failed to keep an idempotent response", error);
+          release().then(() => res.type("json").send(body));
+        }
+      );
+      return res;
+    };
+    // Anything that isn't answered with JSON like a dropped connection can be retried
+    res.once("close", () => answered || release());
+    next();
+  };
+  // Marked so the OpenAPI spec has the header on the routes that take it
+  return Object.assign(middleware, { idempotent: true });
+};
@@ -1,16 +1,64 @@
-import chalk from "chalk";
-import express, { NextFunction } from "express";
-import { Logger } from "../utils/logger";
+import { Request, Response, NextFunction } from "express";
+import { v4 as uuidv4 } from "uuid";
+import type { LoggedInRequest } from "../database/schemas/user";
+import { Logger, LogLevel, ScopedLogger } from "../utils/logger";
 
-export default async function (req: express.Request, res: express.Response, next: NextFunction) {
-  const startedAt = process.hrtime();
-  next();
-  const elapsed = process.hrtime(startedAt);
-  const ms = elapsed[0] * 1e3 + elapsed[1] * 1e-6;
+// Ids from the proxies in front of us are kept as long as they can't mess up the logs
+const REQUEST_ID = /^[\w.:-]{1,128}$/;
 
-  Logger.info(
-    `${req.method} ${req.originalUrl || req.url} ${ms.toFixed(2)}ms ${chalk.gray(
-      `-- ${req.headers["cf-connecting-ip"] || "0.0.0.0"}`
-    )}`
-  );
-}
+/**
+ * The route a request matched like /users/:uuid so requests to the same route can be grouped
+ */
+const route_template = (req: Request) => {
+  if (!req.route) return;
+  const paths: string[] = [].concat(req.route.path);
+  return paths.map((path) => `${req.baseUrl}${path}`).join("|");
+};
+
+const content_length = (value: unknown) => (value === undefined ? undefined : parseInt(String(value)) || 0);
+
+/**
+ * The middleware that gives every request an id and logs it as JSON once the response is done,
+ * an X-Request-ID from a proxy in front of us is reused so its logs line up with ours
+ * @param logger The logger the request scoped loggers are made from
+ * @tested
+ */
+export const init_request_log = (logger: ScopedLogger = Logger) => {
+  return (req: LoggedInRequest, res: Response, next: NextFunction) => {
+    const header = req.headers["x-request-id"];
+    const request_id = typeof header === "string" && REQUEST_ID.test(header) ? header : uuidv4();
+    res.locals.request_id = request_id;
+    res.locals.logger = logger.scoped({ request_id });
+    res.setHeader("X-Request-ID", request_id);
+
+    const startedAt = process.hrtime();
+    res.once("close", () => {
+      const [seconds, nanoseconds] = process.hrtime(startedAt);
+      // 499 is what nginx logs when the client hung up before getting a response
+      const status = res.writableFinished ? res.statusCode : 499;
+      const level: LogLevel = status >= 500 ? "error" : status >= 400 ? "warn" : "info";
+      get_logger(res).structured(level, "request", {
+        method: req.method,
+        // The query is left out since it can contain tokens
+        path: (req.originalUrl || req.url).split("?")[0],
+        route: route_template(req),
+        status,
+        latency_ms: Math.round((seconds * 1e3 + nanoseconds * 1e-6) * 100) / 100,
+        user_uuid: req.user?.uuid,
+        bytes_in: content_length(req.headers["content-length"]),
+        bytes_out: content_length(res.getHeader("content-length")),
+      });
+    });
+    next();
+  };
+};
+
+/**
+ * Gets the id the log middleware gave the request so the errors logged for it can be found with it
+ */
+export const get_request_id = (res: Response): string | undefined => res.locals.request_id;
+
+/**
+ * Gets the logger that adds the id of the request to every log, falls back to the plain one outside of requests
+ */
+export const get_logger = (res: Response): ScopedLogger => res.locals.logger ?? Logger;
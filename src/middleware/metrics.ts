@@ -0,0 +1,50 @@
+import crypto from "crypto";
+import express, { NextFunction } from "express";
+import { ErrorCode, sendError } from "../utils/errors";
+import { metrics } from "../utils/metrics";
+
+const LABELS = ["method", "route", "status"];
+const requests = metrics.counter("xornet_http_requests_total", "How many requests were handled", LABELS);
+const duration = metrics.histogram("xornet_http_request_duration_seconds", "How long requests took", LABELS);
+
+/**
+ * Gets the template of the route that handled a request like /users/:uuid,
+ * labeling with the actual path would create a series for every uuid
+ */
+export const routeTemplate = (req: express.Request) => {
+  if (!req.route) return "unmatched";
+  const path = Array.isArray(req.route.path) ? req.route.path[0] : req.route.path;
+  return `${req.baseUrl}${path}`;
+};
+
+export default function (req: express.Request, res: express.Response, next: NextFunction) {
+  const startedAt = process.hrtime();
+  res.once("finish", () => {
+    const [seconds, nanoseconds] = process.hrtime(startedAt);
+    const labels = { method: req.method, route: routeTemplate(req), status: res.statusCode };
+    requests.inc(labels);
+    duration.observe(labels, seconds + nanoseconds / 1e9);
+  });
+  next();
+}
+
+/**
+ * The middleware that keeps /metrics from being scraped by anyone, the scraper has to send the token
+ * as a bearer token, when no token is set the metrics are public
+ * @param token The token the scraper authenticates with
+ * @tested
+ */
+export const init_metrics_auth = (token?: string) => {
+  const expected = token && crypto.createHash("sha256").update(token).digest();
+  const middleware = (req: express.Request, res: express.Response, next: NextFunction) => {
+    if (!expected) return next();
+    const header = req.headers.authorization;
+    if (!header) return sendError(res, 401, ErrorCode.AuthRequired);
+    if (!header.startsWith("Bearer ")) return sendError(res, 401, ErrorCode.AuthMalformed);
+    // Comparing hashes keeps the lengths equal so timingSafeEqual doesn't throw
+    const actual = crypto.createHash("sha256").update(header.replace("Bearer ", "").trim()).digest();
+    if (!crypto.timingSafeEqual(actual, expected)) return sendError(res, 401, ErrorCode.TokenInvalid);
+    next();
+  };
+  return Object.assign(middleware, { security: "metrics" });
+};
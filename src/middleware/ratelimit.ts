@@ -0,0 +1,62 @@
+import { Request, Response, NextFunction } from "express";
+import { IncomingMessage } from "http";
+import { RateLimiter, RateLimitStore } from "../classes/rateLimiter.class";
+import { LoggedInRequest } from "../database/schemas/user";
+import { Time } from "../types";
+import { ErrorCode, sendError } from "../utils/errors";
+
+// How many proxies sit in front of us unless TRUSTED_PROXY_HOPS is set,
+// each of them appends the address it got the request from to X-Forwarded-For
+export const TRUSTED_PROXY_HOPS = 1;
+// What client_ip() goes by, the backend sets it from the config
+export const proxy_hops = { trusted: TRUSTED_PROXY_HOPS };
+
+/**
+ * Gets the IP of the client behind our proxies, only the entries of X-Forwarded-For that our own proxies
+ * appended are trusted since the client can put anything it wants in front of them
+ * @tested
+ */
+export const client_ip = (req: IncomingMessage, hops = proxy_hops.trusted) => {
+  const fly = req.headers["fly-client-ip"];
+  if (typeof fly === "string" && fly) return fly;
+
+  const forwarded = req.headers["x-forwarded-for"];
+  if (forwarded && hops > 0) {
+    const addresses = (Array.isArray(forwarded) ? forwarded.join(",") : forwarded).split(",").map((ip) => ip.trim());
+    return addresses[Math.max(0, addresses.length - hops)];
+  }
+
+  return (req.headers["cf-connecting-ip"] as string | undefined) || req.socket.remoteAddress || "unknown";
+};
+
+/**
+ * The middleware that limits how often a client can hit a route, logged in users are limited by their uuid
+ * and everyone else by their IP so users behind the same NAT don't share a limit
+ * @param limit How many requests a client can make in a window
+ * @param window How long the window is in milliseconds
+ * @param store Where the counters are kept, defaults to memory
+ * @param key Who a request counts against, defaults to the user or the IP
+ */
+export const init_rate_limit = (
+  limit: number,
+  window: number = Time.Minute,
+  store?: RateLimitStore,
+  key: (req: LoggedInRequest) => string = (req) => (req.user ? `user:${req.user.uuid}` : `ip:${client_ip(req)}`)
+) => {
+  const limiter = new RateLimiter(limit, window, store);
+  const middleware = (req: LoggedInRequest, res: Response, next: NextFunction) => {
+    limiter
+      .consume(key(req))
+      .then(({ allowed, remaining, reset, retryAfter }) => {
+        res.setHeader("X-RateLimit-Limit", limit);
+        res.setHeader("X-RateLimit-Remaining", remaining);
+        res.setHeader("X-RateLimit-Reset", Math.ceil(reset / Time.Second));
+        if (allowed) return next();
+        res.setHeader("Retry-After", Math.ceil(retryAfter / Time.Second));
+        sendError(res, 429, ErrorCode.RateLimited);
+      })
+      .catch(next);
+  };
+  // Exposed so tests can reset keys
+  return Object.assign(middleware, { limiter });
+};
@@ -0,0 +1,21 @@
+import { Request, Response, NextFunction } from "express";
+import { Time } from "../types";
+
+// How long browsers stick to https after seeing the header once, in seconds
+const HSTS_MAX_AGE = (365 * Time.Day) / Time.Second;
+
+/**
+ * The middleware that sets the standard security headers on every response, HSTS is only sent in production
+ * since development is served over plain http and browsers would refuse to load it afterwards
+ * @param hsts Whether to send Strict-Transport-Security
+ * @tested
+ */
+export const init_security_headers = (hsts: boolean) => {
+  return (req: Request, res: Response, next: NextFunction) => {
+    hsts && res.setHeader("Strict-Transport-Security", `max-age=${HSTS_MAX_AGE}; includeSubDomains`);
+    res.setHeader("X-Content-Type-Options", "nosniff");
+    res.setHeader("X-Frame-Options", "DENY");
+    res.setHeader("Referrer-Policy", "no-referrer");
+    next();
+  };
+};
@@ -0,0 +1,33 @@
+import { Request, Response, NextFunction } from "express";
+import { ErrorCode, sendError } from "../utils/errors";
+import { get_signal } from "./context";
+
+/**
+ * The middleware that gives up on a request that wasn't answered in time, it's answered with a 504 and its signal
+ * aborts so the queries it's waiting on are given up on too. Responses that already started like streams are left
+ * alone since they're meant to last. It has to come after the context middleware since it replaces its signal,
+ * routes that should give up sooner can have one of their own
+ * @param timeout How long a request has to be answered in
+ * @tested
+ */
+export const init_timeout = (timeout: number) => {
+  return (req: Request, res: Response, next: NextFunction) => {
+    const controller = new AbortController();
+    const abort = () => controller.abort();
+    const parent = get_signal(res);
+    parent?.aborted ? abort() : parent?.addEventListener("abort", abort, { once: true });
+    const timer = setTimeout(() => {
+      if (res.headersSent) return;
+      // The handler fails once its signal aborts, the error handler leaves the response to this
+      res.locals.timed_out = true;
+      sendError(res, 504, ErrorCode.RequestTimeout);
+      abort();
+    }, timeout);
+    res.once("close", () => {
+      clearTimeout(timer);
+      parent?.removeEventListener("abort", abort);
+    });
+    res.locals.signal = controller.signal;
+    return next();
+  };
+};
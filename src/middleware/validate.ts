@@ -0,0 +1,52 @@
+import express, { Request, Response, NextFunction } from "express";
+import Joi from "joi";
+import { ErrorCode, sendError } from "../utils/errors";
+import { Validators } from "../validators";
+
+/**
+ * The maximum size of a JSON body in bytes unless JSON_BODY_LIMIT is set, uploads have their own limit
+ */
+export const JSON_BODY_LIMIT = 1024 * 1024;
+
+/**
+ * The middleware that parses JSON bodies, malformed and oversized ones are turned into
+ * 400 and 413 envelopes by the error handler
+ * @param limit The maximum size of a body in bytes
+ * @tested
+ */
+export const init_json_body = (limit = JSON_BODY_LIMIT) => express.json({ limit });
+
+/**
+ * The middleware that validates the body against a schema and replaces it with the validated value,
+ * responds with the reason each field failed otherwise, a missing body is validated as an empty object
+ * @param schema The schema the body has to match
+ * @param code What the envelope says failed, for the bodies clients already switch on a code of their own for
+ * @tested
+ */
+export const validate_body = (schema: Joi.ObjectSchema, code: ErrorCode = ErrorCode.InvalidBody) => {
+  const middleware = (req: Request, res: Response, next: NextFunction) => {
+    const { value, fields } = Validators.validate_body(schema, req.body);
+    if (fields) return sendError(res, 400, code, "some fields are invalid", { fields });
+    req.body = value;
+    return next();
+  };
+  // Exposed so the OpenAPI spec can describe the body
+  return Object.assign(middleware, { body: schema });
+};
+
+/**
+ * The middleware that validates the query against a schema and replaces it with the validated value,
+ * like validate_body but for the links people open from their emails
+ * @param schema The schema the query has to match
+ * @tested
+ */
+export const validate_query = (schema: Joi.ObjectSchema) => {
+  const middleware = (req: Request, res: Response, next: NextFunction) => {
+    const { value, fields } = Validators.validate_body(schema, req.query);
+    if (fields) return sendError(res, 400, ErrorCode.InvalidQuery, "some query params are invalid", { fields });
+    req.query = value as Request["query"];
+    return next();
+  };
+  // Exposed so the OpenAPI spec can describe the query params
+  return Object.assign(middleware, { query: schema });
+};
@@ -0,0 +1,688 @@
+import { AUDIT_ACTIONS, MAX_EXPORT_AUDIT_ENTRIES } from "../../database/schemas/auditLog";
+import { LABEL_ICONS } from "../../database/schemas/label";
+import { MACHINE_FIELDS } from "../../database/schemas/machine";
+import { MAX_PROCESSES } from "../../database/schemas/machineDetails";
+import { MAX_WEBHOOK_FAILURES, MAX_WEBHOOKS } from "../../database/schemas/webhook";
+import { PRIVATE_USER_FIELDS, PUBLIC_USER_FIELDS } from "../../database/schemas/user";
+import { MAX_EXPORT_POINTS, STAT_FIELDS } from "../../database/schemas/stats";
+import { ALERT_METRICS, ALERT_OPERATORS, ALERT_TARGETS } from "../../utils/alerts";
+import { RouteDocs, Schema } from "../../utils/openapi";
+import {
+  API_TOKEN_SCOPES,
+  MACHINE_ICONS,
+  MAX_COMPARED_MACHINES,
+  PROFILE_VISIBILITIES,
+  WEBHOOK_EVENTS,
+} from "../../validators";
+
+const ref = (name: string): Schema => ({ $ref: `#/components/schemas/${name}` });
+const list = (name: string): Schema => ({ type: "array", items: ref(name) });
+const object = (properties: { [name: string]: Schema }, required?: string[]): Schema => ({
+  type: "object",
+  properties,
+  ...(required && { required }),
+});
+
+const string: Schema = { type: "string" };
+const number: Schema = { type: "number" };
+const integer: Schema = { type: "integer" };
+const uuid: Schema = { type: "string", format: "uuid" };
+const timestamp: Schema = { type: "integer", description: "Milliseconds since the epoch" };
+const url: Schema = { type: "string", format: "uri" };
+const message = ref("Message");
+// The ?fields= of the routes that can send only some fields
+const fields = (selectable: string[]): Schema => ({
+  type: "string",
+  description: `Comma separated fields to send instead of all of them, out of ${selectable.join(", ")}`,
+});
+
+// The created_at and updated_at every document has
+const base = { uuid, created_at: timestamp, updated_at: timestamp };
+
+// The params parsePagination reads
+const pagination = {
+  page: integer,
+  limit: integer,
+  skip: integer,
+  sort: { type: "string", enum: ["created_at", "username"] },
+  order: { type: "string", enum: ["asc", "desc"] },
+};
+
+// The params parseAuditLogQuery reads on top of the page
+const audit_query = {
+  page: integer,
+  limit: integer,
+  skip: integer,
+  from: { ...string, description: "An RFC 3339 date, the oldest entry by default" },
+  to: { ...string, description: "An RFC 3339 date, the newest entry by default" },
+  type: { type: "string", enum: AUDIT_ACTIONS },
+};
+
+const usage = object({ used: number, total: number });
+// What the dashboards show of a group of machines, only the online ones count towards the usage
+const machine_summary = {
+  machines: object({ total: integer, online: integer, offline: integer }),
+  cores: { ...integer, description: "The cores of every machine, online or not" },
+  cpu: { ...number, nullable: true, description: "The average usage of the online machines" },
+  ram: usage,
+  network: object({ download: number, upload: number }),
+};
+const stats_range = { from: timestamp, to: timestamp };
+
+/**
+ * The schemas the docs of the V1 routes refer to
+ */
+export const V1_SCHEMAS: { [name: string]: Schema } = {
+  Message: object({ message: string }, ["message"]),
+  PublicUser: object({
+    ...base,
+    avatar: string,
+    banner: string,
+    username: string,
+    biography: string,
+    location: string,
+    is_admin: { type: "boolean" },
+    deleted_at: timestamp,
+    disabled_at: timestamp,
+    version: integer,
+  }),
+  AdminUserPage: object({ items: list("PrivateUser"), total: integer, page: integer, pages: integer, limit: integer }),
+  AuditLogPage: object({ items: list("AuditLog"), total: integer, page: integer, pages: integer, limit: integer }),
+  AuditLog: object({
+    ...base,
+    action: { type: "string", enum: AUDIT_ACTIONS },
+    actor_uuid: uuid,
+    subject_uuid: { ...uuid, description: "The user or machine it was done to" },
+    details: { type: "object", description: "Depends on the action, a transfer has the owner it was from and to" },
+    ip: string,
+    user_agent: string,
+  }),
+  PrivateUser: {
+    allOf: [
+      ref("PublicUser"),
+      object({
+        email: { type: "string", format: "email" },
+        email_verified: { type: "boolean" },
+        profile_visibility: {
+          type: "string",
+          enum: PROFILE_VISIBILITIES,
+          description: "Who else can see the profile and the machines, friends are the accepted ones",
+        },
+      }),
+    ],
+  },
+  UserPreview: object({ uuid, username: string, avatar: string }),
+  FriendList: object({
+    friends: { type: "array", items: { allOf: [ref("UserPreview"), object({ since: timestamp })] } },
+    incoming: { type: "array", items: { allOf: [ref("UserPreview"), object({ requested_at: timestamp })] } },
+    outgoing: { type: "array", items: { allOf: [ref("UserPreview"), object({ requested_at: timestamp })] } },
+  }),
+  AuthResult: object({ user: ref("PrivateUser"), token: string, refresh_token: string }, ["user", "token", "refresh_token"]),
+  Login: object({ agent: string, ip: string, date: timestamp }),
+  Session: object({
+    ...base,
+    agent: string,
+    ip: string,
+    last_used_at: timestamp,
+    expires_at: { type: "string", format: "date-time" },
+  }),
+  SignupKey: object({ key: string, expiration: timestamp }),
+  ApiToken: object({
+    ...base,
+    name: string,
+    prefix: { ...string, description: "The start of the token so it can be told apart from the others" },
+    scopes: { type: "array", items: { type: "string", enum: API_TOKEN_SCOPES } },
+    last_used_at: { ...timestamp, description: "Only updated once a minute" },
+  }),
+  NewApiToken: {
+    allOf: [ref("ApiToken"), object({ token: { ...string, description: "The token itself, it's only ever shown once" } })],
+  },
+  Webhook: object({
+    ...base,
+    url: string,
+    events: { type: "array", items: { type: "string", enum: WEBHOOK_EVENTS } },
+    failures: { ...integer, description: "How many deliveries in a row failed every retry" },
+    disabled_at: { ...timestamp, description: `Set once ${MAX_WEBHOOK_FAILURES} deliveries in a row failed` },
+  }),
+  NewWebhook: {
+    allOf: [
+      ref("Webhook"),
+      object({ secret: { ...string, description: "What the deliveries are signed with, it's only ever shown once" } }),
+    ],
+  },
+  UserPage: object({
+    items: list("PublicUser"),
+    total: integer,
+    page: integer,
+    pages: integer,
+    limit: integer,
+    next_cursor: { ...uuid, nullable: true, description: "Only when paging with ?after=" },
+  }),
+  Summary: object({ user: ref("PublicUser"), ...machine_summary }),
+  MachineSummary: object(machine_summary),
+  Machine: object({
+    ...base,
+    owner_uuid: uuid,
+    hardware_uuid: uuid,
+    name: string,
+    icon: { type: "string", enum: MACHINE_ICONS },
+    description: string,
+    labels: { type: "array", items: uuid },
+    tags: { type: "array", items: string },
+    access: { type: "array", items: uuid },
+    status: { type: "string", enum: ["online", "offline"] },
+    last_seen: timestamp,
+    static_data: { type: "object", description: "The hardware the reporter found on startup" },
+    dynamic_data: { type: "object", description: "The latest stats the reporter sent" },
+    network: { type: "object", description: "Where the reporter connects from" },
+    deleted_at: timestamp,
+  }),
+  AccessToken: object({ access_token: string }, ["access_token"]),
+  Label: object({
+    ...base,
+    owner_uuid: uuid,
+    name: string,
+    color: { type: "string", pattern: "^#[0-9a-fA-F]{6}$" },
+    icon: { type: "string", enum: LABEL_ICONS },
+    description: string,
+  }),
+  Datacenter: object({
+    ...base,
+    name: string,
+    logo: url,
+    owner_uuid: uuid,
+    machines: { type: "array", items: uuid },
+    members: { type: "array", items: uuid },
+  }),
+  Alert: object({
+    ...base,
+    machine_uuid: uuid,
+    owner_uuid: uuid,
+    metric: { type: "string", enum: ALERT_METRICS },
+    operator: { type: "string", enum: ALERT_OPERATORS },
+    threshold: number,
+    duration: { ...integer, description: "Milliseconds" },
+    cooldown: { ...integer, description: "Milliseconds" },
+    target: object({ type: { type: "string", enum: ALERT_TARGETS }, url }),
+    last_fired_at: timestamp,
+  }),
+  Stats: { type: "object", description: "The stats after the backend stamped them and computed the totals" },
+  MachineDisks: object({
+    updated_at: { ...timestamp, description: "When the machine last reported them, missing if it never did" },
+    disks: { type: "array", items: object({ fs: string, mount: string, type: string, total: number, used: number }) },
+  }),
+  MachineProcesses: object({
+    updated_at: timestamp,
+    processes: {
+      type: "array",
+      description: `The ${MAX_PROCESSES} processes using the most CPU, empty until the reporter of the machine sends them`,
+      items: object({
+        pid: integer,
+        name: string,
+        cpu: { ...number, description: "Percent" },
+        ram: { ...number, description: "Bytes" },
+      }),
+    },
+  }),
+  ShareLink: object({
+    ...base,
+    token: { ...string, description: "What goes in /v1/public/machines/:token" },
+    machine_uuid: uuid,
+    owner_uuid: uuid,
+    expires_at: { type: "string", format: "date-time" },
+    expose_host: { type: "boolean" },
+  }),
+  PublicStats: object({ timestamp, cau: { ...number, description: "The average CPU usage" }, ram: usage, host_uptime: number }),
+  PublicMachine: object({
+    uuid,
+    status: { type: "string", enum: ["online", "offline"] },
+    last_seen: timestamp,
+    stats: ref("PublicStats"),
+    name: { ...string, description: "This and the rest only when the owner opted into showing the host" },
+    hostname: string,
+    ip: string,
+  }),
+  StatsHistory: object({
+    ...stats_range,
+    resolution: { ...integer, description: "How many milliseconds each point covers" },
+    points: list("StatsPoint"),
+  }),
+  StatsPoint: object({
+    timestamp,
+    ...STAT_FIELDS.reduce((fields, field) => ({ ...fields, [field]: number }), {}),
+  }),
+  StatsComparison: object({
+    ...stats_range,
+    resolution: { ...integer, description: "How many milliseconds each point covers" },
+    machines: { type: "array", items: uuid },
+    unauthorized: { type: "array", items: uuid, description: "The machines the user can't see, they're left out" },
+    points: {
+      type: "array",
+      items: object({
+        timestamp,
+        machines: {
+          type: "object",
+          additionalProperties: { allOf: [ref("StatsPoint")], nullable: true },
+          description: "The values of each machine by uuid, null when it didn't report in the bucket",
+        },
+      }),
+    },
+  }),
+  StatsMetric: object({
+    metric: { type: "string", enum: STAT_FIELDS },
+    ...stats_range,
+    interval: integer,
+    points: { type: "array", items: object({ timestamp, avg: number, min: number, max: number }) },
+  }),
+  Uptime: object({
+    days: integer,
+    ...stats_range,
+    uptime: { ...number, nullable: true, description: "The percentage of the range the machine was up" },
+    downtime: { type: "array", items: object(stats_range) },
+  }),
+  Health: object({ status: string, uptime: number, version: string, commit: string }),
+  Readiness: {
+    allOf: [
+      ref("Health"),
+      object({
+        dependencies: { type: "object", additionalProperties: { ...string, description: "ok or why it can't be reached" } },
+        websockets: object({ clients: integer, reporters: integer }),
+      }),
+    ],
+  },
+};
+
+// The query params of the routes that range over the stats
+const STATS_QUERY = {
+  from: { ...string, description: "A timestamp or RFC 3339 date, an hour before ?to= by default" },
+  to: { ...string, description: "A timestamp or RFC 3339 date, now by default" },
+  resolution: { ...string, description: "How much time each point covers like 1m" },
+};
+
+// What the avatar and banner can be set to instead of uploading them
+const image_url = object({ url }, ["url"]);
+
+/**
+ * What each V1 route does, a route that's registered without being in here fails the tests
+ */
+export const V1_DOCS: RouteDocs = {
+  "GET /": { summary: "Says hello", response: message },
+  "GET /ping": { summary: "Answers with an empty body" },
+  "GET /status": {
+    summary: "The memory, processor and uptime of the shard",
+    response: object({ memory: usage, processor: number, uptime: number, shard: string }),
+  },
+  "GET /metrics": {
+    summary: "The Prometheus metrics of the shard",
+    description: "Public unless METRICS_TOKEN is set",
+    response: string,
+  },
+  "GET /healthz": { summary: "Whether the process is alive", response: ref("Health") },
+  "GET /readyz": { summary: "Whether mongo and redis can be reached, 503 when they can't", response: ref("Readiness") },
+  "GET /openapi.json": { summary: "This spec", response: { type: "object" } },
+  "GET /docs": { summary: "Swagger UI for this spec" },
+
+  "POST /v1/auth/@refresh": { summary: "Trades a refresh token for a new pair of tokens", response: ref("AuthResult") },
+
+  "GET /v1/users/@me": {
+    summary: "The logged in user",
+    query: { fields: fields(PRIVATE_USER_FIELDS) },
+    response: ref("PrivateUser"),
+  },
+  "GET /v1/users/@me/logins": { summary: "Where the logged in user logged in from", response: list("Login") },
+  "GET /v1/users/@me/@export": {
+    summary: "Downloads a zip of everything stored about the logged in user",
+    description:
+      `The stats of each machine are newline delimited JSON of at most ${MAX_EXPORT_POINTS} points, see export.json, ` +
+      `audit_log.json has the latest ${MAX_EXPORT_AUDIT_ENTRIES} entries of the audit log`,
+    query: {
+      from: { ...string, description: "An RFC 3339 date, the oldest stats that are still kept by default" },
+      to: { ...string, description: "An RFC 3339 date, now by default" },
+    },
+  },
+  "GET /v1/users/@me/audit": {
+    summary: "The audit log of the logged in user newest first",
+    description: "Failed logins are on it too with where they came from",
+    query: audit_query,
+    response: ref("AuditLogPage"),
+  },
+  "GET /v1/users/@me/summary": { summary: "Everything the dashboard shows", response: ref("Summary") },
+  "POST /v1/users/@me/keys": { summary: "Generates a key to sign a machine up with", response: ref("SignupKey") },
+  "GET /v1/users/@me/keys": { summary: "The signup keys that haven't been used or expired", response: list("SignupKey") },
+  "POST /v1/users/@me/tokens": {
+    summary: "Creates an API token to script against the API with",
+    description: "API tokens can only use the routes of their scopes and can't manage API tokens themselves",
+    status: 201,
+    response: ref("NewApiToken"),
+  },
+  "GET /v1/users/@me/tokens": { summary: "The API tokens of the logged in user", response: list("ApiToken") },
+  "DELETE /v1/users/@me/tokens/:uuid": { summary: "Revokes an API token", response: message },
+  "POST /v1/users/@me/webhooks": {
+    summary: "Registers a webhook for the events of the machines of the logged in user",
+    description:
+      `Every delivery is a JSON POST with the event in X-Xornet-Event and X-Xornet-Signature set to sha256= and ` +
+      `the hex HMAC-SHA256 of the raw body with the secret. Deliveries that aren't answered with a 2xx are retried ` +
+      `for an hour and the webhook is disabled after ${MAX_WEBHOOK_FAILURES} in a row failed, ` +
+      `a user can have ${MAX_WEBHOOKS} webhooks. alert.fired is sent when an alert rule of a machine fires ` +
+      `and has the rule and the observed value in data.alert`,
+    status: 201,
+    response: ref("NewWebhook"),
+  },
+  "GET /v1/users/@me/webhooks": { summary: "The webhooks of the logged in user", response: list("Webhook") },
+  "DELETE /v1/users/@me/webhooks/:uuid": { summary: "Deletes a webhook", response: message },
+  "POST /v1/webhooks/:uuid/@test": {
+    summary: "Sends the webhook.test event to a webhook",
+    description: "Disabled webhooks get it too and a test that's received enables them again",
+    status: 202,
+    response: object({ delivery: { ...uuid, description: "The X-Xornet-Delivery the test is sent with" } }),
+  },
+  "GET /v1/users/@me/sessions": { summary: "The devices the logged in user is logged in on", response: list("Session") },
+  "DELETE /v1/users/@me/sessions": {
+    summary: "Logs out everywhere",
+    response: object({ message: string, count: integer }),
+  },
+  "DELETE /v1/users/@me/sessions/:id": { summary: "Logs out a device", response: message },
+  "PATCH /v1/users/@me": {
+    summary: "Updates the logged in user",
+    description: "Responds with a 409 when the version in the body is stale, fetch the user again and retry",
+    response: ref("PrivateUser"),
+  },
+  "DELETE /v1/users/@me": {
+    summary: "Schedules the logged in user for deletion",
+    description: "Logging in again before purged_at cancels it",
+    response: object({ message: string, purged_at: timestamp }),
+  },
+  "GET /v1/users/@me/machines": { summary: "The machines of the logged in user", response: list("Machine") },
+  "GET /v1/users/@me/friends": {
+    summary: "The friends of the logged in user and the requests they got and sent",
+    response: ref("FriendList"),
+  },
+  "POST /v1/users/@me/friends/:uuid": {
+    summary: "Sends a friend request",
+    description: "Responds with 409 when you're already friends or either of you already sent a request",
+    status: 201,
+    response: message,
+  },
+  "POST /v1/users/@me/friends/:uuid/accept": { summary: "Accepts a friend request you got", response: message },
+  "DELETE /v1/users/@me/friends/:uuid": { summary: "Unfriends a user or cancels or declines a request", response: message },
+  "GET /v1/users": {
+    summary: "Pages through every user",
+    query: {
+      ...pagination,
+      after: { ...uuid, description: "Pages by cursor, takes precedence over ?page= and ?skip=" },
+      include_deleted: { type: "boolean" },
+      fields: fields(PUBLIC_USER_FIELDS),
+    },
+    response: ref("UserPage"),
+  },
+  "GET /v1/users/search": {
+    summary: "Finds users by their username",
+    query: { q: { ...string, minLength: 2 }, limit: integer },
+    response: list("UserPreview"),
+  },
+  "POST /v1/users/batch": {
+    summary: "Gets many users at once",
+    response: { type: "object", additionalProperties: ref("PublicUser") },
+  },
+  "PATCH /v1/users/:uuid": {
+    summary: "Updates a user, admins can update anyone",
+    description: "Responds with a 409 when the version in the body is stale, fetch the user again and retry",
+    response: { oneOf: [ref("PrivateUser"), ref("PublicUser")] },
+  },
+  "POST /v1/users/:uuid/password": {
+    summary: "Changes the password of the logged in user",
+    description: "Every other session is logged out",
+    response: ref("AuthResult"),
+  },
+  "DELETE /v1/users/:uuid": {
+    summary: "Deletes a user, admins can delete anyone",
+    description: "Users can delete themselves with their password in the body, the same as DELETE /v1/users/@me",
+    response: message,
+  },
+  "POST /v1/users/:uuid/admin": { summary: "Promotes or demotes a user, admins only", response: ref("PublicUser") },
+  "GET /v1/users/:uuid/audit": {
+    summary: "The audit log of a user newest first, the user themselves or admins only",
+    description: "Has what they did and what was done to them like logins, password changes, promotions and transfers",
+    query: audit_query,
+    response: ref("AuditLogPage"),
+  },
+  "GET /v1/users/:uuid": {
+    summary: "A user",
+    description: "Users who hid their profile from the logged in user are answered with a 404 like missing ones",
+    query: { fields: fields(PUBLIC_USER_FIELDS) },
+    response: ref("PublicUser"),
+  },
+  "GET /v1/users/:uuid/machines": {
+    summary: "The machines of a user",
+    description: "Hidden along with the profile",
+    response: list("Machine"),
+  },
+  "PUT /v1/users/@avatar": { summary: "Uploads the avatar of the logged in user", response: ref("PrivateUser") },
+  "PUT /v1/users/@banner": { summary: "Uploads the banner of the logged in user", response: ref("PrivateUser") },
+  "POST /v1/users/:uuid/avatar": { summary: "Uploads the avatar of the logged in user", response: ref("PrivateUser") },
+  "POST /v1/users/:uuid/banner": { summary: "Uploads the banner of the logged in user", response: ref("PrivateUser") },
+  "PATCH /v1/users/@avatar": {
+    summary: "Sets the avatar of the logged in user to an image that's hosted somewhere trusted",
+    body: image_url,
+    response: ref("PrivateUser"),
+  },
+  "PATCH /v1/users/@banner": {
+    summary: "Sets the banner of the logged in user to an image that's hosted somewhere trusted",
+    body: image_url,
+    response: ref("PrivateUser"),
+  },
+  "POST /v1/users/@signup": { summary: "Signs up and logs in", status: 201, response: ref("AuthResult") },
+  "POST /v1/users/@login": { summary: "Logs in", response: ref("AuthResult") },
+  "POST /v1/users/@verify": { summary: "Verifies the email a token was sent to", response: ref("PrivateUser") },
+  "GET /v1/users/@verify": { summary: "Verifies the email a token was sent to", response: ref("PrivateUser") },
+  "POST /v1/users/@resend_verification": { summary: "Sends the verification email again", response: message },
+  "POST /v1/users/@forgot_password": { summary: "The same as POST /password/forgot", response: message },
+  "POST /v1/users/@reset_password": { summary: "The same as POST /password/reset", response: message },
+
+  "POST /v1/password/forgot": {
+    summary: "Emails a link to reset the password",
+    description: "Answers the same whether or not anyone has the email",
+    response: message,
+  },
+  "POST /v1/password/reset": { summary: "Sets a new password with the token from the email", response: message },
+
+  "GET /v1/labels": { summary: "The labels of the logged in user", response: list("Label") },
+  "GET /v1/labels/admin/all": { summary: "Every label", response: list("Label") },
+  "GET /v1/labels/:uuid": { summary: "A label of the logged in user", response: ref("Label") },
+  "DELETE /v1/labels/:uuid": { summary: "Deletes a label and takes it off its machines", response: message },
+  "PATCH /v1/labels/:uuid": {
+    summary: "Updates a label, invalid fields are ignored",
+    body: object({ name: string, color: string, description: string, icon: { type: "string", enum: LABEL_ICONS } }),
+    response: ref("Label"),
+  },
+  "POST /v1/labels": {
+    summary: "Creates a label",
+    status: 201,
+    body: object({ name: string, color: string, description: string, icon: { type: "string", enum: LABEL_ICONS } }, ["name"]),
+    response: ref("Label"),
+  },
+
+  "GET /v1/datacenters": { summary: "The datacenters the logged in user owns or is a member of", response: list("Datacenter") },
+  "POST /v1/datacenters": { summary: "Creates a datacenter", status: 201, response: ref("Datacenter") },
+  "GET /v1/datacenters/:uuid": { summary: "A datacenter", response: ref("Datacenter") },
+  "GET /v1/datacenters/:uuid/summary": {
+    summary: "Sums up the machines of a datacenter",
+    description: "Summed up again at most every 2 seconds",
+    response: ref("MachineSummary"),
+  },
+  "PATCH /v1/datacenters/:uuid": { summary: "Updates a datacenter, owners only", response: ref("Datacenter") },
+  "DELETE /v1/datacenters/:uuid": { summary: "Deletes a datacenter, owners only", response: message },
+  "PUT /v1/datacenters/:uuid/machines/:machine_uuid": {
+    summary: "Adds a machine to a datacenter",
+    response: ref("Datacenter"),
+  },
+  "DELETE /v1/datacenters/:uuid/machines/:machine_uuid": {
+    summary: "Removes a machine from a datacenter",
+    response: ref("Datacenter"),
+  },
+  "PUT /v1/datacenters/:uuid/members/:user_uuid": { summary: "Adds a member to a datacenter", response: ref("Datacenter") },
+  "DELETE /v1/datacenters/:uuid/members/:user_uuid": {
+    summary: "Removes a member from a datacenter",
+    response: ref("Datacenter"),
+  },
+
+  "GET /v1/machines": {
+    summary: "The machines the logged in user can see",
+    query: {
+      owner: { ...uuid, description: "Only the machines of this user the caller can see" },
+      tag: string,
+      fields: fields(MACHINE_FIELDS),
+    },
+    response: list("Machine"),
+  },
+  "GET /v1/machines/@newkey": { summary: "The same as POST /users/@me/keys", response: ref("SignupKey") },
+  "POST /v1/machines/:uuid/transfer": {
+    summary: "Hands a machine to another user, owners only",
+    description: "The access token is rotated and the labels, datacenters and alert rules of the previous owner are dropped",
+    response: ref("Machine"),
+  },
+  "POST /v1/machines/@signup": { summary: "Signs a reporter up with a signup key", response: ref("AccessToken") },
+  "PUT /v1/machines/:uuid/labels/:label_uuid": { summary: "Adds a label to a machine", response: message },
+  "DELETE /v1/machines/:uuid/labels/:label_uuid": { summary: "Removes a label from a machine", response: message },
+  "POST /v1/machines/label/:machine_uuid/:label_uuid": {
+    summary: "The same as PUT /v1/machines/:uuid/labels/:label_uuid",
+    response: message,
+  },
+  "DELETE /v1/machines/label/:machine_uuid/:label_uuid": {
+    summary: "The same as DELETE /v1/machines/:uuid/labels/:label_uuid",
+    response: message,
+  },
+  "POST /v1/machines/:uuid/tags": { summary: "Tags a machine", response: ref("Machine") },
+  "DELETE /v1/machines/:uuid/tags/:tag": { summary: "Removes a tag from a machine", response: ref("Machine") },
+  "POST /v1/machines/:uuid/token": {
+    summary: "Gives a machine a new access token",
+    description: "The reporter is disconnected since it's using the old one",
+    response: ref("AccessToken"),
+  },
+  "PUT /v1/machines/:uuid/access/:user_uuid": {
+    summary: "Shares a machine with a user",
+    description: "They can see it and its live stats but only the owner can change it",
+    response: object({ shared_with: { type: "array", items: uuid } }),
+  },
+  "DELETE /v1/machines/:uuid/access/:user_uuid": {
+    summary: "Stops sharing a machine with a user",
+    response: object({ shared_with: { type: "array", items: uuid } }),
+  },
+  "POST /v1/machines/:uuid/@share": {
+    summary: "Creates a public link to the live stats of a machine, owners only",
+    description: "Without expires_in it works until it's revoked, the host of the machine is only shown with expose_host",
+    status: 201,
+    response: ref("ShareLink"),
+  },
+  "GET /v1/machines/:uuid/shares": {
+    summary: "The share links of a machine that still work, owners only",
+    response: list("ShareLink"),
+  },
+  "DELETE /v1/machines/:uuid/shares/:share_uuid": {
+    summary: "Revokes a share link",
+    description: "Its public streams are ended right away",
+    response: message,
+  },
+  "POST /v1/machines/:uuid/stats": {
+    summary: "Reports the stats of a machine over http",
+    security: "machine",
+    response: ref("Stats"),
+  },
+  "GET /v1/machines/:uuid/stats/stream": {
+    summary: "Streams the live stats of a machine as Server-Sent Events",
+    description: "For networks that block websockets, the event ids count up from the Last-Event-ID a reconnect sends",
+  },
+  "GET /v1/machines/:uuid/disks": { summary: "The latest usage of every disk of a machine", response: ref("MachineDisks") },
+  "GET /v1/machines/:uuid/processes": { summary: "The busiest processes of a machine", response: ref("MachineProcesses") },
+  "POST /v1/machines/stats/compare": {
+    summary: "The downsampled histories of some machines lined up by their buckets",
+    description: `At most ${MAX_COMPARED_MACHINES} machines, the range is the same as the query of the history`,
+    response: ref("StatsComparison"),
+  },
+  "GET /v1/machines/:uuid/stats/history": {
+    summary: "The downsampled history of a machine",
+    query: STATS_QUERY,
+    response: ref("StatsHistory"),
+  },
+  "GET /v1/machines/:uuid/alerts": { summary: "The alert rules of a machine, owners only", response: list("Alert") },
+  "POST /v1/machines/:uuid/alerts": { summary: "Adds an alert rule to a machine", status: 201, response: ref("Alert") },
+  "DELETE /v1/machines/:uuid/alerts/:alert_uuid": { summary: "Deletes an alert rule", response: message },
+  "GET /v1/machines/:uuid/uptime": {
+    summary: "The uptime of a machine and when it was down",
+    query: { days: { ...integer, default: 30 } },
+    response: ref("Uptime"),
+  },
+  "GET /v1/machines/:uuid/stats": {
+    summary: "The downsampled average, minimum and maximum of a metric of a machine",
+    query: { metric: { type: "string", enum: STAT_FIELDS }, ...STATS_QUERY },
+    response: ref("StatsMetric"),
+  },
+  "GET /v1/machines/:uuid": {
+    summary: "A machine the logged in user owns, it's shared with or is in one of their datacenters",
+    response: ref("Machine"),
+  },
+  "PATCH /v1/machines/:uuid": {
+    summary: "Renames a machine or changes its icon, owners only",
+    description: "The reporter never changes these, the name is the hostname until it's renamed",
+    response: ref("Machine"),
+  },
+  "DELETE /v1/machines/:uuid": {
+    summary: "Schedules a machine and its stats for deletion",
+    description:
+      "Its access token stops working right away and the clients watching it get machine-removed, " +
+      "restoring it before purged_at cancels it",
+    response: object({ message: string, purged_at: timestamp }),
+  },
+  "POST /v1/machines/:uuid/@restore": {
+    summary: "Restores a deleted machine that hasn't been purged yet, owners only",
+    description: "The reporter can connect with its old access token again, signing it up again fails while it's deleted",
+    response: ref("Machine"),
+  },
+  "GET /v1/admin/users": {
+    summary: "Pages through every user with their email, admins only",
+    description: "The created_after and created_before timestamps are in milliseconds",
+    query: pagination,
+    response: ref("AdminUserPage"),
+  },
+  "POST /v1/admin/users/:uuid/@disable": {
+    summary: "Disables a user, admins only",
+    description: "Their sessions are revoked and the tokens of their machines stop working until they're enabled again",
+    response: ref("PublicUser"),
+  },
+  "POST /v1/admin/users/:uuid/@enable": {
+    summary: "Lets a disabled user log in again, admins only",
+    response: ref("PublicUser"),
+  },
+  "DELETE /v1/admin/users/:uuid": {
+    summary: "Purges a user and everything they own right away, admins only",
+    description: "Unlike DELETE /v1/users/:uuid there's no grace period to restore them in",
+    response: message,
+  },
+  "GET /v1/public/machines/:token": {
+    summary: "What a share link shows of a machine, no login needed",
+    response: ref("PublicMachine"),
+  },
+  "GET /v1/sse/machines/:uuid": {
+    summary: "Streams the live stats of a machine as Server-Sent Events without naming the events",
+    description:
+      "The same stream as /v1/machines/:uuid/stats/stream except every event is a message, for EventSource.onmessage",
+  },
+  "GET /v1/public/machines/:token/stream": {
+    summary: "Streams the public stats of the machine of a share link as Server-Sent Events",
+    description: "The stream ends when the link is revoked or expires, the stats events only have what PublicStats has",
+  },
+};
+
+/**
+ * How the V1 routes authenticate, the names are what the middlewares mark themselves with
+ */
+export const V1_SECURITY_SCHEMES = {
+  user: { type: "http", scheme: "bearer", bearerFormat: "JWT" },
+  api_token: {
+    type: "http",
+    scheme: "bearer",
+    description: "An API token from POST /v1/users/@me/tokens, they start with xor_",
+  },
+  metrics: { type: "http", scheme: "bearer", description: "The METRICS_TOKEN" },
+  machine: { type: "apiKey", in: "header", name: "X-Machine-Token", description: "The access token of the machine" },
+};
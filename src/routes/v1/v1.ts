@@ -1,145 +1,737 @@
-import express, { Router } from "express";
-import { MongoAPIError } from "mongodb";
-import { KeyManager } from "../../classes/keyManager.class";
+import express, { RequestHandler, Response, Router } from "express";
+import { Cache, MemoryCacheStore } from "../../classes/cache.class";
+import { ClientToBackendEvents, PublicStreamEvents, WebsocketManager } from "../../classes/websocketManager.class";
+import type { Config } from "../../config";
 import { DatabaseManager } from "../../database/DatabaseManager";
+import { AUDIT_ACTIONS } from "../../database/schemas/auditLog";
 import { ICreateLabelInput } from "../../database/schemas/label";
-import { LoggedInRequest } from "../../database/schemas/user";
-import { getServerMetrics } from "../../logic";
+import { IMachine, MACHINE_FIELDS, machine_presence, MachineSignupInput } from "../../database/schemas/machine";
+import { IStatValues, MAX_EXPORT_POINTS, STAT_FIELDS } from "../../database/schemas/stats";
+import { ISessionDevice } from "../../database/schemas/session";
+import { public_stats, SHARE_TOKEN_PATTERN } from "../../database/schemas/shareLink";
+import {
+  AdminUsersQuery,
+  ISafeUser,
+  IUser,
+  LoggedInRequest,
+  PRIVATE_USER_FIELDS,
+  PUBLIC_USER_FIELDS,
+  UserAuthResult,
+} from "../../database/schemas/user";
+import {
+  checkDependencies,
+  getHealth,
+  getServerMetrics,
+  ndjson,
+  parseAuditLogQuery,
+  parseExportRange,
+  parseFields,
+  parsePagination,
+  parseStatsRange,
+  pickFields,
+  StatsRange,
+} from "../../logic";
 import { adminMiddleware } from "../../middleware/admin";
-import { init_auth } from "../../middleware/auth";
+import { get_user, init_auth, verifiedMiddleware } from "../../middleware/auth";
+import { get_signal } from "../../middleware/context";
+import { init_deprecation } from "../../middleware/deprecation";
+import { send_versioned, versioned_etag } from "../../middleware/etag";
+import { init_idempotency } from "../../middleware/idempotency";
+import { get_logger } from "../../middleware/log";
+import { init_metrics_auth } from "../../middleware/metrics";
+import { client_ip, init_rate_limit } from "../../middleware/ratelimit";
+import { validate_body, validate_query } from "../../middleware/validate";
 import { redisPublisher } from "../../redis";
-import { Validators } from "../../validators";
+import { ApiError, ErrorCode, nullIfNotFound, sendError } from "../../utils/errors";
+import { PROFILE_IMAGE_SIZES, readImageUpload, resizeImage } from "../../utils/images";
+import { ScopedLogger } from "../../utils/logger";
+import { Mailer } from "../../utils/mailer";
+import { metrics, METRICS_CONTENT_TYPE } from "../../utils/metrics";
+import { buildSpec, swaggerPage } from "../../utils/openapi";
+import { SseConnection } from "../../utils/sse";
+import { deleteUpload, saveUpload } from "../../utils/uploads";
+import { ZipWriter } from "../../utils/zip";
+import { Time } from "../../types";
+import { ApiTokenScope, Validators } from "../../validators";
+import { version } from "../../../package.json";
+import { V1_DOCS, V1_SCHEMAS, V1_SECURITY_SCHEMES } from "./docs";
 
 export class V1 {
   private static HELLO_WORLD = JSON.stringify({ message: "Hello World" });
-  private auth = init_auth(this.db);
+  // Where the API is served so a v2 can be mounted next to it
+  public static PREFIX = "/v1";
+  // Readiness probes time out after a few seconds so the checks have to answer well before that
+  private static READINESS_TIMEOUT = 2 * Time.Second;
+  // Login and signup are limited harder to slow down brute forcing
+  private credentials_limit = init_rate_limit(5);
+  private general_limit = init_rate_limit(60);
+  // Every verification email resent costs us and lands in someone's inbox
+  private verification_limit = init_rate_limit(3, 10 * Time.Minute);
+  // An export reads every stat of every machine of a user
+  private export_limit = init_rate_limit(3, Time.Hour);
+  // Share links are public so they're limited by their token, a status page polling once a second still fits
+  private share_limit = init_rate_limit(120, Time.Minute, undefined, (req) => `share:${req.params.token}`);
+  private auth = [init_auth(this.db, this.config.jwt.secret), this.general_limit];
+  // For the routes that create something so a retry on a flaky network doesn't create it twice, after the auth
+  private idempotent = init_idempotency(this.db);
+  // The routes API tokens can use, only the tokens with the scope get through
+  private scoped = (scope: ApiTokenScope) => [init_auth(this.db, this.config.jwt.secret, scope), this.general_limit];
+  // The probes, metrics and docs, they aren't versioned so what scrapes them never has to change
   public router: Router = express.Router();
-  public keyManager = new KeyManager();
+  // Every module of the API, served under the prefix
+  public api: Router = express.Router();
+  // Marked so the OpenAPI spec describes the body as an image
+  private upload = Object.assign(express.raw({ type: () => true, limit: this.config.limits.upload }), { upload: true });
+  // Built on the first request since every route has to be registered first
+  private spec?: object;
+  // Dashboards poll the summaries so they're only summed up again once a second or two, nothing invalidates them
+  // since what they sum up changes with every report anyway
+  private summaries = new Cache(new MemoryCacheStore(), 2 * Time.Second);
 
-  public constructor(public db: DatabaseManager) {
+  public constructor(
+    public db: DatabaseManager,
+    public websocketManager: WebsocketManager,
+    private mailer: Mailer,
+    private config: Config
+  ) {
     this.router.get("/", (_, res) => res.send(V1.HELLO_WORLD));
     this.router.get("/ping", (_, res) => res.send());
-    this.router.get("/status", async (_, res) => res.json(await getServerMetrics()));
-    this.router.use("/users", this.generate_user_routes());
-    this.router.use("/labels", this.generate_label_routes());
-    this.router.use("/machines", this.generate_machine_routes());
+    this.router.get("/status", async (_, res) => res.json(await getServerMetrics(this.config.shard)));
+    this.router.get("/metrics", init_metrics_auth(this.config.metrics_token), (_, res) =>
+      res.setHeader("Content-Type", METRICS_CONTENT_TYPE).send(metrics.render())
+    );
+    this.router.get(["/healthz", "/health"], (_, res) => res.json(getHealth(this.config.commit)));
+    this.router.get(["/readyz", "/ready"], async (_, res) => {
+      const { ready, dependencies } = await checkDependencies(
+        {
+          mongodb: () => this.db.ping(),
+          redis: () => redisPublisher.ping(),
+        },
+        V1.READINESS_TIMEOUT
+      );
+      res.status(ready ? 200 : 503).json({
+        ...getHealth(this.config.commit),
+        status: ready ? "ready" : "unavailable",
+        dependencies,
+        websockets: {
+          clients: this.websocketManager.clientHub.size,
+          reporters: Object.keys(this.websocketManager.reporterConnections).length,
+        },
+      });
+    });
+    this.router.get("/openapi.json", (_, res) => res.json(this.openapi()));
+    this.router.get("/docs", (_, res) => res.type("html").send(swaggerPage("/openapi.json", "Xornet API")));
+    this.register("/auth", this.generate_auth_routes());
+    this.register("/users", this.generate_user_routes());
+    this.register("/password", this.generate_password_routes());
+    this.register("/labels", this.generate_label_routes());
+    this.register("/machines", this.generate_machine_routes());
+    this.register("/datacenters", this.generate_datacenter_routes());
+    this.register("/webhooks", this.generate_webhook_routes());
+    this.register("/admin", this.generate_admin_routes());
+    this.register("/public", this.generate_public_routes());
+    // For integrations that only know how to read plain EventSource messages
+    this.register("/sse", this.generate_sse_routes());
+    this.router.use(V1.PREFIX, this.api);
+    // Reporters and frontends from before the prefix keep working until they're updated, it's mounted through
+    // a function so the spec only has the prefixed paths
+    if (this.config.legacy_routes !== false) {
+      const deprecation = init_deprecation(V1.PREFIX);
+      this.router.use((req, res, next) => deprecation(req, res, () => this.api(req, res, next)));
+    }
+  }
+
+  /**
+   * Registers the routes of a module under the prefix
+   * @param path Where the module is mounted like /users
+   * @param routes The routes of the module
+   * @param middlewares What runs before every route of the module, like auth when none of its routes are public
+   */
+  private register(path: string, routes: Router, ...middlewares: RequestHandler[]) {
+    this.api.use(path, ...middlewares, routes);
+  }
+
+  /**
+   * Where a request comes from, stored on the session it logs in or refreshes
+   */
+  private static device = (req: express.Request): ISessionDevice => ({
+    agent: req.headers["user-agent"] || "unknown",
+    ip: client_ip(req),
+  });
+
+  // What a refresh can fail with that means the client has to log in again
+  private static AUTH_ERRORS: string[] = [
+    ErrorCode.TokenInvalid,
+    ErrorCode.TokenExpired,
+    ErrorCode.TokenRevoked,
+    ErrorCode.UserNotFound,
+  ];
+
+  // What signing up a machine with a bad key fails with
+  private static KEY_ERRORS: string[] = [ErrorCode.KeyInvalid, ErrorCode.KeyExpired];
+
+  // What using a token from an email fails with when it's bad, expired or already used
+  private static EMAIL_TOKEN_ERRORS: string[] = [ErrorCode.TokenInvalid, ErrorCode.TokenExpired];
+
+  private static auth_response = ({ user, token, refresh_token }: UserAuthResult) => ({
+    user: user.to_private(),
+    token,
+    refresh_token,
+  });
+
+  /**
+   * Sends machines with an ETag, whether they're online is part of it since that changes without a write
+   */
+  private static send_machines = (req: express.Request, res: Response, machines: IMachine | IMachine[], fields?: string[]) => {
+    const list = Array.isArray(machines) ? machines : [machines];
+    const etag = versioned_etag(list, list.map((machine) => machine_presence(machine)).concat(fields ?? []));
+    // Picked from what toJSON sends so nothing it strips can be asked for
+    const picked = () => list.map((machine) => pickFields(machine.toJSON(), fields));
+    return send_versioned(req, res, etag, () => (!fields ? machines : Array.isArray(machines) ? picked() : picked()[0]));
+  };
+
+  // Responds to a ?fields= asking for something that's missing or protected with what can be asked for instead
+  private static invalid_fields = (res: Response, selectable: string[]) =>
+    sendError(res, 400, ErrorCode.InvalidFields, `the fields can be ${selectable.join(", ")}`, { valid_fields: selectable });
+
+  /**
+   * The OpenAPI spec of every route on the router
+   */
+  public openapi() {
+    this.spec ??= buildSpec(this.router, {
+      title: "Xornet API",
+      version,
+      docs: V1_DOCS,
+      schemas: V1_SCHEMAS,
+      security_schemes: V1_SECURITY_SCHEMES,
+      guards: [adminMiddleware, verifiedMiddleware],
+    });
+    return this.spec;
+  }
+
+  private generate_auth_routes() {
+    return express
+      .Router()
+      // Refreshing isn't limited as hard as logging in since every open tab refreshes on its own
+      .post("/@refresh", this.general_limit, validate_body(Validators.REFRESH_BODY), (req, res, next) =>
+        this.db
+          .refresh_session(req.body.refresh_token, V1.device(req), get_logger(res))
+          .then((result) => res.json(V1.auth_response(result)))
+          .catch((error) => {
+            if (error === ErrorCode.AccountDisabled) return next(new ApiError(403, error));
+            next(V1.AUTH_ERRORS.includes(error) ? new ApiError(401, error) : error);
+          })
+      );
   }
 
   private generate_user_routes() {
     return express
       .Router()
-      .get("/@me", this.auth, (req: LoggedInRequest, res) => res.send(req.user!))
-      .get("/@me/logins", this.auth, (req: LoggedInRequest, res) => res.json(req.user!.login_history))
-      .delete("/@me", this.auth, async (req: LoggedInRequest, res) => {
-        try {
-          const machines = await this.db.find_machines({ owner_uuid: req.user!.uuid });
-          const labels = await this.db.find_labels({ owner_uuid: req.user!.uuid });
-
-          await req.user!.delete();
-          await Promise.all(machines.map((machine) => machine.delete()));
-          await Promise.all(labels.map((label) => label.delete()));
-
-          res.send({ message: "deleted user" });
-        } catch (error) {
-          res.status(500).json(error);
-        }
+      .get("/@me", this.auth, (req: LoggedInRequest, res) => {
+        const { fields, invalid } = parseFields(req.query.fields, PRIVATE_USER_FIELDS);
+        if (invalid) return V1.invalid_fields(res, PRIVATE_USER_FIELDS);
+        res.send(pickFields(get_user(req).to_private(), fields));
+      })
+      .get("/@me/logins", this.auth, (req: LoggedInRequest, res) => res.json(get_user(req).login_history))
+      .get("/@me/audit", this.auth, (req: LoggedInRequest, res, next) =>
+        this.send_audit_logs(req, res, get_user(req).uuid).catch(next)
+      )
+      .get("/@me/@export", this.auth, this.export_limit, (req: LoggedInRequest, res, next) => {
+        const { range, error } = parseExportRange(req.query);
+        if (!range) return sendError(res, 400, error!);
+        this.export_user(req, res, range).catch(next);
+      })
+      .get("/@me/summary", this.auth, (req: LoggedInRequest, res, next) => {
+        const { uuid } = get_user(req);
+        this.summaries
+          .wrap("user", uuid, `viewer:${uuid}`, () => this.db.get_user_dashboard(uuid, get_signal(res)))
+          .then((summary) => res.json({ user: get_user(req).to_public(), ...summary }))
+          .catch(next);
+      })
+      .post("/@me/keys", this.auth, verifiedMiddleware, this.idempotent, (req: LoggedInRequest, res, next) =>
+        this.new_signup_key(req, res).catch(next)
+      )
+      .get("/@me/keys", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_signup_keys(get_user(req).uuid, get_signal(res))
+          .then((keys) => res.json(keys))
+          .catch(next)
+      )
+      // Only a login can manage the API tokens so a leaked token can't make more of itself
+      .post(
+        "/@me/tokens",
+        this.auth,
+        validate_body(Validators.API_TOKEN_BODY),
+        this.idempotent,
+        (req: LoggedInRequest, res, next) =>
+          this.db
+            .new_api_token(get_user(req).uuid, req.body, V1.device(req))
+            .then(({ token, secret }) => res.status(201).json({ ...token.toJSON(), token: secret }))
+            .catch((error) => next(error === ErrorCode.TooManyApiTokens ? new ApiError(429, error) : error))
+      )
+      .get("/@me/tokens", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_api_tokens(get_user(req).uuid, get_signal(res))
+          .then((tokens) => res.json(tokens))
+          .catch(next)
+      )
+      .delete("/@me/tokens/:uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .delete_api_token(req.params.uuid, get_user(req).uuid, V1.device(req))
+          .then(() => res.json({ message: "API token revoked" }))
+          .catch(next)
+      )
+      .post(
+        "/@me/webhooks",
+        this.auth,
+        validate_body(Validators.WEBHOOK_BODY),
+        this.idempotent,
+        (req: LoggedInRequest, res, next) =>
+          this.db
+            .new_webhook(get_user(req).uuid, req.body, V1.device(req))
+            .then(({ webhook, secret }) => res.status(201).json({ ...webhook.toJSON(), secret }))
+            .catch((error) => next(error === ErrorCode.TooManyWebhooks ? new ApiError(429, error) : error))
+      )
+      .get("/@me/webhooks", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_webhooks(get_user(req).uuid, get_signal(res))
+          .then((webhooks) => res.json(webhooks))
+          .catch(next)
+      )
+      .delete("/@me/webhooks/:uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .delete_webhook(req.params.uuid, get_user(req).uuid, V1.device(req))
+          .then(() => res.json({ message: "webhook deleted" }))
+          .catch(next)
+      )
+      .get("/@me/sessions", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_sessions(get_user(req).uuid, get_signal(res))
+          .then((sessions) => res.json(sessions))
+          .catch(next)
+      )
+      .delete("/@me/sessions", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .delete_sessions(get_user(req).uuid)
+          .then((count) => res.json({ message: "sessions revoked", count }))
+          .catch(next)
+      )
+      .delete("/@me/sessions/:id", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .delete_session(req.params.id, get_user(req).uuid)
+          .then(() => res.json({ message: "session revoked" }))
+          .catch(next)
+      )
+      .patch("/@me", this.auth, validate_body(Validators.USER_UPDATE_BODY), (req: LoggedInRequest, res, next) => {
+        const { update } = Validators.validate_user_update(req.body);
+        this.db
+          .update_user(get_user(req).uuid, update, req.body.version)
+          .then((user) => {
+            update.email && this.verify_in_background(user, get_logger(res));
+            res.send(user.to_private());
+          })
+          .catch((error) => next(error === ErrorCode.VersionConflict ? new ApiError(409, error) : error));
+      })
+      .delete(
+        "/@me",
+        this.credentials_limit,
+        this.auth,
+        validate_body(Validators.ACCOUNT_DELETION_BODY),
+        (req: LoggedInRequest, res, next) => this.delete_own_account(req, res).catch(next)
+      )
+      .get("/@me/machines", this.scoped("read:machines"), (req: LoggedInRequest, res, next) => {
+        get_user(req)
+          .get_machines()
+          .then((machines) => res.send(machines))
+          .catch(next);
       })
-      .get("/@me/machines", this.auth, (req: LoggedInRequest, res) => {
-        req.user!.get_machines().then((machines) => res.send(machines));
+      .get("/@me/friends", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_friends(get_user(req), get_signal(res))
+          .then((friends) => res.json(friends))
+          .catch(next)
+      )
+      .post("/@me/friends/:uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .request_friend(get_user(req).uuid, req.params.uuid)
+          .then(() => res.status(201).json({ message: "friend request sent" }))
+          .catch(next)
+      )
+      .post("/@me/friends/:uuid/accept", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .accept_friend(get_user(req).uuid, req.params.uuid)
+          .then(() => res.json({ message: "friend request accepted" }))
+          .catch(next)
+      )
+      .delete("/@me/friends/:uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .remove_friend(get_user(req).uuid, req.params.uuid)
+          .then(() => res.json({ message: "friend removed" }))
+          .catch(next)
+      )
+      .get(["/", "/all"], this.auth, adminMiddleware, (req, res, next) => {
+        const { pagination, error } = parsePagination(req.query, ["created_at", "username"]);
+        if (!pagination) return sendError(res, 400, error!);
+        const { fields, invalid } = parseFields(req.query.fields, PUBLIC_USER_FIELDS);
+        if (invalid) return V1.invalid_fields(res, PUBLIC_USER_FIELDS);
+        const include_deleted = req.query.include_deleted === "true";
+        const items = (users: IUser[]) => users.map((user) => pickFields(user.to_public(), fields));
+        if (pagination.after !== undefined)
+          return this.db
+            .find_users_after(pagination.after, pagination.limit, include_deleted, get_signal(res), fields)
+            .then(({ users, next_cursor }) => res.send({ items: items(users), next_cursor, limit: pagination.limit }))
+            .catch((error) => next(error === ErrorCode.InvalidCursor ? new ApiError(400, error) : error));
+        this.db
+          .find_users_paginated({}, pagination, include_deleted, get_signal(res), fields)
+          .then(({ users, total }) =>
+            res.send({
+              items: items(users),
+              total,
+              page: pagination.page,
+              pages: Math.ceil(total / pagination.limit),
+              limit: pagination.limit,
+            })
+          )
+          .catch(next);
       })
-      .get("/all", this.auth, adminMiddleware, (req, res) => {
+      .get(["/search", "/@search"], this.auth, (req: LoggedInRequest, res, next) => {
+        const query = typeof req.query.q === "string" ? req.query.q.trim() : undefined;
+        // Anything shorter would match most of the collection
+        if (!query || query.length < 2)
+          return sendError(res, 400, ErrorCode.InvalidQuery, "the query has to be at least 2 characters");
+        const { SEARCH_LIMIT } = DatabaseManager;
+        const limit = req.query.limit === undefined ? SEARCH_LIMIT : Number(req.query.limit);
+        if (!Number.isInteger(limit) || limit < 1 || limit > SEARCH_LIMIT)
+          return sendError(res, 400, ErrorCode.InvalidLimit, `the limit has to be between 1 and ${SEARCH_LIMIT}`);
         this.db
-          .find_users({})
-          .then((users) => res.send(users.map((user) => user.toJSON({ transform: false }))))
-          .catch((error) => res.status(500).send(error));
+          .search_users(query, limit, get_signal(res))
+          .then((users) => res.send(users.map((user) => user.to_preview())))
+          .catch(next);
       })
-      .delete("/:uuid", this.auth, adminMiddleware, async (req: LoggedInRequest, res) => {
-        try {
-          const user = await this.db.find_user({ uuid: req.params.uuid });
-          const machines = await this.db.find_machines({ owner_uuid: user.uuid });
-          const labels = await this.db.find_labels({ owner_uuid: user.uuid });
-
-          await user.delete();
-          await Promise.all(machines.map((machine) => machine.delete()));
-          await Promise.all(labels.map((label) => label.delete()));
-
-          res.send({ message: "deleted user" });
-        } catch (error) {
-          res.status(500).json(error);
-        }
+      .post(["/batch", "/@batch"], this.auth, validate_body(Validators.USER_BATCH_BODY), (req: LoggedInRequest, res, next) => {
+        this.db
+          .find_users_by_uuids(req.body.uuids, get_signal(res))
+          .then((users) => {
+            const map: { [uuid: string]: ISafeUser } = {};
+            users.forEach((user) => (map[user.uuid] = user.to_public()));
+            res.send(map);
+          })
+          .catch(next);
       })
-      .get("/:uuid", this.auth, async (req: LoggedInRequest, res) =>
+      .post("/@verify", this.general_limit, validate_body(Validators.EMAIL_VERIFICATION_BODY), (req, res, next) =>
+        this.verify_email(req.body.token, res).catch(next)
+      )
+      .get("/@verify", this.general_limit, validate_query(Validators.EMAIL_VERIFICATION_BODY), (req, res, next) =>
+        this.verify_email(req.query.token as string, res).catch(next)
+      )
+      .patch("/@avatar", this.auth, (req: LoggedInRequest, res, next) => {
+        if (!Validators.validate_avatar_url(req.body.url)) return sendError(res, 400, ErrorCode.InvalidUrl);
+        get_user(req)
+          .update_avatar(req.body.url)
+          .then((user) => res.send(user.to_private()))
+          .catch(next);
+      })
+      .patch("/@banner", this.auth, (req: LoggedInRequest, res, next) => {
+        if (!Validators.validate_avatar_url(req.body.url)) return sendError(res, 400, ErrorCode.InvalidUrl);
+        get_user(req)
+          .update_banner(req.body.url)
+          .then((user) => res.send(user.to_private()))
+          .catch(next);
+      })
+      .patch(
+        ["/:uuid", "/uuid/:uuid"],
+        this.auth,
+        validate_body(Validators.USER_UPDATE_BODY),
+        (req: LoggedInRequest, res, next) => {
+          const user = get_user(req);
+          if (user.uuid !== req.params.uuid && !user.is_admin)
+            return sendError(res, 403, ErrorCode.Forbidden, "you do not have permission to update this user");
+          const { update } = Validators.validate_user_update(req.body);
+          this.db
+            .update_user(req.params.uuid, update, req.body.version)
+            .then((updated) => {
+              update.email && this.verify_in_background(updated, get_logger(res));
+              res.send(updated.uuid === user.uuid ? updated.to_private() : updated.to_public());
+            })
+            .catch((error) => next(error === ErrorCode.VersionConflict ? new ApiError(409, error) : error));
+        }
+      )
+      .post(
+        ["/:uuid/password", "/uuid/:uuid/password"],
+        this.credentials_limit,
+        this.auth,
+        validate_body(Validators.PASSWORD_UPDATE_BODY),
+        (req: LoggedInRequest, res, next) => {
+          if (get_user(req).uuid !== req.params.uuid)
+            return sendError(res, 403, ErrorCode.Forbidden, "you can only change your own password");
+          this.db
+            .update_user_password(req.params.uuid, req.body.old_password, req.body.new_password, V1.device(req))
+            .then((user) => this.db.start_session(user, req.headers, V1.device(req)))
+            .then((result) => res.send(V1.auth_response(result)))
+            .catch((error) => next(error === ErrorCode.InvalidPassword ? new ApiError(401, ErrorCode.InvalidPassword) : error));
+        }
+      )
+      // Users deleting themselves need their password like through DELETE /users/@me, only admins can delete anyone else
+      .delete(
+        ["/:uuid", "/uuid/:uuid"],
+        this.auth,
+        this.credentials_limit,
+        validate_body(Validators.USER_DELETION_BODY),
+        (req: LoggedInRequest, res, next) => {
+          const user = get_user(req);
+          if (user.uuid === req.params.uuid) {
+            if (req.body.password === undefined)
+              return sendError(res, 400, ErrorCode.InvalidBody, "your password is needed to delete your own account");
+            return this.delete_own_account(req, res).catch(next);
+          }
+          if (!user.is_admin) return sendError(res, 403, ErrorCode.Forbidden, "you do not have permission to delete this user");
+          this.db
+            .soft_delete_user(req.params.uuid, user.uuid, V1.device(req))
+            .then(() => res.send({ message: "deleted user" }))
+            .catch(next);
+        }
+      )
+      .post(["/:uuid/admin", "/uuid/:uuid/admin"], this.auth, adminMiddleware, (req: LoggedInRequest, res, next) =>
         this.db
-          .find_user({ uuid: req.params.uuid })
-          .then((user) => res.send(user))
-          .catch((error) => res.status(404).json({ error }))
+          .toggle_admin(req.params.uuid, get_user(req).uuid, V1.device(req))
+          .then((user) => res.send(user.to_public()))
+          .catch((error) => next(error === ErrorCode.LastAdmin ? new ApiError(409, ErrorCode.LastAdmin) : error))
       )
-      .get("/:uuid/machines", this.auth, (req: LoggedInRequest, res) => {
+      .get(["/:uuid/audit", "/uuid/:uuid/audit"], this.auth, (req: LoggedInRequest, res, next) => {
+        const user = get_user(req);
+        if (user.uuid !== req.params.uuid && !user.is_admin)
+          return sendError(res, 403, ErrorCode.Forbidden, "you can only see your own audit log");
+        this.send_audit_logs(req, res, req.params.uuid).catch(next);
+      })
+      .get(["/:uuid", "/uuid/:uuid"], this.auth, async (req: LoggedInRequest, res, next) => {
+        const { fields, invalid } = parseFields(req.query.fields, PUBLIC_USER_FIELDS);
+        if (invalid) return V1.invalid_fields(res, PUBLIC_USER_FIELDS);
+        this.db
+          .find_public_user(req.params.uuid, get_user(req).uuid, get_signal(res))
+          .then((user) => send_versioned(req, res, versioned_etag([user], fields), () => pickFields(user, fields)))
+          .catch(next);
+      })
+      .get("/:uuid/machines", this.auth, (req: LoggedInRequest, res, next) => {
         this.db
-          .find_user({ uuid: req.params.uuid })
+          .find_visible_user(req.params.uuid, get_user(req).uuid, get_signal(res))
           .then((user) => user.get_machines(true))
-          .then((machines) => res.send(machines))
-          .catch((error) => res.status(500).json(error));
-      })
-      .patch("/@avatar", this.auth, (req: LoggedInRequest, res) => {
-        Validators.validate_avatar_url(req.body.url)
-          ? req.user!.update_avatar(req.body.url).then((user) => res.send(user))
-          : res.status(400).json({ error: "invalid url" });
-      })
-      .patch("/@banner", this.auth, (req: LoggedInRequest, res) =>
-        Validators.validate_avatar_url(req.body.url)
-          ? req.user!.update_banner(req.body.url).then((user) => res.send(user))
-          : res.status(400).json({ error: "invalid url" })
-      )
-      .post("/@signup", async (req, res) =>
-        this.db.new_user(req.body, req.headers).then(
-          ({ user, token }) => res.status(201).json({ user: user, token }),
-          (reason) => res.status(400).json({ error: reason })
-        )
+          .then((machines) => V1.send_machines(req, res, machines))
+          .catch(next);
+      })
+      .put("/@avatar", this.auth, this.upload, (req: LoggedInRequest, res, next) =>
+        this.upload_profile_image(req, res, "avatar").catch(next)
       )
-      .post("/@login", async (req, res) =>
-        this.db.login_user(req.body, req.headers).then(
-          ({ user, token }) => res.status(200).json({ user: user, token }),
-          (reason) => res.status(400).json({ error: reason })
+      .put("/@banner", this.auth, this.upload, (req: LoggedInRequest, res, next) =>
+        this.upload_profile_image(req, res, "banner").catch(next)
+      )
+      .post(["/:uuid/avatar", "/uuid/:uuid/avatar"], this.auth, this.upload, (req: LoggedInRequest, res, next) => {
+        if (get_user(req).uuid !== req.params.uuid)
+          return sendError(res, 403, ErrorCode.Forbidden, "you can only change your own avatar");
+        this.upload_profile_image(req, res, "avatar").catch(next);
+      })
+      .post(["/:uuid/banner", "/uuid/:uuid/banner"], this.auth, this.upload, (req: LoggedInRequest, res, next) => {
+        if (get_user(req).uuid !== req.params.uuid)
+          return sendError(res, 403, ErrorCode.Forbidden, "you can only change your own banner");
+        this.upload_profile_image(req, res, "banner").catch(next);
+      })
+      .post(
+        "/@signup",
+        this.credentials_limit,
+        validate_body(Validators.SIGNUP_BODY),
+        this.idempotent,
+        async (req, res, next) => {
+          this.db
+            .new_user(req.body, req.headers, V1.device(req))
+            .then((result) => {
+              this.verify_in_background(result.user, get_logger(res));
+              res.status(201).json(V1.auth_response(result));
+            })
+            .catch(next);
+        }
+      )
+      .post("/@login", this.credentials_limit, validate_body(Validators.LOGIN_BODY), async (req, res) =>
+        this.db.login_user(req.body, req.headers, V1.device(req), get_logger(res)).then(
+          (result) => res.status(200).json(V1.auth_response(result)),
+          (error) =>
+            error === ErrorCode.AccountDisabled
+              ? sendError(res, 403, ErrorCode.AccountDisabled)
+              : sendError(res, 401, ErrorCode.InvalidCredentials)
         )
+      )
+      .post("/@resend_verification", this.auth, this.verification_limit, (req: LoggedInRequest, res, next) =>
+        this.send_verification(get_user(req))
+          .then(() => res.json({ message: "verification email sent" }))
+          .catch((error) => next(error === ErrorCode.EmailAlreadyVerified ? new ApiError(409, error) : error))
+      )
+      // The paths from before /password, the frontend still uses them
+      .post("/@forgot_password", this.credentials_limit, validate_body(Validators.FORGOT_PASSWORD_BODY), (req, res) =>
+        this.forgot_password(req.body.email, res)
+      )
+      .post("/@reset_password", this.credentials_limit, validate_body(Validators.PASSWORD_RESET_BODY), (req, res, next) =>
+        this.reset_password(req.body.token, req.body.new_password, V1.device(req), res).catch(next)
       );
   }
 
+  private generate_password_routes() {
+    return express
+      .Router()
+      .post("/forgot", this.credentials_limit, validate_body(Validators.FORGOT_PASSWORD_BODY), (req, res) =>
+        this.forgot_password(req.body.email, res)
+      )
+      .post("/reset", this.credentials_limit, validate_body(Validators.PASSWORD_RESET_BODY), (req, res, next) =>
+        this.reset_password(req.body.token, req.body.new_password, V1.device(req), res).catch(next)
+      );
+  }
+
+  /**
+   * Responds the same whether the email belongs to anyone so it can't be used to find out who has an account
+   */
+  private forgot_password(email: string, res: Response) {
+    this.send_password_reset(email).catch((error) => get_logger(res).error("Failed to send a password reset email", error));
+    res.json({ message: "if an account has that email a reset link was sent to it" });
+  }
+
+  /**
+   * Sets the new password, expired, used and made up tokens are a 400 with the reason
+   */
+  private async reset_password(token: string, password: string, device: ISessionDevice, res: Response) {
+    await this.db
+      .reset_password(token, password, device)
+      .catch((error) => Promise.reject(V1.EMAIL_TOKEN_ERRORS.includes(error) ? new ApiError(400, error) : error));
+    res.json({ message: "password reset, log in with the new one" });
+  }
+
+  /**
+   * Emails the user with an email the link that resets their password, does nothing if there's no such user
+   */
+  private async send_password_reset(email: string) {
+    const reset = await this.db.request_password_reset(email);
+    if (!reset) return;
+    await this.mailer.send({
+      to: reset.user.email,
+      subject: "Reset your Xornet password",
+      text: [
+        `Hi ${reset.user.username},`,
+        "",
+        "Open this link to choose a new password, it works once and expires in 30 minutes:",
+        `${this.config.email_links.password_reset}?token=${encodeURIComponent(reset.token)}`,
+        "",
+        "If you didn't ask for this you can ignore this email, your password stays the same.",
+      ].join("\n"),
+    });
+  }
+
+  /**
+   * Emails a user the link that verifies their email
+   */
+  private async send_verification(user: IUser) {
+    const token = await this.db.new_email_verification(user);
+    await this.mailer.send({
+      to: user.email,
+      subject: "Verify your Xornet email",
+      text: [
+        `Hi ${user.username},`,
+        "",
+        "Open this link to verify your email, it works once and expires in a day:",
+        `${this.config.email_links.verification}?token=${encodeURIComponent(token)}`,
+        "",
+        "If you didn't sign up for Xornet you can ignore this email.",
+      ].join("\n"),
+    });
+  }
+
+  /**
+   * Marks the email the verification token was sent to as verified
+   */
+  private async verify_email(token: string, res: Response) {
+    const user = await this.db
+      .verify_email(token)
+      .catch((error) => Promise.reject(V1.EMAIL_TOKEN_ERRORS.includes(error) ? new ApiError(400, error) : error));
+    res.json(user.to_private());
+  }
+
+  /**
+   * Schedules the logged in user for deletion, the password in the body has to be theirs so a stolen token can't do it
+   */
+  private async delete_own_account(req: LoggedInRequest, res: Response) {
+    const purged_at = await this.db
+      .request_user_deletion(get_user(req).uuid, req.body.password)
+      .catch((error) => Promise.reject(error === ErrorCode.InvalidPassword ? new ApiError(401, error) : error));
+    res.send({ message: "account scheduled for deletion, log in to cancel it", purged_at });
+  }
+
+  /**
+   * Sends the verification email without making the request wait for it or fail with it, the user can ask for it again
+   */
+  private verify_in_background(user: IUser, logger: ScopedLogger) {
+    if (user.email_verified) return;
+    this.send_verification(user).catch((error) => logger.error("Failed to send a verification email", error));
+  }
+
+  /**
+   * Generates a key for the logged in user to sign a reporter up with
+   */
+  private async new_signup_key(req: LoggedInRequest, res: Response) {
+    const { key, expires_at } = await this.db
+      .new_signup_key(get_user(req).uuid)
+      .catch((error) => Promise.reject(error === ErrorCode.TooManyKeys ? new ApiError(429, error) : error));
+    res.json({ key, expiration: expires_at.getTime() });
+  }
+
+  /**
+   * Stores an uploaded avatar or banner and deletes the one it replaces,
+   * accepts either a multipart/form-data body or the raw image as the body
+   */
+  private async upload_profile_image(req: LoggedInRequest, res: Response, field: "avatar" | "banner") {
+    const upload = readImageUpload(req.body, req.headers["content-type"], this.config.limits.profile_image);
+    if ("code" in upload) return sendError(res, upload.status, upload.code);
+    const { file, type } = upload;
+    const image = await resizeImage(file, type, PROFILE_IMAGE_SIZES[field]).catch(() => undefined);
+    if (!image) return sendError(res, 400, ErrorCode.InvalidFile);
+
+    const user = get_user(req);
+    const previous = user[field];
+    const url = await saveUpload(this.config, image, type);
+    field === "avatar" ? await user.update_avatar(url) : await user.update_banner(url);
+    await deleteUpload(this.config, previous);
+    res.send(user.to_private());
+  }
+
   private generate_label_routes() {
     return express
       .Router()
-      .get("/all", this.auth, async (req: LoggedInRequest, res) =>
+      .get(["/", "/all"], this.scoped("read:labels"), async (req: LoggedInRequest, res, next) =>
         this.db
-          .find_labels({ owner_uuid: req.user!.uuid })
+          .find_labels({ owner_uuid: get_user(req).uuid }, get_signal(res))
           .then((labels) => res.send(labels))
-          .catch((error) => res.status(404).json(error))
+          .catch(next)
       )
-      .get("/admin/all", this.auth, adminMiddleware, async (req: LoggedInRequest, res) =>
+      .get("/admin/all", this.auth, adminMiddleware, async (req: LoggedInRequest, res, next) =>
         this.db
-          .find_labels({})
+          .find_labels({}, get_signal(res))
           .then((labels) => res.send(labels))
-          .catch((error) => res.status(404).json(error))
+          .catch(next)
       )
-      .get("/:uuid", this.auth, async (req: LoggedInRequest, res) =>
+      .get(["/:uuid", "/uuid/:uuid"], this.scoped("read:labels"), async (req: LoggedInRequest, res, next) =>
         this.db
-          .find_label({ uuid: req.params.uuid })
+          .find_label({ uuid: req.params.uuid, owner_uuid: get_user(req).uuid }, get_signal(res))
           .then((label) => res.send(label))
-          .catch((error) => res.status(404).json(error))
+          .catch(next)
       )
-      .delete("/:uuid", this.auth, async (req: LoggedInRequest, res) =>
+      .delete("/:uuid", this.scoped("write:labels"), async (req: LoggedInRequest, res, next) =>
         this.db
-          .find_label({ uuid: req.params.uuid, owner_uuid: req.user!.uuid })
+          .find_label({ uuid: req.params.uuid, owner_uuid: get_user(req).uuid }, get_signal(res))
           .then(async (label) => {
-            const machines = await this.db.find_machines({ labels: label.uuid });
+            const machines = await this.db.find_machines({ labels: label.uuid }, get_signal(res));
             await Promise.all(machines.map((machine) => machine.remove_label(label.uuid)));
             return label.delete();
           })
           .then(() => res.send({ message: "deleted label" }))
-          .catch((error) => res.status(403).json(error))
+          .catch(next)
       )
-      .patch<{}, {}, ICreateLabelInput>("/:uuid", this.auth, async (req: LoggedInRequest, res) =>
+      .patch<{}, {}, ICreateLabelInput>("/:uuid", this.scoped("write:labels"), async (req: LoggedInRequest, res, next) =>
         this.db
-          .find_label({ uuid: req.params.uuid, owner_uuid: req.user!.uuid })
+          .find_label({ uuid: req.params.uuid, owner_uuid: get_user(req).uuid }, get_signal(res))
           .then((label) => {
             req.body.name && Validators.validate_label_name(req.body.name) && (label.name = req.body.name);
             req.body.color && Validators.validate_hex_color(req.body.color) && (label.color = req.body.color);
@@ -150,99 +742,673 @@ export class V1 {
             return label.save();
           })
           .then((label) => res.json(label))
-          .catch((error) => res.status(403).json(error))
+          .catch(next)
       )
-      .post("/new", this.auth, (req: LoggedInRequest, res) => {
+      .post(["/", "/new"], this.scoped("write:labels"), this.idempotent, (req: LoggedInRequest, res, next) => {
         this.db
-          .new_label({ ...req.body, owner_uuid: req.user!.uuid })
+          .new_label({ ...req.body, owner_uuid: get_user(req).uuid })
           .then((label) => res.status(201).json(label))
-          .catch((error) => res.status(400).json(error));
+          .catch(next);
       });
   }
 
-  private generate_machine_routes() {
+  private generate_datacenter_routes() {
     return express
       .Router()
-      .get("/@newkey", this.auth, (req: LoggedInRequest, res) => res.json(this.keyManager.createNewKey(req.user!.uuid)))
-      .post("/@signup", async (req, res) => {
-        const { two_factor_key, hardware_uuid, hostname } = req.body;
-        const userUuid = this.keyManager.validate(two_factor_key);
+      .get("/", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_datacenters({ $or: [{ owner_uuid: get_user(req).uuid }, { members: get_user(req).uuid }] }, get_signal(res))
+          .then((datacenters) => res.send(datacenters))
+          .catch(next)
+      )
+      .post(
+        ["/", "/new"],
+        this.auth,
+        validate_body(Validators.DATACENTER_BODY),
+        this.idempotent,
+        (req: LoggedInRequest, res, next) =>
+          this.db
+            .new_datacenter({ ...req.body, owner_uuid: get_user(req).uuid })
+            .then((datacenter) => res.status(201).json(datacenter))
+            .catch(next)
+      )
+      .get("/:uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_datacenter(
+            { uuid: req.params.uuid, $or: [{ owner_uuid: get_user(req).uuid }, { members: get_user(req).uuid }] },
+            get_signal(res)
+          )
+          .then((datacenter) => res.send(datacenter))
+          .catch(next)
+      )
+      .get("/:uuid/summary", this.auth, (req: LoggedInRequest, res, next) => {
+        const { uuid } = get_user(req);
+        this.summaries
+          .wrap("datacenter", req.params.uuid, `viewer:${uuid}`, () =>
+            this.db.get_datacenter_summary(req.params.uuid, uuid, get_signal(res))
+          )
+          .then((summary) => res.json(summary))
+          .catch(next);
+      })
+      .patch("/:uuid", this.auth, validate_body(Validators.DATACENTER_UPDATE_BODY), (req: LoggedInRequest, res, next) =>
+        this.db
+          .update_datacenter_profile(req.params.uuid, get_user(req).uuid, req.body)
+          .then((datacenter) => res.json(datacenter))
+          .catch(next)
+      )
+      .delete("/:uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .delete_datacenter(req.params.uuid, get_user(req).uuid)
+          .then((datacenter) => this.revoke_access(datacenter.members, datacenter.machines))
+          .then(() => res.send({ message: "deleted datacenter" }))
+          .catch(next)
+      )
+      .put("/:uuid/machines/:machine_uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_machine({ uuid: req.params.machine_uuid, owner_uuid: get_user(req).uuid }, get_signal(res))
+          .then((machine) =>
+            this.db.update_datacenter(req.params.uuid, get_user(req).uuid, { $addToSet: { machines: machine.uuid } })
+          )
+          .then(async (datacenter) => {
+            await Promise.all(
+              datacenter.members.map((member) => this.websocketManager.setAccess(member, [req.params.machine_uuid], true))
+            );
+            res.json(datacenter);
+          })
+          .catch(next)
+      )
+      .delete("/:uuid/machines/:machine_uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .update_datacenter(req.params.uuid, get_user(req).uuid, { $pull: { machines: req.params.machine_uuid } })
+          .then(async (datacenter) => {
+            await this.revoke_access(datacenter.members, [req.params.machine_uuid]);
+            res.json(datacenter);
+          })
+          .catch(next)
+      )
+      .put("/:uuid/members/:user_uuid", this.auth, (req: LoggedInRequest, res, next) => {
+        if (req.params.user_uuid === get_user(req).uuid)
+          return sendError(res, 400, ErrorCode.InvalidMember, "you already own this datacenter");
+        this.db
+          .find_user({ uuid: req.params.user_uuid }, get_signal(res))
+          .then((user) => this.db.update_datacenter(req.params.uuid, get_user(req).uuid, { $addToSet: { members: user.uuid } }))
+          .then(async (datacenter) => {
+            await this.websocketManager.setAccess(req.params.user_uuid, datacenter.machines, true);
+            res.json(datacenter);
+          })
+          .catch(next);
+      })
+      .delete("/:uuid/members/:user_uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .update_datacenter(req.params.uuid, get_user(req).uuid, { $pull: { members: req.params.user_uuid } })
+          .then(async (datacenter) => {
+            await this.revoke_access([req.params.user_uuid], datacenter.machines);
+            res.json(datacenter);
+          })
+          .catch(next)
+      );
+  }
+
+  /**
+   * Cuts the websocket feed of some users for the machines they can't see anymore,
+   * they keep the ones they still have access to through something else like another datacenter
+   */
+  private async revoke_access(user_uuids: string[], machine_uuids: string[]) {
+    if (!machine_uuids.length) return;
+    await Promise.all(
+      user_uuids.map(async (user_uuid) => {
+        const accessible = await this.db.find_accessible_machines(user_uuid, machine_uuids);
+        const kept = new Set(accessible.map((machine) => machine.uuid));
+        const lost = machine_uuids.filter((uuid) => !kept.has(uuid));
+        await this.websocketManager.setAccess(user_uuid, lost, false);
+      })
+    );
+  }
+
+  /**
+   * Adds or removes a label from a machine, both of them have to belong to the logged in user
+   */
+  private async set_machine_label(req: LoggedInRequest, res: Response, machine_uuid: string, label_uuid: string, add: boolean) {
+    const owner_uuid = get_user(req).uuid;
+    const machine = await this.db.find_machine({ uuid: machine_uuid, owner_uuid }, get_signal(res));
+    const label = await this.db.find_label({ uuid: label_uuid, owner_uuid }, get_signal(res));
+    add ? await machine.add_label(label.uuid) : await machine.remove_label(label.uuid);
+    res.send({ message: add ? "label added" : "label removed" });
+  }
+
+  /**
+   * Streams a zip of everything stored about a user with the stats of each of their machines as newline delimited JSON,
+   * the stats are read through cursors and written as they're read so the archive is never held in memory
+   */
+  private async export_user(req: LoggedInRequest, res: Response, range: Pick<StatsRange, "from" | "to">) {
+    const user = get_user(req);
+    const data = await this.db.find_user_export(user, get_signal(res));
+    const exported_at = Date.now();
+    // What's in the archive, the stats files say how many points they have and whether the cap cut them off
+    const manifest = { user_uuid: user.uuid, exported_at, range, files: {} as { [name: string]: object } };
+    const date = new Date(exported_at).toISOString().slice(0, 10);
+    res.status(200).set({
+      "Content-Type": "application/zip",
+      "Content-Disposition": `attachment; filename="xornet-${user.username}-${date}.zip"`,
+    });
+
+    const zip = new ZipWriter(res);
+    const json = (value: unknown) => JSON.stringify(value, null, 2);
+    try {
+      for (const [name, value] of Object.entries(data)) {
+        await zip.add(`${name}.json`, json(value));
+        manifest.files[`${name}.json`] = { count: Array.isArray(value) ? value.length : 1 };
+      }
+      for (const machine of data.machines) {
+        for (const rollups of [false, true]) {
+          const name = `stats/${machine.uuid}${rollups ? ".hourly" : ""}.ndjson`;
+          // One more than the cap is read to know whether the cap cut it off
+          const cursor = this.db.export_stats(machine.uuid, range, rollups, MAX_EXPORT_POINTS + 1);
+          const written = { count: 0, truncated: false };
+          try {
+            await zip.add(name, ndjson(cursor, MAX_EXPORT_POINTS, written));
+          } finally {
+            await cursor.close();
+          }
+          manifest.files[name] = written;
+        }
+      }
+      await zip.add("export.json", json(manifest));
+      await zip.finish();
+      res.end();
+    } catch (error) {
+      // The headers went out already so the download is cut off instead, a zip without its end doesn't open
+      get_signal(res)?.aborted || get_logger(res).error(`Failed to export the data of ${user.uuid}`, error);
+      res.destroy();
+    }
+  }
+
+  /**
+   * Streams the live stats of a machine as Server-Sent Events for the networks that block websockets,
+   * it's fed by the same hub as the websockets and starts with the latest stats so a reconnect doesn't miss the state
+   * @param event What the stats events are called, "message" is what an EventSource hands to its onmessage
+   */
+  private async stream_stats(req: LoggedInRequest, res: Response, machine_uuid: string, event = "stats") {
+    const user = get_user(req);
+    const [machine] = await this.db.find_accessible_machines(user.uuid, [machine_uuid], get_signal(res));
+    if (!machine) return Promise.reject(ErrorCode.MachineNotFound);
+    const { clientHub } = this.websocketManager;
+    // The hub subscribes every client of a user to their new machines, a stream only sends the one it's for
+    const stream = new SseConnection<ClientToBackendEvents>(
+      req,
+      res,
+      { "dynamic-data": event },
+      (data) => (data as { uuid?: string })?.uuid === machine.uuid
+    );
+    clientHub.register(stream, user.uuid, [machine.uuid]);
+    // Shutting down ends the streams so they reconnect to another shard
+    get_signal(res)?.addEventListener("abort", () => stream.close(), { once: true });
+    const latest = this.websocketManager.snapshot([machine])[machine.uuid];
+    latest && stream.send(event, latest);
+  }
+
+  /**
+   * Finds the latest disks and processes of a machine the user can see, the others are treated as missing
+   */
+  private async find_machine_details(req: LoggedInRequest, res: Response) {
+    const machines = await this.db.find_accessible_machines(get_user(req).uuid, [req.params.uuid], get_signal(res));
+    if (!machines.length) throw ErrorCode.MachineNotFound;
+    return this.db.find_machine_details(req.params.uuid, get_signal(res));
+  }
+
+  /**
+   * Streams the public stats of the machine a share link is for, it ends as soon as the link is revoked or expires
+   */
+  private async stream_shared_stats(req: express.Request, res: Response, token: string) {
+    const link = await this.db.find_share_link(token, get_signal(res));
+    const machine = await this.db.find_machine({ uuid: link.machine_uuid }, get_signal(res));
+    const stream = new SseConnection<PublicStreamEvents>(req, res, { stats: "stats" });
+    this.websocketManager.publicHub.register(stream, link.uuid, [machine.uuid]);
+    this.websocketManager.watchShare(link, stream);
+    get_signal(res)?.addEventListener("abort", () => stream.close(), { once: true });
+    const latest = this.websocketManager.snapshot([machine])[machine.uuid];
+    latest && stream.send("stats", public_stats(latest));
+  }
 
-        if (!userUuid) return res.status(403).json({ error: "the 2FA token you provided has expired" });
+  /**
+   * Hands a machine to another user and moves the websocket feed of the machine along with it,
+   * the share links of the previous owner stop working
+   */
+  private async transfer_machine(req: LoggedInRequest, res: Response, machine_uuid: string, to_uuid: string) {
+    const links = await this.db.find_share_links(machine_uuid, get_user(req).uuid, get_signal(res));
+    const machine = await this.db
+      .transfer_machine(machine_uuid, get_user(req).uuid, to_uuid, V1.device(req))
+      .catch((error) => Promise.reject(error === ErrorCode.Forbidden ? new ApiError(403, error) : error));
+    await this.websocketManager.revokeMachine(machine_uuid);
+    await this.revoke_access([get_user(req).uuid], [machine_uuid]);
+    await this.websocketManager.setAccess(to_uuid, [machine_uuid], true);
+    await this.websocketManager.revokeShares(links.map((link) => link.uuid));
+    res.json(machine);
+  }
+
+  private generate_machine_routes() {
+    return express
+      .Router()
+      .get("/", this.scoped("read:machines"), (req: LoggedInRequest, res, next) => {
+        // Filtering by owner only narrows down what the logged in user can see so it can't list anyone else's machines
+        const owner = req.query.owner as string | undefined;
+        if (owner !== undefined && !Validators.validate_uuid(owner)) return sendError(res, 400, ErrorCode.InvalidOwner);
+        const tag = req.query.tag as string | undefined;
+        if (tag !== undefined && !Validators.validate_machine_tag(tag)) return sendError(res, 400, ErrorCode.InvalidTag);
+        const { fields, invalid } = parseFields(req.query.fields, MACHINE_FIELDS);
+        if (invalid) return V1.invalid_fields(res, MACHINE_FIELDS);
+        const filter = { ...(tag !== undefined && { tags: tag }), ...(owner !== undefined && { owner_uuid: owner }) };
         this.db
-          .find_user({ uuid: userUuid })
-          .then((user) => {
-            this.db
-              .new_machine({ owner_uuid: user.uuid, hardware_uuid, hostname })
-              .then((machine) => {
-                // broadcast to everyone
-                // TODO: probably move this redis line somewhere else
-                redisPublisher.publish("machine-added", JSON.stringify(machine));
-                res.json({ access_token: machine.access_token });
-              })
-              .catch((error: MongoAPIError) => {
-                switch (error.code) {
-                  case 11000:
-                    res.status(400).json({ error: "this machine is already registered in the database" });
-                    break;
-                  default:
-                    res.status(500).json({ error });
-                    break;
-                }
-              });
-          })
-          .catch((error) => res.status(404).json({ error }));
-      })
-      .post("/label/:machine_uuid/:label_uuid", this.auth, (req: LoggedInRequest, res) => {
-        this.db
-          .find_machine({ uuid: req.params.machine_uuid })
-          .then((machine) => {
-            this.db
-              .find_label({ uuid: req.params.label_uuid })
-              .then((label) => {
-                if (machine.owner_uuid !== label.owner_uuid)
-                  return Promise.reject({ error: "you are not allowed to add this label to this machine" });
-                return machine.add_label(label.uuid);
-              })
-              .catch((e) => res.status(403).json(e))
-              .then(() => res.send({ message: "label added" }))
-              .catch((error) => res.status(404).json(error));
-          })
-          .catch((error) => res.status(404).json(error));
-      })
-      .delete("/label/:machine_uuid/:label_uuid", this.auth, (req: LoggedInRequest, res) => {
-        this.db
-          .find_machine({ uuid: req.params.machine_uuid })
-          .then((machine) => {
-            this.db
-              .find_label({ uuid: req.params.label_uuid })
-              .then((label) => {
-                if (machine.owner_uuid !== label.owner_uuid)
-                  return Promise.reject({ error: "you are not allowed to remove this label from this machine" });
-                return machine.remove_label(label.uuid);
-              })
-              .catch((e) => res.status(403).json(e))
-              .then(() => res.send({ message: "label removed" }))
-              .catch((error) => res.status(404).json(error));
-          })
-          .catch((error) => res.status(404).json(error));
-      })
-      .get("/:uuid", this.auth, async (req: LoggedInRequest, res) =>
-        this.db
-          .find_machine({ uuid: req.params.uuid })
+          .find_accessible_machines(get_user(req).uuid, undefined, get_signal(res), filter, fields)
+          .then((machines) => V1.send_machines(req, res, machines, fields))
+          .catch(next);
+      })
+      .get("/@newkey", this.auth, verifiedMiddleware, (req: LoggedInRequest, res, next) =>
+        this.new_signup_key(req, res).catch(next)
+      )
+      // Only the owner can hand a machine over, the reporter has to sign up again with the token of the new owner
+      .post(
+        "/:uuid/transfer",
+        this.auth,
+        validate_body(Validators.MACHINE_TRANSFER_BODY),
+        (req: LoggedInRequest, res, next) => {
+          if (req.body.to_uuid === get_user(req).uuid) return sendError(res, 400, ErrorCode.InvalidRecipient);
+          this.transfer_machine(req, res, req.params.uuid, req.body.to_uuid).catch(next);
+        }
+      )
+      .post(
+        "/@signup",
+        this.credentials_limit,
+        validate_body(Validators.MACHINE_SIGNUP_BODY),
+        this.idempotent,
+        async (req, res, next) => {
+          const { two_factor_key, hardware_uuid, hostname } = req.body as MachineSignupInput;
+          this.db
+            .consume_signup_key(two_factor_key)
+            .catch((error) => Promise.reject(V1.KEY_ERRORS.includes(error) ? new ApiError(403, error) : error))
+            .then((owner_uuid) => this.db.find_user({ uuid: owner_uuid }, get_signal(res)))
+            // The owner could have changed their email since generating the key
+            .then((user) => (user.email_verified ? user : Promise.reject(new ApiError(403, ErrorCode.EmailNotVerified))))
+            .then((user) => this.db.new_machine({ owner_uuid: user.uuid, hardware_uuid, hostname }))
+            .then((machine) => {
+              // broadcast to everyone
+              // TODO: probably move this redis line somewhere else
+              redisPublisher.publish("machine-added", JSON.stringify(machine));
+              res.json({ access_token: machine.access_token });
+            })
+            .catch((error) => next(error?.code === 11000 ? new ApiError(409, ErrorCode.MachineExists) : error));
+        }
+      )
+      .put("/:uuid/labels/:label_uuid", this.scoped("write:labels"), (req: LoggedInRequest, res, next) =>
+        this.set_machine_label(req, res, req.params.uuid, req.params.label_uuid, true).catch(next)
+      )
+      .delete("/:uuid/labels/:label_uuid", this.scoped("write:labels"), (req: LoggedInRequest, res, next) =>
+        this.set_machine_label(req, res, req.params.uuid, req.params.label_uuid, false).catch(next)
+      )
+      .post("/label/:machine_uuid/:label_uuid", this.scoped("write:labels"), (req: LoggedInRequest, res, next) =>
+        this.set_machine_label(req, res, req.params.machine_uuid, req.params.label_uuid, true).catch(next)
+      )
+      .delete("/label/:machine_uuid/:label_uuid", this.scoped("write:labels"), (req: LoggedInRequest, res, next) =>
+        this.set_machine_label(req, res, req.params.machine_uuid, req.params.label_uuid, false).catch(next)
+      )
+      .post(
+        "/:uuid/tags",
+        this.scoped("write:machines"),
+        validate_body(Validators.MACHINE_TAG_BODY),
+        (req: LoggedInRequest, res, next) =>
+          this.db
+            .add_machine_tag(req.params.uuid, get_user(req).uuid, req.body.tag)
+            .then((machine) => res.send(machine))
+            .catch((error) => next(error === ErrorCode.Forbidden ? new ApiError(403, error) : error))
+      )
+      .delete("/:uuid/tags/:tag", this.scoped("write:machines"), (req: LoggedInRequest, res, next) => {
+        if (!Validators.validate_machine_tag(req.params.tag)) return sendError(res, 400, ErrorCode.InvalidTag);
+        this.db
+          .remove_machine_tag(req.params.uuid, get_user(req).uuid, req.params.tag)
           .then((machine) => res.send(machine))
-          .catch((error) => res.status(404).json(error))
-      )
-      .delete("/:uuid", this.auth, async (req: LoggedInRequest, res) => {
-        if (!Validators.validate_uuid(req.params.uuid)) return res.status(400).json({ error: "uuid is invalid" });
-        const machine = await this.db.find_machine({ uuid: req.params.uuid });
-        if (!machine) return res.status(404).json({ error: "machine not found" });
-        if (machine.owner_uuid !== req.user!.uuid)
-          return res.status(403).json({ error: "you are not the owner of this machine" });
-        machine
-          .delete()
-          .then(() => res.json({ message: "gon" }))
-          .catch((error: any) => res.status(500).json({ error }));
+          .catch((error) => next(error === ErrorCode.Forbidden ? new ApiError(403, error) : error));
+      })
+      .post(["/:uuid/token", "/:uuid/@regenerate_token"], this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .rotate_machine_token(req.params.uuid, get_user(req).uuid, V1.device(req))
+          .then(async (access_token) => {
+            await this.websocketManager.revokeMachine(req.params.uuid);
+            res.json({ access_token });
+          })
+          .catch((error) => next(error === ErrorCode.Forbidden ? new ApiError(403, error) : error))
+      )
+      .put("/:uuid/access/:user_uuid", this.auth, (req: LoggedInRequest, res, next) => {
+        if (req.params.user_uuid === get_user(req).uuid)
+          return sendError(res, 400, ErrorCode.InvalidMember, "you already own this machine");
+        this.db
+          .share_machine(req.params.uuid, get_user(req).uuid, req.params.user_uuid)
+          .then(async (machine) => {
+            await this.websocketManager.setAccess(req.params.user_uuid, [machine.uuid], true);
+            res.json({ shared_with: machine.access });
+          })
+          .catch((error) => next(error === ErrorCode.Forbidden ? new ApiError(403, error) : error));
+      })
+      .delete("/:uuid/access/:user_uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .unshare_machine(req.params.uuid, get_user(req).uuid, req.params.user_uuid)
+          .then(async (machine) => {
+            await this.revoke_access([req.params.user_uuid], [machine.uuid]);
+            res.json({ shared_with: machine.access });
+          })
+          .catch((error) => next(error === ErrorCode.Forbidden ? new ApiError(403, error) : error))
+      )
+      .post(
+        "/:uuid/@share",
+        this.auth,
+        validate_body(Validators.SHARE_LINK_BODY),
+        this.idempotent,
+        (req: LoggedInRequest, res, next) =>
+          this.db
+            .new_share_link(req.params.uuid, get_user(req).uuid, req.body)
+            .then((link) => res.status(201).json(link))
+            .catch((error) =>
+              next(
+                error === ErrorCode.Forbidden
+                  ? new ApiError(403, error)
+                  : error === ErrorCode.TooManyShareLinks
+                  ? new ApiError(429, error)
+                  : error
+              )
+            )
+      )
+      .get("/:uuid/shares", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_machine({ uuid: req.params.uuid, owner_uuid: get_user(req).uuid }, get_signal(res))
+          .then(() => this.db.find_share_links(req.params.uuid, get_user(req).uuid, get_signal(res)))
+          .then((links) => res.json(links))
+          .catch(next)
+      )
+      .delete("/:uuid/shares/:share_uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .delete_share_link(req.params.share_uuid, req.params.uuid, get_user(req).uuid)
+          .then(async (link) => {
+            await this.websocketManager.revokeShares([link.uuid]);
+            res.json({ message: "share link revoked" });
+          })
+          .catch(next)
+      )
+      .post("/:uuid/stats", validate_body(Validators.DYNAMIC_DATA_BODY, ErrorCode.InvalidStats), (req, res, next) => {
+        const access_token = req.header("X-Machine-Token");
+        if (!access_token) return sendError(res, 401, ErrorCode.TokenRequired);
+
+        this.db
+          .find_machine_by_token(access_token)
+          .catch(nullIfNotFound(ErrorCode.MachineNotFound))
+          .then(async (machine) => {
+            if (!machine || machine.uuid !== req.params.uuid)
+              return sendError(res, 403, ErrorCode.TokenInvalid, "invalid access token");
+            res.json(await this.websocketManager.ingestDynamicData(machine, req.body));
+          })
+          .catch(next);
+      })
+      .post(
+        "/stats/compare",
+        this.scoped("read:stats"),
+        validate_body(Validators.STATS_COMPARE_BODY),
+        async (req: LoggedInRequest, res, next) => {
+          const { range, error } = parseStatsRange(req.body);
+          if (!range) return sendError(res, 400, error!);
+          const uuids: string[] = req.body.uuids;
+          try {
+            const accessible = await this.db.find_accessible_machines(get_user(req).uuid, uuids, get_signal(res));
+            const machines = accessible.map((machine) => machine.uuid);
+            const unauthorized = uuids.filter((uuid) => !machines.includes(uuid));
+            const comparison = await this.db.find_stats_comparison(machines, range, get_signal(res));
+            res.json({ ...comparison.range, machines, unauthorized, points: comparison.points });
+          } catch (error) {
+            next(error);
+          }
+        }
+      )
+      .get("/:uuid/stats/history", this.scoped("read:stats"), (req: LoggedInRequest, res, next) => {
+        const { range, error } = parseStatsRange(req.query);
+        if (!range) return sendError(res, 400, error!);
+        this.db
+          .find_accessible_machines(get_user(req).uuid, [req.params.uuid], get_signal(res))
+          .then((machines) => {
+            // Machines the user can't see are treated as missing so their uuids can't be probed
+            if (!machines.length) throw ErrorCode.MachineNotFound;
+            return this.db.find_stats_history(req.params.uuid, range, get_signal(res));
+          })
+          .then(({ range, points }) => res.json({ ...range, points }))
+          .catch(next);
+      })
+      .get("/:uuid/stats/stream", this.scoped("read:stats"), (req: LoggedInRequest, res, next) =>
+        this.stream_stats(req, res, req.params.uuid).catch(next)
+      )
+      .get("/:uuid/disks", this.scoped("read:stats"), (req: LoggedInRequest, res, next) =>
+        this.find_machine_details(req, res)
+          .then((details) => res.json({ updated_at: details?.updated_at, disks: details?.disks ?? [] }))
+          .catch(next)
+      )
+      .get("/:uuid/processes", this.scoped("read:stats"), (req: LoggedInRequest, res, next) =>
+        this.find_machine_details(req, res)
+          .then((details) => res.json({ updated_at: details?.updated_at, processes: details?.processes ?? [] }))
+          .catch(next)
+      )
+      // Only the owner sees the rules since the webhook urls are as good as passwords
+      .get("/:uuid/alerts", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_machine({ uuid: req.params.uuid, owner_uuid: get_user(req).uuid }, get_signal(res))
+          .then(() => this.db.find_alerts(req.params.uuid, get_user(req).uuid, get_signal(res)))
+          .then((alerts) => res.json(alerts))
+          .catch(next)
+      )
+      .post(
+        "/:uuid/alerts",
+        this.auth,
+        validate_body(Validators.ALERT_BODY),
+        this.idempotent,
+        (req: LoggedInRequest, res, next) =>
+          this.db
+            .new_alert(req.params.uuid, get_user(req).uuid, req.body)
+            .then((alert) => {
+              this.websocketManager.alerts.invalidate(req.params.uuid);
+              res.status(201).json(alert);
+            })
+            .catch((error) => next(error === ErrorCode.TooManyAlerts ? new ApiError(429, error) : error))
+      )
+      .delete("/:uuid/alerts/:alert_uuid", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .delete_alert(req.params.alert_uuid, req.params.uuid, get_user(req).uuid)
+          .then(() => {
+            this.websocketManager.alerts.invalidate(req.params.uuid);
+            res.json({ message: "alert deleted" });
+          })
+          .catch(next)
+      )
+      .get("/:uuid/uptime", this.scoped("read:stats"), (req: LoggedInRequest, res, next) => {
+        const days = req.query.days === undefined ? 30 : Number(req.query.days);
+        if (!Number.isInteger(days) || days < 1 || days * Time.Day > this.config.machines.events_retention)
+          return sendError(res, 400, ErrorCode.InvalidDays);
+        this.db
+          .find_accessible_machines(get_user(req).uuid, [req.params.uuid], get_signal(res))
+          .then((machines) => {
+            if (!machines.length) throw ErrorCode.MachineNotFound;
+            return this.db.find_machine_uptime(req.params.uuid, days, get_signal(res));
+          })
+          .then((uptime) => res.json({ days, ...uptime }))
+          .catch(next);
+      })
+      .get("/:uuid/stats", this.scoped("read:stats"), (req: LoggedInRequest, res, next) => {
+        const metric = req.query.metric as keyof IStatValues;
+        if (!STAT_FIELDS.includes(metric))
+          return sendError(res, 400, ErrorCode.InvalidMetric, `the metric has to be one of ${STAT_FIELDS.join(", ")}`);
+        const { range, error } = parseStatsRange(req.query);
+        if (!range) return sendError(res, 400, error!);
+        this.db
+          .find_accessible_machines(get_user(req).uuid, [req.params.uuid], get_signal(res))
+          .then((machines) => {
+            if (!machines.length) throw ErrorCode.MachineNotFound;
+            return this.db.find_stats_metric(req.params.uuid, metric, range, get_signal(res));
+          })
+          .then(({ range, points }) => res.json({ metric, from: range.from, to: range.to, interval: range.resolution, points }))
+          .catch(next);
+      })
+      .get(["/:uuid", "/uuid/:uuid"], this.scoped("read:machines"), async (req: LoggedInRequest, res, next) =>
+        this.db
+          .find_accessible_machines(get_user(req).uuid, [req.params.uuid], get_signal(res))
+          .then(([machine]) => (machine ? V1.send_machines(req, res, machine) : Promise.reject(ErrorCode.MachineNotFound)))
+          .catch(next)
+      )
+      .patch(
+        "/:uuid",
+        this.scoped("write:machines"),
+        validate_body(Validators.MACHINE_UPDATE_BODY),
+        (req: LoggedInRequest, res, next) =>
+          this.db
+            .update_machine(req.params.uuid, get_user(req).uuid, req.body)
+            .then((machine) => res.send(machine))
+            .catch((error) => next(error === ErrorCode.Forbidden ? new ApiError(403, error) : error))
+      )
+      .delete("/:uuid", this.auth, async (req: LoggedInRequest, res, next) => {
+        if (!Validators.validate_uuid(req.params.uuid)) return sendError(res, 400, ErrorCode.InvalidUuid);
+        this.db
+          .delete_machine(req.params.uuid, get_user(req).uuid, V1.device(req))
+          .then(async (purged_at) => {
+            await this.websocketManager.removeMachine(req.params.uuid);
+            res.json({ message: "gon", purged_at });
+          })
+          .catch((error) => next(error === ErrorCode.Forbidden ? new ApiError(403, error) : error));
+      })
+      .post("/:uuid/@restore", this.auth, (req: LoggedInRequest, res, next) => {
+        if (!Validators.validate_uuid(req.params.uuid)) return sendError(res, 400, ErrorCode.InvalidUuid);
+        this.db
+          .restore_machine(req.params.uuid, get_user(req).uuid)
+          .then((machine) => res.json(machine))
+          .catch(next);
       });
   }
+
+  /**
+   * Sends a page of the audit log of a user narrowed down by ?from=, ?to= and ?type=
+   */
+  private async send_audit_logs(req: LoggedInRequest, res: Response, uuid: string) {
+    const { pagination, error } = parsePagination(req.query);
+    if (!pagination) return sendError(res, 400, error!);
+    const { audit, error: invalid } = parseAuditLogQuery(req.query, AUDIT_ACTIONS);
+    if (!audit) return sendError(res, 400, invalid!);
+    const { entries, total } = await this.db.find_audit_logs(uuid, pagination, audit, get_signal(res));
+    res.send({
+      items: entries,
+      total,
+      page: pagination.page,
+      pages: Math.ceil(total / pagination.limit),
+      limit: pagination.limit,
+    });
+  }
+
+  /**
+   * Kicks the reporters of every machine of a user, their tokens already fail by the time this runs
+   */
+  private async revoke_user_machines(user_uuid: string) {
+    const machines = await this.db.find_machines_by_owner(user_uuid);
+    await Promise.all(machines.map((machine) => this.websocketManager.revokeMachine(machine.uuid)));
+  }
+
+  /**
+   * Purges a user and kicks the reporters of their machines, they're looked up first since the purge deletes them
+   */
+  private async force_delete_user(req: LoggedInRequest, res: Response, uuid: string) {
+    const machines = await this.db.find_machines_by_owner(uuid);
+    await this.db.force_delete_user(uuid, get_user(req).uuid, V1.device(req));
+    await Promise.all(machines.map((machine) => this.websocketManager.revokeMachine(machine.uuid)));
+    res.send({ message: "purged user" });
+  }
+
+  // What share links show without logging in, a token that can't exist is answered like a revoked one
+  private generate_public_routes() {
+    const valid_token = (req: express.Request, res: Response, next: express.NextFunction) =>
+      SHARE_TOKEN_PATTERN.test(req.params.token) ? next() : sendError(res, 404, ErrorCode.ShareLinkNotFound);
+    return express
+      .Router()
+      .get("/machines/:token", valid_token, this.share_limit, (req, res, next) =>
+        this.db
+          .find_share_link(req.params.token, get_signal(res))
+          .then(async (link) => {
+            const machine = await this.db.find_shared_machine(link, get_signal(res));
+            const latest = this.websocketManager.snapshot([{ uuid: machine.uuid }])[machine.uuid];
+            res.json(latest ? { ...machine, stats: public_stats(latest) } : machine);
+          })
+          .catch(next)
+      )
+      .get("/machines/:token/stream", valid_token, this.share_limit, (req, res, next) =>
+        this.stream_shared_stats(req, res, req.params.token).catch(next)
+      );
+  }
+
+  // The test event is sent by the workers like any other event so it goes through the same retries
+  private generate_webhook_routes() {
+    return express
+      .Router()
+      .post("/:uuid/@test", this.auth, (req: LoggedInRequest, res, next) =>
+        this.db
+          .queue_webhook_test(req.params.uuid, get_user(req).uuid)
+          .then((delivery) => {
+            this.websocketManager.webhooks.wake();
+            res.status(202).json({ delivery: delivery.uuid });
+          })
+          .catch(next)
+      );
+  }
+
+  // The streams of the other routes under the paths integrations expect, every event is a plain message
+  private generate_sse_routes() {
+    return express
+      .Router()
+      .get("/machines/:uuid", this.scoped("read:stats"), (req: LoggedInRequest, res, next) =>
+        this.stream_stats(req, res, req.params.uuid, "message").catch(next)
+      );
+  }
+
+  // Admins moderating other users, they can't do any of it to themselves so they can't lock themselves out
+  private generate_admin_routes() {
+    const not_self = (req: LoggedInRequest, res: Response, next: express.NextFunction) =>
+      req.params.uuid === get_user(req).uuid
+        ? sendError(res, 403, ErrorCode.Forbidden, "admins can't do this to themselves")
+        : next();
+    return express
+      .Router()
+      .get("/users", this.auth, adminMiddleware, validate_query(Validators.ADMIN_USERS_QUERY), (req, res, next) => {
+        const { pagination, error } = parsePagination(req.query, ["created_at", "username"]);
+        if (!pagination) return sendError(res, 400, error!);
+        const filter = DatabaseManager.admin_users_filter(req.query as AdminUsersQuery);
+        this.db
+          .find_users_paginated(filter, pagination, false, get_signal(res))
+          .then(({ users, total }) =>
+            res.send({
+              items: users.map((user) => user.to_private()),
+              total,
+              page: pagination.page,
+              pages: Math.ceil(total / pagination.limit),
+              limit: pagination.limit,
+            })
+          )
+          .catch(next);
+      })
+      .post("/users/:uuid/@disable", this.auth, adminMiddleware, not_self, (req: LoggedInRequest, res, next) =>
+        this.db
+          .disable_user(req.params.uuid, get_user(req).uuid, V1.device(req))
+          .then(async (user) => {
+            await this.revoke_user_machines(user.uuid);
+            res.send(user.to_public());
+          })
+          .catch(next)
+      )
+      .post("/users/:uuid/@enable", this.auth, adminMiddleware, (req: LoggedInRequest, res, next) =>
+        this.db
+          .enable_user(req.params.uuid, get_user(req).uuid, V1.device(req))
+          .then((user) => res.send(user.to_public()))
+          .catch(next)
+      )
+      // Skips the grace period DELETE /users/:uuid gives, there's no getting the user back after this
+      .delete("/users/:uuid", this.auth, adminMiddleware, not_self, (req: LoggedInRequest, res, next) =>
+        this.force_delete_user(req, res, req.params.uuid).catch(next)
+      );
+  }
 }
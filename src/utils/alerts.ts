@@ -0,0 +1,134 @@
+import axios from "axios";
+import type { IComputedDynamicData } from "../database/schemas/machine";
+import { Time } from "../types";
+
+export const ALERT_METRICS = ["cpu", "ram", "swap", "download", "upload", "ping", "offline"] as const;
+export const ALERT_OPERATORS = [">", ">=", "<", "<="] as const;
+export const ALERT_TARGETS = ["webhook", "discord"] as const;
+
+export type AlertMetric = typeof ALERT_METRICS[number];
+export type AlertOperator = typeof ALERT_OPERATORS[number];
+export type AlertTargetType = typeof ALERT_TARGETS[number];
+
+// Webhooks that take longer than this to answer are given up on, the alert isn't retried
+const WEBHOOK_TIMEOUT = 5 * Time.Second;
+
+export interface AlertTarget {
+  type: AlertTargetType;
+  url: string;
+}
+
+/**
+ * What a webhook is sent when an alert fires
+ */
+export interface AlertPayload {
+  machine: { uuid: string; name: string };
+  rule: { uuid: string; metric: AlertMetric; operator: AlertOperator; threshold?: number; duration: number };
+  observed: number; // The value that broke the threshold, how long the machine has been offline for offline rules
+  fired_at: number;
+}
+
+/**
+ * Gets the value of a metric from the stats of a machine, memory is a percentage like the CPU
+ * @returns the value or undefined if the stats don't have it
+ * @tested
+ */
+export const alertMetricValue = (stats: IComputedDynamicData, metric: AlertMetric): number | undefined => {
+  const percent = (usage?: { used: number; total: number }) => (usage?.total ? (usage.used / usage.total) * 100 : undefined);
+  switch (metric) {
+    case "cpu":
+      return stats.cau;
+    case "ram":
+      return percent(stats.ram);
+    case "swap":
+      return percent(stats.swap);
+    case "download":
+      return stats.td;
+    case "upload":
+      return stats.tu;
+    case "ping":
+      return stats.ping;
+    default:
+      return undefined;
+  }
+};
+
+/**
+ * Whether a value breaks the threshold of a rule
+ * @tested
+ */
+export const alertBreached = (operator: AlertOperator, threshold: number, value: number): boolean => {
+  switch (operator) {
+    case ">":
+      return value > threshold;
+    case ">=":
+      return value >= threshold;
+    case "<":
+      return value < threshold;
+    case "<=":
+      return value <= threshold;
+  }
+};
+
+const UNITS: { [metric in AlertMetric]: string } = {
+  cpu: "%",
+  ram: "%",
+  swap: "%",
+  download: " MB",
+  upload: " MB",
+  ping: "ms",
+  offline: "",
+};
+
+// Like 90s, 5m or 2h
+const formatDuration = (duration: number) => {
+  if (duration % Time.Hour === 0) return `${duration / Time.Hour}h`;
+  if (duration % Time.Minute === 0) return `${duration / Time.Minute}m`;
+  return `${Math.round(duration / Time.Second)}s`;
+};
+
+/**
+ * Describes an alert in a sentence like "xnet-mirai cpu is 97.3% (> 90% for 5m)"
+ * @tested
+ */
+export const describeAlert = ({ machine, rule, observed }: AlertPayload) => {
+  if (rule.metric === "offline") {
+    return `${machine.name} has been offline for ${Math.max(1, Math.round(observed / Time.Minute))}m`;
+  }
+  const unit = UNITS[rule.metric];
+  const duration = rule.duration ? ` for ${formatDuration(rule.duration)}` : "";
+  const value = Math.round(observed * 10) / 10;
+  return `${machine.name} ${rule.metric} is ${value}${unit} (${rule.operator} ${rule.threshold}${unit}${duration})`;
+};
+
+/**
+ * Formats the body a target is sent, Discord wants a message so the payload is turned into an embed
+ * @tested
+ */
+export const formatAlert = (type: AlertTargetType, payload: AlertPayload) => {
+  if (type === "webhook") return payload;
+  return {
+    username: "Xornet",
+    embeds: [
+      {
+        title: payload.rule.metric === "offline" ? `${payload.machine.name} went offline` : `${payload.machine.name} alert`,
+        description: describeAlert(payload),
+        color: 0xff4444,
+        timestamp: new Date(payload.fired_at).toISOString(),
+        footer: { text: `machine ${payload.machine.uuid} · rule ${payload.rule.uuid}` },
+      },
+    ],
+  };
+};
+
+/**
+ * Posts an alert to where the rule says it should go
+ */
+export const deliverAlert = async (target: AlertTarget, payload: AlertPayload) => {
+  await axios.post(target.url, formatAlert(target.type, payload), {
+    timeout: WEBHOOK_TIMEOUT,
+    // Redirects could point the request at something on our own network
+    maxRedirects: 0,
+    headers: { "content-type": "application/json", "user-agent": "Xornet-Alerts" },
+  });
+};
@@ -0,0 +1,261 @@
+import { NextFunction, Request, Response } from "express";
+import { v4 as uuidv4 } from "uuid";
+import { get_logger, get_request_id } from "../middleware/log";
+
+/**
+ * Every code the API responds with, the frontend can switch on these so they must never change
+ */
+export enum ErrorCode {
+  InvalidBody = "invalid.body",
+  InvalidUrl = "invalid.url",
+  InvalidFile = "invalid.file",
+  InvalidDimensions = "invalid.dimensions",
+  InvalidUuid = "invalid.uuid",
+  InvalidOwner = "invalid.owner",
+  InvalidQuery = "invalid.query",
+  InvalidFields = "invalid.fields",
+  InvalidLimit = "invalid.limit",
+  InvalidCursor = "invalid.cursor",
+  InvalidStats = "invalid.stats",
+  InvalidFrom = "invalid.from",
+  InvalidTo = "invalid.to",
+  InvalidRange = "invalid.range",
+  InvalidResolution = "invalid.resolution",
+  InvalidDays = "invalid.days",
+  InvalidMetric = "invalid.metric",
+  InvalidMember = "invalid.member",
+  InvalidRecipient = "invalid.recipient",
+  InvalidFriend = "invalid.friend",
+  InvalidTag = "invalid.tag",
+  InvalidCredentials = "invalid.credentials",
+  InvalidPassword = "invalid.password",
+  InvalidIdempotencyKey = "invalid.idempotencyKey",
+  PayloadTooLarge = "payload.too.large",
+  UnsupportedMediaType = "unsupported.media.type",
+  UnsupportedProtocol = "unsupported.protocol",
+  AuthRequired = "auth.required",
+  AuthMalformed = "auth.malformed",
+  TokenRequired = "token.required",
+  TokenExpired = "token.expired",
+  TokenInvalid = "token.invalid",
+  TokenRevoked = "token.revoked",
+  TokenScope = "token.scope",
+  KeyInvalid = "key.invalid",
+  KeyExpired = "key.expired",
+  TooManyKeys = "keys.limit",
+  TooManyAlerts = "alerts.limit",
+  TooManyShareLinks = "shareLinks.limit",
+  TooManyApiTokens = "apiTokens.limit",
+  TooManyWebhooks = "webhooks.limit",
+  EmailNotVerified = "email.unverified",
+  EmailAlreadyVerified = "email.verified",
+  AccountDisabled = "account.disabled",
+  Forbidden = "forbidden",
+  OriginForbidden = "origin.forbidden",
+  RouteNotFound = "route.notFound",
+  UserNotFound = "user.notFound",
+  LabelNotFound = "label.notFound",
+  MachineNotFound = "machine.notFound",
+  DatacenterNotFound = "datacenter.notFound",
+  SessionNotFound = "session.notFound",
+  AlertNotFound = "alert.notFound",
+  FriendNotFound = "friend.notFound",
+  ShareLinkNotFound = "shareLink.notFound",
+  ApiTokenNotFound = "apiToken.notFound",
+  WebhookNotFound = "webhook.notFound",
+  UsernameExists = "username.exists",
+  EmailExists = "email.exists",
+  MachineExists = "machine.exists",
+  FriendExists = "friend.exists",
+  DuplicateKey = "duplicate.key",
+  VersionConflict = "version.conflict",
+  IdempotencyKeyPending = "idempotencyKey.pending",
+  IdempotencyKeyReused = "idempotencyKey.reused",
+  LastAdmin = "admin.last",
+  RateLimited = "rate.limited",
+  RequestAborted = "request.aborted",
+  QueryTimeout = "query.timeout",
+  RequestTimeout = "request.timeout",
+  Internal = "internal.error",
+}
+
+/**
+ * The default human readable message of each code
+ */
+export const ERROR_MESSAGES: { [code in ErrorCode]: string } = {
+  [ErrorCode.InvalidBody]: "the body is invalid",
+  [ErrorCode.InvalidUrl]: "the url is invalid",
+  [ErrorCode.InvalidFile]: "the file is missing, empty or corrupt",
+  [ErrorCode.InvalidDimensions]: "the image can't be larger than 4096x4096",
+  [ErrorCode.InvalidUuid]: "the uuid is invalid",
+  [ErrorCode.InvalidOwner]: "the owner uuid is invalid",
+  [ErrorCode.InvalidQuery]: "the query is invalid",
+  [ErrorCode.InvalidFields]: "some of the fields can't be asked for",
+  [ErrorCode.InvalidLimit]: "the limit is invalid",
+  [ErrorCode.InvalidCursor]: "the cursor is invalid, start over from the first page",
+  [ErrorCode.InvalidStats]: "the stats are invalid",
+  [ErrorCode.InvalidFrom]: "from has to be an RFC3339 timestamp",
+  [ErrorCode.InvalidTo]: "to has to be an RFC3339 timestamp",
+  [ErrorCode.InvalidRange]: "from has to be before to and the range can't be longer than 30 days",
+  [ErrorCode.InvalidResolution]: "the resolution has to be a duration like 1m, 5m or 1h that gives at most 1000 points",
+  [ErrorCode.InvalidDays]: "the days have to be a whole number within the retention",
+  [ErrorCode.InvalidMetric]: "the metric is invalid",
+  [ErrorCode.InvalidMember]: "the member is invalid",
+  [ErrorCode.InvalidRecipient]: "you already own this machine",
+  [ErrorCode.InvalidFriend]: "you can't be friends with yourself",
+  [ErrorCode.InvalidTag]: "tags have to be lowercase letters, numbers and dashes, up to 24 characters",
+  [ErrorCode.InvalidCredentials]: "invalid credentials",
+  [ErrorCode.InvalidPassword]: "the current password is wrong",
+  [ErrorCode.InvalidIdempotencyKey]: "the Idempotency-Key header can't be empty or longer than 255 characters",
+  [ErrorCode.PayloadTooLarge]: "the body is too large",
+  [ErrorCode.UnsupportedMediaType]: "the file type is not supported",
+  [ErrorCode.UnsupportedProtocol]: "this protocol version or encoding is not supported, update the reporter",
+  [ErrorCode.AuthRequired]: "authorization header not set",
+  [ErrorCode.AuthMalformed]: "malformed authorization header",
+  [ErrorCode.TokenRequired]: "X-Machine-Token header not set",
+  [ErrorCode.TokenExpired]: "authentication token expired",
+  [ErrorCode.TokenInvalid]: "invalid authentication token",
+  [ErrorCode.TokenRevoked]: "this token was revoked, log in again",
+  [ErrorCode.TokenScope]: "this API token isn't allowed to use this route",
+  [ErrorCode.KeyInvalid]: "the 2FA token you provided is invalid",
+  [ErrorCode.KeyExpired]: "the 2FA token you provided has expired, generate a new one",
+  [ErrorCode.TooManyKeys]: "you have too many unused 2FA tokens, wait for them to expire",
+  [ErrorCode.TooManyAlerts]: "this machine has too many alerts, delete some first",
+  [ErrorCode.TooManyShareLinks]: "this machine has too many share links, revoke some first",
+  [ErrorCode.TooManyApiTokens]: "you have too many API tokens, revoke some first",
+  [ErrorCode.TooManyWebhooks]: "you have too many webhooks, delete some first",
+  [ErrorCode.EmailNotVerified]: "verify your email first",
+  [ErrorCode.EmailAlreadyVerified]: "your email is already verified",
+  [ErrorCode.AccountDisabled]: "this account was disabled by an admin",
+  [ErrorCode.Forbidden]: "you do not have permission to access this route",
+  [ErrorCode.OriginForbidden]: "this origin is not allowed to use the API",
+  [ErrorCode.RouteNotFound]: "this route does not exist",
+  [ErrorCode.UserNotFound]: "user not found",
+  [ErrorCode.LabelNotFound]: "label not found",
+  [ErrorCode.MachineNotFound]: "machine not found",
+  [ErrorCode.DatacenterNotFound]: "datacenter not found",
+  [ErrorCode.SessionNotFound]: "session not found",
+  [ErrorCode.AlertNotFound]: "alert not found",
+  [ErrorCode.FriendNotFound]: "there's no friend or friend request with this user",
+  [ErrorCode.ShareLinkNotFound]: "this share link doesn't exist, expired or was revoked",
+  [ErrorCode.ApiTokenNotFound]: "API token not found",
+  [ErrorCode.WebhookNotFound]: "webhook not found",
+  [ErrorCode.UsernameExists]: "that username is taken",
+  [ErrorCode.EmailExists]: "that email is already in use",
+  [ErrorCode.MachineExists]: "this machine is already registered",
+  [ErrorCode.FriendExists]: "you're already friends or one of you already sent a request",
+  [ErrorCode.DuplicateKey]: "a document with that value already exists",
+  [ErrorCode.VersionConflict]: "this was changed in the meantime, fetch it again and retry",
+  [ErrorCode.IdempotencyKeyPending]: "a request with this Idempotency-Key is still running, retry once it's done",
+  [ErrorCode.IdempotencyKeyReused]: "this Idempotency-Key was already used for a different request",
+  [ErrorCode.LastAdmin]: "the last admin can't be demoted",
+  [ErrorCode.RateLimited]: "too many requests, try again later",
+  [ErrorCode.RequestAborted]: "the request was aborted",
+  [ErrorCode.QueryTimeout]: "the database took too long to answer, try again later",
+  [ErrorCode.RequestTimeout]: "the request took too long to answer, try again later",
+  [ErrorCode.Internal]: "something went wrong",
+};
+
+const default_message = (code: string) => ERROR_MESSAGES[code as ErrorCode] ?? code;
+
+/**
+ * The body every failed request responds with
+ */
+export interface ErrorEnvelope {
+  error: {
+    code: string;
+    message: string;
+    status: number;
+    request_id?: string; // Missing outside of the log middleware
+    [key: string]: unknown;
+  };
+}
+
+/**
+ * An error that already knows what status and code it should respond with
+ */
+export class ApiError extends Error {
+  public constructor(public status: number, public code: string, message = default_message(code), public details?: object) {
+    super(message);
+  }
+}
+
+/**
+ * Responds with the error envelope
+ * @param res The response to send the error on
+ * @param status The HTTP status code
+ * @param code A dotted machine readable code like "user.notFound"
+ * @param message A human readable message, defaults to the message of the code
+ * @param details Extra fields to put in the envelope like the invalid fields of a form,
+ * the id of the request is always added so bug reports can be matched to the logs
+ */
+export const sendError = (res: Response, status: number, code: string, message = default_message(code), details?: object) => {
+  const error = { request_id: get_request_id(res), ...details, code, message, status };
+  return res.status(status).json({ error } as ErrorEnvelope);
+};
+
+/**
+ * Gets where the JSON parser gave up so the client can find the mistake, engines that don't report
+ * the position still get the reason
+ * @tested
+ */
+export const jsonErrorDetails = (error: { message?: string }) => {
+  const reason = `${error.message ?? "invalid JSON"}`;
+  const position = /at position (\d+)/.exec(reason);
+  return position ? { reason, position: parseInt(position[1]) } : { reason };
+};
+
+// What mongo fails a query with when it ran for longer than its maxTimeMS
+export const MAX_TIME_EXPIRED = 50;
+
+/**
+ * Maps anything a handler throws or rejects with to an ApiError,
+ * the database rejects with dotted string codes so those get mapped by their suffix
+ */
+export const toApiError = (error: any): ApiError => {
+  if (error instanceof ApiError) return error;
+  // The client is either gone already or the server is shutting down
+  if (error === ErrorCode.RequestAborted) return new ApiError(503, error);
+  if (error === ErrorCode.QueryTimeout || error?.code === MAX_TIME_EXPIRED) return new ApiError(504, ErrorCode.QueryTimeout);
+  if (typeof error === "string") {
+    if (error.endsWith(".notFound")) return new ApiError(404, error);
+    if (error.endsWith(".exists")) return new ApiError(409, error);
+    return new ApiError(400, error);
+  }
+  if (error?.type === "entity.parse.failed")
+    return new ApiError(400, ErrorCode.InvalidBody, "the body is not valid JSON", jsonErrorDetails(error));
+  if (error?.type === "entity.too.large") return new ApiError(413, ErrorCode.PayloadTooLarge);
+  if (error?.code === 11000) {
+    const field = Object.keys(error.keyValue ?? {})[0];
+    return new ApiError(409, field ? `${field}.exists` : ErrorCode.DuplicateKey);
+  }
+  if (error?.name === "ValidationError") return new ApiError(400, ErrorCode.InvalidBody, error.message);
+  if (error?.name === "CastError") return new ApiError(400, `invalid.${error.path ?? "value"}`);
+  // Schema hooks throw errors whose message is a code
+  if (typeof error?.message === "string" && error.message.startsWith("invalid.")) return new ApiError(400, error.message);
+  return new ApiError(500, ErrorCode.Internal);
+};
+
+/**
+ * Makes a lookup resolve with null when it found nothing, anything else still rejects
+ * so a database that's down isn't answered like a wrong token
+ * @param code What the lookup rejects with when it finds nothing
+ * @tested
+ */
+export const nullIfNotFound = (code: ErrorCode) => (error: any) => error === code ? null : Promise.reject(error);
+
+/**
+ * The last middleware in the chain, turns errors into the envelope and logs the unknown ones
+ * with the id of the request so they can be found along with its log without leaking them to the client
+ */
+export const errorHandler = (error: any, req: Request, res: Response, next: NextFunction) => {
+  // It was already answered with a 504 and this is the handler failing because its signal aborted
+  if (res.locals.timed_out) return;
+  if (res.headersSent) return next(error);
+  const apiError = toApiError(error);
+  if (apiError.status !== 500) return sendError(res, apiError.status, apiError.code, apiError.message, apiError.details);
+
+  const request_id = get_request_id(res) ?? uuidv4();
+  get_logger(res).error(`Unhandled error on ${req.method} ${req.originalUrl} (request ${request_id})`, error);
+  return sendError(res, 500, apiError.code, apiError.message, { request_id });
+};
@@ -0,0 +1,295 @@
+import dns from "dns";
+import fs from "fs";
+import net from "net";
+import { Time } from "../types";
+import { Logger } from "./logger";
+
+// Reverse lookups that take longer than this are given up on, the hostname is left empty
+const REVERSE_DNS_TIMEOUT = 2 * Time.Second;
+
+// Every database ends with this marker followed by the metadata
+const METADATA_MARKER = Buffer.from("abcdef4d61784d696e642e636f6d", "hex");
+
+// The search tree and the data section are separated by 16 zero bytes
+const DATA_SECTION_SEPARATOR = 16;
+
+export interface MaxMindMetadata {
+  [key: string]: unknown;
+  node_count: number;
+  record_size: 24 | 28 | 32;
+  ip_version: 4 | 6;
+  database_type: string;
+  build_epoch: number;
+}
+
+/**
+ * The parts of a GeoLite2 record that we use
+ */
+export interface GeoIpRecord {
+  country?: { iso_code?: string; names?: { [language: string]: string } };
+  subdivisions?: { iso_code?: string; names?: { [language: string]: string } }[];
+}
+
+/**
+ * The network a machine's reporter connects from
+ */
+export interface IMachineNetwork {
+  ip: string; // The public IP the reporter connected from
+  country?: string; // The ISO code of the country, like GB
+  country_name?: string; // The English name of the country
+  region?: string; // The English name of the region, only in the City database
+  hostname?: string; // What the reverse DNS of the IP points to
+  resolved_at: number; // When the IP was resolved
+}
+
+/**
+ * Parses an IP into its bytes, IPv4 mapped IPv6 addresses are parsed as IPv4
+ * @returns 4 bytes for IPv4, 16 for IPv6 or undefined if it isn't an IP
+ * @tested
+ */
+export const parseIp = (ip: string): number[] | undefined => {
+  if (net.isIPv4(ip)) return ip.split(".").map(Number);
+  if (!net.isIPv6(ip)) return;
+
+  const mapped = ip.match(/^::ffff:(\d+\.\d+\.\d+\.\d+)$/i);
+  if (mapped) return parseIp(mapped[1]);
+
+  // Addresses like ::1.2.3.4 end with an IPv4 which is the last two groups
+  const embedded = ip.match(/^(.*:)(\d+\.\d+\.\d+\.\d+)$/);
+  if (embedded) {
+    const [a, b, c, d] = parseIp(embedded[2])!;
+    return parseIp(`${embedded[1]}${((a << 8) | b).toString(16)}:${((c << 8) | d).toString(16)}`);
+  }
+
+  // Zone ids like %eth0 don't matter for the lookup
+  const groups = (part: string) => (part ? part.split("%")[0].split(":") : []);
+  const [head, tail] = ip.split("::");
+  const left = groups(head);
+  const right = groups(tail);
+  const zeros = new Array(8 - left.length - right.length).fill("0");
+  return [...left, ...zeros, ...right].reduce((bytes: number[], group) => {
+    const value = parseInt(group, 16);
+    return bytes.concat(value >> 8, value & 0xff);
+  }, []);
+};
+
+/**
+ * Whether an IP can't be geolocated because it's private, loopback, link local or otherwise not on the internet,
+ * reporters on the same host or Docker network as the backend connect from these
+ * @tested
+ */
+export const isPrivateIp = (ip: string) => {
+  const bytes = parseIp(ip);
+  if (!bytes) return true;
+  const [a, b] = bytes;
+  if (bytes.length === 4) {
+    return (
+      a === 0 || // This network
+      a === 10 ||
+      a === 127 ||
+      (a === 100 && (b & 0xc0) === 64) || // Carrier grade NAT
+      (a === 169 && b === 254) ||
+      (a === 172 && (b & 0xf0) === 16) || // Docker networks are in here
+      (a === 192 && b === 168) ||
+      a >= 224 // Multicast and reserved
+    );
+  }
+  return (
+    bytes.slice(0, 15).every((byte) => byte === 0) || // :: and ::1
+    (a & 0xfe) === 0xfc || // Unique local
+    (a === 0xfe && (b & 0xc0) === 0x80) || // Link local
+    a === 0xff // Multicast
+  );
+};
+
+/**
+ * Reads MaxMind DB files like the GeoLite2 databases, the whole file is kept in memory
+ * @see https://maxmind.github.io/MaxMind-DB/
+ */
+export class MaxMindReader {
+  public metadata: MaxMindMetadata;
+  private dataSection: number;
+  private ipv4Start = 0;
+
+  public constructor(private buffer: Buffer) {
+    const marker = buffer.lastIndexOf(METADATA_MARKER);
+    if (marker === -1) throw new Error("not a MaxMind database, the metadata marker is missing");
+    const metadataStart = marker + METADATA_MARKER.length;
+    this.metadata = this.decode(metadataStart, metadataStart)[0] as MaxMindMetadata;
+
+    const { node_count, record_size, ip_version } = this.metadata;
+    if (![24, 28, 32].includes(record_size)) throw new Error(`unsupported record size ${record_size}`);
+    this.dataSection = ((record_size * 2) / 8) * node_count + DATA_SECTION_SEPARATOR;
+
+    // IPv4 addresses are stored under ::/96 in IPv6 databases
+    if (ip_version === 6) {
+      for (let i = 0; i < 96 && this.ipv4Start < node_count; i++) this.ipv4Start = this.record(this.ipv4Start, 0);
+    }
+  }
+
+  public static open(path: string) {
+    return new MaxMindReader(fs.readFileSync(path));
+  }
+
+  /**
+   * Finds the record of the network an IP is in
+   * @returns the record or undefined if the IP isn't in the database
+   * @tested
+   */
+  public lookup<T = GeoIpRecord>(ip: string): T | undefined {
+    const bytes = parseIp(ip);
+    const { node_count, ip_version } = this.metadata;
+    if (!bytes || (bytes.length === 16 && ip_version === 4)) return;
+
+    let node = bytes.length === 4 ? this.ipv4Start : 0;
+    for (let i = 0; i < bytes.length * 8 && node < node_count; i++) {
+      node = this.record(node, (bytes[i >> 3] >> (7 - (i & 7))) & 1);
+    }
+    // Pointing at the node count means there's no data, anything above it points into the data section
+    if (node <= node_count) return;
+    const offset = this.dataSection + node - node_count - DATA_SECTION_SEPARATOR;
+    return this.decode(offset, this.dataSection)[0] as T;
+  }
+
+  // The left (0) or right (1) record of a node in the search tree
+  private record(node: number, bit: number) {
+    const { buffer } = this;
+    switch (this.metadata.record_size) {
+      case 24:
+        return buffer.readUIntBE(node * 6 + bit * 3, 3);
+      case 28: {
+        // The middle byte holds the high nibble of both records
+        const offset = node * 7;
+        return bit === 0
+          ? ((buffer[offset + 3] & 0xf0) << 20) | buffer.readUIntBE(offset, 3)
+          : ((buffer[offset + 3] & 0x0f) << 24) | buffer.readUIntBE(offset + 4, 3);
+      }
+      default:
+        return buffer.readUInt32BE(node * 8 + bit * 4);
+    }
+  }
+
+  private uint(offset: number, size: number) {
+    let value = 0;
+    for (let i = 0; i < size; i++) value = value * 256 + this.buffer[offset + i];
+    return value;
+  }
+
+  /**
+   * Decodes the value at an offset of the file
+   * @param offset Where the value starts
+   * @param base Where the section the value is in starts, pointers are relative to it
+   * @returns the value and where the next one starts
+   */
+  private decode(offset: number, base: number): [unknown, number] {
+    const { buffer } = this;
+    const control = buffer[offset++];
+    let type = control >> 5;
+
+    if (type === 1) {
+      const size = (control >> 3) & 0x3;
+      const bits = control & 0x7;
+      const pointer = [
+        () => bits * 2 ** 8 + this.uint(offset, 1),
+        () => bits * 2 ** 16 + this.uint(offset, 2) + 2048,
+        () => bits * 2 ** 24 + this.uint(offset, 3) + 526336,
+        () => this.uint(offset, 4),
+      ][size]();
+      return [this.decode(base + pointer, base)[0], offset + size + 1];
+    }
+
+    // Extended types store their type in the next byte
+    if (type === 0) type = 7 + buffer[offset++];
+
+    let size = control & 0x1f;
+    if (size >= 29) {
+      const bytes = size - 28;
+      size = [29, 285, 65821][bytes - 1] + this.uint(offset, bytes);
+      offset += bytes;
+    }
+
+    switch (type) {
+      case 2: // UTF-8 string
+        return [buffer.toString("utf8", offset, offset + size), offset + size];
+      case 3: // Double
+        return [buffer.readDoubleBE(offset), offset + 8];
+      case 4: // Bytes
+        return [buffer.subarray(offset, offset + size), offset + size];
+      case 5: // Unsigned 16, 32, 64 and 128 bit integers, the big ones lose precision
+      case 6:
+      case 9:
+      case 10:
+        return [this.uint(offset, size), offset + size];
+      case 7: {
+        const map: { [key: string]: unknown } = {};
+        for (let i = 0; i < size; i++) {
+          const [key, valueOffset] = this.decode(offset, base);
+          const [value, next] = this.decode(valueOffset, base);
+          map[key as string] = value;
+          offset = next;
+        }
+        return [map, offset];
+      }
+      case 8: // Signed 32 bit integer, shorter ones are positive
+        return [size === 4 ? buffer.readInt32BE(offset) : this.uint(offset, size), offset + size];
+      case 11: {
+        const array: unknown[] = [];
+        for (let i = 0; i < size; i++) {
+          const [value, next] = this.decode(offset, base);
+          array.push(value);
+          offset = next;
+        }
+        return [array, offset];
+      }
+      case 14: // Boolean, the value is the size
+        return [size !== 0, offset];
+      case 15: // Float
+        return [buffer.readFloatBE(offset), offset + 4];
+      default:
+        throw new Error(`unsupported data type ${type} at ${offset}`);
+    }
+  }
+}
+
+/**
+ * Loads the GeoIP database at startup, a database that can't be read only disables the geolocation
+ * @param path Where the MaxMind GeoLite2 Country or City database is, machines aren't geolocated without one
+ */
+export const loadGeoIp = (path?: string) => {
+  if (!path) return;
+  try {
+    const reader = MaxMindReader.open(path);
+    Logger.info(`Loaded the ${reader.metadata.database_type} database from ${path}`);
+    return reader;
+  } catch (error) {
+    Logger.warn(`Failed to load the GeoIP database from ${path}, machines won't be geolocated`, error);
+  }
+};
+
+const resolver = new dns.promises.Resolver({ timeout: REVERSE_DNS_TIMEOUT, tries: 1 });
+
+/**
+ * Geolocates an IP and looks up its reverse DNS, private IPs are neither geolocated nor looked up
+ * @param ip The IP to resolve
+ * @param reader The GeoIP database, only the reverse DNS is looked up without one
+ * @param reverse Looks up the hostnames of an IP
+ * @tested
+ */
+export const resolveNetwork = async (
+  ip: string,
+  reader?: MaxMindReader,
+  reverse = (ip: string) => resolver.reverse(ip)
+): Promise<IMachineNetwork> => {
+  const network: IMachineNetwork = { ip, resolved_at: Date.now() };
+  if (isPrivateIp(ip)) return network;
+
+  const record = reader?.lookup(ip);
+  network.country = record?.country?.iso_code;
+  network.country_name = record?.country?.names?.en;
+  network.region = record?.subdivisions?.[0]?.names?.en;
+  network.hostname = await reverse(ip).then(
+    (hostnames) => hostnames[0],
+    () => undefined
+  );
+  return network;
+};
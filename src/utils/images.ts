@@ -0,0 +1,159 @@
+import sharp from "sharp";
+import { ErrorCode } from "./errors";
+
+export type ImageType = "png" | "jpeg" | "webp";
+
+// Neither side of an avatar or banner can be longer than this
+export const MAX_IMAGE_DIMENSION = 4096;
+
+export interface ImageDimensions {
+  width: number;
+  height: number;
+}
+
+export type ProfileImage = "avatar" | "banner";
+
+// What avatars and banners are resized to, they're never shown any bigger
+export const PROFILE_IMAGE_SIZES: { [image in ProfileImage]: ImageDimensions } = {
+  avatar: { width: 512, height: 512 },
+  banner: { width: 1500, height: 500 },
+};
+
+// The JPEG markers that start a frame and hold its dimensions, C4, C8 and CC share the range but aren't frames
+const JPEG_FRAME_MARKERS = [0xc0, 0xc1, 0xc2, 0xc3, 0xc5, 0xc6, 0xc7, 0xc9, 0xca, 0xcb, 0xcd, 0xce, 0xcf];
+
+/**
+ * Figures out the type of an image from its magic bytes rather than trusting the Content-Type
+ * @param buffer The contents of the file
+ * @returns the type of the image or undefined if it's not a supported image
+ */
+export const sniffImageType = (buffer: Buffer): ImageType | undefined => {
+  if (buffer.length < 12) return;
+  if (buffer.subarray(0, 8).equals(Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]))) return "png";
+  if (buffer[0] === 0xff && buffer[1] === 0xd8 && buffer[2] === 0xff) return "jpeg";
+  if (buffer.toString("ascii", 0, 4) === "RIFF" && buffer.toString("ascii", 8, 12) === "WEBP") return "webp";
+};
+
+/**
+ * Reads the dimensions of an image from its header without decoding it
+ * @param buffer The contents of the file
+ * @param type The type sniffImageType() detected
+ * @returns the dimensions or undefined if the header is cut off or corrupt
+ * @tested
+ */
+export const imageDimensions = (buffer: Buffer, type: ImageType): ImageDimensions | undefined => {
+  try {
+    switch (type) {
+      case "png":
+        // The IHDR chunk always comes first
+        if (buffer.toString("ascii", 12, 16) !== "IHDR") return;
+        return { width: buffer.readUInt32BE(16), height: buffer.readUInt32BE(20) };
+      case "webp":
+        return webpDimensions(buffer);
+      case "jpeg":
+        return jpegDimensions(buffer);
+    }
+  } catch {
+    // Reading past the end of a truncated file throws a RangeError
+    return;
+  }
+};
+
+const webpDimensions = (buffer: Buffer): ImageDimensions | undefined => {
+  switch (buffer.toString("ascii", 12, 16)) {
+    case "VP8 ":
+      return { width: buffer.readUInt16LE(26) & 0x3fff, height: buffer.readUInt16LE(28) & 0x3fff };
+    case "VP8L": {
+      const bits = buffer.readUInt32LE(21);
+      return { width: (bits & 0x3fff) + 1, height: ((bits >> 14) & 0x3fff) + 1 };
+    }
+    case "VP8X":
+      return { width: buffer.readUIntLE(24, 3) + 1, height: buffer.readUIntLE(27, 3) + 1 };
+  }
+};
+
+const jpegDimensions = (buffer: Buffer): ImageDimensions | undefined => {
+  // Walks the segments after the SOI marker until it finds the frame header
+  let offset = 2;
+  while (offset + 9 < buffer.length) {
+    if (buffer[offset] !== 0xff) return;
+    const marker = buffer[offset + 1];
+    // Padding before a marker
+    if (marker === 0xff) {
+      offset++;
+      continue;
+    }
+    if (JPEG_FRAME_MARKERS.includes(marker))
+      return { height: buffer.readUInt16BE(offset + 5), width: buffer.readUInt16BE(offset + 7) };
+    offset += 2 + buffer.readUInt16BE(offset + 2);
+  }
+};
+
+/**
+ * Extracts the first file from a multipart/form-data body
+ * @param body The raw body of the request
+ * @param contentType The Content-Type header of the request containing the boundary
+ * @returns the contents of the file or undefined if there's no file in the body
+ */
+export const extractMultipartFile = (body: Buffer, contentType: string): Buffer | undefined => {
+  const boundary = /boundary=(?:"([^"]+)"|([^;]+))/i.exec(contentType);
+  if (!boundary) return;
+  const delimiter = Buffer.from(`--${boundary[1] ?? boundary[2]}`);
+
+  let start = body.indexOf(delimiter);
+  while (start !== -1) {
+    const headersEnd = body.indexOf("\r\n\r\n", start);
+    if (headersEnd === -1) return;
+    const end = body.indexOf(delimiter, headersEnd);
+    if (end === -1) return;
+
+    const headers = body.toString("utf8", start, headersEnd);
+    // Strip the \r\n that precedes the next delimiter
+    if (/filename=/i.test(headers)) return body.subarray(headersEnd + 4, end - 2);
+    start = end;
+  }
+};
+
+/**
+ * Gets the image out of an upload, accepts either a multipart/form-data body or the raw image as the body
+ * @param body The raw body of the request
+ * @param contentType The Content-Type header of the request
+ * @param limit The maximum size of the image in bytes
+ * @returns the image and its type or the status and code to reject the upload with
+ * @tested
+ */
+export const readImageUpload = (
+  body: unknown,
+  contentType = "",
+  limit: number
+): { file: Buffer; type: ImageType } | { status: number; code: ErrorCode } => {
+  if (!Buffer.isBuffer(body)) return { status: 415, code: ErrorCode.UnsupportedMediaType };
+  const file = contentType.startsWith("multipart/form-data") ? extractMultipartFile(body, contentType) : body;
+  if (!file?.length) return { status: 400, code: ErrorCode.InvalidFile };
+  if (file.length > limit) return { status: 413, code: ErrorCode.PayloadTooLarge };
+
+  // The extension and the Content-Type of the part are up to the client so only the bytes are trusted
+  const type = sniffImageType(file);
+  if (!type) return { status: 415, code: ErrorCode.UnsupportedMediaType };
+
+  const dimensions = imageDimensions(file, type);
+  if (!dimensions) return { status: 400, code: ErrorCode.InvalidFile };
+  if (dimensions.width > MAX_IMAGE_DIMENSION || dimensions.height > MAX_IMAGE_DIMENSION)
+    return { status: 400, code: ErrorCode.InvalidDimensions };
+  return { file, type };
+};
+
+/**
+ * Resizes an image to cover the size it's shown at and encodes it again, which leaves its EXIF and other metadata behind
+ * @param file The contents of the image
+ * @param type The type sniffImageType() detected, the image is encoded as that type again
+ * @param size What to resize it to, images that are smaller are never enlarged
+ * @throws if the image can't be decoded
+ * @tested
+ */
+export const resizeImage = (file: Buffer, type: ImageType, { width, height }: ImageDimensions) =>
+  sharp(file)
+    .rotate() // Applies the orientation from the EXIF before it's left behind
+    .resize({ width, height, fit: "cover", withoutEnlargement: true })
+    .toFormat(type)
+    .toBuffer();
@@ -6,7 +6,35 @@ const RED = "\x1b[31m";
 const DIM = "\x1b[2m";
 const RESET = "\x1b[0m";
 
+export type LogLevel = "debug" | "info" | "warn" | "error";
+const LOG_LEVELS: LogLevel[] = ["debug", "info", "warn", "error"];
+
+/**
+ * Parses the LOG_LEVEL, anything that isn't a level falls back to info
+ * @tested
+ */
+export const parseLogLevel = (value?: string): LogLevel =>
+  LOG_LEVELS.includes(value?.toLowerCase() as LogLevel) ? (value!.toLowerCase() as LogLevel) : "info";
+
+/**
+ * What Logger and the loggers it scopes have in common so either can be passed around
+ */
+export type ScopedLogger = Pick<typeof Logger, "debug" | "info" | "warn" | "error" | "structured" | "scoped">;
+
 export class Logger {
+  /**
+   * The lowest level that gets printed, it's set from the config on startup
+   */
+  public static level: LogLevel = "info";
+
+  /**
+   * Whether logs of a level get printed
+   * @tested
+   */
+  public static enabled(level: LogLevel) {
+    return LOG_LEVELS.indexOf(level) >= LOG_LEVELS.indexOf(this.level);
+  }
+
   /**
    * Puts the log together and prints it
    * @param color the color for the prefix
@@ -15,6 +43,7 @@ export class Logger {
    * @author Geoxor
    */
   private static log(color: string, prefix: string, ...args: any[]) {
+    if (!this.enabled(prefix.toLowerCase() as LogLevel)) return;
     console.log(`${this.getCurrentMemoryHeap()} ${this.time()} ${color}[${prefix.toUpperCase()}]${RESET}`, ...args);
   }
 
@@ -38,6 +67,16 @@ export class Logger {
     return chalk.bgWhite(chalk.black(`${DIM}${time}${RESET}`));
   }
 
+  /**
+   * Log a message with level of debug.
+   * Should be used on noisy messages that only help while debugging.
+   * @example Logger.debug("Sent ping to", reporter.uuid);
+   * @param args the arguments to be logged.
+   */
+  static debug = (...args: any[]): void => {
+    this.log(DIM, "Debug", ...args);
+  };
+
   /**
    * Log a message with level of normal information.
    * Should be used on normal log messages and etc.
@@ -70,4 +109,40 @@ export class Logger {
   static error = (...args: any[]): void => {
     this.log(RED, "Error", ...args);
   };
+
+  /**
+   * Log a single line of JSON so log collectors can parse the fields.
+   * Should be used on logs that get searched by their fields like requests.
+   * @example Logger.structured("info", "request", { request_id, status: 200 });
+   * @param level the level of the log.
+   * @param message what happened.
+   * @param fields the fields to log along with it.
+   */
+  static structured = (level: LogLevel, message: string, fields: { [key: string]: unknown } = {}): void => {
+    if (!this.enabled(level)) return;
+    console.log(JSON.stringify({ time: new Date().toISOString(), level, msg: message, ...fields }));
+  };
+
+  /**
+   * Creates a logger that adds the same fields to every log, like the id of the request it's for
+   * @example Logger.scoped({ request_id }).warn("Refresh token was reused");
+   * @param fields the fields to add.
+   * @tested
+   */
+  static scoped = (fields: { [key: string]: unknown }): ScopedLogger => {
+    const suffix = chalk.gray(
+      Object.entries(fields)
+        .filter(([, value]) => value !== undefined)
+        .map(([key, value]) => `${key}=${value}`)
+        .join(" ")
+    );
+    return {
+      debug: (...args: any[]) => this.debug(...args, suffix),
+      info: (...args: any[]) => this.info(...args, suffix),
+      warn: (...args: any[]) => this.warn(...args, suffix),
+      error: (...args: any[]) => this.error(...args, suffix),
+      structured: (level, message, extra = {}) => this.structured(level, message, { ...fields, ...extra }),
+      scoped: (extra) => this.scoped({ ...fields, ...extra }),
+    };
+  };
 }
@@ -0,0 +1,225 @@
+import net from "net";
+import os from "os";
+import tls from "tls";
+import { v4 as uuidv4 } from "uuid";
+import { Time } from "../types";
+import { Logger } from "./logger";
+
+export interface Mail {
+  to: string;
+  subject: string;
+  text: string;
+}
+
+/**
+ * Whatever sends the emails, V1 gets one injected so tests can swap it for a fake
+ */
+export interface Mailer {
+  send(mail: Mail): Promise<void>;
+}
+
+export interface SmtpConfig {
+  host: string;
+  port: number;
+  secure: boolean; // Whether to connect over TLS right away, otherwise the connection is upgraded with STARTTLS
+  user?: string;
+  password?: string;
+  from: string; // Like Xornet <noreply@xornet.cloud>
+}
+
+// The server gets this long to answer each command before we give up on it
+const SMTP_TIMEOUT = 10 * Time.Second;
+
+// Headers can't contain line breaks or a user could inject their own
+const header = (value: string) => value.replace(/[\r\n]+/g, " ");
+const encodeHeader = (value: string) =>
+  /^[\x20-\x7e]*$/.test(value) ? header(value) : `=?UTF-8?B?${Buffer.from(header(value)).toString("base64")}?=`;
+const address = (from: string) => from.match(/<([^>]+)>/)?.[1] ?? from;
+
+/**
+ * Formats a plain text email the way it goes over the wire after DATA, without the terminating dot
+ * @param from Who the email is from
+ * @param mail The email to format
+ * @param date When the email was sent
+ * @tested
+ */
+export const formatMail = (from: string, mail: Mail, date = new Date()) => {
+  const headers = [
+    `From: ${header(from)}`,
+    `To: ${header(mail.to)}`,
+    `Subject: ${encodeHeader(mail.subject)}`,
+    `Date: ${date.toUTCString()}`,
+    `Message-ID: <${uuidv4()}@${address(from).split("@")[1] ?? os.hostname()}>`,
+    "MIME-Version: 1.0",
+    "Content-Type: text/plain; charset=utf-8",
+    "Content-Transfer-Encoding: 8bit",
+  ];
+  // Lines starting with a dot get another one so they can't end the message early
+  const body = mail.text
+    .split(/\r?\n/)
+    .map((line) => (line.startsWith(".") ? `.${line}` : line))
+    .join("\r\n");
+  return `${headers.join("\r\n")}\r\n\r\n${body}`;
+};
+
+interface SmtpReply {
+  code: number;
+  lines: string[];
+}
+
+/**
+ * One connection to an SMTP server, commands are sent one at a time and each waits for its reply
+ */
+class SmtpConnection {
+  private buffer = "";
+  private lines: string[] = [];
+  private replies: SmtpReply[] = [];
+  private waiting?: { resolve: (reply: SmtpReply) => void; reject: (error: Error) => void };
+  private failure?: Error;
+
+  private constructor(private socket: net.Socket) {
+    this.listen(socket);
+  }
+
+  public static open(config: SmtpConfig) {
+    return new Promise<SmtpConnection>((resolve, reject) => {
+      const { host, port } = config;
+      const socket = config.secure ? tls.connect({ host, port, servername: host }) : net.connect({ host, port });
+      socket.setTimeout(SMTP_TIMEOUT, () => socket.destroy(new Error("SMTP server timed out")));
+      socket.once("error", reject);
+      socket.once(config.secure ? "secureConnect" : "connect", () => {
+        socket.off("error", reject);
+        resolve(new SmtpConnection(socket));
+      });
+    });
+  }
+
+  private listen(socket: net.Socket) {
+    socket.on("data", (chunk: Buffer) => this.receive(chunk.toString("utf8")));
+    socket.on("error", (error) => this.fail(error));
+    socket.on("close", () => this.fail(new Error("SMTP connection closed")));
+  }
+
+  private receive(chunk: string) {
+    this.buffer += chunk;
+    let index: number;
+    while ((index = this.buffer.indexOf("\r\n")) !== -1) {
+      const line = this.buffer.slice(0, index);
+      this.buffer = this.buffer.slice(index + 2);
+      this.lines.push(line.slice(4));
+      // Multiline replies have a dash after the code on every line but the last
+      if (line[3] === "-") continue;
+      this.replies.push({ code: parseInt(line.slice(0, 3)), lines: this.lines });
+      this.lines = [];
+    }
+    this.deliver();
+  }
+
+  private fail(error: Error) {
+    this.failure ??= error;
+    this.deliver();
+  }
+
+  private deliver() {
+    if (!this.waiting) return;
+    const { resolve, reject } = this.waiting;
+    if (this.replies.length) resolve(this.replies.shift()!);
+    else if (this.failure) reject(this.failure);
+    else return;
+    this.waiting = undefined;
+  }
+
+  /**
+   * Waits for the next reply and rejects if it isn't one of the expected codes
+   */
+  public expect(...codes: number[]) {
+    return new Promise<SmtpReply>((resolve, reject) => {
+      this.waiting = { resolve, reject };
+      this.deliver();
+    }).then((reply) => {
+      if (codes.includes(reply.code)) return reply;
+      return Promise.reject(new Error(`SMTP server replied ${reply.code} ${reply.lines.join(" ")}`));
+    });
+  }
+
+  public command(line: string, ...codes: number[]) {
+    this.socket.write(`${line}\r\n`);
+    return this.expect(...codes);
+  }
+
+  /**
+   * Switches the connection to TLS after the server accepted STARTTLS
+   */
+  public upgrade(host: string) {
+    ["data", "error", "close"].forEach((event) => this.socket.removeAllListeners(event));
+    return new Promise<void>((resolve, reject) => {
+      const socket = tls.connect({ socket: this.socket, servername: host });
+      socket.once("error", reject);
+      socket.once("secureConnect", () => {
+        socket.off("error", reject);
+        this.socket = socket;
+        this.listen(socket);
+        resolve();
+      });
+    });
+  }
+
+  public close() {
+    this.socket.destroy();
+  }
+}
+
+/**
+ * Sends emails through an SMTP relay like Postfix, SES or Mailgun
+ */
+export class SmtpMailer implements Mailer {
+  public constructor(private config: SmtpConfig) {}
+
+  public async send(mail: Mail) {
+    const { config } = this;
+    const connection = await SmtpConnection.open(config);
+    try {
+      await connection.expect(220);
+      const { lines } = await connection.command(`EHLO ${os.hostname()}`, 250);
+      if (!config.secure && lines.some((line) => line.toUpperCase().startsWith("STARTTLS"))) {
+        await connection.command("STARTTLS", 220);
+        await connection.upgrade(config.host);
+        await connection.command(`EHLO ${os.hostname()}`, 250);
+      } else if (!config.secure && config.user) {
+        throw new Error("the SMTP server doesn't support STARTTLS, refusing to send the credentials in plain text");
+      }
+
+      if (config.user) {
+        const credentials = Buffer.from(`\0${config.user}\0${config.password ?? ""}`).toString("base64");
+        await connection.command(`AUTH PLAIN ${credentials}`, 235);
+      }
+      await connection.command(`MAIL FROM:<${address(config.from)}>`, 250);
+      await connection.command(`RCPT TO:<${header(mail.to)}>`, 250, 251);
+      await connection.command("DATA", 354);
+      await connection.command(`${formatMail(config.from, mail)}\r\n.`, 250);
+      await connection.command("QUIT", 221).catch(() => {});
+    } finally {
+      connection.close();
+    }
+  }
+}
+
+/**
+ * Logs emails instead of sending them so signing up works in development without an SMTP server
+ */
+export class LogMailer implements Mailer {
+  public async send(mail: Mail) {
+    Logger.info(`Email to ${mail.to}: ${mail.subject}\n${mail.text}`);
+  }
+}
+
+/**
+ * Picks the mailer from the config, emails are only logged when there's no relay
+ * @param config The relay emails go through
+ * @param production Whether to warn that emails aren't sent
+ */
+export const createMailer = (config?: SmtpConfig, production = false): Mailer => {
+  if (config) return new SmtpMailer(config);
+  production && Logger.warn("SMTP_HOST isn't set, emails will only be logged");
+  return new LogMailer();
+};
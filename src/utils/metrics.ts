@@ -0,0 +1,145 @@
+/**
+ * A tiny Prometheus client, we only need counters, gauges and histograms
+ * rendered in the text exposition format
+ */
+
+export type Labels = { [name: string]: string | number };
+
+export const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8";
+
+const escapeLabel = (value: string | number) => `${value}`.replace(/\\/g, "\\\\").replace(/"/g, '\\"').replace(/\n/g, "\\n");
+
+abstract class Metric<T> {
+  protected series = new Map<string, { labels: string[]; value: T }>();
+
+  public constructor(public name: string, public help: string, public labelNames: string[] = []) {}
+
+  public abstract type: "counter" | "gauge" | "histogram";
+
+  /**
+   * Gets the series of a set of labels, creating it if it doesn't exist yet
+   */
+  protected get(labels: Labels, initial: () => T) {
+    const values = this.labelNames.map((name) => `${labels[name] ?? ""}`);
+    const key = values.join("\u0000");
+    let series = this.series.get(key);
+    if (!series) this.series.set(key, (series = { labels: values, value: initial() }));
+    return series;
+  }
+
+  protected formatLabels(values: string[], extra?: [string, string]) {
+    const pairs = this.labelNames.map((name, i) => `${name}="${escapeLabel(values[i])}"`);
+    if (extra) pairs.push(`${extra[0]}="${escapeLabel(extra[1])}"`);
+    return pairs.length ? `{${pairs.join(",")}}` : "";
+  }
+
+  public reset() {
+    this.series.clear();
+  }
+
+  public abstract render(): string[];
+}
+
+export class Counter extends Metric<number> {
+  public type = "counter" as const;
+
+  public inc(labels: Labels = {}, amount = 1) {
+    this.get(labels, () => 0).value += amount;
+  }
+
+  public render() {
+    return [...this.series.values()].map(({ labels, value }) => `${this.name}${this.formatLabels(labels)} ${value}`);
+  }
+}
+
+export class Gauge extends Metric<number> {
+  public type = "gauge" as const;
+
+  /**
+   * @param collect Called right before rendering so the gauge can read its values from somewhere else
+   */
+  public constructor(name: string, help: string, labelNames: string[] = [], public collect?: (gauge: Gauge) => void) {
+    super(name, help, labelNames);
+  }
+
+  public set(labels: Labels, value: number) {
+    this.get(labels, () => 0).value = value;
+  }
+
+  public render() {
+    this.collect?.(this);
+    return [...this.series.values()].map(({ labels, value }) => `${this.name}${this.formatLabels(labels)} ${value}`);
+  }
+}
+
+export class Histogram extends Metric<{ buckets: number[]; sum: number; count: number }> {
+  public type = "histogram" as const;
+  public static DEFAULT_BUCKETS = [0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10];
+
+  public constructor(name: string, help: string, labelNames: string[] = [], public buckets = Histogram.DEFAULT_BUCKETS) {
+    super(name, help, labelNames);
+  }
+
+  public observe(labels: Labels, value: number) {
+    const series = this.get(labels, () => ({ buckets: this.buckets.map(() => 0), sum: 0, count: 0 })).value;
+    // Buckets are cumulative when rendered so we only count the first one the value fits in
+    const index = this.buckets.findIndex((bound) => value <= bound);
+    if (index !== -1) series.buckets[index]++;
+    series.sum += value;
+    series.count++;
+  }
+
+  public render() {
+    const lines: string[] = [];
+    for (const { labels, value } of this.series.values()) {
+      let cumulative = 0;
+      this.buckets.forEach((bound, i) => {
+        cumulative += value.buckets[i];
+        lines.push(`${this.name}_bucket${this.formatLabels(labels, ["le", `${bound}`])} ${cumulative}`);
+      });
+      lines.push(`${this.name}_bucket${this.formatLabels(labels, ["le", "+Inf"])} ${value.count}`);
+      lines.push(`${this.name}_sum${this.formatLabels(labels)} ${value.sum}`);
+      lines.push(`${this.name}_count${this.formatLabels(labels)} ${value.count}`);
+    }
+    return lines;
+  }
+}
+
+/**
+ * Holds every metric and renders them for the /metrics endpoint
+ */
+export class Registry {
+  private metrics = new Map<string, Counter | Gauge | Histogram>();
+
+  private register<T extends Counter | Gauge | Histogram>(metric: T): T {
+    // Modules can be loaded more than once in tests so reuse what's already there
+    const existing = this.metrics.get(metric.name);
+    if (existing) return existing as T;
+    this.metrics.set(metric.name, metric);
+    return metric;
+  }
+
+  public counter(name: string, help: string, labelNames?: string[]) {
+    return this.register(new Counter(name, help, labelNames));
+  }
+
+  public gauge(name: string, help: string, labelNames?: string[], collect?: (gauge: Gauge) => void) {
+    const gauge = this.register(new Gauge(name, help, labelNames));
+    if (collect) gauge.collect = collect;
+    return gauge;
+  }
+
+  public histogram(name: string, help: string, labelNames?: string[], buckets?: number[]) {
+    return this.register(new Histogram(name, help, labelNames, buckets));
+  }
+
+  public render() {
+    const lines: string[] = [];
+    for (const metric of this.metrics.values()) {
+      lines.push(`# HELP ${metric.name} ${metric.help}`, `# TYPE ${metric.name} ${metric.type}`, ...metric.render());
+    }
+    return `${lines.join("\n")}\n`;
+  }
+}
+
+export const metrics = new Registry();
@@ -0,0 +1,220 @@
+// Deeper than any frame a reporter sends, it stops a crafted frame from blowing the stack
+const MAX_DEPTH = 64;
+
+/**
+ * A frame that isn't valid MessagePack or uses what the frames never need like the ext types
+ */
+export class MsgpackError extends Error {}
+
+/**
+ * Encodes a value the way JSON.stringify would see it, undefined properties are left out and Buffers are bin
+ * @tested
+ */
+export const encodeMsgpack = (value: unknown): Buffer => {
+  const chunks: Buffer[] = [];
+  write(value, chunks);
+  return Buffer.concat(chunks);
+};
+
+// The type bytes of the headers of what has a length, the smallest one the length fits in is used
+interface LengthTypes {
+  fixed?: [number, number]; // The type the length is added to and the longest it can be
+  eight?: number;
+  sixteen: number;
+  thirtyTwo: number;
+}
+
+const STR: LengthTypes = { fixed: [0xa0, 31], eight: 0xd9, sixteen: 0xda, thirtyTwo: 0xdb };
+const BIN: LengthTypes = { eight: 0xc4, sixteen: 0xc5, thirtyTwo: 0xc6 };
+const ARRAY: LengthTypes = { fixed: [0x90, 15], sixteen: 0xdc, thirtyTwo: 0xdd };
+const MAP: LengthTypes = { fixed: [0x80, 15], sixteen: 0xde, thirtyTwo: 0xdf };
+
+const typed = (type: number, size: number, fill: (buffer: Buffer) => unknown) => {
+  const buffer = Buffer.alloc(1 + size);
+  buffer[0] = type;
+  fill(buffer);
+  return buffer;
+};
+
+const header = (length: number, { fixed, eight, sixteen, thirtyTwo }: LengthTypes) => {
+  if (fixed && length <= fixed[1]) return Buffer.from([fixed[0] | length]);
+  if (eight !== undefined && length < 0x100) return Buffer.from([eight, length]);
+  if (length < 0x10000) return typed(sixteen, 2, (buffer) => buffer.writeUInt16BE(length, 1));
+  return typed(thirtyTwo, 4, (buffer) => buffer.writeUInt32BE(length, 1));
+};
+
+// Numbers are only exact up to 2^53 so the 64 bit integers are written and read as two halves
+const writeInt64 = (buffer: Buffer, value: number) => {
+  const high = Math.floor(value / 2 ** 32);
+  buffer.writeInt32BE(high, 1);
+  buffer.writeUInt32BE(value - high * 2 ** 32, 5);
+};
+
+const encodeNumber = (value: number) => {
+  if (!Number.isSafeInteger(value)) return typed(0xcb, 8, (buffer) => buffer.writeDoubleBE(value, 1));
+  if (value >= 0) {
+    if (value < 0x80) return Buffer.from([value]);
+    if (value < 0x100) return Buffer.from([0xcc, value]);
+    if (value < 0x10000) return typed(0xcd, 2, (buffer) => buffer.writeUInt16BE(value, 1));
+    if (value < 0x100000000) return typed(0xce, 4, (buffer) => buffer.writeUInt32BE(value, 1));
+    return typed(0xcf, 8, (buffer) => writeInt64(buffer, value));
+  }
+  if (value >= -0x20) return Buffer.from([value & 0xff]);
+  if (value >= -0x80) return typed(0xd0, 1, (buffer) => buffer.writeInt8(value, 1));
+  if (value >= -0x8000) return typed(0xd1, 2, (buffer) => buffer.writeInt16BE(value, 1));
+  if (value >= -0x80000000) return typed(0xd2, 4, (buffer) => buffer.writeInt32BE(value, 1));
+  return typed(0xd3, 8, (buffer) => writeInt64(buffer, value));
+};
+
+const write = (value: unknown, chunks: Buffer[]): void => {
+  if (value === null || value === undefined) chunks.push(Buffer.from([0xc0]));
+  else if (typeof value === "boolean") chunks.push(Buffer.from([value ? 0xc3 : 0xc2]));
+  else if (typeof value === "number") chunks.push(encodeNumber(value));
+  else if (typeof value === "string") {
+    const bytes = Buffer.from(value, "utf8");
+    chunks.push(header(bytes.length, STR), bytes);
+  } else if (Buffer.isBuffer(value)) chunks.push(header(value.length, BIN), value);
+  else if (Array.isArray(value)) {
+    chunks.push(header(value.length, ARRAY));
+    value.forEach((item) => write(item, chunks));
+  } else if (typeof value === "object") {
+    const entries = Object.entries(value as object).filter(([, item]) => item !== undefined);
+    chunks.push(header(entries.length, MAP));
+    entries.forEach(([key, item]) => (write(key, chunks), write(item, chunks)));
+  } else throw new MsgpackError(`can't encode a ${typeof value}`);
+};
+
+/**
+ * Decodes a single MessagePack value that takes up the whole buffer, maps become plain objects with string keys
+ * like JSON.parse makes so what's decoded goes through the same validators
+ * @throws MsgpackError if it's malformed
+ * @tested
+ */
+export const decodeMsgpack = (data: Buffer): unknown => {
+  const reader = new Reader(data);
+  const value = reader.read(0);
+  if (reader.offset !== data.length) throw new MsgpackError("trailing bytes after the value");
+  return value;
+};
+
+class Reader {
+  public offset = 0;
+
+  constructor(private data: Buffer) {}
+
+  // Every length is checked against what's left before anything is allocated for it
+  private take(length: number) {
+    if (this.offset + length > this.data.length) throw new MsgpackError("unexpected end of the value");
+    const start = this.offset;
+    this.offset += length;
+    return start;
+  }
+
+  private uint(bytes: 1 | 2 | 4) {
+    const start = this.take(bytes);
+    return bytes === 1 ? this.data[start] : bytes === 2 ? this.data.readUInt16BE(start) : this.data.readUInt32BE(start);
+  }
+
+  private int64(signed: boolean) {
+    const start = this.take(8);
+    const high = signed ? this.data.readInt32BE(start) : this.data.readUInt32BE(start);
+    return high * 2 ** 32 + this.data.readUInt32BE(start + 4);
+  }
+
+  private string(length: number) {
+    const start = this.take(length);
+    // Most keys are short and ASCII, building those by hand is much faster than going through a decoder
+    if (length <= 16) {
+      let string = "";
+      for (let i = start; i < start + length; i++) {
+        if (this.data[i] > 0x7f) return this.data.toString("utf8", start, start + length);
+        string += String.fromCharCode(this.data[i]);
+      }
+      return string;
+    }
+    return this.data.toString("utf8", start, start + length);
+  }
+
+  private array(length: number, depth: number) {
+    // Every item is at least a byte so this can't make a huge array out of a tiny frame
+    if (length > this.data.length - this.offset) throw new MsgpackError("unexpected end of the value");
+    const items: unknown[] = [];
+    for (let i = 0; i < length; i++) items.push(this.read(depth + 1));
+    return items;
+  }
+
+  private map(length: number, depth: number) {
+    const map: { [key: string]: unknown } = {};
+    for (let i = 0; i < length; i++) {
+      const key = this.read(depth + 1);
+      if (typeof key !== "string") throw new MsgpackError("map keys have to be strings");
+      const value = this.read(depth + 1);
+      // Set as its own property like JSON.parse does instead of changing the prototype of the map
+      if (key !== "__proto__") map[key] = value;
+      else Object.defineProperty(map, key, { value, enumerable: true, writable: true, configurable: true });
+    }
+    return map;
+  }
+
+  public read(depth: number): unknown {
+    if (depth > MAX_DEPTH) throw new MsgpackError("the value is nested too deep");
+    const type = this.data[this.take(1)];
+    if (type < 0x80) return type;
+    if (type < 0x90) return this.map(type & 0x0f, depth);
+    if (type < 0xa0) return this.array(type & 0x0f, depth);
+    if (type < 0xc0) return this.string(type & 0x1f);
+    if (type >= 0xe0) return type - 0x100;
+    switch (type) {
+      case 0xc0:
+        return null;
+      case 0xc2:
+        return false;
+      case 0xc3:
+        return true;
+      case 0xc4:
+      case 0xc5:
+      case 0xc6: {
+        const length = this.uint(type === 0xc4 ? 1 : type === 0xc5 ? 2 : 4);
+        const start = this.take(length);
+        return Buffer.from(this.data.subarray(start, start + length));
+      }
+      case 0xca:
+        return this.data.readFloatBE(this.take(4));
+      case 0xcb:
+        return this.data.readDoubleBE(this.take(8));
+      case 0xcc:
+        return this.uint(1);
+      case 0xcd:
+        return this.uint(2);
+      case 0xce:
+        return this.uint(4);
+      // Past 2^53 they lose precision like they would in JSON
+      case 0xcf:
+        return this.int64(false);
+      case 0xd0:
+        return this.data.readInt8(this.take(1));
+      case 0xd1:
+        return this.data.readInt16BE(this.take(2));
+      case 0xd2:
+        return this.data.readInt32BE(this.take(4));
+      case 0xd3:
+        return this.int64(true);
+      case 0xd9:
+        return this.string(this.uint(1));
+      case 0xda:
+        return this.string(this.uint(2));
+      case 0xdb:
+        return this.string(this.uint(4));
+      case 0xdc:
+        return this.array(this.uint(2), depth);
+      case 0xdd:
+        return this.array(this.uint(4), depth);
+      case 0xde:
+        return this.map(this.uint(2), depth);
+      case 0xdf:
+        return this.map(this.uint(4), depth);
+      default:
+        throw new MsgpackError(`unsupported type 0x${type.toString(16)}`);
+    }
+  }
+}
@@ -0,0 +1,323 @@
+import { Router } from "express";
+import Joi from "joi";
+
+/**
+ * A JSON schema the way OpenAPI 3.0 wants it
+ */
+export interface Schema {
+  [key: string]: any;
+}
+
+/**
+ * What the code can't tell about a route, keyed by its method and path like "GET /users/:uuid"
+ */
+export interface RouteDoc {
+  summary: string;
+  description?: string;
+  status?: number; // What it succeeds with, 200 unless set
+  response?: Schema; // Missing when it succeeds with an empty body
+  body?: Schema; // For bodies that aren't validated with a schema
+  query?: { [name: string]: Schema }; // For query params that aren't validated with a schema or that it lets through
+  security?: string; // For routes that authenticate without a security middleware
+}
+
+export type RouteDocs = { [route: string]: RouteDoc };
+
+/**
+ * A route as it's registered on the router, its first path is the one documented and the rest are aliases
+ */
+export interface RegisteredRoute {
+  method: string;
+  path: string;
+  aliases: string[];
+  handlers: any[];
+}
+
+/**
+ * Gets the path a router was mounted at from the regexp express compiled it to, /auth is compiled to ^\/auth\/?(?=\/|$)
+ */
+const mountPath = (layer: any): string => {
+  if (layer.regexp.fast_slash) return "";
+  return layer.regexp.source
+    .replace(/^\^/, "")
+    .replace("\\/?(?=\\/|$)", "")
+    .replace(/\\\//g, "/");
+};
+
+/**
+ * Lists every route registered on a router and the routers mounted on it
+ * @param router The router to walk
+ * @param prefix Where the router is mounted
+ * @tested
+ */
+export const listRoutes = (router: Router, prefix = ""): RegisteredRoute[] =>
+  router.stack.reduce((routes: RegisteredRoute[], layer: any) => {
+    if (layer.name === "router") return routes.concat(listRoutes(layer.handle, prefix + mountPath(layer)));
+    if (!layer.route) return routes;
+    // The root of a mounted router is documented without the trailing slash like /users
+    const paths = ([] as string[]).concat(layer.route.path).map((path) => (prefix && path === "/" ? prefix : prefix + path));
+    const [path, ...aliases] = paths;
+    const handlers = layer.route.stack.map((handler: any) => handler.handle);
+    const methods = Object.keys(layer.route.methods).filter((method) => method !== "_all");
+    return routes.concat(methods.map((method) => ({ method: method.toUpperCase(), path, aliases, handlers })));
+  }, []);
+
+/**
+ * The key a route is documented under like "GET /users/:uuid"
+ */
+export const routeKey = ({ method, path }: Pick<RegisteredRoute, "method" | "path">) => `${method} ${path}`;
+
+/**
+ * Converts a path like /users/:uuid to the /users/{uuid} OpenAPI uses
+ */
+export const openApiPath = (path: string) => path.replace(/:(\w+)/g, "{$1}");
+
+// Turns "/^[a-z]+$/i" back into what the regex was written as
+const sourceOf = (regex: string) => regex.replace(/^\/(.*)\/\w*$/, "$1");
+
+const RULES: { [type: string]: { [rule: string]: (args: any) => Schema } } = {
+  string: {
+    min: ({ limit }) => ({ minLength: limit }),
+    max: ({ limit }) => ({ maxLength: limit }),
+    length: ({ limit }) => ({ minLength: limit, maxLength: limit }),
+    email: () => ({ format: "email" }),
+    guid: () => ({ format: "uuid" }),
+    uri: () => ({ format: "uri" }),
+    alphanum: () => ({ pattern: "^[a-zA-Z0-9]*$" }),
+    pattern: ({ regex }) => ({ pattern: sourceOf(regex) }),
+  },
+  number: {
+    min: ({ limit }) => ({ minimum: limit }),
+    max: ({ limit }) => ({ maximum: limit }),
+    greater: ({ limit }) => ({ minimum: limit, exclusiveMinimum: true }),
+    less: ({ limit }) => ({ maximum: limit, exclusiveMaximum: true }),
+    integer: () => ({ type: "integer" }),
+  },
+  array: {
+    min: ({ limit }) => ({ minItems: limit }),
+    max: ({ limit }) => ({ maxItems: limit }),
+    length: ({ limit }) => ({ minItems: limit, maxItems: limit }),
+    unique: () => ({ uniqueItems: true }),
+  },
+};
+
+/**
+ * Converts what Joi describes a schema as to a JSON schema, rules that JSON schema can't express like
+ * custom ones are left out so the spec is looser than the validation but never stricter
+ * @param description What schema.describe() gave
+ */
+const describedSchema = (description: any): Schema => {
+  const { type, flags = {}, rules = [], allow = [] } = description;
+  const schema: Schema = {};
+
+  if (type === "object") {
+    schema.type = "object";
+    const keys = description.keys || {};
+    schema.properties = {};
+    Object.keys(keys).forEach((key) => (schema.properties[key] = describedSchema(keys[key])));
+    // Renamed keys are the old names of the fields, they're still accepted
+    (description.renames || []).forEach(({ from, to }: { from: string; to: string }) => {
+      if (schema.properties[to]) schema.properties[from] = { ...schema.properties[to], deprecated: true };
+    });
+    const required = Object.keys(keys).filter((key) => keys[key].flags?.presence === "required");
+    if (required.length) schema.required = required;
+    if (flags.unknown) schema.additionalProperties = true;
+  } else if (type === "array") {
+    schema.type = "array";
+    schema.items = description.items?.length ? describedSchema(description.items[0]) : {};
+  } else if (type === "alternatives") {
+    const matches = (description.matches || []).filter((match: any) => match.schema);
+    schema.oneOf = matches.map((match: any) => describedSchema(match.schema));
+  } else if (["string", "number", "boolean"].includes(type)) {
+    schema.type = type;
+  }
+
+  rules.forEach(({ name, args }: { name: string; args?: any }) => Object.assign(schema, RULES[type]?.[name]?.(args || {})));
+
+  const values = allow.filter((value: unknown) => value !== null && value !== "");
+  if (flags.only && values.length) schema.enum = values;
+  if (allow.includes(null)) schema.nullable = true;
+  if (flags.default !== undefined && typeof flags.default !== "function") schema.default = flags.default;
+  if (flags.description) schema.description = flags.description;
+  return schema;
+};
+
+/**
+ * Converts a Joi schema to a JSON schema
+ * @tested
+ */
+export const joiSchema = (schema: Joi.Schema) => describedSchema(schema.describe());
+
+const json = (schema: Schema) => ({ "application/json": { schema } });
+const error = (description: string) => ({ description, content: json({ $ref: "#/components/schemas/Error" }) });
+
+// Retrying a request with the same one gets what the first one was answered with
+const IDEMPOTENCY_HEADER = {
+  name: "Idempotency-Key",
+  in: "header",
+  required: false,
+  schema: { type: "string", maxLength: 255 },
+  description: "Retries with the same key get the first answer again instead of doing it twice, for an hour",
+};
+
+// Where a versioned API is mounted like /v1
+const VERSION_SEGMENT = /^v\d+$/;
+
+// The path params that are uuids, everything else is a plain string
+const UUID_PARAM = /(^|_)uuid$/;
+
+/**
+ * What the middlewares of a route tell about it
+ * @param guards The middlewares that only let some users through after they're authenticated
+ */
+const describeHandlers = (handlers: any[], guards: Function[]) => ({
+  security: handlers.find((handler) => handler.security)?.security as string | undefined,
+  scope: handlers.find((handler) => handler.scope)?.scope as string | undefined,
+  body: handlers.find((handler) => handler.body)?.body as Joi.Schema | undefined,
+  query: handlers.find((handler) => handler.query)?.query as Joi.Schema | undefined,
+  upload: handlers.some((handler) => handler.upload),
+  idempotent: handlers.some((handler) => handler.idempotent),
+  limited: handlers.some((handler) => handler.limiter),
+  guarded: handlers.some((handler) => guards.includes(handler)),
+});
+
+/**
+ * Builds the operation of a route from its middlewares and its doc
+ */
+const operation = (route: RegisteredRoute, doc: RouteDoc, guards: Function[]) => {
+  const { security, scope, body, query, upload, idempotent, limited, guarded } = describeHandlers(route.handlers, guards);
+  const params = (route.path.match(/:\w+/g) || []).map((param) => param.slice(1));
+  const validated: Schema = query ? joiSchema(query) : { properties: {} };
+  const query_schema: Schema = { ...validated, properties: { ...doc.query, ...validated.properties } };
+  const auth = security || doc.security;
+
+  const parameters = [
+    ...params.map((name) => ({
+      name,
+      in: "path",
+      required: true,
+      schema: UUID_PARAM.test(name) ? { type: "string", format: "uuid" } : { type: "string" },
+    })),
+    ...Object.keys(query_schema.properties).map((name) => ({
+      name,
+      in: "query",
+      required: (query_schema.required || []).includes(name),
+      schema: query_schema.properties[name],
+    })),
+    ...(idempotent ? [IDEMPOTENCY_HEADER] : []),
+  ];
+
+  const request_body = body ? joiSchema(body) : doc.body;
+  const responses: { [status: string]: object } = {
+    [doc.status || 200]: { description: doc.summary, ...(doc.response && { content: json(doc.response) }) },
+  };
+  if (request_body || upload || parameters.some((param) => param.in === "query")) responses[400] = error("Invalid input");
+  if (auth) responses[401] = error("Missing, invalid or expired token");
+  if (guarded || auth === "user") responses[403] = error("Not allowed");
+  if (params.length) responses[404] = error("Not found");
+  if (idempotent) responses[409] = error("A request with the same Idempotency-Key is still running");
+  if (idempotent) responses[422] = error("The Idempotency-Key was already used for a different request");
+  if (limited) responses[429] = error("Rate limited");
+  responses.default = error("Anything else that went wrong");
+
+  return {
+    // Tagged by the module, not by the version it's under
+    tags: [route.path.split("/").find((segment) => segment && !VERSION_SEGMENT.test(segment)) || "server"],
+    summary: doc.summary,
+    ...((doc.description || scope) && {
+      description: [doc.description, scope && `API tokens need the ${scope} scope`].filter(Boolean).join(", "),
+    }),
+    // The routes API tokens can use take either, the scopes aren't OAuth scopes so they're only described
+    ...(auth && { security: [{ [auth]: [] }, ...(scope ? [{ api_token: [] }] : [])] }),
+    ...(parameters.length && { parameters }),
+    ...(request_body && { requestBody: { required: true, content: json(request_body) } }),
+    ...(upload && {
+      requestBody: {
+        required: true,
+        content: {
+          "image/*": { schema: { type: "string", format: "binary" } },
+          "multipart/form-data": { schema: { type: "object", properties: { file: { type: "string", format: "binary" } } } },
+        },
+      },
+    }),
+    responses,
+  };
+};
+
+export interface SpecOptions {
+  title: string;
+  version: string;
+  docs: RouteDocs;
+  schemas: { [name: string]: Schema }; // What the docs refer to with #/components/schemas/
+  security_schemes: { [name: string]: object };
+  guards?: Function[]; // The middlewares that answer 403 to authenticated users they don't let through
+}
+
+/**
+ * Builds the OpenAPI spec of the routes on a router, routes without a doc are still in it with the
+ * method and path as their summary so nothing registered goes missing
+ * @param router The router to document
+ * @tested
+ */
+export const buildSpec = (router: Router, options: SpecOptions) => {
+  const paths: { [path: string]: { [method: string]: object } } = {};
+  listRoutes(router).forEach((route) => {
+    const doc = options.docs[routeKey(route)] || { summary: routeKey(route) };
+    const documented = operation(route, doc, options.guards || []);
+    [route.path, ...route.aliases].forEach((path, index) => {
+      const item = (paths[openApiPath(path)] = paths[openApiPath(path)] || {});
+      item[route.method.toLowerCase()] = index ? { ...documented, deprecated: true } : documented;
+    });
+  });
+
+  return {
+    openapi: "3.0.3",
+    info: { title: options.title, version: options.version },
+    paths,
+    components: {
+      schemas: {
+        Error: {
+          type: "object",
+          required: ["error"],
+          properties: {
+            error: {
+              type: "object",
+              required: ["code", "message", "status"],
+              properties: {
+                code: { type: "string", example: "user.notFound" },
+                message: { type: "string" },
+                status: { type: "integer" },
+                request_id: { type: "string" },
+                fields: { type: "object", additionalProperties: { type: "string" }, description: "Why each field failed" },
+              },
+              additionalProperties: true,
+            },
+          },
+        },
+        ...options.schemas,
+      },
+      securitySchemes: options.security_schemes,
+    },
+  };
+};
+
+/**
+ * The page that renders a spec with Swagger UI, the assets come from a CDN so they don't have to be bundled
+ * @param url Where the spec is served
+ */
+export const swaggerPage = (url: string, title: string) => `<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8" />
+    <title>${title}</title>
+    <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@4/swagger-ui.css" />
+  </head>
+  <body>
+    <div id="swagger-ui"></div>
+    <script src="https://unpkg.com/swagger-ui-dist@4/swagger-ui-bundle.js"></script>
+    <script>
+      window.ui = SwaggerUIBundle({ url: "${url}", dom_id: "#swagger-ui" });
+    </script>
+  </body>
+</html>
+`;
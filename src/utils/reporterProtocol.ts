@@ -0,0 +1,61 @@
+import { ErrorCode, ERROR_MESSAGES } from "./errors";
+import type { FrameEncoding } from "./ws";
+
+/**
+ * What each protocol version can encode the frames of the reporter with, 1 is what every reporter spoke before
+ * they could pick so it's what they get without asking and it keeps working for as long as they're out there
+ */
+export const REPORTER_PROTOCOLS: { [version: number]: FrameEncoding[] } = {
+  1: ["json"],
+  2: ["json", "msgpack"],
+};
+
+export const DEFAULT_REPORTER_PROTOCOL: ReporterProtocol = { version: 1, encoding: "json" };
+
+export interface ReporterProtocol {
+  version: number;
+  encoding: FrameEncoding;
+}
+
+/**
+ * What a reporter asking for a protocol that isn't supported is sent before it's disconnected,
+ * it has what is so the reporter can say what to update to
+ */
+export interface ReporterProtocolRejection {
+  code: ErrorCode;
+  message: string;
+  supported: ReporterProtocol[];
+}
+
+/**
+ * Picks the protocol a reporter asked for, a reporter that only asks for a version gets JSON
+ * @param requested The version and encoding from the query of the url or the protocol frame
+ * @returns the protocol or why the reporter can't have it
+ * @tested
+ */
+export const negotiateReporterProtocol = (requested: { version?: unknown; encoding?: unknown }) => {
+  const version = Number(requested?.version ?? DEFAULT_REPORTER_PROTOCOL.version);
+  const encoding = requested?.encoding ?? DEFAULT_REPORTER_PROTOCOL.encoding;
+  const encodings = Number.isInteger(version) ? REPORTER_PROTOCOLS[version] : undefined;
+  if (encodings?.includes(encoding as FrameEncoding)) {
+    const protocol: ReporterProtocol = { version, encoding: encoding as FrameEncoding };
+    return { protocol };
+  }
+  const supported: ReporterProtocol[] = [];
+  for (const [version, encodings] of Object.entries(REPORTER_PROTOCOLS))
+    encodings.forEach((encoding) => supported.push({ version: Number(version), encoding }));
+  const code = ErrorCode.UnsupportedProtocol;
+  const rejection: ReporterProtocolRejection = { code, message: ERROR_MESSAGES[code], supported };
+  return { rejection };
+};
+
+/**
+ * The protocol a reporter asked for in the query of the url it connected to like ?version=2&encoding=msgpack
+ * @returns what it asked for or undefined if it didn't
+ * @tested
+ */
+export const requestedReporterProtocol = (url: string) => {
+  const { searchParams } = new URL(url, "http://localhost");
+  if (!searchParams.has("version") && !searchParams.has("encoding")) return;
+  return { version: searchParams.get("version") ?? undefined, encoding: searchParams.get("encoding") ?? undefined };
+};
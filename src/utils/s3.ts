@@ -0,0 +1,81 @@
+import axios from "axios";
+import crypto from "crypto";
+
+export interface S3Config {
+  endpoint: string; // Like https://s3.eu-central-1.amazonaws.com or the url of a minio
+  bucket: string;
+  region: string;
+  access_key_id: string;
+  secret_access_key: string;
+  public_url: string; // Where the objects are served from, a CDN in front of the bucket for example
+}
+
+const sha256 = (data: string | Buffer) => crypto.createHash("sha256").update(data).digest("hex");
+const hmac = (key: string | Buffer, data: string) => crypto.createHmac("sha256", key).update(data).digest();
+
+/**
+ * The path style url of an object, works with AWS and every S3 compatible store
+ */
+export const objectUrl = (config: S3Config, key: string) =>
+  `${config.endpoint}/${config.bucket}/${key.split("/").map(encodeURIComponent).join("/")}`;
+
+/**
+ * Signs a request to the bucket with AWS Signature Version 4
+ * @param config The bucket to sign for
+ * @param method The HTTP method of the request
+ * @param key The key of the object
+ * @param body The body of the request
+ * @param date When the request is signed, the signature is only valid for a few minutes
+ * @returns the headers to send along with the request
+ * @tested
+ */
+export const signS3Request = (config: S3Config, method: string, key: string, body: Buffer, date = new Date()) => {
+  const url = new URL(objectUrl(config, key));
+  const amzDate = date.toISOString().replace(/[:-]|\.\d{3}/g, "");
+  const day = amzDate.slice(0, 8);
+  const payloadHash = sha256(body);
+  const headers: { [name: string]: string } = {
+    host: url.host,
+    "x-amz-content-sha256": payloadHash,
+    "x-amz-date": amzDate,
+  };
+
+  const signedHeaders = Object.keys(headers).sort().join(";");
+  const canonicalHeaders = Object.keys(headers)
+    .sort()
+    .map((name) => `${name}:${headers[name]}\n`)
+    .join("");
+  const canonicalRequest = [method, url.pathname, "", canonicalHeaders, signedHeaders, payloadHash].join("\n");
+  const scope = `${day}/${config.region}/s3/aws4_request`;
+  const stringToSign = ["AWS4-HMAC-SHA256", amzDate, scope, sha256(canonicalRequest)].join("\n");
+
+  const signingKey = ["s3", "aws4_request"].reduce(
+    (key, part) => hmac(key, part),
+    hmac(hmac(`AWS4${config.secret_access_key}`, day), config.region)
+  );
+  const signature = crypto.createHmac("sha256", signingKey).update(stringToSign).digest("hex");
+
+  const credential = `${config.access_key_id}/${scope}`;
+  return {
+    ...headers,
+    authorization: `AWS4-HMAC-SHA256 Credential=${credential}, SignedHeaders=${signedHeaders}, Signature=${signature}`,
+  };
+};
+
+/**
+ * Uploads an object to the bucket
+ */
+export const putObject = async (config: S3Config, key: string, body: Buffer, contentType: string) => {
+  await axios.put(objectUrl(config, key), body, {
+    headers: { ...signS3Request(config, "PUT", key, body), "content-type": contentType },
+    maxBodyLength: Infinity,
+  });
+};
+
+/**
+ * Deletes an object from the bucket, deleting an object that doesn't exist succeeds
+ */
+export const deleteObject = async (config: S3Config, key: string) => {
+  const body = Buffer.alloc(0);
+  await axios.delete(objectUrl(config, key), { headers: signS3Request(config, "DELETE", key, body) });
+};
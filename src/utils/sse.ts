@@ -0,0 +1,88 @@
+import { Request, Response } from "express";
+import { Time } from "../types";
+import { Mitt, MittEvent } from "./mitt";
+
+// Proxies drop streams that are quiet for too long, a comment every so often keeps them open
+export const SSE_KEEP_ALIVE = 15 * Time.Second;
+// How long browsers wait before reconnecting after the stream drops
+export const SSE_RETRY = 3 * Time.Second;
+
+/**
+ * A Server-Sent Events stream that can stand in for a websocket in the machine hub, for networks that block websockets
+ */
+export class SseConnection<T extends MittEvent> extends Mitt<T> {
+  /**
+   * The id of the last event that was written, it resumes from the Last-Event-ID the client reconnected with
+   */
+  public lastEventId: number;
+
+  private keepAlive: NodeJS.Timeout;
+  private closed = false;
+
+  /**
+   * @param req The request of the stream
+   * @param res The response the events are written to
+   * @param events What the hub events are called on the stream, the rest aren't sent
+   * @param accept Which of the event data is for this stream, everything is by default
+   */
+  constructor(
+    req: Request,
+    private res: Response,
+    events: { [event in keyof T]?: string },
+    accept: (data: unknown) => boolean = () => true
+  ) {
+    super();
+    const resumed = Number(req.header("Last-Event-ID"));
+    this.lastEventId = Number.isSafeInteger(resumed) && resumed > 0 ? resumed : 0;
+
+    res.status(200).set({
+      "Content-Type": "text/event-stream",
+      "Cache-Control": "no-cache",
+      Connection: "keep-alive",
+      // Otherwise nginx holds the events back until its buffer fills
+      "X-Accel-Buffering": "no",
+    });
+    res.flushHeaders();
+    this.write(`retry: ${SSE_RETRY}\n\n`);
+
+    this.keepAlive = setInterval(() => this.write(": keep-alive\n\n"), SSE_KEEP_ALIVE);
+    res.once("close", () => this.close());
+
+    this.on("*", (event, data) => {
+      const name = events[event];
+      if (name && accept(data)) this.send(name, data);
+    });
+  }
+
+  /**
+   * Writes an event with the next id
+   * @tested
+   */
+  public send(name: string, data: unknown) {
+    this.write(`id: ${++this.lastEventId}\nevent: ${name}\ndata: ${JSON.stringify(data)}\n\n`);
+  }
+
+  /**
+   * Calls back once the client disconnected or the stream was ended
+   */
+  public onClose(callback: () => void) {
+    this.closed ? callback() : this.res.once("close", callback);
+  }
+
+  /**
+   * Ends the stream, clients reconnect on their own unless they're gone
+   */
+  public close() {
+    if (this.closed) return;
+    this.closed = true;
+    clearInterval(this.keepAlive);
+    this.res.end();
+  }
+
+  private write(chunk: string) {
+    if (this.closed) return;
+    this.res.write(chunk);
+    // The compression middleware buffers what's written until it's flushed
+    (this.res as Response & { flush?: () => void }).flush?.();
+  }
+}
@@ -0,0 +1,51 @@
+import fs from "fs";
+import path from "path";
+import { v4 as uuidv4 } from "uuid";
+import { ImageType } from "./images";
+import { deleteObject, putObject } from "./s3";
+import type { Config } from "../config";
+
+// Where the uploads are stored when there's no bucket unless UPLOADS_DIR is set
+export const UPLOADS_DIR = "./uploads";
+export const UPLOADS_ROUTE = "/uploads";
+
+/**
+ * The maximum size of an uploaded file in bytes unless UPLOAD_LIMIT is set
+ */
+export const UPLOAD_LIMIT = 5 * 1024 * 1024;
+
+/**
+ * The maximum size of an avatar or banner in bytes unless PROFILE_IMAGE_LIMIT is set
+ */
+export const PROFILE_IMAGE_LIMIT = 2 * 1024 * 1024;
+
+// Where the uploads can be accessed, the bucket when there is one and our own /uploads route otherwise
+const uploadsPrefix = ({ s3, uploads }: Config) => (s3 ? `${s3.public_url}/` : `${uploads.public_url}${UPLOADS_ROUTE}/`);
+
+/**
+ * Stores an uploaded image in the bucket or on the disk
+ * @param config The config of the backend, the image goes to its bucket when it has one
+ * @returns the url the image can be accessed on
+ */
+export const saveUpload = async (config: Config, buffer: Buffer, type: ImageType) => {
+  const filename = `${uuidv4()}.${type}`;
+  if (config.s3) {
+    await putObject(config.s3, filename, buffer, `image/${type}`);
+  } else {
+    await fs.promises.mkdir(config.uploads.dir, { recursive: true });
+    await fs.promises.writeFile(path.join(config.uploads.dir, filename), buffer);
+  }
+  return `${uploadsPrefix(config)}${filename}`;
+};
+
+/**
+ * Deletes a previously uploaded image, urls that weren't uploaded to us are ignored
+ * @param config The config of the backend
+ * @param url The url of the upload
+ */
+export const deleteUpload = async (config: Config, url?: string) => {
+  if (!url?.startsWith(uploadsPrefix(config))) return;
+  const filename = path.basename(url);
+  const { s3, uploads } = config;
+  await (s3 ? deleteObject(s3, filename) : fs.promises.unlink(path.join(uploads.dir, filename))).catch(() => {});
+};
@@ -1,52 +1,181 @@
 import http from "http";
 import mitt, { Emitter } from "mitt";
 import { default as ws, RawData } from "ws";
+import { Time } from "../types";
+import { metrics } from "./metrics";
 import { Mitt, MittEvent } from "./mitt";
-import pako from "pako";
+import { decodeMsgpack } from "./msgpack";
+
+// How long a socket can go without answering a ping or sending anything before its TCP connection is considered dead,
+// unless WEBSOCKET_IDLE_TIMEOUT is set
+export const WEBSOCKET_IDLE_TIMEOUT = 30 * Time.Second;
+// Frames bigger than this close the socket with 1009 before they're read into memory
+export const WEBSOCKET_MAX_PAYLOAD = 128 * 1024;
+// How many frames a socket can have waiting to be sent, the oldest are dropped past it since the newer stats replace them
+export const WEBSOCKET_MAX_QUEUE = 64;
+// How many bytes can be handed to the socket before the rest waits in the queue
+export const WEBSOCKET_HIGH_WATER_MARK = 256 * 1024;
+
+const dropped = metrics.counter("xornet_websocket_frames_dropped_total", "How many frames were dropped for slow sockets");
+const reaped = metrics.counter("xornet_websocket_connections_reaped_total", "How many dead sockets were terminated");
 
 export interface WebsocketMessage<T extends string, D extends object> {
   e: T;
   d: D;
 }
 
+/**
+ * What the frames a socket gets are encoded with, the text frames are always JSON and the binary ones are
+ * only read as MessagePack once the socket asked for it
+ */
+export type FrameEncoding = "json" | "msgpack";
+
 export class WebsocketConnection<T extends MittEvent> extends Mitt<T> {
-  constructor(public socket: ws) {
+  /**
+   * The amount of frames that couldn't be parsed and were dropped
+   */
+  public malformedFrames = 0;
+
+  /**
+   * The amount of frames that were dropped because the socket couldn't keep up
+   */
+  public droppedFrames = 0;
+
+  /**
+   * The last time the socket sent a frame or answered a ping
+   */
+  public lastSeen = Date.now();
+
+  /**
+   * What the binary frames the socket sends are decoded with, what's sent to it is always JSON
+   */
+  public encoding: FrameEncoding = "json";
+
+  // The frames waiting for the socket to drain, bounded so one slow client can't grow the memory of the shard
+  private queue: string[] = [];
+
+  /**
+   * @param idleTimeout How long the socket can go without answering a ping or sending anything
+   */
+  constructor(public socket: ws, public request: http.IncomingMessage, private idleTimeout = WEBSOCKET_IDLE_TIMEOUT) {
     super();
-    socket.on("message", (message) => {
-      const { e: event, d: data } = parseData(message);
-      this.emit(event, data);
+    socket.on("message", (message, isBinary) => {
+      this.lastSeen = Date.now();
+      const parsed = parseData(message, isBinary && this.encoding === "msgpack" ? "msgpack" : "json");
+      if (!parsed) {
+        this.malformedFrames++;
+        return;
+      }
+      this.emit(parsed.e, parsed.d);
     });
-    socket.on("close", () => this.emit("close" as any));
-    this.on("*", (name, event) => {
-      socket.send(
-        // pako.gzip(
-        JSON.stringify({
-          e: name,
-          d: event,
-        })
-        // )
-      );
+    socket.on("pong", () => (this.lastSeen = Date.now()));
+    socket.on("close", () => {
+      this.queue = [];
+      this.emit("close" as any);
     });
+    this.on("*", (name, event) => this.send(JSON.stringify({ e: name, d: event })));
+  }
+
+  /**
+   * Queues a frame and sends as much of the queue as the socket can take
+   * @tested
+   */
+  public send(frame: string) {
+    this.queue.push(frame);
+    if (this.queue.length > WEBSOCKET_MAX_QUEUE) {
+      this.queue.shift();
+      this.droppedFrames++;
+      dropped.inc();
+    }
+    this.flush();
+  }
+
+  /**
+   * Calls back once the socket closed
+   */
+  public onClose(callback: () => void) {
+    this.socket.once("close", callback);
+  }
+
+  /**
+   * The amount of frames waiting to be sent
+   */
+  public get queued() {
+    return this.queue.length;
+  }
+
+  private flush() {
+    while (
+      this.queue.length &&
+      this.socket.readyState === ws.OPEN &&
+      this.socket.bufferedAmount < WEBSOCKET_HIGH_WATER_MARK
+    ) {
+      // Whatever is left is sent once the socket wrote this one
+      this.socket.send(this.queue.shift()!, () => this.flush());
+    }
+  }
+
+  /**
+   * Pings the socket, or terminates it if it didn't answer the last pings or send anything for too long
+   * @returns whether the socket is still alive
+   * @tested
+   */
+  public heartbeat(now = Date.now()) {
+    if (now - this.lastSeen > this.idleTimeout) {
+      this.socket.terminate();
+      reaped.inc();
+      return false;
+    }
+    this.socket.ping();
+    return true;
   }
 }
 
-export function parseData(data: RawData) {
-  return JSON.parse(data.toString()) as WebsocketMessage<string, any>;
+/**
+ * Parses a websocket frame
+ * @param encoding What the frame is encoded with
+ * @returns the parsed message or undefined if the frame is malformed
+ * @tested
+ */
+export function parseData(data: RawData, encoding: FrameEncoding = "json") {
+  try {
+    const message: any = encoding === "msgpack" ? decodeMsgpack(toBuffer(data)) : JSON.parse(data.toString());
+    if (typeof message?.e !== "string") return;
+    return message as WebsocketMessage<string, any>;
+  } catch (error) {
+    return;
+  }
 }
 
+const toBuffer = (data: RawData) =>
+  Buffer.isBuffer(data) ? data : Array.isArray(data) ? Buffer.concat(data) : Buffer.from(data);
+
 interface WebsocketEmitter<T extends MittEvent> {
   connection: WebsocketConnection<T>;
   [key: string | symbol]: unknown;
 }
 
-export function newWebSocketHandler<T extends MittEvent>(server: http.Server, path: string): Emitter<WebsocketEmitter<T>> {
+/**
+ * Creates a websocket handler that accepts upgrades on the given paths
+ * @param server The http server to listen for upgrades on
+ * @param idleTimeout How long a socket can go without answering a ping or sending anything before it's terminated
+ * @param paths The paths the websocket is reachable on
+ */
+export function newWebSocketHandler<T extends MittEvent>(
+  server: http.Server,
+  idleTimeout: number,
+  ...paths: string[]
+): Emitter<WebsocketEmitter<T>> {
   const websocketServer = new ws.Server({
     noServer: true,
-    path,
+    maxPayload: WEBSOCKET_MAX_PAYLOAD,
+    // The stats are the same JSON over and over so a small window still compresses them well
+    perMessageDeflate: { threshold: 256, serverMaxWindowBits: 11, zlibDeflateOptions: { memLevel: 7 } },
   });
 
   server.on("upgrade", function upgrade(request, socket, head) {
-    if (request.url === path) {
+    const { pathname } = new URL(request.url!, "http://localhost");
+    if (paths.includes(pathname)) {
       websocketServer.handleUpgrade(request, socket, head, function done(ws) {
         websocketServer.emit("connection", ws, request);
       });
@@ -54,8 +183,22 @@ export function newWebSocketHandler<T extends MittEvent>(server: http.Server, pa
   });
 
   const emitter = mitt<WebsocketEmitter<T>>();
+  const connections = new Set<WebsocketConnection<T>>();
+
+  // Pings often enough that a socket gets a few chances to answer before the timeout
+  const heartbeat = setInterval(
+    () => connections.forEach((connection) => connection.heartbeat() || connections.delete(connection)),
+    idleTimeout / 3
+  );
+  heartbeat.unref();
+  server.on("close", () => clearInterval(heartbeat));
 
-  websocketServer.on("connection", (socket) => emitter.emit("connection", new WebsocketConnection(socket)));
+  websocketServer.on("connection", (socket, request) => {
+    const connection = new WebsocketConnection<T>(socket, request, idleTimeout);
+    connections.add(connection);
+    socket.on("close", () => connections.delete(connection));
+    emitter.emit("connection", connection);
+  });
 
   return emitter;
 }
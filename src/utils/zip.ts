@@ -0,0 +1,166 @@
+import { Writable } from "stream";
+import zlib from "zlib";
+
+// The sizes and offsets are 32 bits without the zip64 extensions, archives are capped well below this
+const MAX_ZIP_SIZE = 0xffffffff;
+// Data descriptors follow the files since their sizes aren't known until they're written, the names are UTF-8
+const FLAGS = 0x0008 | 0x0800;
+const DEFLATE = 8;
+const VERSION = 20;
+
+const CRC_TABLE = new Int32Array(256).map((_, n) => {
+  for (let k = 0; k < 8; k++) n = n & 1 ? 0xedb88320 ^ (n >>> 1) : n >>> 1;
+  return n;
+});
+
+/**
+ * The CRC-32 zip files check their contents with
+ * @param data The bytes to checksum
+ * @param crc The checksum of the bytes before these, to checksum something in chunks
+ * @tested
+ */
+export const crc32 = (data: Buffer, crc = 0) => {
+  let c = ~crc;
+  for (let i = 0; i < data.length; i++) c = CRC_TABLE[(c ^ data[i]) & 0xff] ^ (c >>> 8);
+  return ~c >>> 0;
+};
+
+// The date and time in the MS-DOS format zip files use, it's local time with a 2 second precision
+const dosTime = (date: Date) => ({
+  time: (date.getHours() << 11) | (date.getMinutes() << 5) | (date.getSeconds() >> 1),
+  date: ((date.getFullYear() - 1980) << 9) | ((date.getMonth() + 1) << 5) | date.getDate(),
+});
+
+/**
+ * Resolves once a stream can take more, rejects if it closed first since nothing would ever drain it
+ */
+const drained = (stream: Writable) =>
+  new Promise<void>((resolve, reject) => {
+    const drain = () => {
+      stream.off("close", close);
+      resolve();
+    };
+    const close = () => {
+      stream.off("drain", drain);
+      reject(new Error("the stream closed before the archive was written"));
+    };
+    stream.once("drain", drain);
+    stream.once("close", close);
+  });
+
+interface ZipEntry {
+  name: Buffer;
+  crc: number;
+  compressed: number;
+  size: number;
+  offset: number; // Where its local header starts
+  modified: { time: number; date: number };
+}
+
+/**
+ * Writes a zip archive to a stream as its files are added so it's never held in memory,
+ * every file is deflated and waits for the stream to drain like a pipe would
+ */
+export class ZipWriter {
+  private entries: ZipEntry[] = [];
+  private offset = 0;
+
+  /**
+   * @param output Where the archive is written, like the response it's downloaded from
+   */
+  public constructor(private output: Writable) {}
+
+  /**
+   * Adds a file, the next one can only be added once this one is written
+   * @param name The path of the file in the archive
+   * @param content What's in it, an iterable is written as it's iterated
+   * @tested
+   */
+  public async add(name: string, content: string | Buffer | AsyncIterable<string | Buffer>) {
+    const entry: ZipEntry = {
+      name: Buffer.from(name),
+      crc: 0,
+      compressed: 0,
+      size: 0,
+      offset: this.offset,
+      modified: dosTime(new Date()),
+    };
+    const header = Buffer.alloc(30);
+    header.writeUInt32LE(0x04034b50, 0);
+    header.writeUInt16LE(VERSION, 4);
+    header.writeUInt16LE(FLAGS, 6);
+    header.writeUInt16LE(DEFLATE, 8);
+    header.writeUInt16LE(entry.modified.time, 10);
+    header.writeUInt16LE(entry.modified.date, 12);
+    // The checksum and the sizes are left at 0 for the data descriptor
+    header.writeUInt16LE(entry.name.length, 26);
+    await this.write(Buffer.concat([header, entry.name]));
+
+    const deflate = zlib.createDeflateRaw();
+    const feed = async () => {
+      const chunks = typeof content === "string" || Buffer.isBuffer(content) ? [content] : content;
+      for await (const chunk of chunks) {
+        const data = Buffer.isBuffer(chunk) ? chunk : Buffer.from(chunk);
+        entry.crc = crc32(data, entry.crc);
+        entry.size += data.length;
+        if (!deflate.write(data)) await drained(deflate);
+      }
+      deflate.end();
+    };
+    // A source that fails ends the deflate stream with its error so reading it below rejects, and the
+    // output closing stops reading it which destroys it so the source stops being read too
+    const feeding = feed().catch((error) => deflate.destroy(error));
+    for await (const compressed of deflate) {
+      entry.compressed += compressed.length;
+      await this.write(compressed);
+    }
+    await feeding;
+    if (entry.size > MAX_ZIP_SIZE || this.offset > MAX_ZIP_SIZE) throw new Error("the archive is too large for a zip");
+
+    const descriptor = Buffer.alloc(16);
+    descriptor.writeUInt32LE(0x08074b50, 0);
+    descriptor.writeUInt32LE(entry.crc, 4);
+    descriptor.writeUInt32LE(entry.compressed, 8);
+    descriptor.writeUInt32LE(entry.size, 12);
+    await this.write(descriptor);
+    this.entries.push(entry);
+  }
+
+  /**
+   * Writes the central directory that lists the files, the archive can't be opened without it
+   * @returns how many bytes the archive is
+   */
+  public async finish() {
+    const start = this.offset;
+    for (const entry of this.entries) {
+      const header = Buffer.alloc(46);
+      header.writeUInt32LE(0x02014b50, 0);
+      header.writeUInt16LE(VERSION, 4);
+      header.writeUInt16LE(VERSION, 6);
+      header.writeUInt16LE(FLAGS, 8);
+      header.writeUInt16LE(DEFLATE, 10);
+      header.writeUInt16LE(entry.modified.time, 12);
+      header.writeUInt16LE(entry.modified.date, 14);
+      header.writeUInt32LE(entry.crc, 16);
+      header.writeUInt32LE(entry.compressed, 20);
+      header.writeUInt32LE(entry.size, 24);
+      header.writeUInt16LE(entry.name.length, 28);
+      header.writeUInt32LE(entry.offset, 42);
+      await this.write(Buffer.concat([header, entry.name]));
+    }
+    const end = Buffer.alloc(22);
+    end.writeUInt32LE(0x06054b50, 0);
+    end.writeUInt16LE(this.entries.length, 8);
+    end.writeUInt16LE(this.entries.length, 10);
+    end.writeUInt32LE(this.offset - start, 12);
+    end.writeUInt32LE(start, 16);
+    await this.write(end);
+    return this.offset;
+  }
+
+  private async write(chunk: Buffer) {
+    if (this.output.destroyed) throw new Error("the stream closed before the archive was written");
+    this.offset += chunk.length;
+    if (!this.output.write(chunk)) await drained(this.output);
+  }
+}
@@ -1,6 +1,55 @@
 import Joi from "joi";
 import { ICreateLabelInput, LabelIcon, LABEL_ICONS } from "./database/schemas/label";
+import type { IDynamicData } from "./database/schemas/machine";
+import type { UserProfileUpdate, UserProfileUpdateInput, UserSignupInput } from "./database/schemas/user";
 import { randomHexColor } from "./logic";
+import { ALERT_METRICS, ALERT_OPERATORS, ALERT_TARGETS } from "./utils/alerts";
+
+// How long the name the owner gives a machine can be
+export const MAX_MACHINE_NAME_LENGTH = 48;
+// What the frontend can show a machine as, they're here since the schemas import the validators
+export const MACHINE_ICONS = [
+  "server",
+  "desktop",
+  "laptop",
+  "raspberry-pi",
+  "virtual-machine",
+  "container",
+  "cloud",
+  "database",
+  "router",
+  "storage",
+  "game-server",
+] as const;
+
+export type MachineIcon = typeof MACHINE_ICONS[number];
+
+// How many machines a chart can compare at once, each of them is an aggregation of its own
+export const MAX_COMPARED_MACHINES = 10;
+
+// What API tokens can be allowed to do, a route that doesn't need one of these can't be used with a token at all
+export const API_TOKEN_SCOPES = [
+  "read:machines",
+  "write:machines",
+  "read:stats",
+  "read:labels",
+  "write:labels",
+] as const;
+
+export type ApiTokenScope = typeof API_TOKEN_SCOPES[number];
+
+// Who can see the profile and the machines of a user, the user themselves always can
+export const PROFILE_VISIBILITIES = ["public", "friends", "private"] as const;
+
+export type ProfileVisibility = typeof PROFILE_VISIBILITIES[number];
+
+// What webhooks can subscribe to, alerts fire when a rule of a machine like a CPU or RAM threshold is broken
+export const WEBHOOK_EVENTS = ["machine.online", "machine.offline", "machine.deleted", "alert.fired"] as const;
+
+/**
+ * The reason each field of a body failed validation
+ */
+export type FieldErrors = { [field: string]: string };
 
 export class Validators {
   public static TRUSTED_IMAGE_HOSTERS = [
@@ -13,6 +62,247 @@ export class Validators {
   ];
   public static ALLOWED_IMAGE_EXTENSIONS = ["png", "gif", "jpg", "jpeg", "webp"];
 
+  private static USAGE_SCHEMA = Joi.object({
+    total: Joi.number().min(0).required(),
+    used: Joi.number().min(0).required(),
+  }).unknown(true);
+
+  // Extra fields are let through since every version of the reporter sends something new
+  public static DYNAMIC_DATA_BODY = Joi.object({
+    cpu: Joi.object({
+      usage: Joi.array().items(Joi.number().min(0).max(100)).min(1).required(),
+      freq: Joi.array().items(Joi.number().min(0)).required(),
+    })
+      .unknown(true)
+      .required(),
+    ram: Validators.USAGE_SCHEMA.required(),
+    swap: Validators.USAGE_SCHEMA.required(),
+    gpu: Joi.object().unknown(true),
+    disks: Joi.array()
+      .items(
+        Joi.object({
+          fs: Joi.string(),
+          mount: Joi.string(),
+          type: Joi.string(),
+          total: Joi.number().min(0),
+          used: Joi.number().min(0),
+        }).unknown(true)
+      )
+      .required(),
+    // Only the busiest ones are kept but the reporter can send all of them
+    processes: Joi.array().items(
+      Joi.object({
+        pid: Joi.number().integer().min(0).required(),
+        name: Joi.string().allow("").required(),
+        cpu: Joi.number().min(0),
+        ram: Joi.number().min(0),
+      }).unknown(true)
+    ),
+    process_count: Joi.number().min(0).required(),
+    temps: Joi.array().items(Joi.object().unknown(true)),
+    network: Joi.array()
+      .items(
+        Joi.object({
+          n: Joi.string().required(),
+          tx: Joi.number().min(0).required(),
+          rx: Joi.number().min(0).required(),
+          s: Joi.number(),
+        }).unknown(true)
+      )
+      .required(),
+    host_uptime: Joi.number().min(0).required(),
+    reporter_uptime: Joi.number().min(0).required(),
+  }).unknown(true);
+
+  private static TRUSTED_IMAGE_URL = Joi.string()
+    .custom((url, helpers) => (Validators.validate_avatar_url(url) ? url : helpers.error("any.invalid")))
+    .messages({ "any.invalid": "must be a trusted image url" });
+
+  // Objects reject keys that aren't in their schema so typos like "usrname" don't silently pass
+  public static SIGNUP_BODY = Joi.object({
+    username: Joi.string().min(3).max(32).alphanum().required(),
+    email: Joi.string().email().required(),
+    password: Joi.string().min(8).max(64).required(),
+  });
+
+  public static LOGIN_BODY = Joi.object({
+    username: Joi.string().required(),
+    password: Joi.string().required(),
+  });
+
+  public static REFRESH_BODY = Joi.object({
+    refresh_token: Joi.string().max(128).required(),
+  });
+
+  public static FORGOT_PASSWORD_BODY = Joi.object({
+    email: Joi.string().email().required(),
+  });
+
+  // The new password follows the same rules as signing up, password is what the frontend sent before new_password
+  public static PASSWORD_RESET_BODY = Joi.object({
+    token: Joi.string().max(128).required(),
+    new_password: Joi.string().min(8).max(64).required(),
+  }).rename("password", "new_password");
+
+  public static EMAIL_VERIFICATION_BODY = Joi.object({
+    token: Joi.string().max(1024).required(),
+  });
+
+  public static USER_UPDATE_BODY = Joi.object({
+    username: Joi.string().min(3).max(32).alphanum(),
+    email: Joi.string().email(),
+    bio: Joi.string().allow("").max(300),
+    avatar: Validators.TRUSTED_IMAGE_URL,
+    banner: Validators.TRUSTED_IMAGE_URL,
+    location: Joi.string().allow("").max(64),
+    profile_visibility: Joi.string().valid(...PROFILE_VISIBILITIES),
+    // The version of the user the client last saw, the update fails with a 409 when someone else changed it since
+    version: Joi.number().integer().min(0),
+  });
+
+  // The new password follows the same rules as signing up
+  public static PASSWORD_UPDATE_BODY = Joi.object({
+    old_password: Joi.string().required(),
+    new_password: Joi.string().min(8).max(64).required(),
+  });
+
+  // Uuids that aren't valid are left in and just won't be found
+  public static ACCOUNT_DELETION_BODY = Joi.object({
+    password: Joi.string().required(),
+  });
+
+  // Only the users deleting themselves need their password, admins deleting someone else don't send one
+  public static USER_DELETION_BODY = Joi.object({
+    password: Joi.string(),
+  });
+
+  public static USER_BATCH_BODY = Joi.object({
+    uuids: Joi.array().items(Joi.string().max(36)).min(1).max(100).required(),
+  });
+
+  public static MACHINE_SIGNUP_BODY = Joi.object({
+    two_factor_key: Joi.string().required(),
+    hardware_uuid: Joi.string().uuid().required(),
+    hostname: Joi.string().max(253).required(),
+  });
+
+  // Lowercase slugs like "eu-west"
+  public static MACHINE_TAG = Joi.string().max(24).pattern(/^[a-z0-9]+(-[a-z0-9]+)*$/);
+
+  public static MACHINE_TAG_BODY = Joi.object({
+    tag: Validators.MACHINE_TAG.required(),
+  });
+
+  // Only what the owner sets, the reporter's fields can't be changed through it
+  public static MACHINE_UPDATE_BODY = Joi.object({
+    name: Joi.string().trim().min(1).max(MAX_MACHINE_NAME_LENGTH),
+    icon: Joi.string().valid(...MACHINE_ICONS),
+  });
+
+  public static MACHINE_TRANSFER_BODY = Joi.object({
+    to_uuid: Joi.string().uuid().required(),
+  });
+
+  // The range is parsed by parseStatsRange the same as the query of the history
+  public static STATS_COMPARE_BODY = Joi.object({
+    uuids: Joi.array().items(Joi.string().uuid()).min(1).max(MAX_COMPARED_MACHINES).unique().required(),
+    from: Joi.string(),
+    to: Joi.string(),
+    resolution: Joi.string(),
+  });
+
+  // The pagination params are left in for parsePagination
+  public static ADMIN_USERS_QUERY = Joi.object({
+    email_verified: Joi.boolean(),
+    disabled: Joi.boolean(),
+    created_after: Joi.number().integer().min(0),
+    created_before: Joi.number().integer().min(0),
+  }).unknown(true);
+
+  // Durations like 30s, 5m or 1h
+  private static DURATION = Joi.string()
+    .pattern(/^\d+(s|m|h|d)$/)
+    .messages({ "string.pattern.base": "must be like 30s, 5m or 1h" });
+
+  public static ALERT_BODY = Joi.object({
+    metric: Joi.string().valid(...ALERT_METRICS).required(),
+    operator: Joi.string().valid(...ALERT_OPERATORS).default(">"),
+    // Offline rules don't have anything to compare
+    threshold: Joi.number().when("metric", { is: "offline", then: Joi.forbidden(), otherwise: Joi.required() }),
+    duration: Validators.DURATION.default("0s"),
+    cooldown: Validators.DURATION,
+    target: Joi.object({
+      type: Joi.string().valid(...ALERT_TARGETS).required(),
+      url: Joi.string()
+        .uri({ scheme: ["https"] })
+        .max(2048)
+        .required()
+        .when("type", {
+          is: "discord",
+          then: Joi.string()
+            .pattern(/^https:\/\/(discord|discordapp)\.com\/api\/webhooks\//)
+            .messages({ "string.pattern.base": "must be a Discord webhook url" }),
+        }),
+    }).required(),
+  });
+
+  public static SHARE_LINK_BODY = Joi.object({
+    // Links without one work until they're revoked
+    expires_in: Validators.DURATION,
+    expose_host: Joi.boolean().default(false),
+  });
+
+  public static API_TOKEN_BODY = Joi.object({
+    name: Joi.string().trim().min(1).max(48).required(),
+    scopes: Joi.array()
+      .items(Joi.string().valid(...API_TOKEN_SCOPES))
+      .min(1)
+      .unique()
+      .required(),
+  });
+
+  // Only https so the signed bodies can't be read on the way
+  public static WEBHOOK_BODY = Joi.object({
+    url: Joi.string()
+      .uri({ scheme: ["https"] })
+      .max(2048)
+      .required(),
+    events: Joi.array()
+      .items(Joi.string().valid(...WEBHOOK_EVENTS))
+      .min(1)
+      .unique()
+      .required(),
+  });
+
+  public static DATACENTER_BODY = Joi.object({
+    name: Joi.string().trim().min(1).max(64).required(),
+    logo: Validators.TRUSTED_IMAGE_URL,
+  });
+
+  public static DATACENTER_UPDATE_BODY = Joi.object({
+    name: Joi.string().trim().min(1).max(64),
+    logo: Validators.TRUSTED_IMAGE_URL.allow(""),
+  });
+
+  /**
+   * Validates a body against a schema
+   * @returns the validated body or the reason each invalid field failed
+   * @tested
+   */
+  public static validate_body = <T>(schema: Joi.ObjectSchema, body: unknown): { value?: T; fields?: FieldErrors } => {
+    const { value, error } = schema.validate(body ?? {}, { abortEarly: false, errors: { wrap: { label: false } } });
+    if (!error) return { value };
+
+    const fields: FieldErrors = {};
+    for (const { path, message, context } of error.details) {
+      const field = path.join(".") || "body";
+      const label = context?.label ?? field;
+      // Joi prefixes every message with the field name which is already the key
+      fields[field] ??= message.startsWith(`${label} `) ? message.slice(label.length + 1) : message;
+    }
+    return { fields };
+  };
+
   public static validate_label = (input: ICreateLabelInput) => {
     const color = input.color || randomHexColor();
     const name = input.name.toLowerCase().replace(/\s/g, "-");
@@ -27,6 +317,40 @@ export class Validators {
     return { color, name, error };
   };
 
+  /**
+   * Validates a profile update against the same rules as PATCH /users/@me and picks only the fields that were provided
+   * so the fields that weren't sent are left untouched
+   * @returns the fields to set on the user and the reason each invalid field failed
+   * @tested
+   */
+  public static validate_user_update = (input: UserProfileUpdateInput) => {
+    const { username, email, bio, avatar, banner, location, profile_visibility } = input ?? {};
+    const { value, fields } = Validators.validate_body<UserProfileUpdateInput>(Validators.USER_UPDATE_BODY, {
+      username,
+      email,
+      bio,
+      avatar,
+      banner,
+      location,
+      profile_visibility,
+    });
+    if (fields) return { update: {}, fields };
+
+    // The body calls it bio while the user document calls it biography
+    const update: UserProfileUpdate = {};
+    const { bio: biography, ...rest } = value!;
+    for (const [field, provided] of Object.entries({ ...rest, biography }))
+      if (provided !== undefined) (update as { [field: string]: unknown })[field] = provided;
+    return { update, fields: undefined };
+  };
+
+  /**
+   * Validates a dynamic data frame sent by a reporter
+   * @tested
+   */
+  public static validate_dynamic_data = (data: IDynamicData) =>
+    Validators.DYNAMIC_DATA_BODY.validate(data).error ? false : true;
+
   public static validate_url = (url: string) => {
     try {
       new URL(url);
@@ -51,11 +375,24 @@ export class Validators {
   public static validate_email = (email: string) =>
     Joi.string().email().not().empty().required().validate(email).error ? false : true;
 
+  /**
+   * @tested
+   */
   public static validate_password = (password: string) =>
-    Joi.string().required().min(4).max(64).not().empty().validate(password).error ? false : true;
+    Joi.string().required().min(8).max(64).not().empty().validate(password).error ? false : true;
 
+  /**
+   * @tested
+   */
   public static validate_username = (username: string) =>
-    Joi.string().required().min(4).max(32).alphanum().not().empty().validate(username).error ? false : true;
+    Joi.string().required().min(3).max(32).alphanum().not().empty().validate(username).error ? false : true;
+
+  /**
+   * Validates a signup form
+   * @returns the reason each invalid field failed or undefined if the form is valid
+   * @tested
+   */
+  public static validate_signup = (form: UserSignupInput) => Validators.validate_body(Validators.SIGNUP_BODY, form).fields;
 
   public static validate_label_name = (label_name: string) =>
     Joi.string()
@@ -67,6 +404,11 @@ export class Validators {
       ? false
       : true;
 
+  /**
+   * @tested
+   */
+  public static validate_machine_tag = (tag: unknown) => !Validators.MACHINE_TAG.required().validate(tag).error;
+
   public static validate_label_icon = (label_icon: LabelIcon) => LABEL_ICONS.includes(label_icon);
 
   public static validate_label_description = (label_description: string) =>
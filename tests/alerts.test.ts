@@ -0,0 +1,183 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import { AlertEvaluator } from "../src/classes/alertEvaluator.class";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import { IComputedDynamicData } from "../src/database/schemas/machine";
+import { Time } from "../src/types";
+import { alertBreached, alertMetricValue, AlertPayload, describeAlert, formatAlert } from "../src/utils/alerts";
+import { Validators } from "../src/validators";
+
+const machine = { uuid: "8bb3cf50-077a-4586-8567-58f596504a0e", name: "xnet-mirai" };
+const stats = (cau: number, timestamp: number) =>
+  ({ uuid: machine.uuid, cau, ram: { used: 3, total: 4 }, swap: { used: 0, total: 0 }, timestamp } as IComputedDynamicData);
+
+describe("Alerts", () => {
+  describe("alertMetricValue()", () => {
+    it("gives memory as a percentage", () => {
+      expect(alertMetricValue(stats(50, 0), "cpu")).to.equal(50);
+      expect(alertMetricValue(stats(50, 0), "ram")).to.equal(75);
+    });
+
+    it("has nothing for machines without swap", () => {
+      expect(alertMetricValue(stats(50, 0), "swap")).to.be.undefined;
+    });
+  });
+
+  describe("alertBreached()", () => {
+    it("compares with the operator of the rule", () => {
+      expect(alertBreached(">", 90, 91)).to.be.true;
+      expect(alertBreached(">", 90, 90)).to.be.false;
+      expect(alertBreached(">=", 90, 90)).to.be.true;
+      expect(alertBreached("<", 10, 5)).to.be.true;
+    });
+  });
+
+  describe("formatAlert()", () => {
+    const payload: AlertPayload = {
+      machine,
+      rule: { uuid: "rule", metric: "cpu", operator: ">", threshold: 90, duration: 5 * Time.Minute },
+      observed: 97.345,
+      fired_at: 0,
+    };
+
+    it("sends webhooks the payload as is", () => {
+      expect(formatAlert("webhook", payload)).to.equal(payload);
+    });
+
+    it("sends Discord an embed describing the alert", () => {
+      const { embeds } = formatAlert("discord", payload) as any;
+      expect(embeds[0].description).to.equal("xnet-mirai cpu is 97.3% (> 90% for 5m)");
+      expect(embeds[0].footer.text).to.contain(machine.uuid);
+    });
+
+    it("describes offline alerts by how long the machine has been gone", () => {
+      const offline = { ...payload, rule: { ...payload.rule, metric: "offline" as const }, observed: 10 * Time.Minute };
+      expect(describeAlert(offline)).to.equal("xnet-mirai has been offline for 10m");
+    });
+  });
+
+  describe("ALERT_BODY", () => {
+    const target = { type: "webhook", url: "https://hooks.xornet.cloud/alerts" };
+    const fields = (body: object) => Validators.validate_body(Validators.ALERT_BODY, body).fields;
+
+    it("accepts a threshold rule and a rule for going offline", () => {
+      expect(fields({ metric: "cpu", operator: ">", threshold: 90, duration: "5m", target })).to.be.undefined;
+      expect(fields({ metric: "offline", duration: "10m", target })).to.be.undefined;
+    });
+
+    it("needs a threshold unless the rule is for going offline", () => {
+      expect(fields({ metric: "cpu", target })).to.have.property("threshold");
+      expect(fields({ metric: "offline", threshold: 1, target })).to.have.property("threshold");
+    });
+
+    it("only sends to https and Discord targets to Discord", () => {
+      const http = { ...target, url: "http://hooks.xornet.cloud" };
+      expect(fields({ metric: "offline", target: http })).to.have.property("target.url");
+      expect(fields({ metric: "offline", target: { ...target, type: "discord" } })).to.have.property("target.url");
+    });
+  });
+
+  describe("AlertEvaluator", () => {
+    const rule = (overrides = {}): any => ({
+      uuid: "rule",
+      metric: "cpu",
+      operator: ">",
+      threshold: 90,
+      duration: 5 * Time.Minute,
+      cooldown: 15 * Time.Minute,
+      target: { type: "webhook", url: "https://hooks.xornet.cloud/alerts" },
+      ...overrides,
+    });
+
+    const evaluator = (rules: any[]) => {
+      const delivered: AlertPayload[] = [];
+      const emitted: unknown[][] = [];
+      let last_fired_at: number | undefined;
+      const db = {
+        find_alerts: async () => rules,
+        // Behaves like the atomic update
+        claim_alert: async (_: string, fired_at: number, fired_before: number) => {
+          if (last_fired_at !== undefined && last_fired_at >= fired_before) return false;
+          last_fired_at = fired_at;
+          return true;
+        },
+      } as unknown as DatabaseManager;
+      const webhooks = { emit: (...args: unknown[]) => void emitted.push(args) };
+      const deliver = async (_: unknown, payload: AlertPayload) => void delivered.push(payload);
+      return { alerts: new AlertEvaluator(db, deliver, webhooks), delivered, emitted };
+    };
+
+    it("fires once the threshold stayed broken for the duration", async () => {
+      const { alerts, delivered } = evaluator([rule()]);
+      await alerts.evaluate(machine, stats(95, 0));
+      await alerts.evaluate(machine, stats(96, 4 * Time.Minute));
+      expect(delivered).to.be.empty;
+      await alerts.evaluate(machine, stats(97, 5 * Time.Minute));
+      expect(delivered).to.have.lengthOf(1);
+      expect(delivered[0]).to.deep.include({ machine, observed: 97, fired_at: 5 * Time.Minute });
+    });
+
+    it("tells the webhooks of the owner subscribed to alert.fired every time it fires", async () => {
+      const { alerts, emitted } = evaluator([rule({ duration: 0 })]);
+      await alerts.evaluate(machine, stats(95, 0));
+      await alerts.evaluate(machine, stats(96, Time.Minute));
+      expect(emitted).to.deep.equal([
+        [
+          "alert.fired",
+          [machine.uuid],
+          {
+            alert: {
+              rule: { uuid: "rule", metric: "cpu", operator: ">", threshold: 90, duration: 0 },
+              observed: 95,
+              fired_at: 0,
+            },
+          },
+        ],
+      ]);
+    });
+
+    it("starts over when the value drops back under the threshold", async () => {
+      const { alerts, delivered } = evaluator([rule()]);
+      await alerts.evaluate(machine, stats(95, 0));
+      await alerts.evaluate(machine, stats(50, 3 * Time.Minute));
+      await alerts.evaluate(machine, stats(95, 4 * Time.Minute));
+      await alerts.evaluate(machine, stats(95, 8 * Time.Minute));
+      expect(delivered).to.be.empty;
+    });
+
+    it("waits for the cooldown before firing again", async () => {
+      const { alerts, delivered } = evaluator([rule({ duration: 0 })]);
+      await alerts.evaluate(machine, stats(95, 0));
+      await alerts.evaluate(machine, stats(95, 10 * Time.Minute));
+      expect(delivered).to.have.lengthOf(1);
+      await alerts.evaluate(machine, stats(95, 16 * Time.Minute));
+      expect(delivered).to.have.lengthOf(2);
+    });
+
+    it("queues the stats instead of evaluating them right away", async () => {
+      const { alerts, delivered } = evaluator([rule({ duration: 0 })]);
+      alerts.observe(machine, stats(95, 0));
+      expect(delivered).to.be.empty;
+      await new Promise((resolve) => setTimeout(resolve, 10));
+      expect(delivered).to.have.lengthOf(1);
+    });
+  });
+
+  describe("find_due_offline_alerts()", () => {
+    it("only gives the rules whose machine has been gone for longer than their duration", async () => {
+      const now = Time.Day;
+      const db = {
+        alerts: {
+          find: async () => [
+            { uuid: "soon", machine_uuid: machine.uuid, duration: 30 * Time.Minute },
+            { uuid: "due", machine_uuid: machine.uuid, duration: 5 * Time.Minute },
+            { uuid: "online", machine_uuid: "nagato", duration: 0 },
+          ],
+        },
+        machines: { find: async () => [{ ...machine, last_seen: now - 10 * Time.Minute }] },
+      };
+      const due = await DatabaseManager.prototype.find_due_offline_alerts.call(db as any, now, Time.Minute);
+      expect(due.map(({ rule }) => rule.uuid)).to.deep.equal(["due"]);
+    });
+  });
+});
@@ -0,0 +1,153 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import jwt from "jsonwebtoken";
+import request from "supertest";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import {
+  API_TOKEN_PREFIX,
+  API_TOKEN_TOUCH_INTERVAL,
+  apiTokens,
+  generate_api_token,
+  hash_api_token,
+} from "../src/database/schemas/apiToken";
+import { init_auth } from "../src/middleware/auth";
+import { errorHandler } from "../src/utils/errors";
+
+const user = { uuid: "8bb3cf50-077a-4586-8567-58f596504a0e", is_token_current: () => true };
+
+describe("API tokens", () => {
+  describe("generate_api_token()", () => {
+    it("generates tokens the auth middleware can tell apart from JWTs", () => {
+      expect(generate_api_token()).to.match(new RegExp(`^${API_TOKEN_PREFIX}[0-9a-f]{40}$`));
+      expect(generate_api_token()).to.not.equal(generate_api_token());
+    });
+  });
+
+  describe("hash_api_token()", () => {
+    it("hashes the same token the same way without keeping it", () => {
+      const token = generate_api_token();
+      expect(hash_api_token(token)).to.equal(hash_api_token(token)).and.not.contain(token.slice(API_TOKEN_PREFIX.length));
+    });
+  });
+
+  describe("toJSON()", () => {
+    it("never sends the hash", () => {
+      const token = new apiTokens({ user_uuid: user.uuid, name: "cron", prefix: "xor_abcd1234", hash: "secret" });
+      expect(token.toJSON()).to.not.have.any.keys("hash", "_id", "__v");
+    });
+  });
+
+  describe("new_api_token()", () => {
+    it("only stores the hash of the token it returns", async () => {
+      let stored: any;
+      const db = {
+        api_tokens: {
+          countDocuments: async () => 0,
+          create: async (value: object) => (stored = { uuid: "token", ...value }),
+        },
+        log_audit: () => {},
+      };
+      const input = { name: "cron", scopes: ["read:machines"] };
+      const { secret } = await DatabaseManager.prototype.new_api_token.call(db as any, user.uuid, input as any);
+      expect(stored.hash).to.equal(hash_api_token(secret));
+      expect(Object.values(stored)).to.not.include(secret);
+      expect(secret.startsWith(stored.prefix)).to.be.true;
+    });
+
+    it("caps how many tokens a user can have", async () => {
+      const db = { api_tokens: { countDocuments: async () => 20 } };
+      const error = await DatabaseManager.prototype.new_api_token
+        .call(db as any, user.uuid, { name: "cron", scopes: ["read:machines"] })
+        .catch((error) => error);
+      expect(error).to.equal("apiTokens.limit");
+    });
+  });
+
+  describe("touch_api_token()", () => {
+    it("only writes when the token was last used a while ago", () => {
+      const writes: number[] = [];
+      const updateOne = async (_: object, { $set }: any) => writes.push($set.last_used_at);
+      const db = { api_tokens: { updateOne } };
+      const now = Date.now();
+      const touch = (last_used_at?: number) =>
+        DatabaseManager.prototype.touch_api_token.call(db as any, { uuid: "a", last_used_at }, now);
+      touch(now - 1000);
+      touch(now - API_TOKEN_TOUCH_INTERVAL);
+      touch();
+      expect(writes).to.deep.equal([now, now]);
+    });
+  });
+
+  describe("init_auth()", () => {
+    const secret = generate_api_token();
+    let touched = 0;
+    let disabled = false;
+    const db = {
+      users: { findOne: async () => ({ ...user, disabled_at: disabled ? Date.now() : undefined }) },
+      find_api_token: async (value: string) =>
+        value === secret ? { uuid: "a", user_uuid: user.uuid, scopes: ["read:machines"] } : Promise.reject("apiToken.notFound"),
+      touch_api_token: () => touched++,
+    } as unknown as DatabaseManager;
+    const app = express()
+      .get("/machines", init_auth(db, "secret", "read:machines"), (req: any, res) => res.json({ token: req.api_token.uuid }))
+      .post("/labels", init_auth(db, "secret", "write:labels"), (_, res) => res.send())
+      .get("/users/@me/tokens", init_auth(db, "secret"), (_, res) => res.send())
+      .use(errorHandler);
+    const get = (path: string, token = secret) => request(app).get(path).set("Authorization", `Bearer ${token}`);
+
+    it("lets tokens use the routes of their scopes", async () => {
+      disabled = false;
+      const { body } = await get("/machines").expect(200);
+      expect(body.token).to.equal("a");
+      expect(touched).to.be.above(0);
+    });
+
+    it("turns tokens away from the routes of other scopes and the ones without a scope", async () => {
+      disabled = false;
+      const other = await request(app).post("/labels").set("Authorization", `Bearer ${secret}`).expect(403);
+      expect(other.body.error.code).to.equal("token.scope");
+      expect((await get("/users/@me/tokens").expect(403)).body.error.code).to.equal("token.scope");
+    });
+
+    it("rejects tokens that were revoked or never existed", async () => {
+      expect((await get("/machines", generate_api_token()).expect(401)).body.error.code).to.equal("token.invalid");
+    });
+
+    it("stops the tokens of disabled users", async () => {
+      disabled = true;
+      expect((await get("/machines").expect(403)).body.error.code).to.equal("account.disabled");
+    });
+
+    it("turns away logins and tokens of users that no longer exist the same way", async () => {
+      const gone = { ...db, users: { findOne: async () => null } } as unknown as DatabaseManager;
+      const app = express()
+        .get("/machines", init_auth(gone, "secret", "read:machines"), (_, res) => res.send())
+        .use(errorHandler);
+      const login = jwt.sign({ uuid: user.uuid, username: "geoxor", token_version: 0 }, "secret");
+      for (const token of [secret, login]) {
+        const { body } = await request(app).get("/machines").set("Authorization", `Bearer ${token}`).expect(401);
+        expect(body.error.code).to.equal("user.notFound");
+      }
+    });
+
+    it("doesn't answer the database failing like a token that doesn't exist", async () => {
+      const down = {
+        users: { findOne: async () => Promise.reject("query.timeout") },
+        find_api_token: async () => Promise.reject("request.aborted"),
+      } as unknown as DatabaseManager;
+      const app = express()
+        .get("/machines", init_auth(down, "secret", "read:machines"), (_, res) => res.send())
+        .use(errorHandler);
+      await request(app).get("/machines").set("Authorization", `Bearer ${secret}`).expect(503);
+      const login = jwt.sign({ uuid: user.uuid, username: "geoxor", token_version: 0 }, "secret");
+      await request(app).get("/machines").set("Authorization", `Bearer ${login}`).expect(504);
+    });
+
+    it("still takes logins on the routes tokens can use", async () => {
+      disabled = false;
+      const login = jwt.sign({ uuid: user.uuid, username: "geoxor", token_version: 0 }, "secret");
+      await request(app).get("/users/@me/tokens").set("Authorization", `Bearer ${login}`).expect(200);
+    });
+  });
+});
@@ -0,0 +1,121 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import { Cache, MemoryCacheStore } from "../src/classes/cache.class";
+import { metrics } from "../src/utils/metrics";
+
+const uuid = "8bb3cf50-077a-4586-8567-58f596504a0e";
+
+// A load that only finishes once it's told to
+const deferred = <T>() => {
+  let resolve!: (value: T) => void;
+  const promise = new Promise<T>((done) => (resolve = done));
+  return { promise, resolve };
+};
+
+describe("Cache", () => {
+  const cache = (ttl = 1000) => new Cache(new MemoryCacheStore(), ttl);
+
+  describe("wrap()", () => {
+    it("only loads a value once until it expires", async () => {
+      const cached = cache(20);
+      let loads = 0;
+      const load = async () => ({ username: "geoxor", loads: ++loads });
+      expect(await cached.wrap("user", uuid, "public", load)).to.deep.equal({ username: "geoxor", loads: 1 });
+      expect(await cached.wrap("user", uuid, "public", load)).to.deep.equal({ username: "geoxor", loads: 1 });
+      await new Promise((resolve) => setTimeout(resolve, 30));
+      expect(await cached.wrap("user", uuid, "public", load)).to.deep.equal({ username: "geoxor", loads: 2 });
+    });
+
+    it("never serves a value to another scope", async () => {
+      const cached = cache();
+      await cached.wrap("machine", uuid, "share:a", async () => ({ name: "mirai" }));
+      expect(await cached.wrap("machine", uuid, "public", async () => ({}))).to.deep.equal({});
+      expect(await cached.wrap("machine", uuid, "share:b", async () => ({}))).to.deep.equal({});
+      expect(await cached.wrap("machine", uuid, "share:a", async () => ({}))).to.deep.equal({ name: "mirai" });
+    });
+
+    it("shares the load of reads made at the same time", async () => {
+      const cached = cache();
+      const load = deferred<string>();
+      let loads = 0;
+      const reads = [1, 2, 3].map(() => cached.wrap("user", uuid, "public", () => (loads++, load.promise)));
+      load.resolve("geoxor");
+      expect(await Promise.all(reads)).to.deep.equal(["geoxor", "geoxor", "geoxor"]);
+      expect(loads).to.equal(1);
+    });
+
+    it("hands out copies so callers can't change what the others get", async () => {
+      const cached = cache();
+      await cached.wrap("user", uuid, "public", async () => ({ username: "geoxor" }));
+      const user = await cached.wrap("user", uuid, "public", async () => ({ username: "" }));
+      user.username = "mirai";
+      expect(await cached.wrap("user", uuid, "public", async () => ({ username: "" }))).to.deep.equal({ username: "geoxor" });
+    });
+
+    it("doesn't cache failed loads", async () => {
+      const cached = cache();
+      const error = await cached.wrap("user", uuid, "public", () => Promise.reject("user.notFound")).catch((error) => error);
+      expect(error).to.equal("user.notFound");
+      expect(await cached.wrap("user", uuid, "public", async () => "geoxor")).to.equal("geoxor");
+    });
+
+    it("always loads when the TTL is 0", async () => {
+      const cached = cache(0);
+      let loads = 0;
+      await cached.wrap("user", uuid, "public", async () => ++loads);
+      expect(await cached.wrap("user", uuid, "public", async () => ++loads)).to.equal(2);
+    });
+
+    it("counts the hits and misses", async () => {
+      const cached = cache();
+      const before = metrics.render();
+      await cached.wrap("machine", "counted", "public", async () => 1);
+      await cached.wrap("machine", "counted", "public", async () => 1);
+      const count = (output: string, result: string) =>
+        Number(new RegExp(`xornet_cache_requests_total\\{kind="machine",result="${result}"\\} (\\d+)`).exec(output)?.[1] ?? 0);
+      expect(count(metrics.render(), "miss") - count(before, "miss")).to.equal(1);
+      expect(count(metrics.render(), "hit") - count(before, "hit")).to.equal(1);
+    });
+  });
+
+  describe("invalidate()", () => {
+    it("drops every scope of the documents that were written to", async () => {
+      const cached = cache();
+      await cached.wrap("machine", uuid, "share:a", async () => "old");
+      await cached.wrap("machine", "other", "share:a", async () => "other");
+      await cached.invalidate("machine", [uuid]);
+      expect(await cached.wrap("machine", uuid, "share:a", async () => "new")).to.equal("new");
+      expect(await cached.wrap("machine", "other", "share:a", async () => "new")).to.equal("other");
+    });
+
+    it("drops every document of the kind without uuids", async () => {
+      const cached = cache();
+      await cached.wrap("machine", uuid, "public", async () => "old");
+      await cached.wrap("user", uuid, "public", async () => "geoxor");
+      await cached.invalidate("machine");
+      expect(await cached.wrap("machine", uuid, "public", async () => "new")).to.equal("new");
+      expect(await cached.wrap("user", uuid, "public", async () => "new")).to.equal("geoxor");
+    });
+
+    it("doesn't cache loads that were waiting on the database during the write", async () => {
+      const cached = cache();
+      const load = deferred<string>();
+      const read = cached.wrap("user", uuid, "public", () => load.promise);
+      await cached.invalidate("user", [uuid]);
+      load.resolve("old");
+      expect(await read).to.equal("old");
+      expect(await cached.wrap("user", uuid, "public", async () => "new")).to.equal("new");
+    });
+  });
+
+  describe("MemoryCacheStore", () => {
+    it("sweeps the values that expired", async () => {
+      const store = new MemoryCacheStore();
+      await store.set("user:a", "public", 1, 10);
+      await store.set("user:b", "public", 1, 1000);
+      store.sweep(Date.now() + 100);
+      expect([...store.entities.keys()]).to.deep.equal(["user:b"]);
+      store.stop();
+    });
+  });
+});
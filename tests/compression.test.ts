@@ -0,0 +1,45 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import jwt from "jsonwebtoken";
+import request from "supertest";
+import { WebsocketManager } from "../src/classes/websocketManager.class";
+import { Config } from "../src/config";
+import { users } from "../src/database/schemas/user";
+import { init_compression } from "../src/middleware/compression";
+import { V1 } from "../src/routes/v1/v1";
+import { Mailer } from "../src/utils/mailer";
+
+describe("init_compression()", () => {
+  const admin = new users({ uuid: "8bb3cf50-077a-4586-8567-58f596504a0e", username: "geoxor", is_admin: true });
+  // Enough users that the page is well over the compression threshold
+  const page = Array.from({ length: 50 }, (_, i) => new users({ uuid: `user-${i}`, username: `user-${i}` }));
+  const db = {
+    users: { findOne: async () => admin },
+    find_users_paginated: async () => ({ users: page, total: page.length }),
+  };
+  const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+  const token = jwt.sign({ uuid: admin.uuid, username: admin.username, token_version: 0 }, "secret");
+  const app = (enabled: boolean) =>
+    express()
+      .use(init_compression(enabled))
+      .use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+
+  it("gzips the user list for clients that accept it", async () => {
+    const res = await request(app(true))
+      .get("/users")
+      .set("Authorization", `Bearer ${token}`)
+      .set("Accept-Encoding", "gzip")
+      .expect(200)
+      .expect("Content-Type", /json/);
+    expect(res.headers["content-encoding"]).to.equal("gzip");
+    // Supertest gunzips the body before parsing it so it only parses if the gzip was valid JSON
+    expect(res.body.items).to.have.lengthOf(50);
+  });
+
+  it("sends the list as it is when it's turned off", async () => {
+    const res = await request(app(false)).get("/users").set("Authorization", `Bearer ${token}`).set("Accept-Encoding", "gzip");
+    expect(res.headers["content-encoding"]).to.be.undefined;
+    expect(res.body.items).to.have.lengthOf(50);
+  });
+});
@@ -0,0 +1,153 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import http from "http";
+import { AddressInfo } from "net";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import { query_limits } from "../src/database/middleware/metrics";
+import request from "supertest";
+import { errorHandler, toApiError } from "../src/utils/errors";
+import { get_signal, init_context } from "../src/middleware/context";
+import { init_timeout } from "../src/middleware/timeout";
+
+// A query that only resolves when told to, like a slow one stuck on mongo
+const slowQuery = () => {
+  const query = {
+    executed: false,
+    timeout: 0,
+    resolve: (_: any) => {},
+    maxTimeMS(ms: number) {
+      query.timeout = ms;
+      return query;
+    },
+    exec() {
+      query.executed = true;
+      return new Promise((resolve) => (query.resolve = resolve));
+    },
+  };
+  return query;
+};
+
+describe("DatabaseManager.abortable()", () => {
+  it("doesn't run the query if the request was already aborted", async () => {
+    const query = slowQuery();
+    const controller = new AbortController();
+    controller.abort();
+    const error = await DatabaseManager.abortable(query as any, controller.signal).catch((error) => error);
+    expect(error).to.equal("request.aborted");
+    expect(query.executed).to.be.false;
+  });
+
+  it("stops waiting for the query when the request aborts", async () => {
+    const query = slowQuery();
+    const controller = new AbortController();
+    const promise = DatabaseManager.abortable(query as any, controller.signal).catch((error) => error);
+    controller.abort();
+    expect(await promise).to.equal("request.aborted");
+    expect(query.executed).to.be.true;
+  });
+
+  it("bounds the query with maxTimeMS", async () => {
+    const query = slowQuery();
+    const promise = DatabaseManager.abortable(query as any);
+    query.resolve("geoxor");
+    expect(await promise).to.equal("geoxor");
+    expect(query.timeout).to.equal(DatabaseManager.QUERY_TIMEOUT);
+  });
+
+  it("gives up on queries that take longer than the timeout and fails the request with a 504", async () => {
+    const { timeout } = query_limits;
+    query_limits.timeout = 20;
+    try {
+      const query = slowQuery();
+      const error = await DatabaseManager.abortable(query as any).catch((error) => error);
+      expect(error).to.equal("query.timeout");
+      expect(query.timeout).to.equal(20);
+      expect(toApiError(error).status).to.equal(504);
+    } finally {
+      query_limits.timeout = timeout;
+    }
+  });
+
+  it("fails with a 504 when mongo gave up on the query by itself", async () => {
+    const query = { ...slowQuery(), exec: () => Promise.reject({ code: 50, codeName: "MaxTimeMSExpired" }) };
+    query.maxTimeMS = () => query;
+    const error = await DatabaseManager.abortable(query as any).catch((error) => error);
+    expect(error).to.equal("query.timeout");
+    expect(toApiError({ code: 50 }).status).to.equal(504);
+  });
+});
+
+describe("init_context()", () => {
+  it("aborts when the client disconnects before the response is sent", async () => {
+    const shutdown = new AbortController();
+    let signal: AbortSignal | undefined;
+    let server: http.Server;
+    await new Promise<void>((resolve) => {
+      const app = express()
+        .use(init_context(shutdown.signal))
+        .get("/", (_, res) => {
+          signal = get_signal(res);
+          signal?.addEventListener("abort", () => resolve());
+          // Never respond so the client gives up first
+        });
+      server = app.listen(0, () => {
+        const req = http.get({ port: (server.address() as AddressInfo).port, path: "/" });
+        req.on("error", () => {});
+        setTimeout(() => req.destroy(), 20);
+      });
+    });
+    server!.close();
+    expect(signal?.aborted).to.be.true;
+  });
+
+  it("aborts in-flight requests when the server shuts down", async () => {
+    const shutdown = new AbortController();
+    const res = Object.assign(new http.ServerResponse(new http.IncomingMessage(null as any)), { locals: {} });
+    init_context(shutdown.signal)({} as any, res as any, () => {});
+    shutdown.abort();
+    expect(get_signal(res as any)?.aborted).to.be.true;
+  });
+});
+
+describe("init_timeout()", () => {
+  // A route waiting on a query that never finishes like one stuck on a busy mongo
+  const setup = (route: (signal: AbortSignal | undefined, res: express.Response) => Promise<unknown>) => {
+    const signals: (AbortSignal | undefined)[] = [];
+    const query = slowQuery();
+    const app = express()
+      .use(init_context(new AbortController().signal))
+      .use(init_timeout(20))
+      .get("/", (_, res, next) => {
+        signals.push(get_signal(res));
+        route(get_signal(res), res).catch(next);
+      })
+      .use(errorHandler);
+    return { app, signals, query };
+  };
+
+  it("answers with a 504 and aborts the signal when the deadline passes", async () => {
+    const { app, signals, query } = setup((signal) => DatabaseManager.abortable(query as any, signal));
+    const { body } = await request(app).get("/").expect(504);
+    expect(body.error.code).to.equal("request.timeout");
+    expect(query.executed).to.be.true;
+    expect(signals[0]?.aborted).to.be.true;
+  });
+
+  it("leaves the requests that were answered in time alone", async () => {
+    const { app, signals } = setup(async (_, res) => res.json({ ok: true }));
+    await request(app).get("/").expect(200, { ok: true });
+    await new Promise((resolve) => setTimeout(resolve, 40));
+    expect(signals[0]?.aborted).to.be.false;
+  });
+
+  it("doesn't cut off responses that already started like streams", async () => {
+    const { app } = setup(async (_, res) => {
+      res.writeHead(200, { "content-type": "text/plain" }).write("first");
+      await new Promise((resolve) => setTimeout(resolve, 40));
+      res.end(" last");
+    });
+    const { text } = await request(app).get("/").expect(200);
+    expect(text).to.equal("first last");
+  });
+});
@@ -0,0 +1,76 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import request from "supertest";
+import { init_cors, parse_cors_origins } from "../src/middleware/cors";
+
+const app = express()
+  .use(init_cors(["https://xornet.cloud"]))
+  .get("/users/@me", (_, res) => res.send())
+  .patch("/users/uuid/:uuid", (_, res) => res.send());
+
+describe("CORS", () => {
+  describe("parse_cors_origins()", () => {
+    it("splits and trims the origins", () => {
+      expect(parse_cors_origins(" https://xornet.cloud/, https://dev.xornet.cloud ")).to.deep.equal([
+        "https://xornet.cloud",
+        "https://dev.xornet.cloud",
+      ]);
+    });
+
+    it("allows any origin in development when none are set", () => {
+      expect(parse_cors_origins("", false)).to.deep.equal(["*"]);
+    });
+
+    it("allows no origin in production when none are set", () => {
+      expect(parse_cors_origins("", true)).to.deep.equal([]);
+    });
+  });
+
+  describe("init_cors()", () => {
+    it("answers preflights from allowed origins", async () => {
+      const res = await request(app)
+        .options("/users/@me")
+        .set("Origin", "https://xornet.cloud")
+        .set("Access-Control-Request-Method", "PATCH")
+        .set("Access-Control-Request-Headers", "Authorization")
+        .expect(204);
+      expect(res.headers["access-control-allow-origin"]).to.equal("https://xornet.cloud");
+      expect(res.headers["access-control-allow-credentials"]).to.equal("true");
+      expect(res.headers["access-control-allow-methods"]).to.contain("PATCH");
+      expect(res.headers["access-control-allow-headers"]).to.contain("Authorization").and.to.contain("X-Machine-Token");
+      expect(res.headers["vary"]).to.contain("Origin");
+    });
+
+    it("answers preflights for routes with path params", async () => {
+      const res = await request(app)
+        .options("/users/uuid/8bb3cf50-077a-4586-8567-58f596504a0e")
+        .set("Origin", "https://xornet.cloud")
+        .set("Access-Control-Request-Method", "PATCH")
+        .expect(204);
+      expect(res.headers["access-control-allow-origin"]).to.equal("https://xornet.cloud");
+      expect(res.headers["access-control-allow-methods"]).to.contain("PATCH").and.to.contain("DELETE");
+    });
+
+    it("rejects preflights from other origins with an error", async () => {
+      const res = await request(app)
+        .options("/users/uuid/8bb3cf50-077a-4586-8567-58f596504a0e")
+        .set("Origin", "https://evil.com")
+        .set("Access-Control-Request-Method", "DELETE")
+        .expect(403);
+      expect(res.headers).to.not.have.property("access-control-allow-origin");
+      expect(res.body.error).to.include({ code: "origin.forbidden", status: 403 });
+    });
+
+    it("doesn't allow other origins on regular requests", async () => {
+      const res = await request(app).get("/users/@me").set("Origin", "https://evil.com").expect(200);
+      expect(res.headers).to.not.have.property("access-control-allow-origin");
+    });
+
+    it("echoes the origin instead of * when any origin is allowed", async () => {
+      const any = express().use(init_cors(["*"])).get("/", (_, res) => res.send());
+      const res = await request(any).get("/").set("Origin", "http://localhost:3000").expect(200);
+      expect(res.headers["access-control-allow-origin"]).to.equal("http://localhost:3000");
+    });
+  });
+});
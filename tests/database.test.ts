@@ -0,0 +1,251 @@
+import { afterEach, beforeEach, describe, it } from "mocha";
+import { expect } from "chai";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import { Migration, MigrationRunner, normalize_identities } from "../src/database/migrations";
+import { Logger } from "../src/utils/logger";
+
+describe("DatabaseManager", () => {
+  describe("connect_with_backoff()", () => {
+    const warn = Logger.warn;
+    let attempts: string[] = [];
+
+    beforeEach(() => {
+      attempts = [];
+      Logger.warn = (message: string) => attempts.push(message);
+    });
+
+    afterEach(() => (Logger.warn = warn));
+
+    it("gives up once the next attempt wouldn't fit in the timeout", async () => {
+      const started = Date.now();
+      // Waits 100, 200 and 400ms between the attempts, waiting another 800ms would go past the second
+      const error = await DatabaseManager.connect_with_backoff("notmongo://xnet-mirai/xornet", {}, 1000, 100).catch(
+        (error) => error
+      );
+      expect(error).to.be.an("error");
+      expect(attempts).to.have.lengthOf(4);
+      expect(attempts[3]).to.contain("giving up");
+      expect(Date.now() - started).to.be.below(1000);
+    });
+  });
+
+  describe("projection()", () => {
+    it("reads everything when no fields were asked for", () => {
+      expect(DatabaseManager.projection("user")).to.be.undefined;
+    });
+
+    it("always reads what the ETags and the statuses need", () => {
+      expect(DatabaseManager.projection("user", ["avatar"])).to.deep.equal({ uuid: 1, updated_at: 1, avatar: 1 });
+      expect(DatabaseManager.projection("machine", ["name"])).to.deep.equal({
+        uuid: 1,
+        updated_at: 1,
+        status: 1,
+        last_seen: 1,
+        name: 1,
+      });
+    });
+  });
+
+  describe("ensure_indexes()", () => {
+    const info = Logger.info;
+    beforeEach(() => (Logger.info = () => {}));
+    afterEach(() => (Logger.info = info));
+
+    // A collection with an _id index and whatever was created on it
+    const collection = (existing: object[] = []) => {
+      const indexes = [{ key: { _id: 1 } }, ...existing];
+      return {
+        indexes: async () => indexes,
+        createIndex: async (key: object, options: { unique: boolean }) => indexes.push({ key, ...options }),
+      };
+    };
+
+    it("creates the missing indexes and leaves the ones that are there alone", async () => {
+      const users = collection([{ key: { uuid: 1 }, unique: true }]);
+      const machines = collection();
+      const db = { users: { collection: users }, machines: { collection: machines } };
+      const { created, present } = await DatabaseManager.prototype.ensure_indexes.call(db as any);
+      expect(created).to.deep.equal(["users.username", "users.email", "machines.owner_uuid"]);
+      expect(present).to.deep.equal(["users.uuid"]);
+      expect(await users.indexes()).to.deep.include({ key: { email: 1 }, unique: true });
+      expect(await machines.indexes()).to.deep.include({ key: { owner_uuid: 1 }, unique: false });
+    });
+
+    it("does nothing the second time", async () => {
+      const db = { users: { collection: collection() }, machines: { collection: collection() } };
+      await DatabaseManager.prototype.ensure_indexes.call(db as any);
+      const { created, present } = await DatabaseManager.prototype.ensure_indexes.call(db as any);
+      expect(created).to.be.empty;
+      expect(present).to.have.lengthOf(DatabaseManager.REQUIRED_INDEXES.length);
+    });
+
+    it("creates TTL indexes and reports the ones that couldn't be created", async () => {
+      const sessions = collection();
+      const stats = { ...collection(), createIndex: async () => Promise.reject(new Error("duplicate key")) };
+      const db = { sessions: { collection: sessions }, stats: { collection: stats } };
+      const error = Logger.error;
+      Logger.error = () => {};
+      const { created, failed } = await DatabaseManager.prototype.ensure_indexes
+        .call(db as any, [
+          { collection: "sessions", key: { expires_at: 1 }, expire_after: 0 },
+          { collection: "stats", key: { machine_uuid: 1, timestamp: 1 } },
+        ])
+        .finally(() => (Logger.error = error));
+      expect(created).to.deep.equal(["sessions.expires_at"]);
+      expect(failed).to.deep.equal(["stats.machine_uuid_timestamp"]);
+      expect(await sessions.indexes()).to.deep.include({ key: { expires_at: 1 }, unique: false, expireAfterSeconds: 0 });
+    });
+
+    it("changes when the TTL indexes expire documents when the retention changed", async () => {
+      const commands: object[] = [];
+      const stats = {
+        ...collection([{ key: { timestamp: 1 }, expireAfterSeconds: 86400 }]),
+        collectionName: "stats",
+        conn: { db: { command: async (command: object) => commands.push(command) } },
+      };
+      const db = { stats: { collection: stats } };
+      const required = [{ collection: "stats" as const, key: { timestamp: 1 as const }, expire_after: 3600 }];
+      const { created, updated } = await DatabaseManager.prototype.ensure_indexes.call(db as any, required);
+      expect(created).to.be.empty;
+      expect(updated).to.deep.equal(["stats.timestamp"]);
+      expect(commands).to.deep.equal([{ collMod: "stats", index: { keyPattern: { timestamp: 1 }, expireAfterSeconds: 3600 } }]);
+    });
+  });
+});
+
+describe("MigrationRunner", () => {
+  const info = Logger.info;
+  beforeEach(() => (Logger.info = () => {}));
+  afterEach(() => (Logger.info = info));
+
+  // A migrations collection in memory that collides on the lock like the unique _id would
+  const collection = () => {
+    const records = new Map<string, any>();
+    return {
+      records,
+      find: () => ({ toArray: async () => [...records.values()].filter((record) => record._id !== "lock") }),
+      insertOne: async (record: any) => records.set(record._id, record),
+      updateOne: async (filter: any, update: any, options: { upsert: boolean }) => {
+        const lock = records.get("lock");
+        const [{ owner }, { expires_at }] = filter.$or;
+        if (lock && (lock.owner === owner || lock.expires_at < expires_at.$lt)) Object.assign(lock, update.$set);
+        else if (lock && options.upsert) throw { code: 11000 };
+        else if (!lock && options.upsert) records.set("lock", { _id: "lock", ...update.$set });
+      },
+      deleteOne: async (filter: any) => records.get(filter._id)?.owner === filter.owner && records.delete(filter._id),
+    };
+  };
+
+  const migration = (id: string, ran: string[], up = async () => {}): Migration => ({
+    id,
+    description: id,
+    up: async () => (ran.push(id), up()),
+  });
+
+  it("runs the migrations that didn't run yet in order and records them", async () => {
+    const migrations = collection();
+    migrations.records.set("0001", { _id: "0001" });
+    const ran: string[] = [];
+    const list = ["0001", "0002", "0003"].map((id) => migration(id, ran));
+    const runner = new MigrationRunner({} as any, migrations as any, list, "mirai");
+    expect(await runner.run()).to.deep.equal(["0002", "0003"]);
+    expect(ran).to.deep.equal(["0002", "0003"]);
+    expect([...migrations.records.keys()]).to.deep.equal(["0001", "0002", "0003"]);
+  });
+
+  it("does nothing the second time", async () => {
+    const migrations = collection();
+    const ran: string[] = [];
+    const list = ["0001", "0002"].map((id) => migration(id, ran));
+    await new MigrationRunner({} as any, migrations as any, list, "mirai").run();
+    expect(await new MigrationRunner({} as any, migrations as any, list, "nagato").run()).to.be.empty;
+    expect(ran).to.deep.equal(["0001", "0002"]);
+  });
+
+  it("doesn't record a migration that failed and releases the lock", async () => {
+    const migrations = collection();
+    const ran: string[] = [];
+    const failing = migration("0002", ran, () => Promise.reject(new Error("nope")));
+    const list = [migration("0001", ran), failing, migration("0003", ran)];
+    const error = await new MigrationRunner({} as any, migrations as any, list, "mirai").run().catch((error) => error);
+    expect(error.message).to.equal("nope");
+    expect(ran).to.deep.equal(["0001", "0002"]);
+    expect([...migrations.records.keys()]).to.deep.equal(["0001"]);
+  });
+
+  it("waits for the replica that holds the lock to finish", async () => {
+    const migrations = collection();
+    migrations.records.set("lock", { _id: "lock", owner: "nagato", expires_at: new Date(Date.now() + 60000) });
+    setTimeout(() => migrations.records.delete("lock"), 50);
+    const ran: string[] = [];
+    const started = Date.now();
+    await new MigrationRunner({} as any, migrations as any, [migration("0001", ran)], "mirai", 10).run();
+    expect(Date.now() - started).to.be.at.least(50);
+    expect(ran).to.deep.equal(["0001"]);
+  });
+
+  it("takes over a lock that expired", async () => {
+    const migrations = collection();
+    migrations.records.set("lock", { _id: "lock", owner: "nagato", expires_at: new Date(Date.now() - 1) });
+    const ran: string[] = [];
+    await new MigrationRunner({} as any, migrations as any, [migration("0001", ran)], "mirai", 10).run();
+    expect(ran).to.deep.equal(["0001"]);
+    expect(migrations.records.has("lock")).to.be.false;
+  });
+});
+
+describe("normalize_identities()", () => {
+  const { info, error } = Logger;
+  let logged: string[];
+  beforeEach(() => {
+    Logger.info = () => {};
+    Logger.error = (message: string) => logged.push(message);
+  });
+  afterEach(() => {
+    Logger.info = info;
+    Logger.error = error;
+  });
+
+  const fake = (collisions: { email?: object[]; username?: object[] }) => {
+    logged = [];
+    const calls: { updated?: any; indexes: object[]; dropped?: string } = { indexes: [] };
+    const db = {
+      ensure_indexes: DatabaseManager.prototype.ensure_indexes,
+      users: {
+        aggregate: async ([{ $group }]: any) => collisions[$group._id.$toLower.$trim.input.slice(1) as "email"] ?? [],
+        updateMany: async (filter: object, update: object) => (calls.updated = { filter, update }),
+        collection: {
+          indexes: async () => calls.indexes,
+          dropIndex: async (name: string) => (calls.dropped = name),
+          createIndex: async (key: object, options: object) => calls.indexes.push({ key, ...options }),
+        },
+      },
+    };
+    return { db, calls };
+  };
+
+  it("lowercases the emails and makes usernames unique regardless of case", async () => {
+    const { db, calls } = fake({});
+    await normalize_identities(db as any);
+    expect(calls.updated.filter).to.deep.equal({ uuid: { $nin: [] } });
+    expect(calls.updated.update[0].$set.email).to.deep.equal({ $toLower: { $trim: { input: "$email" } } });
+    expect(calls.dropped).to.equal("username_lower_1");
+    expect(calls.indexes).to.deep.include({ key: { username_lower: 1 }, unique: true });
+  });
+
+  it("reports the users that only differ in case instead of merging them", async () => {
+    const { db, calls } = fake({
+      email: [{ _id: "geo@xornet.cloud", users: ["mirai", "nagato"] }],
+      username: [{ _id: "geoxor", users: ["mirai", "yamato"] }],
+    });
+    const failed = await normalize_identities(db as any).catch((error) => error);
+    expect(failed.message).to.equal("2 emails or usernames are used by more than one user");
+    expect(logged).to.deep.equal([
+      "The users mirai, nagato have emails that are all geo@xornet.cloud",
+      "The users mirai, yamato have usernames that are all geoxor",
+    ]);
+    // Everyone else is still normalized, the migration runs again once they're sorted out
+    expect(calls.updated.filter).to.deep.equal({ uuid: { $nin: ["mirai", "nagato"] } });
+    expect(calls.indexes).to.be.empty;
+  });
+});
@@ -0,0 +1,54 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import { datacenters } from "../src/database/schemas/datacenter";
+import { Validators } from "../src/validators";
+
+describe("Datacenter", () => {
+  describe("toJSON()", () => {
+    const serialized = JSON.parse(JSON.stringify(new datacenters({ name: "home", owner_uuid: "geoxor" })));
+
+    it("should not contain _id or __v", () => {
+      expect(serialized).to.not.have.property("_id");
+      expect(serialized).to.not.have.property("__v");
+    });
+
+    it("should start without machines or members", () => {
+      expect(serialized).to.deep.include({ machines: [], members: [] });
+    });
+  });
+
+  describe("accessible_machines_filter()", () => {
+    it("matches owned machines and machines the user was given access to", () => {
+      expect(DatabaseManager.accessible_machines_filter("geoxor", [])).to.deep.equal({
+        $or: [{ owner_uuid: "geoxor" }, { access: "geoxor" }],
+      });
+    });
+
+    it("matches the machines of the datacenters the user is a member of", () => {
+      const filter = DatabaseManager.accessible_machines_filter("geoxor", ["a", "b"]);
+      expect(filter.$or).to.deep.include({ uuid: { $in: ["a", "b"] } });
+    });
+
+    it("narrows down to the requested machines", () => {
+      const filter = DatabaseManager.accessible_machines_filter("geoxor", ["a"], ["b"]);
+      expect(filter.uuid).to.deep.equal({ $in: ["b"] });
+    });
+  });
+
+  describe("DATACENTER_BODY", () => {
+    it("requires a name", () => {
+      expect(Validators.validate_body(Validators.DATACENTER_BODY, {}).fields).to.have.property("name");
+    });
+
+    it("only accepts logos from trusted hosters", () => {
+      const { fields } = Validators.validate_body(Validators.DATACENTER_BODY, { name: "home", logo: "https://evil.com/a.png" });
+      expect(fields).to.deep.equal({ logo: "must be a trusted image url" });
+    });
+
+    it("accepts a valid datacenter", () => {
+      const body = { name: "home", logo: "https://i.imgur.com/logo.png" };
+      expect(Validators.validate_body(Validators.DATACENTER_BODY, body).value).to.deep.equal(body);
+    });
+  });
+});
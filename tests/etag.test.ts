@@ -0,0 +1,49 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import request from "supertest";
+import { send_versioned, versioned_etag } from "../src/middleware/etag";
+
+describe("ETags", () => {
+  describe("versioned_etag()", () => {
+    const user = { uuid: "8bb3cf50-077a-4586-8567-58f596504a0e", updated_at: 1000 };
+
+    it("is the same for the same versions", () => {
+      expect(versioned_etag([user])).to.equal(versioned_etag([{ ...user }]));
+      expect(versioned_etag([user])).to.match(/^"[0-9a-f]{40}"$/);
+    });
+
+    it("changes when a document is updated or something else it depends on does", () => {
+      expect(versioned_etag([user])).to.not.equal(versioned_etag([{ ...user, updated_at: 2000 }]));
+      expect(versioned_etag([user], ["online"])).to.not.equal(versioned_etag([user], ["offline"]));
+    });
+  });
+
+  describe("send_versioned()", () => {
+    const user = { uuid: "8bb3cf50-077a-4586-8567-58f596504a0e", username: "geoxor", updated_at: 1000 };
+    let serialized = 0;
+    const app = express().get("/users/:uuid", (req, res) =>
+      send_versioned(req, res, versioned_etag([user]), () => {
+        serialized++;
+        return user;
+      })
+    );
+
+    it("responds with 304 until the user is updated", async () => {
+      const first = await request(app).get(`/users/${user.uuid}`).expect(200);
+      expect(first.body.username).to.equal("geoxor");
+      expect(first.headers["cache-control"]).to.equal("private, no-cache");
+      const etag = first.headers.etag;
+
+      const cached = await request(app).get(`/users/${user.uuid}`).set("If-None-Match", etag).expect(304);
+      expect(cached.text).to.be.empty;
+      expect(serialized).to.equal(1);
+
+      user.username = "geo";
+      user.updated_at = 2000;
+      const updated = await request(app).get(`/users/${user.uuid}`).set("If-None-Match", etag).expect(200);
+      expect(updated.body.username).to.equal("geo");
+      expect(updated.headers.etag).to.not.equal(etag);
+    });
+  });
+});
@@ -0,0 +1,95 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import path from "path";
+import { isPrivateIp, MaxMindReader, parseIp, resolveNetwork } from "../src/utils/geoip";
+
+// An IPv6 database with 28 bit records that has 81.2.69.0/24 in England, 89.160.20.0/24 in Östergötland and
+// 2001:218::/32 in Japan, the country of the England record is stored behind a pointer
+const reader = MaxMindReader.open(path.join(__dirname, "fixtures", "geoip-test.mmdb"));
+
+describe("GeoIP", () => {
+  describe("parseIp()", () => {
+    it("parses IPv4 and IPv6", () => {
+      expect(parseIp("81.2.69.160")).to.deep.equal([81, 2, 69, 160]);
+      expect(parseIp("2001:db8::1")).to.deep.equal([0x20, 0x01, 0x0d, 0xb8, ...new Array(11).fill(0), 1]);
+    });
+
+    it("parses IPv4 mapped addresses as IPv4", () => {
+      expect(parseIp("::ffff:81.2.69.160")).to.deep.equal([81, 2, 69, 160]);
+    });
+
+    it("rejects things that aren't IPs", () => {
+      expect(parseIp("unknown")).to.be.undefined;
+      expect(parseIp("256.0.0.1")).to.be.undefined;
+    });
+  });
+
+  describe("isPrivateIp()", () => {
+    it("skips the addresses reporters on the same host or Docker network connect from", () => {
+      ["127.0.0.1", "10.0.0.4", "172.17.0.2", "192.168.1.20", "169.254.1.1", "100.64.0.1", "::1", "fd00::2", "fe80::1"].forEach(
+        (ip) => expect(isPrivateIp(ip), ip).to.be.true
+      );
+    });
+
+    it("geolocates public addresses", () => {
+      ["81.2.69.160", "172.32.0.1", "2001:218::1", "::ffff:89.160.20.1"].forEach(
+        (ip) => expect(isPrivateIp(ip), ip).to.be.false
+      );
+    });
+  });
+
+  describe("MaxMindReader", () => {
+    it("reads the metadata", () => {
+      expect(reader.metadata).to.include({ ip_version: 6, record_size: 28, database_type: "Xornet-Test-City" });
+    });
+
+    it("finds the network an IPv4 is in", () => {
+      const record = reader.lookup("81.2.69.160");
+      expect(record?.country).to.include({ iso_code: "GB" });
+      expect(record?.subdivisions?.[0].names?.en).to.equal("England");
+      expect(reader.lookup("89.160.20.128")?.subdivisions?.[0].names?.en).to.equal("Östergötland County");
+    });
+
+    it("finds the network an IPv6 is in", () => {
+      expect(reader.lookup("2001:218:1::5")?.country?.names?.en).to.equal("Japan");
+    });
+
+    it("finds nothing for IPs that aren't in the database", () => {
+      expect(reader.lookup("1.1.1.1")).to.be.undefined;
+      expect(reader.lookup("2001:db8::1")).to.be.undefined;
+    });
+
+    it("refuses files that aren't databases", () => {
+      expect(() => new MaxMindReader(Buffer.from("not a database"))).to.throw();
+    });
+  });
+
+  describe("resolveNetwork()", () => {
+    it("geolocates the IP and looks up its hostname", async () => {
+      const network = await resolveNetwork("81.2.69.160", reader, async () => ["mirai.xornet.cloud"]);
+      expect(network).to.include({
+        ip: "81.2.69.160",
+        country: "GB",
+        country_name: "United Kingdom",
+        region: "England",
+        hostname: "mirai.xornet.cloud",
+      });
+    });
+
+    it("leaves the hostname out when the reverse lookup fails", async () => {
+      const network = await resolveNetwork("89.160.20.128", reader, () => Promise.reject(new Error("ENOTFOUND")));
+      expect(network).to.include({ country: "SE" });
+      expect(network.hostname).to.be.undefined;
+    });
+
+    it("doesn't look up private IPs", async () => {
+      const looked: string[] = [];
+      const network = await resolveNetwork("172.17.0.2", reader, async (ip) => {
+        looked.push(ip);
+        return [];
+      });
+      expect(network).to.deep.equal({ ip: "172.17.0.2", resolved_at: network.resolved_at });
+      expect(looked).to.be.empty;
+    });
+  });
+});
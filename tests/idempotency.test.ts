@@ -0,0 +1,141 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import request from "supertest";
+import { WebsocketManager } from "../src/classes/websocketManager.class";
+import { Config } from "../src/config";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import { IDEMPOTENCY_PENDING_TIMEOUT } from "../src/database/schemas/idempotencyKey";
+import { init_idempotency } from "../src/middleware/idempotency";
+import { V1 } from "../src/routes/v1/v1";
+import { errorHandler } from "../src/utils/errors";
+import { Mailer } from "../src/utils/mailer";
+
+// The keys collection with the unique index on the key
+const collection = () => {
+  const keys = new Map<string, any>();
+  return {
+    keys,
+    create: async (document: any) => {
+      if (keys.has(document.key)) throw { code: 11000 };
+      keys.set(document.key, { ...document });
+    },
+    findOne: async ({ key }: any) => keys.get(key) ?? null,
+    findOneAndUpdate: async ({ key, created_at }: any, { $set }: any) => {
+      const existing = keys.get(key);
+      if (!existing || existing.status !== undefined || !(existing.created_at < created_at.$lt)) return null;
+      return Object.assign(existing, $set);
+    },
+    updateOne: async ({ key }: any, { $set }: any) => Object.assign(keys.get(key), $set),
+    deleteOne: async ({ key }: any) => keys.get(key)?.status === undefined && keys.delete(key),
+  };
+};
+
+const fake_db = () => ({
+  idempotency_keys: collection(),
+  reserve_idempotency_key: DatabaseManager.prototype.reserve_idempotency_key,
+  complete_idempotency_key: DatabaseManager.prototype.complete_idempotency_key,
+  release_idempotency_key: DatabaseManager.prototype.release_idempotency_key,
+});
+
+describe("Idempotency keys", () => {
+  describe("POST /users/@signup", () => {
+    const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+    const body = { username: "geoxor", email: "geo@xornet.cloud", password: "hunter2hunter2" };
+    const setup = () => {
+      const created: string[] = [];
+      const db = {
+        ...fake_db(),
+        new_user: async ({ username }: typeof body) => {
+          created.push(username);
+          const uuid = `${username}-${created.length}`;
+          return { user: { email_verified: true, to_private: () => ({ uuid, username }) }, token: uuid, refresh_token: uuid };
+        },
+      };
+      const app = express()
+        .use(express.json())
+        .use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+      return { app, created };
+    };
+
+    it("creates one user for two signups with the same key and answers both the same", async () => {
+      const { app, created } = setup();
+      const first = await request(app).post("/users/@signup").set("Idempotency-Key", "retry-1").send(body).expect(201);
+      const second = await request(app).post("/users/@signup").set("Idempotency-Key", "retry-1").send(body).expect(201);
+      expect(created).to.deep.equal(["geoxor"]);
+      expect(second.body).to.deep.equal(first.body);
+      expect(second.headers["idempotent-replayed"]).to.equal("true");
+    });
+
+    it("creates a user for every signup without one", async () => {
+      const { app, created } = setup();
+      await request(app).post("/users/@signup").send(body).expect(201);
+      await request(app).post("/users/@signup").send(body).expect(201);
+      expect(created).to.have.lengthOf(2);
+    });
+
+    it("refuses a key that was used for a different request", async () => {
+      const { app, created } = setup();
+      await request(app).post("/users/@signup").set("Idempotency-Key", "retry-1").send(body).expect(201);
+      const { body: error } = await request(app)
+        .post("/users/@signup")
+        .set("Idempotency-Key", "retry-1")
+        .send({ ...body, username: "nagato" })
+        .expect(422);
+      expect(error.error.code).to.equal("idempotencyKey.reused");
+      expect(created).to.deep.equal(["geoxor"]);
+    });
+  });
+
+  describe("init_idempotency()", () => {
+    const setup = (fail_first: boolean) => {
+      const db = fake_db();
+      let calls = 0;
+      const app = express()
+        .use(express.json())
+        .post("/labels", init_idempotency(db as any), (_, res, next) =>
+          ++calls === 1 && fail_first ? next(new Error("mongo went away")) : res.status(201).json({ calls })
+        )
+        .use(errorHandler);
+      return { app, db, calls: () => calls };
+    };
+
+    it("lets a request that failed on our side run again", async () => {
+      const { app, calls } = setup(true);
+      await request(app).post("/labels").set("Idempotency-Key", "retry-1").send({}).expect(500);
+      const { body } = await request(app).post("/labels").set("Idempotency-Key", "retry-1").send({}).expect(201);
+      expect(body).to.deep.equal({ calls: 2 });
+      expect(calls()).to.equal(2);
+    });
+
+    it("tells a retry to wait while the first one is still running", async () => {
+      const db = fake_db();
+      let finish = () => {};
+      const app = express()
+        .use(express.json())
+        .post("/labels", init_idempotency(db as any), (_, res) => {
+          finish = () => res.status(201).json({});
+        });
+      const first = request(app).post("/labels").set("Idempotency-Key", "retry-1").send({}).then((res) => res);
+      while (!db.idempotency_keys.keys.size) await new Promise((resolve) => setImmediate(resolve));
+      const { body } = await request(app).post("/labels").set("Idempotency-Key", "retry-1").send({}).expect(409);
+      expect(body.error.code).to.equal("idempotencyKey.pending");
+      finish();
+      expect((await first).status).to.equal(201);
+    });
+
+    it("refuses an empty key", async () => {
+      const { app } = setup(false);
+      await request(app).post("/labels").set("Idempotency-Key", "").send({}).expect(400);
+    });
+
+    it("takes over a key whose request never finished", async () => {
+      const { db } = setup(false);
+      await db.idempotency_keys.create({ key: "crashed", fingerprint: "a", created_at: new Date(0) });
+      expect(await db.reserve_idempotency_key.call(db as any, "crashed", "b")).to.be.undefined;
+      const taken = db.idempotency_keys.keys.get("crashed");
+      expect(taken.fingerprint).to.equal("b");
+      expect(Date.now() - taken.created_at.getTime()).to.be.below(IDEMPOTENCY_PENDING_TIMEOUT);
+    });
+  });
+});
@@ -0,0 +1,165 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import request from "supertest";
+import sharp from "sharp";
+import { ErrorCode, sendError } from "../src/utils/errors";
+import {
+  extractMultipartFile,
+  imageDimensions,
+  PROFILE_IMAGE_SIZES,
+  readImageUpload,
+  resizeImage,
+  sniffImageType,
+} from "../src/utils/images";
+
+const PNG = Buffer.concat([Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]), Buffer.alloc(16)]);
+const JPEG = Buffer.concat([Buffer.from([0xff, 0xd8, 0xff, 0xe0]), Buffer.alloc(16)]);
+const WEBP = Buffer.concat([Buffer.from("RIFF"), Buffer.alloc(4), Buffer.from("WEBP"), Buffer.alloc(16)]);
+
+const png = (width: number, height: number) => {
+  const ihdr = Buffer.alloc(17);
+  ihdr.write("IHDR", 0, "ascii");
+  ihdr.writeUInt32BE(width, 4);
+  ihdr.writeUInt32BE(height, 8);
+  return Buffer.concat([PNG.subarray(0, 8), Buffer.from([0, 0, 0, 13]), ihdr]);
+};
+
+const jpeg = (width: number, height: number) => {
+  const app0 = Buffer.concat([Buffer.from([0xff, 0xe0, 0x00, 0x10]), Buffer.alloc(14)]);
+  const sof = Buffer.from([0xff, 0xc0, 0x00, 0x11, 0x08, 0, 0, 0, 0, 0x03]);
+  sof.writeUInt16BE(height, 5);
+  sof.writeUInt16BE(width, 7);
+  return Buffer.concat([Buffer.from([0xff, 0xd8]), app0, sof, Buffer.alloc(8)]);
+};
+
+const webp = (width: number, height: number) => {
+  const vp8x = Buffer.alloc(18);
+  vp8x.write("VP8X", 0, "ascii");
+  vp8x.writeUIntLE(width - 1, 12, 3);
+  vp8x.writeUIntLE(height - 1, 15, 3);
+  return Buffer.concat([Buffer.from("RIFF"), Buffer.alloc(4), Buffer.from("WEBP"), vp8x]);
+};
+
+describe("Images", () => {
+  describe("sniffImageType()", () => {
+    it("detects png", () => expect(sniffImageType(PNG)).to.equal("png"));
+    it("detects jpeg", () => expect(sniffImageType(JPEG)).to.equal("jpeg"));
+    it("detects webp", () => expect(sniffImageType(WEBP)).to.equal("webp"));
+
+    const INVALID_FILES = [Buffer.from("GIF89a0000000000"), Buffer.from("<html><body></body></html>"), Buffer.alloc(4)];
+    for (const file of INVALID_FILES) {
+      it(`rejects non images: ${file.toString("hex").slice(0, 16)}`, () => expect(sniffImageType(file)).to.be.undefined);
+    }
+  });
+
+  describe("extractMultipartFile()", () => {
+    const boundary = "----xornet";
+    const body = Buffer.concat([
+      Buffer.from(`--${boundary}\r\nContent-Disposition: form-data; name="note"\r\n\r\nhello\r\n`),
+      Buffer.from(`--${boundary}\r\nContent-Disposition: form-data; name="file"; filename="avatar.png"\r\n`),
+      Buffer.from("Content-Type: image/png\r\n\r\n"),
+      PNG,
+      Buffer.from(`\r\n--${boundary}--\r\n`),
+    ]);
+
+    it("extracts the file part", () => {
+      const file = extractMultipartFile(body, `multipart/form-data; boundary=${boundary}`);
+      expect(file!.equals(PNG)).to.be.true;
+    });
+
+    it("returns undefined without a boundary", () => {
+      expect(extractMultipartFile(body, "multipart/form-data")).to.be.undefined;
+    });
+  });
+
+  describe("imageDimensions()", () => {
+    it("reads png dimensions", () => {
+      expect(imageDimensions(png(256, 128), "png")).to.deep.equal({ width: 256, height: 128 });
+    });
+
+    it("reads jpeg dimensions", () => {
+      expect(imageDimensions(jpeg(640, 480), "jpeg")).to.deep.equal({ width: 640, height: 480 });
+    });
+
+    it("reads webp dimensions", () => {
+      expect(imageDimensions(webp(512, 300), "webp")).to.deep.equal({ width: 512, height: 300 });
+    });
+
+    it("returns undefined for truncated headers", () => {
+      expect(imageDimensions(PNG, "png")).to.be.undefined;
+      expect(imageDimensions(JPEG, "jpeg")).to.be.undefined;
+      expect(imageDimensions(png(256, 128).subarray(0, 20), "png")).to.be.undefined;
+    });
+  });
+
+  describe("readImageUpload()", () => {
+    const app = express().post("/users/uuid/:uuid/avatar", express.raw({ type: () => true }), (req, res) => {
+      const upload = readImageUpload(req.body, req.headers["content-type"], 1024);
+      if ("code" in upload) return sendError(res, upload.status, upload.code);
+      res.json({ type: upload.type });
+    });
+    const avatar = "/users/uuid/8bb3cf50-077a-4586-8567-58f596504a0e/avatar";
+
+    it("rejects a fake binary even when it claims to be a png", async () => {
+      const res = await request(app)
+        .post(avatar)
+        .attach("file", Buffer.from("MZ\x90\x00 definitely not an image"), { filename: "avatar.png", contentType: "image/png" })
+        .expect(415);
+      expect(res.body.error.code).to.equal(ErrorCode.UnsupportedMediaType);
+    });
+
+    it("accepts a real image as a multipart upload", async () => {
+      const res = await request(app).post(avatar).attach("file", png(256, 256), "avatar.bin").expect(200);
+      expect(res.body).to.deep.equal({ type: "png" });
+    });
+
+    it("accepts the raw image as the body", async () => {
+      await request(app).post(avatar).set("Content-Type", "image/jpeg").send(jpeg(64, 64)).expect(200);
+    });
+
+    it("rejects oversized files with 413", async () => {
+      const big = Buffer.concat([webp(64, 64), Buffer.alloc(2048)]);
+      const res = await request(app).post(avatar).set("Content-Type", "image/webp").send(big).expect(413);
+      expect(res.body.error.code).to.equal(ErrorCode.PayloadTooLarge);
+    });
+
+    it("rejects images that are too large", async () => {
+      const res = await request(app).post(avatar).set("Content-Type", "image/png").send(png(10000, 100)).expect(400);
+      expect(res.body.error.code).to.equal(ErrorCode.InvalidDimensions);
+    });
+
+    it("rejects empty uploads", () => {
+      expect(readImageUpload(Buffer.alloc(0), "image/png", 1024)).to.deep.equal({ status: 400, code: ErrorCode.InvalidFile });
+    });
+  });
+
+  describe("resizeImage()", () => {
+    const photo = (width: number, height: number) =>
+      sharp({ create: { width, height, channels: 3, background: "#ff4e8a" } })
+        .withMetadata({ exif: { IFD0: { Copyright: "geoxor" } } })
+        .jpeg()
+        .toBuffer();
+
+    it("resizes avatars to the size they're shown at", async () => {
+      const avatar = await resizeImage(await photo(2000, 1000), "jpeg", PROFILE_IMAGE_SIZES.avatar);
+      expect(await sharp(avatar).metadata()).to.include({ format: "jpeg", width: 512, height: 512 });
+    });
+
+    it("leaves the EXIF of the upload behind", async () => {
+      const upload = await photo(600, 200);
+      expect((await sharp(upload).metadata()).exif).to.exist;
+      const banner = await resizeImage(upload, "jpeg", PROFILE_IMAGE_SIZES.banner);
+      expect((await sharp(banner).metadata()).exif).to.be.undefined;
+    });
+
+    it("doesn't enlarge images that are smaller", async () => {
+      const banner = await resizeImage(await photo(300, 100), "jpeg", PROFILE_IMAGE_SIZES.banner);
+      expect(await sharp(banner).metadata()).to.include({ width: 300, height: 100 });
+    });
+
+    it("rejects images it can't decode", async () => {
+      expect(await resizeImage(PNG, "png", PROFILE_IMAGE_SIZES.avatar).catch(() => "undecodable")).to.equal("undecodable");
+    });
+  });
+});
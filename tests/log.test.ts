@@ -0,0 +1,135 @@
+import { afterEach, beforeEach, describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import request from "supertest";
+import { get_request_id, init_request_log } from "../src/middleware/log";
+import { ErrorCode, errorHandler, sendError } from "../src/utils/errors";
+import { Logger, LogLevel, parseLogLevel } from "../src/utils/logger";
+
+describe("init_request_log()", () => {
+  let logged: { level: LogLevel; message: string; fields: any }[] = [];
+  const structured = Logger.structured;
+  const error = Logger.error;
+
+  beforeEach(() => {
+    logged = [];
+    Logger.structured = (level, message, fields) => logged.push({ level, message, fields });
+    Logger.error = () => {};
+  });
+
+  afterEach(() => {
+    Logger.structured = structured;
+    Logger.error = error;
+  });
+
+  const app = express()
+    .use(init_request_log())
+    .use(express.json())
+    .get("/machines", (_, res) => res.json({ request_id: get_request_id(res) }))
+    .use(
+      "/users",
+      express
+        .Router()
+        // Stands in for the auth middleware
+        .use("/:uuid", (req: any, _, next) => {
+          req.user = { uuid: req.params.uuid };
+          next();
+        })
+        .post("/:uuid", (_, res) => res.send("ok"))
+        .get("/:uuid", (_, res) => sendError(res, 404, ErrorCode.UserNotFound))
+    )
+    .get("/broken", () => {
+      throw new Error("broken");
+    })
+    .use(errorHandler);
+
+  // The log is written once the response closes which can be right after supertest resolves
+  const nextLog = async () => {
+    while (!logged.length) await new Promise((resolve) => setImmediate(resolve));
+    return logged[0];
+  };
+
+  it("gives every request an id and echoes it back", async () => {
+    const res = await request(app).get("/machines").expect(200);
+    expect(res.headers["x-request-id"]).to.match(/^[0-9a-f-]{36}$/);
+    expect(res.body.request_id).to.equal(res.headers["x-request-id"]);
+  });
+
+  it("reuses the id of the proxy in front of us", async () => {
+    const res = await request(app).get("/machines").set("X-Request-ID", "edge-1234").expect(200);
+    expect(res.headers["x-request-id"]).to.equal("edge-1234");
+  });
+
+  it("replaces ids that could mess up the logs", async () => {
+    const res = await request(app).get("/machines").set("X-Request-ID", '"}{"level":"error').expect(200);
+    expect(res.headers["x-request-id"]).to.match(/^[0-9a-f-]{36}$/);
+  });
+
+  it("logs the method, path, status, latency and id without the query", async () => {
+    const res = await request(app).get("/machines?token=secret").expect(200);
+    const { level, message, fields } = await nextLog();
+    expect(level).to.equal("info");
+    expect(message).to.equal("request");
+    expect(fields).to.include({ request_id: res.headers["x-request-id"], method: "GET", path: "/machines", status: 200 });
+    expect(fields.latency_ms).to.be.a("number");
+  });
+
+  it("logs the route template, the caller and the body sizes", async () => {
+    await request(app).post("/users/geoxor").send({ biography: "I like servers" }).expect(200);
+    const { fields } = await nextLog();
+    expect(fields).to.include({ path: "/users/geoxor", route: "/users/:uuid", user_uuid: "geoxor", bytes_out: 2 });
+    expect(fields.bytes_in).to.equal(JSON.stringify({ biography: "I like servers" }).length);
+  });
+
+  it("puts the id in the error envelope", async () => {
+    const res = await request(app).get("/users/geoxor").expect(404);
+    expect(res.body.error).to.include({ code: "user.notFound", request_id: res.headers["x-request-id"] });
+    expect((await nextLog()).level).to.equal("warn");
+  });
+
+  it("puts the same id on unhandled errors", async () => {
+    const res = await request(app).get("/broken").expect(500);
+    expect(res.body.error.request_id).to.equal(res.headers["x-request-id"]);
+    expect((await nextLog()).level).to.equal("error");
+  });
+});
+
+describe("Logger", () => {
+  describe("parseLogLevel()", () => {
+    it("parses the levels in any case", () => {
+      expect(parseLogLevel("debug")).to.equal("debug");
+      expect(parseLogLevel("WARN")).to.equal("warn");
+    });
+
+    it("falls back to info", () => {
+      expect(parseLogLevel(undefined)).to.equal("info");
+      expect(parseLogLevel("verbose")).to.equal("info");
+    });
+  });
+
+  describe("scoped()", () => {
+    it("adds its fields to every structured log", () => {
+      const structured = Logger.structured;
+      let fields: any;
+      Logger.structured = (_, __, logged) => (fields = logged);
+      Logger.scoped({ request_id: "abc" }).scoped({ user_uuid: "geoxor" }).structured("info", "request", { status: 200 });
+      Logger.structured = structured;
+      expect(fields).to.deep.equal({ request_id: "abc", user_uuid: "geoxor", status: 200 });
+    });
+  });
+
+  describe("enabled()", () => {
+    const level = Logger.level;
+    afterEach(() => (Logger.level = level));
+
+    it("prints the level it's set to and everything above it", () => {
+      Logger.level = "warn";
+      expect(["debug", "info", "warn", "error"].map((level) => Logger.enabled(level as LogLevel))).to.deep.equal([
+        false,
+        false,
+        true,
+        true,
+      ]);
+    });
+  });
+});
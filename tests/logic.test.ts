@@ -1,9 +1,83 @@
 import { describe, it } from "mocha";
 import { expect } from "chai";
+import { AUDIT_ACTIONS } from "../src/database/schemas/auditLog";
 import { Validators } from "../src/validators";
-import { randomHexColor } from "../src/logic";
+import {
+  checkDependencies,
+  computeUptime,
+  escapeRegex,
+  getHealth,
+  ndjson,
+  normalizeEmail,
+  normalizeUsername,
+  parseAuditLogQuery,
+  parseDuration,
+  parseExportRange,
+  parseFields,
+  parsePagination,
+  parseStatsRange,
+  pickFields,
+  randomHexColor,
+  retry,
+} from "../src/logic";
+import { Time } from "../src/types";
 
 describe("Logic functions", () => {
+  describe("checkDependencies()", () => {
+    it("is ready when every check passes", async () => {
+      const result = await checkDependencies({ mongodb: async () => 1, redis: async () => "PONG" });
+      expect(result).to.deep.equal({ ready: true, dependencies: { mongodb: "ok", redis: "ok" } });
+    });
+
+    it("lists which dependency failed", async () => {
+      const { ready, dependencies } = await checkDependencies({
+        mongodb: () => Promise.reject("database.disconnected"),
+        redis: async () => "PONG",
+      });
+      expect(ready).to.be.false;
+      expect(dependencies).to.deep.equal({ mongodb: "database.disconnected", redis: "ok" });
+    });
+
+    it("fails checks that take too long", async () => {
+      const { ready, dependencies } = await checkDependencies({ mongodb: () => new Promise(() => {}) }, 10);
+      expect(ready).to.be.false;
+      expect(dependencies.mongodb).to.contain("timed out");
+    });
+  });
+
+  describe("getHealth()", () => {
+    it("reports the uptime and build", () => {
+      const health = getHealth("8480f81");
+      expect(health.uptime).to.be.a("number");
+      expect(health.version).to.be.a("string");
+      expect(health.commit).to.equal("8480f81");
+    });
+  });
+
+  describe("escapeRegex()", () => {
+    const INPUTS = [".*", "(a+)+$", "[geo]", "geo\\xor", "^geoxor$", "a|b", "{1,2}?"];
+    for (const input of INPUTS) {
+      it(`matches ${input} literally`, () => {
+        const regex = new RegExp(`^${escapeRegex(input)}$`);
+        expect(regex.test(input)).to.be.true;
+        expect(regex.test("geoxor")).to.be.false;
+      });
+    }
+  });
+
+  describe("normalizeEmail()", () => {
+    it("ignores the case and the whitespace around emails", () => {
+      expect(normalizeEmail("  Geo@Xornet.CLOUD ")).to.equal("geo@xornet.cloud");
+      expect(normalizeEmail("geo@xornet.cloud")).to.equal(normalizeEmail("GEO@xornet.cloud"));
+    });
+  });
+
+  describe("normalizeUsername()", () => {
+    it("makes usernames that only differ in case the same", () => {
+      expect(normalizeUsername("Geoxor")).to.equal(normalizeUsername("geoXOR "));
+    });
+  });
+
   describe("randomHexColor()", () => {
     it("can generate a valid hex color", () => {
       const color = randomHexColor();
@@ -11,4 +85,284 @@ describe("Logic functions", () => {
       expect(Validators.validate_hex_color(color)).to.be.true;
     });
   });
+
+  describe("parsePagination()", () => {
+    it("uses the defaults when nothing is provided", () => {
+      expect(parsePagination({}).pagination).to.deep.equal({ limit: 50, skip: 0, page: 1 });
+    });
+
+    it("parses numeric values", () => {
+      expect(parsePagination({ limit: "25", skip: "100" }).pagination).to.deep.equal({ limit: 25, skip: 100, page: 5 });
+    });
+
+    it("prefers ?page= over ?skip=", () => {
+      expect(parsePagination({ limit: "10", page: "3", skip: "5" }).pagination).to.deep.equal({ limit: 10, skip: 20, page: 3 });
+    });
+
+    it("prefers ?after= over ?page= and ?skip=", () => {
+      const after = "8bb3cf50-077a-4586-8567-58f596504a0e";
+      expect(parsePagination({ limit: "10", page: "3", skip: "5", after }).pagination).to.deep.equal({
+        limit: 10,
+        skip: 0,
+        page: 1,
+        after,
+      });
+    });
+
+    it("starts cursor paging with an empty ?after=", () => {
+      expect(parsePagination({ after: "" }).pagination?.after).to.equal("");
+    });
+
+    it("rejects cursors that aren't uuids or combined with ?sort=", () => {
+      expect(parsePagination({ after: "abc" }).error).to.equal("invalid.cursor");
+      const after = "8bb3cf50-077a-4586-8567-58f596504a0e";
+      expect(parsePagination({ after, sort: "username" }, ["username"]).error).to.equal("invalid.sort");
+    });
+
+    it("parses sorting on allowed fields", () => {
+      const { pagination } = parsePagination({ sort: "username", order: "desc" }, ["username"]);
+      expect(pagination!.sort).to.deep.equal({ username: -1 });
+    });
+
+    const INVALID_QUERIES = [
+      { limit: "-1" },
+      { limit: "abc" },
+      { limit: "101" },
+      { limit: "0" },
+      { skip: "-5" },
+      { skip: "1.5" },
+      { page: "0" },
+      { page: "-1" },
+      { sort: "password" },
+      { sort: "username", order: "sideways" },
+    ];
+    for (const query of INVALID_QUERIES) {
+      it(`returns an error for invalid query: ${JSON.stringify(query)}`, () => {
+        const { pagination, error } = parsePagination(query, ["username"]);
+        expect(pagination).to.be.undefined;
+        expect(error).to.be.a("string");
+      });
+    }
+  });
+
+  describe("parseFields()", () => {
+    const SELECTABLE = ["uuid", "username", "avatar"];
+
+    it("returns nothing when no fields were asked for", () => {
+      expect(parseFields(undefined, SELECTABLE)).to.deep.equal({});
+    });
+
+    it("splits, trims and dedupes the fields", () => {
+      expect(parseFields("username, avatar,username", SELECTABLE)).to.deep.equal({ fields: ["username", "avatar"] });
+    });
+
+    it("returns the fields that can't be selected", () => {
+      expect(parseFields("username,email,password", SELECTABLE)).to.deep.equal({ invalid: ["email", "password"] });
+    });
+
+    it("rejects an empty or repeated parameter", () => {
+      expect(parseFields(",", SELECTABLE)).to.deep.equal({ invalid: [] });
+      expect(parseFields(["uuid", "avatar"], SELECTABLE)).to.deep.equal({ invalid: [] });
+    });
+  });
+
+  describe("pickFields()", () => {
+    const user = { uuid: "mirai", username: "kaine", avatar: "https://example.com/avatar.png" };
+
+    it("keeps only the fields asked for", () => {
+      expect(pickFields(user, ["uuid", "username", "banner"])).to.deep.equal({ uuid: "mirai", username: "kaine" });
+    });
+
+    it("keeps everything without fields", () => {
+      expect(pickFields(user)).to.equal(user);
+    });
+  });
+
+  describe("parseDuration()", () => {
+    it("parses every unit", () => {
+      expect(parseDuration("250ms")).to.equal(250);
+      expect(parseDuration("30s")).to.equal(30 * Time.Second);
+      expect(parseDuration("5m")).to.equal(5 * Time.Minute);
+      expect(parseDuration("1h")).to.equal(Time.Hour);
+      expect(parseDuration("1d")).to.equal(Time.Day);
+    });
+
+    it("returns NaN for anything else", () => {
+      for (const duration of ["", "m", "1", "1w", "-1m", "1.5h", " 1m"]) expect(parseDuration(duration)).to.be.NaN;
+    });
+  });
+
+  describe("parseStatsRange()", () => {
+    const now = Date.parse("2022-05-01T12:00:00Z");
+
+    it("defaults to the last hour at a minute", () => {
+      expect(parseStatsRange({}, now).range).to.deep.equal({ from: now - Time.Hour, to: now, resolution: Time.Minute });
+    });
+
+    it("parses RFC3339 timestamps with offsets", () => {
+      const query = { from: "2022-05-01T13:00:00+02:00", to: "2022-05-01T12:00:00.500Z", resolution: "5m" };
+      const { range } = parseStatsRange(query);
+      expect(range).to.deep.equal({ from: now - Time.Hour, to: now + 500, resolution: 5 * Time.Minute });
+    });
+
+    it("accepts ?interval= instead of ?resolution=", () => {
+      expect(parseStatsRange({ interval: "5m" }, now).range!.resolution).to.equal(5 * Time.Minute);
+    });
+
+    const INVALID_QUERIES: [object, string][] = [
+      [{ from: "yesterday" }, "invalid.from"],
+      [{ from: "2022-05-01" }, "invalid.from"],
+      [{ to: "1651406400000" }, "invalid.to"],
+      [{ from: "2022-05-01T12:00:00Z", to: "2022-05-01T11:00:00Z" }, "invalid.range"],
+      [{ from: "2022-05-01T12:00:00Z", to: "2022-05-01T12:00:00Z" }, "invalid.range"],
+      [{ from: "2022-01-01T00:00:00Z", to: "2022-05-01T00:00:00Z", resolution: "1d" }, "invalid.range"],
+      [{ resolution: "fast" }, "invalid.resolution"],
+      [{ resolution: "0s" }, "invalid.resolution"],
+      [{ from: "2022-04-01T12:00:00Z", to: "2022-05-01T12:00:00Z", resolution: "1m" }, "invalid.resolution"],
+    ];
+    for (const [query, code] of INVALID_QUERIES) {
+      it(`returns ${code} for ${JSON.stringify(query)}`, () => {
+        const { range, error } = parseStatsRange(query as { [key: string]: unknown }, now);
+        expect(range).to.be.undefined;
+        expect(error).to.equal(code);
+      });
+    }
+  });
+
+  describe("parseExportRange()", () => {
+    const now = Date.parse("2022-05-01T12:00:00Z");
+
+    it("defaults to everything up to now", () => {
+      expect(parseExportRange({}, now).range).to.deep.equal({ from: 0, to: now });
+    });
+
+    it("allows ranges longer than the history does", () => {
+      const { range } = parseExportRange({ from: "2021-05-01T12:00:00Z" }, now);
+      expect(range).to.deep.equal({ from: now - 365 * Time.Day, to: now });
+    });
+
+    it("rejects invalid ranges", () => {
+      expect(parseExportRange({ from: "yesterday" }, now).error).to.equal("invalid.from");
+      expect(parseExportRange({ to: "1651406400000" }, now).error).to.equal("invalid.to");
+      expect(parseExportRange({ from: "2022-05-01T13:00:00Z" }, now).error).to.equal("invalid.range");
+    });
+  });
+
+  describe("parseAuditLogQuery()", () => {
+    it("doesn't narrow anything down by default", () => {
+      expect(parseAuditLogQuery({}, AUDIT_ACTIONS).audit).to.deep.equal({});
+    });
+
+    it("parses the dates and the type", () => {
+      const { audit } = parseAuditLogQuery({ from: "2022-05-01T12:00:00Z", type: "machine.delete" }, AUDIT_ACTIONS);
+      expect(audit).to.deep.equal({ from: Date.parse("2022-05-01T12:00:00Z"), action: "machine.delete" });
+    });
+
+    it("rejects what it can't parse", () => {
+      expect(parseAuditLogQuery({ from: "yesterday" }, AUDIT_ACTIONS).error).to.equal("invalid.from");
+      expect(parseAuditLogQuery({ to: "" }, AUDIT_ACTIONS).error).to.equal("invalid.to");
+      const backwards = { from: "2022-05-02T00:00:00Z", to: "2022-05-01T00:00:00Z" };
+      expect(parseAuditLogQuery(backwards, AUDIT_ACTIONS).error).to.equal("invalid.range");
+      expect(parseAuditLogQuery({ type: "user.hacked" }, AUDIT_ACTIONS).error).to.equal("invalid.type");
+    });
+  });
+
+  describe("ndjson()", () => {
+    async function* documents(count: number) {
+      for (let i = 0; i < count; i++) yield { i };
+    }
+    const read = async (chunks: AsyncIterable<string>) => {
+      let text = "";
+      for await (const chunk of chunks) text += chunk;
+      return text;
+    };
+
+    it("writes a line for every document", async () => {
+      const written = { count: 0, truncated: false };
+      expect(await read(ndjson(documents(3), 10, written))).to.equal('{"i":0}\n{"i":1}\n{"i":2}\n');
+      expect(written).to.deep.equal({ count: 3, truncated: false });
+    });
+
+    it("stops at the limit and says it did", async () => {
+      const written = { count: 0, truncated: false };
+      expect(await read(ndjson(documents(3), 2, written))).to.equal('{"i":0}\n{"i":1}\n');
+      expect(written).to.deep.equal({ count: 2, truncated: true });
+    });
+
+    it("writes many lines at once", async () => {
+      const chunks: string[] = [];
+      for await (const chunk of ndjson(documents(10000), 10000)) chunks.push(chunk);
+      expect(chunks.length).to.be.greaterThan(1).and.lessThan(10);
+      expect(chunks.join("").split("\n")).to.have.lengthOf(10001);
+    });
+  });
+
+  describe("retry()", () => {
+    it("resolves once the function does", async () => {
+      let calls = 0;
+      const result = await retry(async () => (++calls < 3 ? Promise.reject("flaky") : "done"), 3, 1);
+      expect(result).to.equal("done");
+      expect(calls).to.equal(3);
+    });
+
+    it("rejects with the last error after every attempt failed", async () => {
+      let calls = 0;
+      const error = await retry(() => Promise.reject(`attempt ${++calls}`), 2, 1).catch((error) => error);
+      expect(error).to.equal("attempt 2");
+      expect(calls).to.equal(2);
+    });
+  });
+
+  describe("computeUptime()", () => {
+    const gap = 15 * Time.Second;
+
+    it("is fully up while the reporter stayed connected", () => {
+      expect(computeUptime([{ connected_at: 0, disconnected_at: Time.Day }], 0, Time.Day, gap)).to.deep.equal({
+        uptime: 100,
+        downtime: [],
+      });
+    });
+
+    it("gives the windows the reporter was gone for", () => {
+      const connections = [
+        { connected_at: 0, disconnected_at: 10 * Time.Hour },
+        { connected_at: 12 * Time.Hour, disconnected_at: 18 * Time.Hour },
+      ];
+      expect(computeUptime(connections, 0, Time.Day, gap)).to.deep.equal({
+        uptime: 66.67,
+        downtime: [
+          { from: 10 * Time.Hour, to: 12 * Time.Hour },
+          { from: 18 * Time.Hour, to: Time.Day },
+        ],
+      });
+    });
+
+    it("doesn't count reconnects shorter than the gap as downtime", () => {
+      const connections = [
+        { connected_at: 5 * Time.Second, disconnected_at: Time.Hour },
+        { connected_at: Time.Hour + 10 * Time.Second },
+      ];
+      expect(computeUptime(connections, 0, Time.Day, gap)).to.deep.equal({ uptime: 100, downtime: [] });
+    });
+
+    it("counts overlapping connections to different shards once", () => {
+      const connections = [
+        { connected_at: 6 * Time.Hour, disconnected_at: Time.Day },
+        { connected_at: 0, disconnected_at: 12 * Time.Hour },
+      ];
+      expect(computeUptime(connections, 0, Time.Day, gap).uptime).to.equal(100);
+    });
+
+    it("clips connections to the range", () => {
+      const connections = [{ connected_at: -Time.Day, disconnected_at: 6 * Time.Hour }, { connected_at: 2 * Time.Day }];
+      expect(computeUptime(connections, 0, Time.Day, gap)).to.deep.equal({
+        uptime: 25,
+        downtime: [{ from: 6 * Time.Hour, to: Time.Day }],
+      });
+    });
+
+    it("has no percentage for an empty range", () => {
+      expect(computeUptime([], 0, 0, gap)).to.deep.equal({ uptime: null, downtime: [] });
+    });
+  });
 });
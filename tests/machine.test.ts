@@ -0,0 +1,491 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import jwt from "jsonwebtoken";
+import request from "supertest";
+import { WebsocketManager } from "../src/classes/websocketManager.class";
+import { Config } from "../src/config";
+import { MACHINE_DELETION_GRACE, machine_presence, machines, MachineStatus } from "../src/database/schemas/machine";
+import { machine_details, MAX_PROCESSES } from "../src/database/schemas/machineDetails";
+import { Time } from "../src/types";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import { softDeletePlugin, WITH_DELETED } from "../src/database/middleware/softDelete";
+import { users } from "../src/database/schemas/user";
+import { V1 } from "../src/routes/v1/v1";
+import { Mailer } from "../src/utils/mailer";
+
+describe("Machine", () => {
+  const now = Date.now();
+
+  describe("machine_presence()", () => {
+    const reported = (ago: number) => ({ status: MachineStatus.Online, last_seen: now - ago });
+
+    it("is online while the machine keeps reporting", () => {
+      expect(machine_presence(reported(10 * Time.Second), now, Time.Minute)).to.equal("online");
+    });
+
+    it("is offline once the machine stops reporting for longer than the threshold", () => {
+      expect(machine_presence(reported(2 * Time.Minute), now, Time.Minute)).to.equal("offline");
+    });
+
+    it("is offline when the machine was marked offline or never reported", () => {
+      expect(machine_presence({ status: MachineStatus.Offline, last_seen: now }, now, Time.Minute)).to.equal("offline");
+      expect(machine_presence({ status: MachineStatus.Online }, now, Time.Minute)).to.equal("offline");
+    });
+  });
+
+  describe("toJSON()", () => {
+    const machine = new machines({
+      owner_uuid: "8bb3cf50-077a-4586-8567-58f596504a0e",
+      access_token: "secret",
+      hardware_uuid: "5b1ad4a6-8f6f-4c2e-9e56-1e4f1a3a4a32",
+      name: "xnet-mirai",
+      status: MachineStatus.Online,
+      last_seen: Date.now(),
+      network: { ip: "81.2.69.160", country: "GB", hostname: "mirai.xornet.cloud", resolved_at: Date.now() },
+    });
+    const serialized = JSON.parse(JSON.stringify(machine));
+
+    it("should show whether the machine is online instead of the stored status", () => {
+      expect(serialized.status).to.equal("online");
+    });
+
+    it("should not contain the access token", () => {
+      expect(serialized).to.not.have.property("access_token");
+    });
+
+    it("should show where the machine is without its IP", () => {
+      expect(serialized.network).to.include({ country: "GB", hostname: "mirai.xornet.cloud" });
+      expect(serialized.network).to.not.have.property("ip");
+    });
+  });
+
+  describe("close_dangling_machine_events()", () => {
+    it("closes the events this shard left open when the machine last reported", async () => {
+      const open = [
+        { _id: 1, machine_uuid: "mirai", connected_at: new Date(1000) },
+        // Never reported so it's closed right when it connected
+        { _id: 2, machine_uuid: "nagato", connected_at: new Date(2000) },
+      ];
+      let filter: any;
+      const updates: { _id: number; disconnected_at: Date }[] = [];
+      const db = {
+        machine_events: {
+          find: async (query: any) => {
+            filter = query;
+            return open;
+          },
+          updateOne: async ({ _id }: any, { $set }: any) => updates.push({ _id, ...$set }),
+        },
+        machines: { find: async () => [{ uuid: "mirai", last_seen: 5000 }] },
+      };
+
+      const closed = await DatabaseManager.prototype.close_dangling_machine_events.call(db as any, "2");
+      expect(closed).to.equal(2);
+      expect(filter).to.deep.equal({ shard: "2", disconnected_at: { $exists: false } });
+      expect(updates).to.deep.equal([
+        { _id: 1, disconnected_at: new Date(5000) },
+        { _id: 2, disconnected_at: new Date(2000) },
+      ]);
+    });
+  });
+
+  describe("user_dashboard_pipeline()", () => {
+    const pipeline = DatabaseManager.user_dashboard_pipeline("geoxor", now, Time.Minute) as any[];
+
+    it("only groups the machines the user owns", () => {
+      expect(pipeline[0]).to.deep.equal({ $match: { owner_uuid: "geoxor" } });
+      expect(pipeline[1].$group._id).to.be.null;
+    });
+
+    it("only sums up the usage of the online machines", () => {
+      const online = pipeline[1].$group.online.$sum.$cond[0];
+      expect(online.$and[0]).to.deep.equal({ $ne: ["$status", MachineStatus.Offline] });
+      expect(online.$and[1]).to.deep.equal({ $gt: [{ $ifNull: ["$last_seen", 0] }, now - Time.Minute] });
+      expect(pipeline[1].$group.cpu).to.deep.equal({ $avg: { $cond: [online, "$dynamic_data.cau", null] } });
+      expect(pipeline[1].$group.download).to.deep.equal({ $sum: { $cond: [online, "$dynamic_data.td", null] } });
+    });
+
+    it("counts the rest as offline", () => {
+      expect(pipeline[2].$project.machines.offline).to.deep.equal({ $subtract: ["$total", "$online"] });
+    });
+
+    it("sums up the cores of every machine whether it's online or not", () => {
+      expect(pipeline[1].$group.cores).to.deep.equal({ $sum: { $ifNull: ["$static_data.cpu_cores", 0] } });
+    });
+  });
+
+  describe("get_user_dashboard()", () => {
+    it("gives an empty summary to users without machines", async () => {
+      const db = { machines: { aggregate: () => ({ maxTimeMS: () => ({ exec: async () => [] }) }) } };
+      const summary = await DatabaseManager.prototype.get_user_dashboard.call(db as any, "geoxor");
+      expect(summary.machines).to.deep.equal({ total: 0, online: 0, offline: 0 });
+      expect(summary.cpu).to.be.null;
+    });
+  });
+
+  describe("get_datacenter_summary()", () => {
+    const fake = (machines: string[]) => {
+      const calls: { filter?: any; pipeline?: any[] } = {};
+      const db = {
+        find_datacenter: async (filter: object) => ((calls.filter = filter), { uuid: "homelab", machines }),
+        machines: {
+          aggregate: (pipeline: any[]) => {
+            calls.pipeline = pipeline;
+            return { maxTimeMS: () => ({ exec: async () => [{ machines: { total: machines.length } }] }) };
+          },
+        },
+      };
+      const summary = DatabaseManager.prototype.get_datacenter_summary.call(db as any, "homelab", "nagato");
+      return { calls, summary };
+    };
+
+    it("only sums up the machines of datacenters the user is a member of", async () => {
+      const { calls, summary } = fake(["mirai", "yamato"]);
+      expect((await summary).machines.total).to.equal(2);
+      expect(calls.filter).to.deep.equal({ uuid: "homelab", $or: [{ owner_uuid: "nagato" }, { members: "nagato" }] });
+      expect(calls.pipeline![0]).to.deep.equal({ $match: { uuid: { $in: ["mirai", "yamato"] } } });
+    });
+
+    it("doesn't aggregate anything for datacenters without machines", async () => {
+      const { calls, summary } = fake([]);
+      expect(await summary).to.deep.include({ machines: { total: 0, online: 0, offline: 0 }, cores: 0 });
+      expect(calls.pipeline).to.be.undefined;
+    });
+  });
+
+  describe("transfer_machine()", () => {
+    const fake = (machine: object | null) => {
+      const calls: { [name: string]: any[] } = {};
+      const record = (name: string, result: unknown) => (...args: any[]) => {
+        calls[name] = args;
+        return { exec: async () => result };
+      };
+      const db = {
+        find_user: async ({ uuid }: { uuid: string }) => ({ uuid }),
+        generate_access_token: () => "new-token",
+        machines: {
+          findOneAndUpdate: async (...args: any[]) => {
+            calls.update = args;
+            return machine;
+          },
+          exists: async () => ({ _id: "mirai" }),
+        },
+        datacenters: { updateMany: record("datacenters", {}) },
+        alerts: { deleteMany: record("alerts", {}) },
+        share_links: { deleteMany: record("share_links", {}) },
+        log_audit: (actor_uuid: string, action: string, subject_uuid: string, details: object) =>
+          (calls.audit = [{ action, actor_uuid, subject_uuid, details }]),
+      };
+      return { db, calls };
+    };
+
+    it("rotates the token, drops what the previous owner had on it and logs the transfer", async () => {
+      const { db, calls } = fake({ uuid: "mirai", owner_uuid: "nagato" });
+      await DatabaseManager.prototype.transfer_machine.call(db as any, "mirai", "geoxor", "nagato");
+      expect(calls.update[0]).to.deep.equal({ uuid: "mirai", owner_uuid: "geoxor" });
+      expect(calls.update[1].$set).to.deep.equal({ owner_uuid: "nagato", access_token: "new-token", labels: [] });
+      expect(calls.datacenters[0]).to.deep.equal({ machines: "mirai" });
+      expect(calls.alerts[0]).to.deep.equal({ machine_uuid: "mirai" });
+      expect(calls.share_links[0]).to.deep.equal({ machine_uuid: "mirai" });
+      expect(calls.audit[0]).to.deep.include({ action: "machine.transfer", actor_uuid: "geoxor", subject_uuid: "mirai" });
+      expect(calls.audit[0].details).to.deep.equal({ from: "geoxor", to: "nagato" });
+    });
+
+    it("rejects anyone but the owner", async () => {
+      const { db, calls } = fake(null);
+      const transfer = DatabaseManager.prototype.transfer_machine.call(db as any, "mirai", "shiro", "nagato");
+      expect(await transfer.catch((error) => error)).to.equal("forbidden");
+      expect(calls.audit).to.be.undefined;
+    });
+  });
+
+  describe("update_machine()", () => {
+    const fake = () => {
+      const calls: any[][] = [];
+      const db = {
+        machines: {
+          findOneAndUpdate: async (...args: any[]) => {
+            calls.push(args);
+            return { uuid: "mirai" };
+          },
+        },
+      };
+      return { db, calls };
+    };
+
+    it("only sets the fields that were given", async () => {
+      const { db, calls } = fake();
+      await DatabaseManager.prototype.update_machine.call(db as any, "mirai", "geoxor", { name: "Mirai" });
+      expect(calls[0][0]).to.deep.equal({ uuid: "mirai", owner_uuid: "geoxor" });
+      expect(calls[0][1]).to.deep.equal({ $set: { name: "Mirai" } });
+    });
+
+    it("never sets what the reporter reports", async () => {
+      const { db, calls } = fake();
+      const update = { icon: "router", static_data: { hostname: "evil" }, dynamic_data: {} } as any;
+      await DatabaseManager.prototype.update_machine.call(db as any, "mirai", "geoxor", update);
+      expect(calls[0][1]).to.deep.equal({ $set: { icon: "router" } });
+    });
+  });
+
+  describe("update_machine_stats()", () => {
+    it("leaves the name and icon the owner set alone", async () => {
+      let update: any;
+      const db = {
+        machines: {
+          findOneAndUpdate: async (_: object, value: object) => {
+            update = value;
+            return null;
+          },
+        },
+      };
+      const stats = { uuid: "mirai", timestamp: now } as any;
+      await DatabaseManager.prototype.update_machine_stats.call(db as any, "mirai", stats);
+      expect(Object.keys(update)).to.deep.equal(["$set"]);
+      expect(update.$set).to.not.have.any.keys("name", "icon", "static_data");
+    });
+  });
+
+  describe("machine_details()", () => {
+    const disk = { fs: "/dev/nvme0n1p2", mount: "/", type: "ext4", total: 512, used: 128 };
+
+    it("keeps the processes using the most CPU", () => {
+      const processes = Array.from({ length: 50 }, (_, pid) => ({ pid, name: `worker-${pid}`, cpu: pid, ram: 1024 }));
+      const details = machine_details({ disks: [disk], processes });
+      expect(details.processes).to.have.lengthOf(MAX_PROCESSES);
+      expect(details.processes![0]).to.deep.equal({ pid: 49, name: "worker-49", cpu: 49, ram: 1024 });
+      expect(details.disks).to.deep.equal([disk]);
+    });
+
+    it("takes the control characters out of the names and shortens them", () => {
+      const processes = [{ pid: 1, name: " \u001b[31mevil\u0007\n", cpu: 0 }, { pid: 2, name: "a".repeat(1000) }];
+      const [evil, long] = machine_details({ disks: [], processes }).processes!;
+      expect(evil.name).to.equal("[31mevil");
+      expect(long.name).to.have.lengthOf(64);
+    });
+
+    it("leaves the processes out for reporters that don't send them", () => {
+      expect(machine_details({ disks: [disk] })).to.deep.equal({ disks: [disk] });
+    });
+  });
+
+  describe("update_machine_details()", () => {
+    it("replaces the one document of the machine instead of appending", async () => {
+      const calls: any[][] = [];
+      const db = { machine_details: { updateOne: async (...args: any[]) => calls.push(args) } };
+      const data = { disks: [], processes: [{ pid: 1, name: "init" }] } as any;
+      await DatabaseManager.prototype.update_machine_details.call(db as any, "mirai", data, 1000);
+      const $set = { disks: [], processes: [{ pid: 1, name: "init" }], updated_at: 1000 };
+      expect(calls).to.deep.equal([[{ machine_uuid: "mirai" }, { $set }, { upsert: true }]]);
+    });
+  });
+
+  describe("softDeletePlugin()", () => {
+    const hooks: { [operation: string]: Function } = {};
+    softDeletePlugin({ pre: (operation: string, ...args: Function[]) => (hooks[operation] = args[args.length - 1]) } as any);
+
+    it("hides soft deleted machines from queries", () => {
+      const query = machines.find({ owner_uuid: "geoxor" });
+      hooks.find.call(query);
+      expect(query.getFilter()).to.deep.equal({ owner_uuid: "geoxor", deleted_at: null });
+      expect(hooks).to.include.keys(["findOne", "findOneAndUpdate", "updateMany", "countDocuments", "distinct"]);
+    });
+
+    it("leaves queries alone that look for them on purpose", () => {
+      const restoring = machines.findOne({ uuid: "mirai", deleted_at: { $gt: 0 } });
+      hooks.findOne.call(restoring);
+      expect(restoring.getFilter()).to.deep.equal({ uuid: "mirai", deleted_at: { $gt: 0 } });
+      const cleanup = machines.distinct("uuid").setOptions(WITH_DELETED);
+      hooks.distinct.call(cleanup);
+      expect(cleanup.getFilter()).to.deep.equal({});
+    });
+
+    it("filters aggregations before anything else", () => {
+      const aggregate = machines.aggregate([{ $match: { owner_uuid: "geoxor" } }]);
+      hooks.aggregate.call(aggregate);
+      expect(aggregate.pipeline()).to.deep.equal([{ $match: { deleted_at: null } }, { $match: { owner_uuid: "geoxor" } }]);
+    });
+  });
+
+  describe("restore_machine()", () => {
+    it("only restores machines of the owner that are still in their grace period", async () => {
+      let filter: any;
+      const db = { machines: { findOneAndUpdate: async (query: object) => ((filter = query), null) } };
+      const now = Date.now();
+      const restore = DatabaseManager.prototype.restore_machine.call(db as any, "mirai", "geoxor");
+      expect(await restore.catch((error) => error)).to.equal("machine.notFound");
+      expect(filter).to.deep.include({ uuid: "mirai", owner_uuid: "geoxor" });
+      expect(filter.deleted_at.$gt).to.be.within(now - MACHINE_DELETION_GRACE, now - MACHINE_DELETION_GRACE + Time.Second);
+    });
+  });
+
+  describe("purgeable_machines_filter()", () => {
+    it("should only match machines deleted before the grace period", () => {
+      const now = Date.now();
+      expect(DatabaseManager.purgeable_machines_filter(now)).to.deep.equal({
+        deleted_at: { $lte: now - MACHINE_DELETION_GRACE },
+      });
+    });
+  });
+
+  describe("sharing", () => {
+    const shared = new users({ uuid: "1c5b2b7e-5b0e-4c1f-9a3b-2f6f1f7f9d10", username: "nagato" });
+    const machine = { uuid: "8bb3cf50-077a-4586-8567-58f596504a0e", owner_uuid: "geoxor", access: [shared.uuid] };
+    // The machine is shared with the logged in user, who doesn't own it
+    let listed: { user_uuid: string; filter: any } | undefined;
+    const db = {
+      users: { findOne: async () => shared },
+      find_accessible_machines: async (user_uuid: string, _uuids?: string[], _signal?: AbortSignal, filter: any = {}) => {
+        listed = { user_uuid, filter };
+        const owned = filter.owner_uuid === undefined || filter.owner_uuid === machine.owner_uuid;
+        return machine.access.includes(user_uuid) && owned ? [machine] : [];
+      },
+      find_stats_metric: async () => ({ range: { from: 0, to: 1, resolution: 1 }, points: [] }),
+      find_stats_comparison: async () => ({ range: { from: 0, to: 1, resolution: 1 }, points: [] }),
+      rotate_machine_token: DatabaseManager.prototype.rotate_machine_token,
+      update_machine: DatabaseManager.prototype.update_machine,
+      delete_machine: DatabaseManager.prototype.delete_machine,
+      not_owned: (DatabaseManager.prototype as any).not_owned,
+      generate_access_token: () => "new-token",
+      machines: {
+        findOneAndUpdate: async (filter: any) => (filter.owner_uuid === machine.owner_uuid ? machine : null),
+        exists: async (filter: any) => (machine.access.includes(filter.access) ? { _id: machine.uuid } : null),
+      },
+    };
+    const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+    const app = express()
+      .use(express.json())
+      .use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+    const token = jwt.sign({ uuid: shared.uuid, username: shared.username, token_version: 0 }, "secret");
+
+    it("only lists the machines of an owner that the caller can already see", async () => {
+      const someone = "0f5a9a3e-3c1d-4b8e-9d53-6c7e2f1a4b90";
+      const { body } = await request(app).get(`/machines?owner=${someone}`).set("Authorization", `Bearer ${token}`).expect(200);
+      expect(body).to.deep.equal([]);
+      expect(listed).to.deep.equal({ user_uuid: shared.uuid, filter: { owner_uuid: someone } });
+    });
+
+    it("lets the users a machine is shared with read its stats", async () => {
+      await request(app)
+        .get(`/machines/${machine.uuid}/stats?metric=cpu`)
+        .set("Authorization", `Bearer ${token}`)
+        .expect(200);
+    });
+
+    it("names the machines they can't see when comparing stats", async () => {
+      const hidden = "0f5a9a3e-3c1d-4b8e-9d53-6c7e2f1a4b90";
+      const { body } = await request(app)
+        .post("/machines/stats/compare")
+        .set("Authorization", `Bearer ${token}`)
+        .send({ uuids: [machine.uuid, hidden] })
+        .expect(200);
+      expect(body.machines).to.deep.equal([machine.uuid]);
+      expect(body.unauthorized).to.deep.equal([hidden]);
+    });
+
+    it("caps how many machines can be compared", async () => {
+      const uuids = Array.from({ length: 11 }, (_, i) => `8bb3cf50-077a-4586-8567-58f5965040${String(i).padStart(2, "0")}`);
+      await request(app).post("/machines/stats/compare").set("Authorization", `Bearer ${token}`).send({ uuids }).expect(400);
+    });
+
+    it("forbids them from rotating its token", async () => {
+      const { body } = await request(app)
+        .post(`/machines/${machine.uuid}/token`)
+        .set("Authorization", `Bearer ${token}`)
+        .expect(403);
+      expect(body.error.code).to.equal("forbidden");
+    });
+
+    it("forbids them from deleting it", async () => {
+      const { body } = await request(app).delete(`/machines/${machine.uuid}`).set("Authorization", `Bearer ${token}`);
+      expect(body.error.code).to.equal("forbidden");
+    });
+
+    it("forbids them from renaming it", async () => {
+      await request(app)
+        .patch(`/machines/${machine.uuid}`)
+        .set("Authorization", `Bearer ${token}`)
+        .send({ name: "mine now" })
+        .expect(403);
+    });
+
+    it("rejects names that are too long and icons that don't exist", async () => {
+      const { body } = await request(app)
+        .patch(`/machines/${machine.uuid}`)
+        .set("Authorization", `Bearer ${token}`)
+        .send({ name: "x".repeat(49), icon: "toaster" })
+        .expect(400);
+      expect(body.error.fields).to.have.all.keys("name", "icon");
+    });
+  });
+
+  describe("token rotation", () => {
+    const owner = new users({ uuid: "1c5b2b7e-5b0e-4c1f-9a3b-2f6f1f7f9d10", username: "geoxor" });
+    const machine = { uuid: "8bb3cf50-077a-4586-8567-58f596504a0e", owner_uuid: owner.uuid, access_token: "old-token" };
+    const db = {
+      users: { findOne: async () => owner },
+      rotate_machine_token: DatabaseManager.prototype.rotate_machine_token,
+      generate_access_token: () => "new-token",
+      log_audit: () => {},
+      find_machine_by_token: async (access_token: string) => {
+        if (access_token === "slow-token") return Promise.reject("query.timeout");
+        return access_token === machine.access_token ? machine : Promise.reject("machine.notFound");
+      },
+      machines: {
+        findOneAndUpdate: async (filter: any, update: any) =>
+          filter.owner_uuid === machine.owner_uuid ? Object.assign(machine, update.$set) : null,
+      },
+    };
+    const websocketManager = { revokeMachine: async () => {}, ingestDynamicData: async (_: unknown, stats: object) => stats };
+    const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+    const app = express()
+      .use(express.json())
+      .use(new V1(db as any, websocketManager as any, {} as Mailer, config).router);
+    const token = jwt.sign({ uuid: owner.uuid, username: owner.username, token_version: 0 }, "secret");
+    const stats = {
+      cpu: { usage: [12], freq: [3600] },
+      ram: { total: 16000, used: 8000 },
+      swap: { total: 0, used: 0 },
+      disks: [],
+      process_count: 100,
+      network: [],
+      host_uptime: 1000,
+      reporter_uptime: 10,
+    };
+    const report = (access_token: string) =>
+      request(app).post(`/machines/${machine.uuid}/stats`).set("X-Machine-Token", access_token).send(stats);
+
+    it("stops accepting the previous token once it's rotated", async () => {
+      await report("old-token").expect(200);
+      const { body } = await request(app)
+        .post(`/machines/${machine.uuid}/token`)
+        .set("Authorization", `Bearer ${token}`)
+        .expect(200);
+      expect(body.access_token).to.equal("new-token");
+      expect((await report("old-token").expect(403)).body.error.code).to.equal("token.invalid");
+      await report(body.access_token).expect(200);
+    });
+
+    it("doesn't answer the database failing like a wrong token", async () => {
+      expect((await report("slow-token").expect(504)).body.error.code).to.equal("query.timeout");
+    });
+  });
+
+  describe("rotate_machine_token()", () => {
+    it("swaps the token of the machine for a new one", async () => {
+      const machine = { uuid: "8bb3cf50-077a-4586-8567-58f596504a0e", owner_uuid: "geoxor", access_token: "old-token" };
+      const db = {
+        generate_access_token: () => "new-token",
+        log_audit: () => {},
+        machines: {
+          findOneAndUpdate: async (filter: any, update: any) =>
+            filter.owner_uuid === machine.owner_uuid ? Object.assign(machine, update.$set) : null,
+        },
+      };
+      const access_token = await DatabaseManager.prototype.rotate_machine_token.call(db as any, machine.uuid, "geoxor");
+      expect(access_token).to.equal("new-token");
+      expect(machine.access_token).to.equal(access_token);
+    });
+  });
+});
@@ -0,0 +1,103 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import net, { AddressInfo } from "net";
+import { formatMail, SmtpMailer } from "../src/utils/mailer";
+
+const mail = { to: "geo@xornet.cloud", subject: "Verify your Xornet email", text: "Hi geoxor,\n.\nbye" };
+
+/**
+ * Starts an SMTP server that accepts everything and remembers what it was sent
+ */
+const fakeSmtpServer = (features = ["8BITMIME"]) => {
+  const received: { commands: string[]; data?: string } = { commands: [] };
+  const server = net.createServer((socket) => {
+    let buffer = "";
+    let reading = false;
+    socket.write("220 fake ESMTP\r\n");
+    socket.on("data", (chunk) => {
+      buffer += chunk.toString();
+      if (reading) {
+        const end = buffer.indexOf("\r\n.\r\n");
+        if (end === -1) return;
+        received.data = buffer.slice(0, end);
+        buffer = buffer.slice(end + 5);
+        reading = false;
+        socket.write("250 queued\r\n");
+      }
+      let index: number;
+      while (!reading && (index = buffer.indexOf("\r\n")) !== -1) {
+        const command = buffer.slice(0, index);
+        buffer = buffer.slice(index + 2);
+        received.commands.push(command);
+        if (command.startsWith("EHLO")) {
+          const lines = ["fake", ...features];
+          socket.write(lines.map((line, i) => `250${i === lines.length - 1 ? " " : "-"}${line}\r\n`).join(""));
+        } else if (command === "DATA") {
+          reading = true;
+          socket.write("354 go ahead\r\n");
+        } else if (command === "QUIT") socket.end("221 bye\r\n");
+        else socket.write("250 ok\r\n");
+      }
+    });
+  });
+  return new Promise<{ server: net.Server; port: number; received: typeof received }>((resolve) =>
+    server.listen(0, "127.0.0.1", () => resolve({ server, port: (server.address() as AddressInfo).port, received }))
+  );
+};
+
+describe("Mailer", () => {
+  describe("formatMail()", () => {
+    const formatted = formatMail("Xornet <noreply@xornet.cloud>", mail, new Date("2022-04-20T12:00:00.000Z"));
+
+    it("puts the headers before the body", () => {
+      const [headers] = formatted.split("\r\n\r\n");
+      expect(headers).to.contain("From: Xornet <noreply@xornet.cloud>\r\nTo: geo@xornet.cloud\r\n");
+      expect(headers).to.contain("Date: Wed, 20 Apr 2022 12:00:00 GMT");
+      expect(headers).to.match(/Message-ID: <[0-9a-f-]+@xornet\.cloud>/);
+    });
+
+    it("uses CRLF and escapes lines that start with a dot", () => {
+      expect(formatted.split("\r\n\r\n")[1]).to.equal("Hi geoxor,\r\n..\r\nbye");
+    });
+
+    it("doesn't let line breaks inject headers", () => {
+      const injected = formatMail("noreply@xornet.cloud", { ...mail, to: "geo@xornet.cloud\r\nBcc: everyone@xornet.cloud" });
+      expect(injected).to.not.match(/^Bcc:/m);
+    });
+
+    it("encodes subjects that aren't ascii", () => {
+      expect(formatMail("noreply@xornet.cloud", { ...mail, subject: "ξ" })).to.contain(
+        `Subject: =?UTF-8?B?${Buffer.from("ξ").toString("base64")}?=`
+      );
+    });
+  });
+
+  describe("SmtpMailer", () => {
+    it("hands the email to the server", async () => {
+      const { server, port, received } = await fakeSmtpServer();
+      try {
+        await new SmtpMailer({ host: "127.0.0.1", port, secure: false, from: "Xornet <noreply@xornet.cloud>" }).send(mail);
+        expect(received.commands).to.include.members([
+          "MAIL FROM:<noreply@xornet.cloud>",
+          "RCPT TO:<geo@xornet.cloud>",
+          "QUIT",
+        ]);
+        expect(received.data).to.contain("Subject: Verify your Xornet email");
+      } finally {
+        server.close();
+      }
+    });
+
+    it("refuses to send credentials over a connection that can't be encrypted", async () => {
+      const { server, port, received } = await fakeSmtpServer();
+      try {
+        const config = { host: "127.0.0.1", port, secure: false, user: "geo", password: "hunter2", from: "a@b.c" };
+        const mailer = new SmtpMailer(config);
+        expect(await mailer.send(mail).catch((error) => error)).to.be.an("error");
+        expect(received.commands.some((command) => command.startsWith("AUTH"))).to.be.false;
+      } finally {
+        server.close();
+      }
+    });
+  });
+});
@@ -0,0 +1,25 @@
+import { EventEmitter } from "events";
+import metricsMiddleware from "../src/middleware/metrics";
+
+/**
+ * Measures how much the metrics middleware adds to a request, run it with `npm run bench`
+ */
+const ITERATIONS = 200_000;
+const req: any = { method: "GET", baseUrl: "/users", route: { path: "/:uuid" } };
+const res: any = Object.assign(new EventEmitter(), { statusCode: 200 });
+
+const run = (middleware?: typeof metricsMiddleware) => {
+  const startedAt = process.hrtime.bigint();
+  for (let i = 0; i < ITERATIONS; i++) {
+    middleware ? middleware(req, res, () => {}) : (() => {})();
+    res.emit("finish");
+  }
+  return Number(process.hrtime.bigint() - startedAt) / ITERATIONS;
+};
+
+run(metricsMiddleware); // warm up
+const baseline = run();
+const instrumented = run(metricsMiddleware);
+console.log(`baseline:     ${baseline.toFixed(0)}ns/request`);
+console.log(`instrumented: ${instrumented.toFixed(0)}ns/request`);
+console.log(`overhead:     ${(instrumented - baseline).toFixed(0)}ns/request`);
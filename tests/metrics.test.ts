@@ -0,0 +1,122 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import request from "supertest";
+import { metricsPlugin, query_limits } from "../src/database/middleware/metrics";
+import { machines } from "../src/database/schemas/machine";
+import metricsMiddleware, { init_metrics_auth } from "../src/middleware/metrics";
+import { Logger } from "../src/utils/logger";
+import { metrics, Registry } from "../src/utils/metrics";
+
+describe("Metrics", () => {
+  describe("Registry", () => {
+    const registry = new Registry();
+    const counter = registry.counter("test_total", "A counter", ["status"]);
+    const histogram = registry.histogram("test_seconds", "A histogram", [], [0.1, 1]);
+    registry.gauge("test_gauge", "A gauge", ["type"], (gauge) => gauge.set({ type: "reporter" }, 3));
+
+    counter.inc({ status: 200 });
+    counter.inc({ status: 200 });
+    counter.inc({ status: 'say "hi"' });
+    histogram.observe({}, 0.05);
+    histogram.observe({}, 0.5);
+    histogram.observe({}, 5);
+    const output = registry.render();
+
+    it("renders the help and type of every metric", () => {
+      expect(output).to.contain("# HELP test_total A counter\n# TYPE test_total counter\n");
+      expect(output).to.contain("# TYPE test_seconds histogram\n");
+    });
+
+    it("renders counters per label set", () => {
+      expect(output).to.contain('test_total{status="200"} 2\n');
+      expect(output).to.contain('test_total{status="say \\"hi\\""} 1\n');
+    });
+
+    it("renders cumulative histogram buckets", () => {
+      expect(output).to.contain('test_seconds_bucket{le="0.1"} 1\n');
+      expect(output).to.contain('test_seconds_bucket{le="1"} 2\n');
+      expect(output).to.contain('test_seconds_bucket{le="+Inf"} 3\n');
+      expect(output).to.contain("test_seconds_sum 5.55\n");
+      expect(output).to.contain("test_seconds_count 3\n");
+    });
+
+    it("collects gauges when rendering", () => {
+      expect(output).to.contain('test_gauge{type="reporter"} 3\n');
+    });
+  });
+
+  describe("middleware", () => {
+    const users = express.Router().get("/:uuid", (_, res) => res.status(404).send());
+    const app = express().use(metricsMiddleware).use("/users", users);
+
+    it("labels requests with the route template instead of the path", async () => {
+      await request(app).get("/users/8bb3cf50-077a-4586-8567-58f596504a0e").expect(404);
+      await request(app).get("/nothing").expect(404);
+      const output = metrics.render();
+      expect(output).to.contain('xornet_http_requests_total{method="GET",route="/users/:uuid",status="404"} 1');
+      expect(output).to.contain('xornet_http_requests_total{method="GET",route="unmatched",status="404"} 1');
+      expect(output).to.not.contain("8bb3cf50");
+    });
+  });
+
+  describe("init_metrics_auth()", () => {
+    const app = (token?: string) => express().get("/metrics", init_metrics_auth(token), (_, res) => res.send());
+
+    it("leaves the metrics public when no token is set", async () => {
+      await request(app("")).get("/metrics").expect(200);
+    });
+
+    it("requires the token when one is set", async () => {
+      const res = await request(app("scrape")).get("/metrics").expect(401);
+      expect(res.body.error.code).to.equal("auth.required");
+    });
+
+    it("rejects the wrong token", async () => {
+      const res = await request(app("scrape")).get("/metrics").set("Authorization", "Bearer scraper").expect(401);
+      expect(res.body.error.code).to.equal("token.invalid");
+    });
+
+    it("accepts the right token", async () => {
+      await request(app("scrape")).get("/metrics").set("Authorization", "Bearer scrape").expect(200);
+    });
+  });
+
+  describe("metricsPlugin()", () => {
+    // The first hooks of every operation, the post ones are the successful ones
+    const hooks: { [name: string]: Function } = {};
+    const capture = (kind: string) => (operation: string, hook: Function) => (hooks[`${kind} ${operation}`] ??= hook);
+    metricsPlugin({ pre: capture("pre"), post: capture("post") } as any);
+
+    it("bounds the queries that don't set a timeout of their own", () => {
+      const query = machines.find({ uuid: "mirai" });
+      hooks["pre find"].call(query);
+      expect(query.getOptions().maxTimeMS).to.equal(query_limits.timeout);
+      const bounded = machines.find({ uuid: "mirai" }).maxTimeMS(100);
+      hooks["pre find"].call(bounded);
+      expect(bounded.getOptions().maxTimeMS).to.equal(100);
+    });
+
+    it("logs the queries that take longer than the slow threshold with their collection", async () => {
+      const { warn } = Logger;
+      const { slow } = query_limits;
+      const logged: string[] = [];
+      Logger.warn = (message: string) => logged.push(message);
+      query_limits.slow = 20;
+      try {
+        const fast = machines.find({ uuid: "mirai" });
+        hooks["pre find"].call(fast);
+        hooks["post find"].call(fast);
+        const query = machines.find({ uuid: "nagato" });
+        hooks["pre find"].call(query);
+        await new Promise((resolve) => setTimeout(resolve, 30));
+        hooks["post find"].call(query);
+      } finally {
+        Logger.warn = warn;
+        query_limits.slow = slow;
+      }
+      expect(logged).to.have.lengthOf(1);
+      expect(logged[0]).to.match(/^Slow find on machines took \d+ms, the limit is 20ms$/);
+    });
+  });
+});
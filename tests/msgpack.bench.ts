@@ -0,0 +1,42 @@
+import { encodeMsgpack } from "../src/utils/msgpack";
+import { parseData } from "../src/utils/ws";
+
+/**
+ * Compares decoding a stats frame sent as JSON and as MessagePack, run it with `npm run bench`
+ */
+const ITERATIONS = 50_000;
+// Roughly what a reporter on a server with a few disks, interfaces and its top processes sends every second
+const frame = {
+  e: "dynamic-data",
+  d: {
+    cpu: { usage: [12, 40, 3, 7, 88, 15, 22, 9], freq: Array(8).fill(3600) },
+    ram: { total: 34359738368, used: 12884901888 },
+    swap: { total: 8589934592, used: 0 },
+    disks: ["/", "/home", "/var", "/boot"].map((mount, i) => ({
+      fs: `/dev/nvme0n1p${i + 1}`,
+      mount,
+      type: "ext4",
+      total: 512110190592,
+      used: 128027547648 + i,
+    })),
+    process_count: 412,
+    processes: Array.from({ length: 10 }, (_, pid) => ({ pid, name: `process-${pid}`, cpu: pid * 1.5, ram: pid * 4096 })),
+    temps: [{ label: "cpu", value: 54.5 }],
+    network: ["eth0", "eth1", "docker0", "lo"].map((n) => ({ n, tx: 1048576.5, rx: 2097152.25, s: 1000 })),
+    host_uptime: 8640000,
+    reporter_uptime: 86400,
+  },
+};
+
+const run = (message: Buffer, encoding: "json" | "msgpack") => {
+  const startedAt = process.hrtime.bigint();
+  for (let i = 0; i < ITERATIONS; i++) parseData(message, encoding);
+  return Number(process.hrtime.bigint() - startedAt) / ITERATIONS;
+};
+
+const json = Buffer.from(JSON.stringify(frame));
+const msgpack = encodeMsgpack(frame);
+run(json, "json"); // warm up
+run(msgpack, "msgpack");
+console.log(`json:    ${json.length} bytes, ${run(json, "json").toFixed(0)}ns/frame`);
+console.log(`msgpack: ${msgpack.length} bytes, ${run(msgpack, "msgpack").toFixed(0)}ns/frame`);
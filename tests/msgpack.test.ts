@@ -0,0 +1,60 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import { decodeMsgpack, encodeMsgpack, MsgpackError } from "../src/utils/msgpack";
+
+const roundtrip = (value: unknown) => decodeMsgpack(encodeMsgpack(value));
+
+describe("MessagePack", () => {
+  describe("encodeMsgpack()", () => {
+    it("uses the smallest type every value fits in", () => {
+      expect(encodeMsgpack(1)).to.deep.equal(Buffer.from([0x01]));
+      expect(encodeMsgpack(-1)).to.deep.equal(Buffer.from([0xff]));
+      expect(encodeMsgpack(200)).to.deep.equal(Buffer.from([0xcc, 200]));
+      expect(encodeMsgpack(0.5)).to.deep.equal(Buffer.from([0xcb, 0x3f, 0xe0, 0, 0, 0, 0, 0, 0]));
+      expect(encodeMsgpack("a".repeat(31))[0]).to.equal(0xbf);
+      expect(encodeMsgpack("a".repeat(32))[0]).to.equal(0xd9);
+      expect(encodeMsgpack({ a: [true, null] })).to.deep.equal(Buffer.from([0x81, 0xa1, 0x61, 0x92, 0xc3, 0xc0]));
+    });
+
+    it("leaves out undefined properties like JSON", () => {
+      expect(encodeMsgpack({ a: undefined, b: 1 })).to.deep.equal(encodeMsgpack({ b: 1 }));
+    });
+  });
+
+  describe("decodeMsgpack()", () => {
+    it("decodes what's encoded back to the same value", () => {
+      const numbers = [0, 127, 128, 65535, 65536, 2 ** 32, 2 ** 40, -32, -33, -129, -40000, -(2 ** 40), 0.1, -2.5];
+      const value = { numbers, text: "é".repeat(40), long: "x".repeat(70000), list: Array(20).fill(1), nested: { a: {} } };
+      expect(roundtrip(value)).to.deep.equal(value);
+      expect(roundtrip([Number.MAX_SAFE_INTEGER, Number.MIN_SAFE_INTEGER])).to.deep.equal([
+        Number.MAX_SAFE_INTEGER,
+        Number.MIN_SAFE_INTEGER,
+      ]);
+    });
+
+    it("decodes the float32 other encoders use for small floats", () => {
+      expect(decodeMsgpack(Buffer.from([0xca, 0x3f, 0xc0, 0, 0]))).to.equal(1.5);
+    });
+
+    it("rejects frames that are cut short or have more after the value", () => {
+      for (const bytes of [[0x92, 0x01], [0xd9, 0x05, 0x61], [0xdd, 0xff, 0xff, 0xff, 0xff], [0x01, 0x02]])
+        expect(() => decodeMsgpack(Buffer.from(bytes))).to.throw(MsgpackError);
+    });
+
+    it("rejects what the frames never use", () => {
+      expect(() => decodeMsgpack(Buffer.from([0xc1]))).to.throw(MsgpackError);
+      expect(() => decodeMsgpack(Buffer.from([0xd4, 0x01, 0x00]))).to.throw(MsgpackError);
+      expect(() => decodeMsgpack(Buffer.from([0x81, 0x01, 0x02]))).to.throw(MsgpackError);
+    });
+
+    it("rejects values nested deep enough to blow the stack", () => {
+      expect(() => decodeMsgpack(Buffer.alloc(100_000, 0x91))).to.throw(MsgpackError);
+    });
+
+    it("doesn't let a __proto__ key change the prototype", () => {
+      const decoded = roundtrip(JSON.parse('{"__proto__": {"is_admin": true}}')) as any;
+      expect(Object.getPrototypeOf(decoded)).to.equal(Object.prototype);
+      expect(decoded.is_admin).to.be.undefined;
+    });
+  });
+});
@@ -0,0 +1,109 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import Joi from "joi";
+import request from "supertest";
+import { WebsocketManager } from "../src/classes/websocketManager.class";
+import { Config } from "../src/config";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import { V1_DOCS } from "../src/routes/v1/docs";
+import { V1 } from "../src/routes/v1/v1";
+import { Mailer } from "../src/utils/mailer";
+import { joiSchema, listRoutes, routeKey } from "../src/utils/openapi";
+import { Validators } from "../src/validators";
+
+describe("OpenAPI", () => {
+  describe("listRoutes()", () => {
+    const router = express.Router().get(["/", "/all"], () => {});
+    router.use("/machines", express.Router().get("/", () => {}).delete("/:uuid", () => {}));
+
+    it("lists the routes of mounted routers under where they're mounted", () => {
+      const routes = listRoutes(router).map((route) => [routeKey(route), route.aliases]);
+      expect(routes).to.deep.equal([
+        ["GET /", ["/all"]],
+        ["GET /machines", []],
+        ["DELETE /machines/:uuid", []],
+      ]);
+    });
+  });
+
+  describe("joiSchema()", () => {
+    it("keeps the types, limits and required fields", () => {
+      const schema = joiSchema(Validators.SIGNUP_BODY);
+      expect(schema.type).to.equal("object");
+      expect(schema.required).to.include.members(["username", "email", "password"]);
+      expect(schema.properties.email).to.include({ type: "string", format: "email" });
+    });
+
+    it("lists the allowed values and the old names of renamed fields", () => {
+      expect(joiSchema(Joi.string().valid("a", "b"))).to.deep.equal({ type: "string", enum: ["a", "b"] });
+      expect(joiSchema(Validators.PASSWORD_RESET_BODY).properties.password).to.include({ minLength: 8, deprecated: true });
+    });
+  });
+
+  describe("V1", () => {
+    const config = {
+      jwt: { secret: "secret", expiration: "15m" },
+      limits: { json_body: 1024, upload: 1024, profile_image: 1024 },
+    } as Config;
+    const v1 = new V1({} as DatabaseManager, {} as WebsocketManager, {} as Mailer, config);
+    const spec: any = v1.openapi();
+
+    it("documents every registered route", () => {
+      const registered = listRoutes(v1.router).map(routeKey);
+      expect(registered.filter((route) => !V1_DOCS[route]), "registered without docs").to.be.empty;
+      expect(Object.keys(V1_DOCS).filter((route) => !registered.includes(route)), "docs without a route").to.be.empty;
+    });
+
+    it("describes the auth, params and bodies of the routes", () => {
+      expect(spec.paths["/v1/users/@me"].get.security).to.deep.equal([{ user: [] }]);
+      expect(spec.paths["/v1/users/@login"].post.security).to.be.undefined;
+      expect(spec.paths["/v1/users/{uuid}"].get.parameters[0]).to.include({ name: "uuid", in: "path", required: true });
+      expect(spec.paths["/v1/users/@signup"].post.requestBody.content["application/json"].schema.required).to.include(
+        "password"
+      );
+      expect(spec.paths["/v1/users/@signup"].post.responses).to.have.keys(["201", "400", "409", "422", "429", "default"]);
+      expect(spec.paths["/v1/users/@verify"].get.parameters[0]).to.include({ name: "token", in: "query", required: true });
+      expect(spec.paths["/v1/users/@avatar"].put.requestBody.content).to.have.property("multipart/form-data");
+      expect(spec.paths["/v1/users"].get.responses).to.have.property("403");
+      expect(spec.paths["/v1/users/@me"].get.tags).to.deep.equal(["users"]);
+      const signup_params = spec.paths["/v1/users/@signup"].post.parameters.map((param: any) => param.name);
+      expect(signup_params).to.deep.equal(["Idempotency-Key"]);
+      expect(spec.paths["/healthz"].get.tags).to.deep.equal(["healthz"]);
+    });
+
+    it("marks aliases as deprecated", () => {
+      expect(spec.paths["/v1/users/uuid/{uuid}"].get.deprecated).to.be.true;
+      expect(spec.paths["/v1/users/{uuid}"].get.deprecated).to.be.undefined;
+    });
+
+    it("serves the spec and the page that renders it", async () => {
+      const app = express().use(v1.router);
+      const { body } = await request(app).get("/openapi.json").expect(200);
+      expect(body.components.schemas.Error.properties.error.required).to.deep.equal(["code", "message", "status"]);
+      await request(app).get("/docs").expect(200).expect("Content-Type", /html/).expect(/openapi\.json/);
+    });
+  });
+
+  describe("prefix", () => {
+    const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+    const app = (legacy_routes?: boolean) =>
+      express().use(new V1({} as DatabaseManager, {} as WebsocketManager, {} as Mailer, { ...config, legacy_routes }).router);
+
+    it("serves the API under /v1 and without it while the legacy routes are on", async () => {
+      const versioned = await request(app(true)).get("/v1/users/@me").expect(401);
+      expect(versioned.headers).to.not.have.property("deprecation");
+      const legacy = await request(app(true)).get("/users/@me").expect(401);
+      expect(legacy.headers).to.include({ deprecation: "true", link: '</v1/users/@me>; rel="successor-version"' });
+    });
+
+    it("only serves it under /v1 once they're off", async () => {
+      await request(app(false)).get("/v1/users/@me").expect(401);
+      await request(app(false)).get("/users/@me").expect(404);
+    });
+
+    it("keeps the probes where they were", async () => {
+      await request(app(false)).get("/healthz").expect(200);
+    });
+  });
+});
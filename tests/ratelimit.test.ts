@@ -0,0 +1,102 @@
+import { describe, it, beforeEach } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import request from "supertest";
+import { RateLimiter } from "../src/classes/rateLimiter.class";
+import { client_ip, init_rate_limit } from "../src/middleware/ratelimit";
+import { Time } from "../src/types";
+
+const hit = async (limiter: RateLimiter, times: number, now: number) => {
+  for (let i = 0; i < times; i++) await limiter.consume("geoxor", now);
+};
+
+describe("RateLimiter", () => {
+  let limiter: RateLimiter;
+  beforeEach(() => (limiter = new RateLimiter(5, Time.Minute)));
+
+  it("allows requests up to the limit", async () => {
+    await hit(limiter, 5, 0);
+    const { allowed, remaining, retryAfter } = await limiter.consume("geoxor", 0);
+    expect(allowed).to.be.false;
+    expect(remaining).to.equal(0);
+    expect(retryAfter).to.equal(Time.Minute);
+  });
+
+  it("keeps keys separate", async () => {
+    await hit(limiter, 5, 0);
+    expect((await limiter.consume("niko", 0)).allowed).to.be.true;
+  });
+
+  it("carries the previous window over weighted by how much of it overlaps", async () => {
+    await hit(limiter, 5, 0);
+    // Halfway into the next window half of the previous 5 hits still count
+    expect((await limiter.consume("geoxor", Time.Minute + Time.Minute / 2)).remaining).to.equal(1);
+    expect((await limiter.consume("geoxor", Time.Minute + Time.Minute / 2)).allowed).to.be.true;
+    expect((await limiter.consume("geoxor", Time.Minute + Time.Minute / 2)).allowed).to.be.false;
+  });
+
+  it("forgets windows older than the previous one", async () => {
+    await hit(limiter, 5, 0);
+    const { allowed, remaining } = await limiter.consume("geoxor", 2 * Time.Minute);
+    expect(allowed).to.be.true;
+    expect(remaining).to.equal(4);
+  });
+
+  it("resets at the end of the window", async () => {
+    const { reset } = await limiter.consume("geoxor", Time.Minute + 10);
+    expect(reset).to.equal(2 * Time.Minute);
+  });
+
+  it("can reset a key", async () => {
+    await hit(limiter, 6, 0);
+    await limiter.reset("geoxor");
+    expect((await limiter.consume("geoxor", 0)).allowed).to.be.true;
+  });
+});
+
+describe("client_ip()", () => {
+  const req = (headers: { [key: string]: string }) => ({ headers, socket: { remoteAddress: "10.0.0.1" } } as any);
+
+  it("prefers Fly-Client-IP", () => {
+    expect(client_ip(req({ "fly-client-ip": "1.1.1.1", "x-forwarded-for": "8.8.8.8" }))).to.equal("1.1.1.1");
+  });
+
+  it("only trusts the entries our proxies appended", () => {
+    expect(client_ip(req({ "x-forwarded-for": "6.6.6.6, 1.1.1.1" }), 1)).to.equal("1.1.1.1");
+    expect(client_ip(req({ "x-forwarded-for": "6.6.6.6, 1.1.1.1, 10.0.0.2" }), 2)).to.equal("1.1.1.1");
+  });
+
+  it("falls back to the socket", () => {
+    expect(client_ip(req({}))).to.equal("10.0.0.1");
+  });
+});
+
+describe("init_rate_limit()", () => {
+  const limit = init_rate_limit(2);
+  const app = express().get("/", limit, (_, res) => res.send());
+  beforeEach(() => limit.limiter.reset("ip:1.1.1.1"));
+
+  it("sets the X-RateLimit headers", async () => {
+    const res = await request(app).get("/").set("fly-client-ip", "1.1.1.1").expect(200);
+    expect(res.headers["x-ratelimit-limit"]).to.equal("2");
+    expect(res.headers["x-ratelimit-remaining"]).to.equal("1");
+    expect(res.headers["x-ratelimit-reset"]).to.match(/^\d+$/);
+  });
+
+  it("responds with 429 and Retry-After when exceeded", async () => {
+    await request(app).get("/").set("fly-client-ip", "1.1.1.1").expect(200);
+    await request(app).get("/").set("fly-client-ip", "1.1.1.1").expect(200);
+    const res = await request(app).get("/").set("fly-client-ip", "1.1.1.1").expect(429);
+    expect(res.headers["retry-after"]).to.match(/^\d+$/);
+    expect(res.body.error.code).to.equal("rate.limited");
+    await request(app).get("/").set("fly-client-ip", "8.8.8.8").expect(200);
+  });
+
+  it("can limit by something other than the client", async () => {
+    const by_token = init_rate_limit(1, Time.Minute, undefined, (req) => `share:${req.params.token}`);
+    const app = express().get("/:token", by_token, (_, res) => res.send());
+    await request(app).get("/a").set("fly-client-ip", "1.1.1.1").expect(200);
+    await request(app).get("/a").set("fly-client-ip", "8.8.8.8").expect(429);
+    await request(app).get("/b").set("fly-client-ip", "8.8.8.8").expect(200);
+  });
+});
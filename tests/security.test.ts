@@ -0,0 +1,23 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import request from "supertest";
+import { init_security_headers } from "../src/middleware/security";
+
+const app = (hsts: boolean) =>
+  express()
+    .use(init_security_headers(hsts))
+    .get("/users/@me", (_, res) => res.send());
+
+describe("Security headers", () => {
+  it("sets the standard headers", async () => {
+    const res = await request(app(false)).get("/users/@me").expect(200);
+    expect(res.headers).to.include({ "x-content-type-options": "nosniff", "x-frame-options": "DENY" });
+  });
+
+  it("only sends HSTS when enabled", async () => {
+    const [on, off] = await Promise.all([request(app(true)).get("/users/@me"), request(app(false)).get("/users/@me")]);
+    expect(on.headers["strict-transport-security"]).to.contain("max-age=31536000");
+    expect(off.headers).to.not.have.property("strict-transport-security");
+  });
+});
@@ -0,0 +1,57 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import {
+  format_refresh_token,
+  generate_refresh_secret,
+  hash_refresh_secret,
+  parse_refresh_token,
+  sessions,
+  sessionSchema,
+} from "../src/database/schemas/session";
+
+describe("Session", () => {
+  describe("indexes", () => {
+    it("lets mongo delete sessions once they expire", () => {
+      const ttl = sessionSchema.indexes().find(([fields]) => Object.keys(fields).join() === "expires_at");
+      expect(ttl?.[1]).to.include({ expireAfterSeconds: 0 });
+    });
+  });
+
+  describe("toJSON()", () => {
+    const serialized = JSON.parse(
+      JSON.stringify(new sessions({ user_uuid: "geoxor", refresh_hash: hash_refresh_secret("secret"), agent: "curl" }))
+    );
+
+    it("should not contain the refresh hash, _id or __v", () => {
+      expect(serialized).to.not.have.any.keys("refresh_hash", "_id", "__v");
+    });
+
+    it("should contain the device", () => {
+      expect(serialized).to.include({ user_uuid: "geoxor", agent: "curl" });
+    });
+  });
+
+  describe("hash_refresh_secret()", () => {
+    it("is deterministic and doesn't contain the secret", () => {
+      const secret = generate_refresh_secret();
+      expect(hash_refresh_secret(secret)).to.equal(hash_refresh_secret(secret)).and.to.not.contain(secret);
+    });
+
+    it("hashes different secrets differently", () => {
+      expect(hash_refresh_secret(generate_refresh_secret())).to.not.equal(hash_refresh_secret(generate_refresh_secret()));
+    });
+  });
+
+  describe("parse_refresh_token()", () => {
+    it("gets back what format_refresh_token() joined", () => {
+      const token = format_refresh_token("8bb3cf50-077a-4586-8567-58f596504a0e", "abc");
+      expect(parse_refresh_token(token)).to.deep.equal({ session_uuid: "8bb3cf50-077a-4586-8567-58f596504a0e", secret: "abc" });
+    });
+
+    it("rejects anything that isn't a refresh token", () => {
+      for (const token of [undefined, 1, "", "abc", ".abc", "abc.", "a.b.c"]) {
+        expect(parse_refresh_token(token)).to.be.undefined;
+      }
+    });
+  });
+});
@@ -0,0 +1,146 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import express from "express";
+import request from "supertest";
+import { WebsocketManager } from "../src/classes/websocketManager.class";
+import { Config } from "../src/config";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import { IComputedDynamicData, MachineStatus } from "../src/database/schemas/machine";
+import {
+  generate_share_token,
+  public_machine,
+  public_stats,
+  SHARE_TOKEN_PATTERN,
+  shareLinkSchema,
+} from "../src/database/schemas/shareLink";
+import { V1 } from "../src/routes/v1/v1";
+import { Mailer } from "../src/utils/mailer";
+
+const stats = {
+  uuid: "mirai",
+  timestamp: 1000,
+  cau: 42,
+  cpu: { usage: [40, 44], freq: [3600, 3600] },
+  ram: { used: 2, total: 8 },
+  swap: { used: 0, total: 2 },
+  disks: [{ fs: "/dev/nvme0n1p2", mount: "/" }],
+  network: [{ n: "eth0", tx: 1, rx: 2, s: 1000 }],
+  process_count: 300,
+  host_uptime: 86400,
+  reporter_uptime: 60,
+} as unknown as IComputedDynamicData;
+
+const machine = {
+  uuid: "8bb3cf50-077a-4586-8567-58f596504a0e",
+  name: "mirai",
+  status: MachineStatus.Online,
+  last_seen: Date.now(),
+  static_data: { hostname: "mirai.xornet.cloud" },
+  network: { ip: "203.0.113.7" },
+} as any;
+
+// A stream that only remembers whether it was ended
+const stream = () => {
+  const callbacks: (() => void)[] = [];
+  return {
+    closed: false,
+    onClose: (callback: () => void) => callbacks.push(callback),
+    close() {
+      this.closed = true;
+      callbacks.forEach((callback) => callback());
+    },
+  };
+};
+
+describe("Share links", () => {
+  describe("generate_share_token()", () => {
+    it("generates tokens the public routes accept", () => {
+      expect(generate_share_token()).to.match(SHARE_TOKEN_PATTERN);
+      expect(generate_share_token()).to.not.equal(generate_share_token());
+    });
+  });
+
+  describe("indexes", () => {
+    it("deletes the links once they expire", () => {
+      const ttl = shareLinkSchema.indexes().find(([fields]) => Object.keys(fields).join() === "expires_at");
+      expect(ttl?.[1]).to.have.property("expireAfterSeconds", 0);
+    });
+  });
+
+  describe("public_stats()", () => {
+    it("only lets the CPU, RAM and uptime through", () => {
+      expect(public_stats(stats)).to.deep.equal({ timestamp: 1000, cau: 42, ram: { used: 2, total: 8 }, host_uptime: 86400 });
+    });
+  });
+
+  describe("public_machine()", () => {
+    it("hides the host of the machine unless the owner opted into showing it", () => {
+      const hidden = public_machine(machine, { expose_host: false }, stats);
+      expect(hidden).to.not.have.any.keys("name", "hostname", "ip");
+      expect(hidden).to.include({ uuid: machine.uuid, status: "online" });
+      expect(hidden.stats).to.deep.equal(public_stats(stats));
+      const shown = public_machine(machine, { expose_host: true });
+      expect(shown).to.include({ name: "mirai", hostname: "mirai.xornet.cloud", ip: "203.0.113.7" });
+      expect(shown.stats).to.be.undefined;
+    });
+  });
+
+  describe("active_share_links()", () => {
+    it("leaves out the links that expired but weren't deleted yet", () => {
+      const filter = DatabaseManager.active_share_links({ token: "abc" }, 1000);
+      expect(filter).to.deep.equal({
+        token: "abc",
+        $or: [{ expires_at: { $exists: false } }, { expires_at: { $gt: new Date(1000) } }],
+      });
+    });
+  });
+
+  describe("watchShare()", () => {
+    const manager = () => ({ shareStreams: new Map() } as any);
+
+    it("ends every stream of a link once it's revoked", () => {
+      const websocketManager = manager();
+      const [first, second, other] = [stream(), stream(), stream()];
+      WebsocketManager.prototype.watchShare.call(websocketManager, { uuid: "a" }, first as any);
+      WebsocketManager.prototype.watchShare.call(websocketManager, { uuid: "a" }, second as any);
+      WebsocketManager.prototype.watchShare.call(websocketManager, { uuid: "b" }, other as any);
+      WebsocketManager.prototype.handleSharesRevoked.call(websocketManager, ["a"]);
+      expect([first.closed, second.closed, other.closed]).to.deep.equal([true, true, false]);
+      expect([...websocketManager.shareStreams.keys()]).to.deep.equal(["b"]);
+    });
+
+    it("ends the stream once the link expires", async () => {
+      const expiring = stream();
+      const expires_at = new Date(Date.now() + 20);
+      WebsocketManager.prototype.watchShare.call(manager(), { uuid: "a", expires_at }, expiring as any);
+      expect(expiring.closed).to.be.false;
+      await new Promise((resolve) => setTimeout(resolve, 40));
+      expect(expiring.closed).to.be.true;
+    });
+  });
+
+  describe("GET /public/machines/:token", () => {
+    const token = generate_share_token();
+    const db = {
+      find_share_link: async (value: string) =>
+        value === token ? { uuid: "a", machine_uuid: machine.uuid, expose_host: false } : Promise.reject("shareLink.notFound"),
+      find_shared_machine: async (link: { expose_host: boolean }) => public_machine(machine, link),
+    };
+    const websocketManager = { snapshot: () => ({ [machine.uuid]: stats }) } as unknown as WebsocketManager;
+    const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+    const app = express().use(new V1(db as any, websocketManager, {} as Mailer, config).router);
+
+    it("shows the public stats of the machine without logging in", async () => {
+      const { body, headers } = await request(app).get(`/public/machines/${token}`).expect(200);
+      expect(body.stats).to.deep.equal(public_stats(stats));
+      expect(body).to.not.have.any.keys("name", "hostname", "ip");
+      expect(headers["x-ratelimit-limit"]).to.equal("120");
+    });
+
+    it("answers revoked and malformed tokens the same way", async () => {
+      const revoked = await request(app).get(`/public/machines/${generate_share_token()}`).expect(404);
+      const malformed = await request(app).get("/public/machines/nope").expect(404);
+      expect(revoked.body.error.code).to.equal(malformed.body.error.code).and.equal("shareLink.notFound");
+    });
+  });
+});
@@ -0,0 +1,26 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import { generate_signup_key, signupKeySchema } from "../src/database/schemas/signupKey";
+
+describe("Signup keys", () => {
+  describe("generate_signup_key()", () => {
+    it("generates 32 uppercase hex characters", () => {
+      expect(generate_signup_key()).to.match(/^[0-9A-F]{32}$/);
+    });
+
+    it("never generates the same key twice", () => {
+      expect(generate_signup_key()).to.not.equal(generate_signup_key());
+    });
+  });
+
+  describe("indexes", () => {
+    it("keeps expired keys around for a while so they can be told apart from invalid ones", () => {
+      const ttl = signupKeySchema.indexes().find(([fields]) => Object.keys(fields).join() === "expires_at");
+      expect(ttl?.[1]).to.have.property("expireAfterSeconds").that.is.above(0);
+    });
+
+    it("looks keys up by their value", () => {
+      expect(signupKeySchema.path("key").options).to.include({ unique: true });
+    });
+  });
+});
@@ -0,0 +1,90 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import { EventEmitter } from "events";
+import { Request, Response } from "express";
+import { MachineHub } from "../src/classes/machineHub.class";
+import { SseConnection } from "../src/utils/sse";
+
+/**
+ * A response that keeps what was written to it
+ */
+class FakeResponse extends EventEmitter {
+  public headers: { [name: string]: string } = {};
+  public written: string[] = [];
+  public flushed = 0;
+  public ended = false;
+
+  status() {
+    return this;
+  }
+  set(headers: { [name: string]: string }) {
+    Object.assign(this.headers, headers);
+    return this;
+  }
+  flushHeaders() {}
+  write(chunk: string) {
+    this.written.push(chunk);
+  }
+  flush() {
+    this.flushed++;
+  }
+  end() {
+    this.ended = true;
+  }
+}
+
+const stream = (last_event_id?: string) => {
+  const res = new FakeResponse();
+  const req = { header: (name: string) => (name === "Last-Event-ID" ? last_event_id : undefined) } as Request;
+  const connection = new SseConnection<any>(req, res as unknown as Response, { "dynamic-data": "stats" }, (data: any) =>
+    data?.uuid === "mirai"
+  );
+  return { res, connection };
+};
+
+describe("SseConnection", () => {
+  it("opens an event stream that tells browsers when to reconnect", () => {
+    const { res, connection } = stream();
+    expect(res.headers["Content-Type"]).to.equal("text/event-stream");
+    expect(res.headers["Cache-Control"]).to.equal("no-cache");
+    expect(res.written[0]).to.match(/^retry: \d+\n\n$/);
+    connection.close();
+  });
+
+  it("sends the hub events it streams with ids that count up and flushes every one", () => {
+    const { res, connection } = stream();
+    connection.emit("dynamic-data", { uuid: "mirai", cpu: 1 });
+    connection.emit("dynamic-data", { uuid: "nagato", cpu: 2 });
+    connection.emit("machine-added", { uuid: "mirai" });
+    connection.emit("dynamic-data", { uuid: "mirai", cpu: 3 });
+    expect(res.written.slice(1)).to.deep.equal([
+      'id: 1\nevent: stats\ndata: {"uuid":"mirai","cpu":1}\n\n',
+      'id: 2\nevent: stats\ndata: {"uuid":"mirai","cpu":3}\n\n',
+    ]);
+    expect(res.flushed).to.equal(res.written.length);
+    connection.close();
+  });
+
+  it("resumes the ids from the Last-Event-ID", () => {
+    const { res, connection } = stream("41");
+    connection.send("stats", { uuid: "mirai" });
+    expect(res.written[1]).to.match(/^id: 42\n/);
+    connection.close();
+    const garbled = stream("nope").connection;
+    expect(garbled.lastEventId).to.equal(0);
+    garbled.close();
+  });
+
+  it("leaves the hub and stops writing once the client disconnects", () => {
+    const hub = new MachineHub<any>();
+    const { res, connection } = stream();
+    hub.register(connection, "geoxor", ["mirai"]);
+    expect(hub.size).to.equal(1);
+    res.emit("close");
+    expect(hub.size).to.equal(0);
+    expect(res.ended).to.be.true;
+    const written = res.written.length;
+    connection.send("stats", { uuid: "mirai" });
+    expect(res.written).to.have.lengthOf(written);
+  });
+});
@@ -0,0 +1,151 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import { statRollupSchema, statSchema, STATS_RAW_RETENTION } from "../src/database/schemas/stats";
+import { MAX_STATS_POINTS } from "../src/logic";
+import { Time } from "../src/types";
+
+describe("Stats", () => {
+  describe("index", () => {
+    it("covers ranges of a single machine", () => {
+      const index = statSchema.indexes().find((index: any) => index[0].machine_uuid === 1);
+      expect(index?.[0]).to.deep.equal({ machine_uuid: 1, timestamp: 1 });
+    });
+
+    it("expires the raw points and the rollups", () => {
+      const ttl = (indexes: any[]) => indexes.find((index) => index[1].expireAfterSeconds)?.[1].expireAfterSeconds;
+      expect(ttl(statSchema.indexes())).to.equal(STATS_RAW_RETENTION / Time.Second);
+      expect(ttl(statRollupSchema.indexes())).to.equal((30 * Time.Day) / Time.Second);
+    });
+  });
+
+  describe("stats_history_pipeline()", () => {
+    const range = { from: 0, to: Time.Hour, resolution: 5 * Time.Minute };
+    const pipeline = DatabaseManager.stats_history_pipeline("8bb3cf50-077a-4586-8567-58f596504a0e", range) as any[];
+
+    it("only matches the machine within the range", () => {
+      expect(pipeline[0]).to.deep.equal({
+        $match: {
+          machine_uuid: "8bb3cf50-077a-4586-8567-58f596504a0e",
+          timestamp: { $gte: new Date(0), $lt: new Date(Time.Hour) },
+        },
+      });
+    });
+
+    it("buckets by the resolution and averages every field", () => {
+      const { _id, cpu, ram_used } = pipeline[1].$group;
+      expect(_id).to.deep.equal({
+        $subtract: [{ $toLong: "$timestamp" }, { $mod: [{ $toLong: "$timestamp" }, 5 * Time.Minute] }],
+      });
+      expect(cpu).to.deep.equal({ $avg: "$cpu" });
+      expect(ram_used).to.deep.equal({ $avg: "$ram_used" });
+    });
+
+    it("sorts the buckets and caps how many are returned", () => {
+      expect(pipeline[2]).to.deep.equal({ $sort: { _id: 1 } });
+      expect(pipeline[3]).to.deep.equal({ $limit: MAX_STATS_POINTS });
+      expect(pipeline[4].$project).to.include({ _id: 0, timestamp: "$_id" });
+    });
+  });
+
+  describe("stats_source()", () => {
+    const now = 100 * Time.Day;
+
+    it("reads recent ranges from the raw points", () => {
+      const range = { from: now - Time.Hour, to: now, resolution: Time.Minute };
+      expect(DatabaseManager.stats_source(range, STATS_RAW_RETENTION, now)).to.deep.equal({ range, rollups: false });
+    });
+
+    it("reads older ranges from the rollups at a resolution of at least an hour", () => {
+      const range = { from: now - 7 * Time.Day, to: now, resolution: 90 * Time.Minute };
+      const source = DatabaseManager.stats_source(range, STATS_RAW_RETENTION, now);
+      expect(source.rollups).to.be.true;
+      expect(source.range.resolution).to.equal(2 * Time.Hour);
+    });
+
+    it("keeps reading from the raw points for as long as they're kept", () => {
+      const range = { from: now - 7 * Time.Day, to: now, resolution: Time.Minute };
+      expect(DatabaseManager.stats_source(range, 14 * Time.Day, now)).to.deep.equal({ range, rollups: false });
+    });
+  });
+
+  describe("stats_metric_pipeline()", () => {
+    const range = { from: 0, to: Time.Day, resolution: Time.Hour };
+
+    it("gets the average, minimum and maximum of the raw points", () => {
+      const pipeline = DatabaseManager.stats_metric_pipeline("uuid", "cpu", range) as any[];
+      const { _id, ...accumulators } = pipeline[1].$group;
+      expect(accumulators).to.deep.equal({ avg: { $avg: "$cpu" }, min: { $min: "$cpu" }, max: { $max: "$cpu" } });
+    });
+
+    it("weights the rollups by how many points went into them", () => {
+      const pipeline = DatabaseManager.stats_metric_pipeline("uuid", "cpu", range, true) as any[];
+      expect(pipeline[1].$group.sum).to.deep.equal({ $sum: "$values.cpu.sum" });
+      expect(pipeline[1].$group.count).to.deep.equal({ $sum: "$count" });
+      expect(pipeline[4].$project.avg).to.deep.equal({ $divide: ["$sum", "$count"] });
+    });
+  });
+
+  describe("stats_rollup_pipeline()", () => {
+    const pipeline = DatabaseManager.stats_rollup_pipeline(0, 2 * Time.Hour, "statrollups") as any[];
+
+    it("groups every machine by the hour", () => {
+      expect(pipeline[1].$group._id.machine_uuid).to.equal("$machine_uuid");
+      expect(pipeline[1].$group._id.timestamp.$subtract[1].$mod[1]).to.equal(Time.Hour);
+      expect(pipeline[1].$group.cpu_sum).to.deep.equal({ $sum: "$cpu" });
+    });
+
+    it("replaces the rollups of hours that were already rolled up", () => {
+      expect(pipeline[3].$merge).to.deep.include({ into: "statrollups", whenMatched: "replace" });
+    });
+  });
+
+  describe("align_stats_histories()", () => {
+    const values = (cpu: number) => ({ cpu, ram_used: 1024, ping: 5 } as any);
+
+    it("lines up the buckets and fills the ones a machine missed with null", () => {
+      const points = DatabaseManager.align_stats_histories({
+        a: [{ timestamp: 2, ...values(20) }, { timestamp: 0, ...values(10) }],
+        b: [{ timestamp: 1, ...values(30) }],
+      });
+      expect(points.map((point) => point.timestamp)).to.deep.equal([0, 1, 2]);
+      expect(points[0].machines).to.deep.equal({ a: values(10), b: null });
+      expect(points[1].machines).to.deep.equal({ a: null, b: values(30) });
+    });
+
+    it("has no buckets when no machine reported", () => {
+      expect(DatabaseManager.align_stats_histories({ a: [], b: [] })).to.deep.equal([]);
+    });
+  });
+
+  describe("purge_stats_before()", () => {
+    const cutoff = new Date("2022-05-01T12:00:00Z");
+    // A collection of points a second before, at and a second after the cutoff
+    const collection = () => {
+      let points = [-1000, 0, 1000].map((offset) => ({ timestamp: new Date(cutoff.getTime() + offset) }));
+      return {
+        get points() {
+          return points;
+        },
+        deleteMany: async ({ timestamp }: any) => {
+          const before = points.length;
+          points = points.filter((point) => !(point.timestamp < timestamp.$lt));
+          return { deletedCount: before - points.length };
+        },
+      };
+    };
+
+    it("only deletes the points older than the cutoff", async () => {
+      const db = { stats: collection(), stat_rollups: collection() };
+      expect(await DatabaseManager.prototype.purge_stats_before.call(db as any, cutoff)).to.equal(1);
+      expect(db.stats.points.map((point) => point.timestamp.getTime() - cutoff.getTime())).to.deep.equal([0, 1000]);
+      expect(db.stat_rollups.points).to.have.lengthOf(3);
+    });
+
+    it("deletes the rollups instead when asked to", async () => {
+      const db = { stats: collection(), stat_rollups: collection() };
+      expect(await DatabaseManager.prototype.purge_stats_before.call(db as any, cutoff, true)).to.equal(1);
+      expect(db.stats.points).to.have.lengthOf(3);
+    });
+  });
+});
@@ -0,0 +1,900 @@
+import { beforeEach, describe, it } from "mocha";
+import { expect } from "chai";
+import bcrypt from "bcryptjs";
+import jwt from "jsonwebtoken";
+import express from "express";
+import request from "supertest";
+import { WebsocketManager } from "../src/classes/websocketManager.class";
+import { Config } from "../src/config";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import { MAX_EXPORT_AUDIT_ENTRIES } from "../src/database/schemas/auditLog";
+import {
+  ACCOUNT_DELETION_GRACE,
+  EMAIL_VERIFICATION_EXPIRATION,
+  sign_verification_token,
+  users,
+  userSchema,
+  verify_verification_token,
+} from "../src/database/schemas/user";
+import { format_refresh_token, hash_refresh_secret } from "../src/database/schemas/session";
+import { V1 } from "../src/routes/v1/v1";
+import { Mailer } from "../src/utils/mailer";
+import { Time } from "../src/types";
+import { v4 as uuidv4 } from "uuid";
+
+describe("User", () => {
+  const SENSITIVE_KEYS = ["password", "email", "login_history", "_id", "__v"];
+  const user = new users({
+    uuid: "8bb3cf50-077a-4586-8567-58f596504a0e",
+    username: "geoxor",
+    email: "geo@xornet.cloud",
+    password: "$2a$10$abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyza",
+    login_history: [{ agent: "curl", ip: "1.1.1.1", date: Date.now() }],
+    avatar: "https://i.imgur.com/avatar.png",
+  });
+
+  describe("to_public()", () => {
+    const serialized = JSON.parse(JSON.stringify(user.to_public()));
+
+    for (const key of SENSITIVE_KEYS) {
+      it(`should not contain ${key}`, () => {
+        expect(serialized).to.not.have.property(key);
+      });
+    }
+
+    it("should contain the public fields", () => {
+      expect(serialized).to.include({ uuid: user.uuid, username: "geoxor", avatar: "https://i.imgur.com/avatar.png" });
+    });
+  });
+
+  describe("to_private()", () => {
+    const serialized = JSON.parse(JSON.stringify(user.to_private()));
+
+    it("should contain the email and whether it's verified on top of the public fields", () => {
+      expect(serialized).to.deep.equal({
+        ...JSON.parse(JSON.stringify(user.to_public())),
+        email: "geo@xornet.cloud",
+        email_verified: false,
+        profile_visibility: "public",
+      });
+    });
+
+    for (const key of SENSITIVE_KEYS.filter((key) => key !== "email")) {
+      it(`should not contain ${key}`, () => {
+        expect(serialized).to.not.have.property(key);
+      });
+    }
+  });
+
+  describe("to_preview()", () => {
+    it("should not contain the email", () => {
+      expect(user.to_preview()).to.not.have.property("email");
+    });
+  });
+
+  describe("toJSON()", () => {
+    const serialized = JSON.parse(JSON.stringify(user));
+
+    for (const key of SENSITIVE_KEYS) {
+      it(`should not contain ${key}`, () => {
+        expect(serialized).to.not.have.property(key);
+      });
+    }
+  });
+
+  describe("is_token_current()", () => {
+    it("should accept tokens signed before token versions existed", () => {
+      expect(user.is_token_current({ username: "geoxor", uuid: user.uuid })).to.be.true;
+    });
+
+    it("should reject tokens signed before the password was changed", () => {
+      const changed = new users({ uuid: user.uuid, token_version: 2 });
+      expect(changed.is_token_current({ username: "geoxor", uuid: user.uuid, token_version: 1 })).to.be.false;
+      expect(changed.is_token_current({ username: "geoxor", uuid: user.uuid, token_version: 2 })).to.be.true;
+    });
+
+    it("should not leak the token version", () => {
+      expect(JSON.parse(JSON.stringify(user))).to.not.have.property("token_version");
+    });
+  });
+
+  describe("verification tokens", () => {
+    const payload = { uuid: user.uuid, email: user.email, nonce: "abc" };
+    const secret = "54rf6y7hjukiolp";
+
+    it("gets back the payload it was signed with", async () => {
+      expect(await verify_verification_token(sign_verification_token(payload, secret), secret)).to.include(payload);
+    });
+
+    it("rejects tokens signed with another secret", async () => {
+      const token = sign_verification_token(payload, "another secret");
+      expect(await verify_verification_token(token, secret).catch((error) => error)).to.equal("token.invalid");
+    });
+
+    it("rejects access tokens", async () => {
+      const token = jwt.sign({ username: "geoxor", uuid: user.uuid }, secret, { algorithm: "HS256" });
+      expect(await verify_verification_token(token, secret).catch((error) => error)).to.equal("token.invalid");
+    });
+
+    it("can't be used as an access token", () => {
+      expect(() => jwt.verify(sign_verification_token(payload, secret), secret, { algorithms: ["HS256"] })).to.throw();
+    });
+
+    it("rejects tokens once they expire", async () => {
+      const iat = Math.floor((Date.now() - EMAIL_VERIFICATION_EXPIRATION - Time.Minute) / Time.Second);
+      const token = sign_verification_token({ ...payload, iat } as typeof payload, secret);
+      expect(await verify_verification_token(token, secret).catch((error) => error)).to.equal("token.expired");
+    });
+
+    it("should not leak whether the email is verified or the nonce", () => {
+      const verifying = new users({ uuid: user.uuid, email_verified: true, verification_nonce: "abc" });
+      expect(JSON.parse(JSON.stringify(verifying))).to.not.have.any.keys("email_verified", "verification_nonce");
+    });
+  });
+
+  describe("is_deletion_cancellable()", () => {
+    const now = Date.now();
+    const deleted = (deleted_by: string, deleted_at: number) => new users({ uuid: user.uuid, deleted_by, deleted_at });
+
+    it("should be cancellable by the user during the grace period", () => {
+      expect(deleted(user.uuid, now - ACCOUNT_DELETION_GRACE + 1000).is_deletion_cancellable(now)).to.be.true;
+    });
+
+    it("should not be cancellable once the grace period is over", () => {
+      expect(deleted(user.uuid, now - ACCOUNT_DELETION_GRACE).is_deletion_cancellable(now)).to.be.false;
+    });
+
+    it("should not be cancellable when an admin deleted the user", () => {
+      expect(deleted("1c5b2b7e-5b0e-4c1f-9a3b-2f6f1f7f9d10", now).is_deletion_cancellable(now)).to.be.false;
+    });
+
+    it("should not be cancellable when the user isn't deleted", () => {
+      expect(user.is_deletion_cancellable(now)).to.be.false;
+    });
+  });
+
+  describe("is_visible_to()", () => {
+    const friend = uuidv4();
+    const requester = uuidv4();
+    const stranger = uuidv4();
+    const visible = (profile_visibility?: string) => {
+      const hidden = new users({
+        uuid: user.uuid,
+        profile_visibility,
+        friends: [
+          { uuid: friend, status: "accepted", incoming: false },
+          { uuid: requester, status: "pending", incoming: true },
+        ],
+      });
+      return [user.uuid, friend, requester, stranger].map((viewer) => hidden.is_visible_to(viewer));
+    };
+
+    it("should show public profiles to everyone", () => {
+      expect(visible("public")).to.deep.equal([true, true, true, true]);
+    });
+
+    it("should only show friends only profiles to accepted friends", () => {
+      expect(visible("friends")).to.deep.equal([true, true, false, false]);
+    });
+
+    it("should only show private profiles to the user themselves", () => {
+      expect(visible("private")).to.deep.equal([true, false, false, false]);
+    });
+
+    it("should treat users from before the setting as public", () => {
+      const old = new users({ uuid: user.uuid });
+      old.set("profile_visibility", undefined);
+      expect(old.is_visible_to(stranger)).to.be.true;
+    });
+
+    describe("GET /users/:uuid", () => {
+      const hidden = new users({
+        uuid: uuidv4(),
+        username: "nagato",
+        profile_visibility: "friends",
+        friends: [{ uuid: friend, status: "accepted", incoming: true }],
+      });
+      const db = {
+        // Whoever the token is for is logged in
+        users: { findOne: async ({ uuid }: { uuid: string }) => (uuid === hidden.uuid ? hidden : new users({ uuid })) },
+        find_user: async ({ uuid }: { uuid: string }) => (uuid === hidden.uuid ? hidden : Promise.reject("user.notFound")),
+        find_visible_user: DatabaseManager.prototype.find_visible_user,
+        find_public_user: DatabaseManager.prototype.find_public_user,
+      };
+      const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+      const app = express().use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+      const get = (viewer: string) =>
+        request(app)
+          .get(`/users/${hidden.uuid}`)
+          .set("Authorization", `Bearer ${jwt.sign({ uuid: viewer, username: "viewer", token_version: 0 }, "secret")}`);
+
+      it("should answer the users it's hidden from like it doesn't exist", async () => {
+        const { body } = await get(stranger).expect(404);
+        expect(body.error.code).to.equal("user.notFound");
+        await request(app)
+          .get(`/users/${hidden.uuid}/machines`)
+          .set("Authorization", `Bearer ${jwt.sign({ uuid: stranger, username: "viewer", token_version: 0 }, "secret")}`)
+          .expect(404);
+      });
+
+      it("should show it to the user themselves and their friends", async () => {
+        expect((await get(hidden.uuid).expect(200)).body).to.include({ uuid: hidden.uuid, username: "nagato" });
+        await get(friend).expect(200);
+      });
+    });
+  });
+
+  describe("purgeable_users_filter()", () => {
+    it("should only match users who deleted themselves before the grace period", () => {
+      const now = Date.now();
+      expect(DatabaseManager.purgeable_users_filter(now)).to.deep.equal({
+        deleted_at: { $lte: now - ACCOUNT_DELETION_GRACE },
+        $expr: { $eq: ["$deleted_by", "$uuid"] },
+      });
+    });
+  });
+
+  describe("search", () => {
+    it("should have an index on the lowercased username", () => {
+      expect(userSchema.indexes().some((index: any) => index[0].username_lower === 1)).to.be.true;
+    });
+
+    it("should filter with an anchored regex on the indexed field", () => {
+      const filter: any = DatabaseManager.user_search_filter("GeO");
+      expect(filter.username_lower.$regex).to.equal("^geo");
+      expect(filter.deleted_at).to.be.null;
+    });
+
+    it("should escape the query", () => {
+      const filter: any = DatabaseManager.user_search_filter(".*");
+      expect(filter.username_lower.$regex).to.equal("^\\.\\*");
+    });
+  });
+
+  describe("find_users_by_uuids()", () => {
+    const existing = ["8bb3cf50-077a-4586-8567-58f596504a0e", "1c5b2b7e-5b0e-4c1f-9a3b-2f6f1f7f9d10"];
+    let queried: string[] = [];
+    // Only the parts of the database find_users_by_uuids touches
+    const db = {
+      users: {
+        find: (filter: any) => {
+          queried = filter.uuid.$in;
+          const found = existing.filter((uuid) => queried.includes(uuid)).map((uuid) => new users({ uuid }));
+          return {
+            maxTimeMS() {
+              return this;
+            },
+            exec: async () => found,
+          };
+        },
+      },
+    };
+    const find = (uuids: string[]) => DatabaseManager.prototype.find_users_by_uuids.call(db as any, uuids);
+
+    it("leaves out the uuids that don't exist or aren't valid", async () => {
+      const found = await find([existing[0], "9d1b1a52-3f0e-4b8c-8f4e-6c0d8d3b2a11", "not-a-uuid", existing[1]]);
+      expect(found.map((user) => user.uuid)).to.have.members(existing);
+      expect(queried).to.not.include("not-a-uuid");
+    });
+
+    it("keeps the order the uuids were asked in", async () => {
+      const found = await find([existing[1], existing[0]]);
+      expect(found.map((user) => user.uuid)).to.deep.equal([existing[1], existing[0]]);
+    });
+
+    it("doesn't query for duplicates", async () => {
+      await find([existing[0], existing[0]]);
+      expect(queried).to.deep.equal([existing[0]]);
+    });
+
+    it("doesn't query at all without a valid uuid", async () => {
+      queried = [];
+      expect(await find(["not-a-uuid"])).to.deep.equal([]);
+      expect(queried).to.deep.equal([]);
+    });
+  });
+
+  describe("reset_password()", () => {
+    const secret = "8f1e2d3c4b5a";
+    let stored: { hash: string; expires_at: number } | undefined;
+    let revoked: string[] = [];
+    let audited: string[] = [];
+    // Only the parts of the database reset_password touches, the hash stands in for the user document
+    const db = {
+      users: {
+        findOneAndUpdate: async (filter: any) => {
+          if (filter.uuid !== user.uuid || !stored || filter["password_reset.hash"] !== stored.hash) return null;
+          const found = new users({ uuid: user.uuid, username: "geoxor", password_reset: stored });
+          stored = undefined;
+          return Object.assign(found, { save: async () => found });
+        },
+      },
+      sessions: { deleteMany: async ({ user_uuid }: any) => revoked.push(user_uuid) },
+      log_audit: (actor_uuid: string, action: string) => audited.push(action),
+    };
+    const reset = (token: string) =>
+      DatabaseManager.prototype.reset_password.call(db as any, token, "hunter2hunter2").catch((error) => error);
+    const request = (expires_at = Date.now() + Time.Minute) => (stored = { hash: hash_refresh_secret(secret), expires_at });
+
+    beforeEach(() => {
+      revoked = [];
+      audited = [];
+    });
+
+    it("sets the password, logs the user out everywhere and audits it", async () => {
+      request();
+      const updated = await reset(format_refresh_token(user.uuid, secret));
+      expect(updated.password).to.equal("hunter2hunter2");
+      expect(updated.token_version).to.equal(1);
+      expect(updated.password_reset?.hash).to.be.undefined;
+      expect(revoked).to.deep.equal([user.uuid]);
+      expect(audited).to.deep.equal(["user.password_reset"]);
+    });
+
+    it("rejects a token that was already used", async () => {
+      request();
+      await reset(format_refresh_token(user.uuid, secret));
+      expect(await reset(format_refresh_token(user.uuid, secret))).to.equal("token.invalid");
+    });
+
+    it("rejects a token once it expires", async () => {
+      request(Date.now() - Time.Second);
+      expect(await reset(format_refresh_token(user.uuid, secret))).to.equal("token.expired");
+      expect(revoked).to.be.empty;
+    });
+
+    it("rejects the token of another user", async () => {
+      request();
+      expect(await reset(format_refresh_token("1c5b2b7e-5b0e-4c1f-9a3b-2f6f1f7f9d10", secret))).to.equal("token.invalid");
+    });
+
+    it("rejects a token that was replaced by a newer one", async () => {
+      request();
+      stored = { hash: hash_refresh_secret("newer"), expires_at: Date.now() + Time.Minute };
+      expect(await reset(format_refresh_token(user.uuid, secret))).to.equal("token.invalid");
+    });
+
+    it("rejects anything that isn't a reset token", async () => {
+      expect(await reset("not a token")).to.equal("token.invalid");
+    });
+  });
+
+  describe("login_user()", () => {
+    let stored: string;
+    const db = (rounds: number) => ({
+      config: { bcrypt_rounds: rounds },
+      users: {
+        findOne: async (filter: any) =>
+          filter.username_lower === "geoxor" ? new users({ uuid: user.uuid, username: "Geoxor", password: stored }) : null,
+        updateOne: async (filter: any, update: any) => filter.password === stored && (stored = update.$set.password),
+      },
+      start_session: async () => ({ access_token: "token" }),
+      log_audit: () => {},
+    });
+    const login = (rounds: number, password = "hunter2hunter2", username = "geoxor") =>
+      DatabaseManager.prototype.login_user.call(db(rounds) as any, { username, password }, {}, {} as any);
+
+    beforeEach(async () => (stored = await bcrypt.hash("hunter2hunter2", 4)));
+
+    it("rehashes passwords that were hashed with fewer rounds than the config", async () => {
+      await login(6);
+      expect(bcrypt.getRounds(stored)).to.equal(6);
+      expect(await bcrypt.compare("hunter2hunter2", stored)).to.be.true;
+    });
+
+    it("leaves hashes that are at least as expensive alone", async () => {
+      const before = stored;
+      await login(4);
+      expect(stored).to.equal(before);
+    });
+
+    it("finds the user whatever the case of the username", async () => {
+      expect(await login(4, "hunter2hunter2", "GEOXOR")).to.deep.equal({ access_token: "token" });
+    });
+
+    it("doesn't rehash when the password is wrong", async () => {
+      expect(await login(6, "wrong").catch((error) => error)).to.equal("invalid.credentials");
+      expect(bcrypt.getRounds(stored)).to.equal(4);
+    });
+  });
+
+  describe("find_users_after()", () => {
+    const all = Array.from({ length: 7 }, () => new users({ uuid: uuidv4() }));
+    const query = <T>(result: T) => ({
+      maxTimeMS() {
+        return this;
+      },
+      exec: async () => result,
+    });
+    // Only the parts of the database find_users_after touches, ObjectIds made in a row sort in the order they were made
+    const db = {
+      users: {
+        findOne: (filter: any) => query(all.find((user) => user.uuid === filter.uuid) ?? null),
+        find: (filter: any) => {
+          let found = all.filter((user) => !filter._id || user._id.toHexString() > filter._id.$gt.toHexString());
+          return {
+            maxTimeMS() {
+              return this;
+            },
+            sort() {
+              found = [...found].sort((a, b) => a._id.toHexString().localeCompare(b._id.toHexString()));
+              return this;
+            },
+            limit(limit: number) {
+              found = found.slice(0, limit);
+              return this;
+            },
+            exec: async () => found,
+          };
+        },
+      },
+    };
+    const page = (after: string | undefined, limit: number) =>
+      DatabaseManager.prototype.find_users_after.call(db as any, after, limit);
+
+    it("yields every user exactly once when paging all the way through", async () => {
+      const seen: string[] = [];
+      let cursor: string | null | undefined = undefined;
+      let pages = 0;
+      do {
+        const { users, next_cursor }: { users: any[]; next_cursor: string | null } = await page(cursor ?? undefined, 3);
+        seen.push(...users.map((user) => user.uuid));
+        cursor = next_cursor;
+        pages++;
+      } while (cursor && pages < 10);
+      expect(pages).to.equal(3);
+      expect(seen).to.deep.equal(all.map((user) => user.uuid));
+    });
+
+    it("picks up users that signed up while paging", async () => {
+      const first = await page(undefined, all.length);
+      expect(first.next_cursor).to.be.null;
+      all.push(new users({ uuid: uuidv4() }));
+      const { users: added } = await page(first.users[first.users.length - 1].uuid, 3);
+      expect(added.map((user) => user.uuid)).to.deep.equal([all[all.length - 1].uuid]);
+    });
+
+    it("rejects cursors that don't exist", async () => {
+      expect(await page("9d1b1a52-3f0e-4b8c-8f4e-6c0d8d3b2a11", 3).catch((error) => error)).to.equal("invalid.cursor");
+    });
+  });
+
+  describe("audit log", () => {
+    const device = { ip: "203.0.113.7", agent: "curl/7.79.1" };
+
+    // The queue and the writer of a database manager without the rest of it
+    const writer = (insertMany: (entries: any[]) => Promise<unknown>) => ({
+      audit_queue: [],
+      audit_writes: Promise.resolve(),
+      audit_logs: { insertMany },
+      log_audit: DatabaseManager.prototype.log_audit,
+      flush_audit_logs: DatabaseManager.prototype.flush_audit_logs,
+    });
+
+    it("records where the request came from without waiting for the write", async () => {
+      const batches: any[][] = [];
+      const db = writer(async (entries) => batches.push(entries));
+      db.log_audit(user.uuid, "user.login", user.uuid, {}, device);
+      expect(batches).to.be.empty;
+      await new Promise((resolve) => setImmediate(resolve));
+      await db.audit_writes;
+      expect(batches[0][0]).to.deep.include({ action: "user.login", ip: "203.0.113.7", user_agent: "curl/7.79.1" });
+      expect(batches[0][0].uuid).to.be.a("string");
+    });
+
+    it("writes what was audited in the same tick together and in order", async () => {
+      const batches: any[][] = [];
+      const db = writer(async (entries) => batches.push(entries));
+      db.log_audit(user.uuid, "user.login", user.uuid);
+      db.log_audit(user.uuid, "user.password", user.uuid);
+      await new Promise((resolve) => setImmediate(resolve));
+      await db.audit_writes;
+      expect(batches.map((entries) => entries.map((entry) => entry.action))).to.deep.equal([["user.login", "user.password"]]);
+    });
+
+    it("writes what's still queued when it's flushed on shutdown", async () => {
+      const batches: any[][] = [];
+      const db = writer(async (entries) => {
+        await new Promise((resolve) => setTimeout(resolve, 20));
+        batches.push(entries);
+      });
+      db.log_audit(user.uuid, "user.login", user.uuid);
+      await db.flush_audit_logs();
+      expect(batches).to.have.lengthOf(1);
+    });
+
+    it("doesn't fail what was audited when the write fails", async () => {
+      const db = writer(() => Promise.reject(new Error("the database is down")));
+      db.log_audit(user.uuid, "user.password", user.uuid);
+      await db.flush_audit_logs();
+    });
+
+    it("narrows the log down to what was asked for", () => {
+      const own = { $or: [{ actor_uuid: user.uuid }, { subject_uuid: user.uuid }] };
+      expect(DatabaseManager.audit_logs_filter(user.uuid)).to.deep.equal(own);
+      expect(DatabaseManager.audit_logs_filter(user.uuid, { from: 1000, action: "user.login_failed" })).to.deep.equal({
+        ...own,
+        action: "user.login_failed",
+        created_at: { $gte: 1000 },
+      });
+    });
+
+    it("audits wrong passwords for users that exist with where they came from", async () => {
+      const entries: any[][] = [];
+      const db = {
+        users: { findOne: async () => ({ uuid: user.uuid, compare_password: async () => false }) },
+        log_audit: (...args: any[]) => entries.push(args),
+      };
+      const login = DatabaseManager.prototype.login_user.call(
+        db as any,
+        { username: "geoxor", password: "wrong" },
+        {},
+        device
+      );
+      expect(await login.catch((error) => error)).to.equal("invalid.credentials");
+      expect(entries).to.deep.equal([[user.uuid, "user.login_failed", user.uuid, { reason: "invalid.credentials" }, device]]);
+    });
+
+    it("puts the latest entries in the export", async () => {
+      const query = (value: unknown) => ({ sort: () => ({ maxTimeMS: () => ({ exec: async () => value }) }) });
+      const entries = [{ action: "user.password", actor_uuid: user.uuid, subject_uuid: user.uuid, created_at: 2 }];
+      let page: any;
+      const db = {
+        find_machines_by_owner: async () => [],
+        find_labels: async () => [],
+        find_datacenters: async () => [],
+        alerts: { find: () => query([]) },
+        share_links: { find: () => query([]) },
+        find_signup_keys: async () => [],
+        find_api_tokens: async () => [],
+        find_sessions: async () => [],
+        find_friends: async () => [],
+        find_audit_logs: async (uuid: string, pagination: object) => {
+          page = pagination;
+          return { entries, total: 5000 };
+        },
+      };
+      const data = await DatabaseManager.prototype.find_user_export.call(db as any, user);
+      expect(data.audit_log).to.deep.equal(entries);
+      expect(page).to.deep.include({ limit: MAX_EXPORT_AUDIT_ENTRIES, skip: 0 });
+      expect(data.profile).to.not.have.property("password");
+    });
+
+    describe("GET /users/:uuid/audit", () => {
+      const other = new users({ uuid: uuidv4(), username: "nagato" });
+      const entries = [{ action: "user.login", actor_uuid: user.uuid, subject_uuid: user.uuid, created_at: 2 }];
+      let filter: any;
+      const db = {
+        users: { findOne: async ({ uuid }: { uuid: string }) => [user, other].find((found) => found.uuid === uuid) },
+        find_audit_logs: DatabaseManager.prototype.find_audit_logs,
+        audit_logs: {
+          find: (value: object) => {
+            filter = value;
+            const query = { maxTimeMS: () => ({ exec: async () => entries }) };
+            return { sort: () => ({ skip: () => ({ limit: () => query }) }) };
+          },
+          countDocuments: () => ({ maxTimeMS: () => ({ exec: async () => entries.length }) }),
+        },
+      };
+      const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+      const app = express().use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+      const token = (as: typeof user) => jwt.sign({ uuid: as.uuid, username: as.username, token_version: 0 }, "secret");
+
+      it("shows users what they did and what was done to them", async () => {
+        const { body } = await request(app)
+          .get(`/users/uuid/${user.uuid}/audit?limit=10`)
+          .set("Authorization", `Bearer ${token(user)}`)
+          .expect(200);
+        expect(body).to.deep.equal({ items: entries, total: 1, page: 1, pages: 1, limit: 10 });
+        expect(filter).to.deep.equal({ $or: [{ actor_uuid: user.uuid }, { subject_uuid: user.uuid }] });
+      });
+
+      it("doesn't show them anyone else's", async () => {
+        await request(app).get(`/users/${user.uuid}/audit`).set("Authorization", `Bearer ${token(other)}`).expect(403);
+      });
+
+      it("narrows their own down by time and type", async () => {
+        await request(app)
+          .get("/users/@me/audit?type=user.login&from=2021-01-01T00:00:00Z")
+          .set("Authorization", `Bearer ${token(user)}`)
+          .expect(200);
+        expect(filter).to.deep.include({ action: "user.login", created_at: { $gte: Date.parse("2021-01-01T00:00:00Z") } });
+        await request(app).get("/users/@me/audit?type=user.hacked").set("Authorization", `Bearer ${token(user)}`).expect(400);
+      });
+    });
+  });
+
+  describe("update_user()", () => {
+    // Every writer reads the user as it was before any of them wrote, like two tabs editing at once
+    const fake = () => {
+      const stored = { uuid: user.uuid, email: user.email, biography: "I like servers", version: 0 };
+      const read = { ...stored };
+      const db = {
+        find_user: async () => ({ ...read }),
+        users: {
+          exists: async () => null,
+          findOneAndUpdate: async (filter: any, update: any) => {
+            if ((filter.version.$in ? 0 : filter.version) !== stored.version) return null;
+            // What the version plugin does on every write
+            Object.assign(stored, update.$set, { version: stored.version + 1 });
+            return { ...stored };
+          },
+        },
+      };
+      const update = (biography: string, version?: number) =>
+        DatabaseManager.prototype.update_user.call(db as any, user.uuid, { biography }, version);
+      return { stored, update, db };
+    };
+
+    it("rejects the second of two writers that saw the same version", async () => {
+      const { stored, update } = fake();
+      expect((await update("first", 0)).version).to.equal(1);
+      expect(await update("second", 0).catch((error) => error)).to.equal("version.conflict");
+      expect(stored).to.include({ biography: "first", version: 1 });
+    });
+
+    it("doesn't let writers that didn't send a version clobber each other either", async () => {
+      const { stored, update } = fake();
+      await update("first");
+      expect(await update("second").catch((error) => error)).to.equal("version.conflict");
+      expect(stored.biography).to.equal("first");
+    });
+
+    it("rejects versions that were never read before writing", async () => {
+      const { stored, update } = fake();
+      expect(await update("ahead", 3).catch((error) => error)).to.equal("version.conflict");
+      expect(stored.version).to.equal(0);
+    });
+
+    it("stores emails lowercased and rejects usernames that only differ in case", async () => {
+      const { stored, db } = fake();
+      await DatabaseManager.prototype.update_user.call(db as any, user.uuid, { email: " Mirai@Xornet.cloud " });
+      expect(stored.email).to.equal("mirai@xornet.cloud");
+      db.users.exists = async (filter: any) => (filter.username_lower === "nagato" ? { _id: "nagato" } : null) as any;
+      const updated = DatabaseManager.prototype.update_user.call(db as any, user.uuid, { username: "Nagato" });
+      expect(await updated.catch((error) => error)).to.equal("username.exists");
+    });
+
+    it("treats users written before versions existed as version 0", () => {
+      expect(DatabaseManager.at_version(user.uuid, 0)).to.deep.equal({
+        deleted_at: null,
+        uuid: user.uuid,
+        version: { $in: [0, null] },
+      });
+      expect(DatabaseManager.at_version(user.uuid, 2)).to.include({ version: 2 });
+    });
+  });
+
+  describe("admins", () => {
+    it("can't be made through PATCH /users/@me", async () => {
+      let updated = false;
+      const db = {
+        users: { findOne: async () => user },
+        update_user: async () => ((updated = true), user),
+      };
+      const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+      const app = express()
+        .use(express.json())
+        .use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+      const token = jwt.sign({ uuid: user.uuid, username: user.username, token_version: 0 }, "secret");
+      for (const body of [{ is_admin: true }, { role: "admin" }, { bio: "hi", is_admin: true }])
+        await request(app).patch("/users/@me").set("Authorization", `Bearer ${token}`).send(body).expect(400);
+      expect(updated).to.be.false;
+    });
+
+    it("are the only ones who can promote through POST /users/uuid/:uuid/admin", async () => {
+      const admin = new users({ uuid: uuidv4(), username: "nagato", is_admin: true });
+      const toggled: string[] = [];
+      const db = {
+        users: { findOne: async ({ uuid }: { uuid: string }) => (uuid === admin.uuid ? admin : user) },
+        toggle_admin: async (uuid: string) => (toggled.push(uuid), user),
+      };
+      const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+      const app = express().use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+      const promote = (as: typeof admin) =>
+        request(app)
+          .post(`/users/uuid/${user.uuid}/admin`)
+          .set("Authorization", `Bearer ${jwt.sign({ uuid: as.uuid, username: as.username, token_version: 0 }, "secret")}`);
+      await promote(user).expect(403);
+      await promote(admin).expect(200);
+      expect(toggled).to.deep.equal([user.uuid]);
+    });
+
+    it("filter the users they list by whatever they ask for", () => {
+      expect(DatabaseManager.admin_users_filter({})).to.deep.equal({});
+      expect(
+        DatabaseManager.admin_users_filter({ email_verified: false, disabled: true, created_after: 1000, created_before: 2000 })
+      ).to.deep.equal({ email_verified: false, disabled_at: { $ne: null }, created_at: { $gte: 1000, $lt: 2000 } });
+      expect(DatabaseManager.admin_users_filter({ disabled: false, created_before: 2000 })).to.deep.equal({
+        disabled_at: null,
+        created_at: { $lt: 2000 },
+      });
+    });
+
+    it("log out the users they disable and record it", async () => {
+      const calls: { [name: string]: any[] } = {};
+      const db = {
+        users: { findOneAndUpdate: async (...args: any[]) => ((calls.update = args), user) },
+        sessions: { deleteMany: async (filter: object) => (calls.sessions = [filter]) },
+        log_audit: (...args: any[]) => (calls.audit = args),
+      };
+      const device = { ip: "203.0.113.7", agent: "curl/7.79.1" };
+      await DatabaseManager.prototype.disable_user.call(db as any, user.uuid, "admin", device);
+      expect(calls.update[1].$inc).to.deep.equal({ token_version: 1 });
+      expect(calls.sessions[0]).to.deep.equal({ user_uuid: user.uuid });
+      expect(calls.audit).to.deep.equal(["admin", "user.disable", user.uuid, {}, device]);
+    });
+
+    it("stop the machine tokens of users they disable from working", async () => {
+      const db = {
+        find_one: async () => ({ uuid: "mirai", owner_uuid: user.uuid }),
+        users: { exists: async (filter: any) => (filter.disabled_at ? { _id: user.uuid } : null) },
+      };
+      const found = DatabaseManager.prototype.find_machine_by_token.call(db as any, "token");
+      expect(await found.catch((error) => error)).to.equal("machine.notFound");
+    });
+  });
+
+  describe("DELETE /users/uuid/:uuid", () => {
+    const admin = new users({ uuid: uuidv4(), username: "nagato", is_admin: true });
+    const someone = new users({ uuid: uuidv4(), username: "yuki" });
+    const deleted: string[] = [];
+    const db = {
+      users: { findOne: async ({ uuid }: { uuid: string }) => (uuid === admin.uuid ? admin : someone) },
+      soft_delete_user: async (uuid: string) => deleted.push(uuid),
+      request_user_deletion: async (uuid: string, password: string) =>
+        password === "hunter2" ? (deleted.push(uuid), Date.now()) : Promise.reject("invalid.password"),
+    };
+    const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+    const app = express()
+      .use(express.json())
+      .use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+    const remove = (as: typeof admin, uuid: string, body = {}) =>
+      request(app)
+        .delete(`/users/uuid/${uuid}`)
+        .set("Authorization", `Bearer ${jwt.sign({ uuid: as.uuid, username: as.username, token_version: 0 }, "secret")}`)
+        .send(body);
+
+    beforeEach(() => deleted.splice(0));
+
+    it("lets users delete themselves with their password", async () => {
+      await remove(someone, someone.uuid).expect(400);
+      await remove(someone, someone.uuid, { password: "wrong" }).expect(401);
+      expect((await remove(someone, someone.uuid, { password: "hunter2" }).expect(200)).body).to.have.property("purged_at");
+      expect(deleted).to.deep.equal([someone.uuid]);
+    });
+
+    it("only lets admins delete anyone else", async () => {
+      await remove(someone, admin.uuid).expect(403);
+      await remove(admin, someone.uuid).expect(200);
+      expect(deleted).to.deep.equal([someone.uuid]);
+    });
+  });
+
+  describe("GET /users/@verify", () => {
+    it("verifies the email from the link without being logged in", async () => {
+      const verified = new users({ uuid: uuidv4(), username: "nagato", email: "nagato@xornet.cloud", email_verified: true });
+      const db = {
+        verify_email: async (token: string) => (token === "link-token" ? verified : Promise.reject("token.invalid")),
+      };
+      const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+      const app = express().use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+      const { body } = await request(app).get("/users/@verify?token=link-token").expect(200);
+      expect(body).to.include({ uuid: verified.uuid, email_verified: true });
+    });
+  });
+
+  describe("PATCH /users/@avatar and /users/@banner", () => {
+    const url = "https://i.imgur.com/new.png";
+    const patch = async (is_admin: boolean, path: string) => {
+      const patched = new users({ uuid: uuidv4(), username: "nagato", is_admin });
+      patched.update_avatar = async (avatar) => Object.assign(patched, { avatar });
+      patched.update_banner = async (banner) => Object.assign(patched, { banner });
+      const db = { users: { findOne: async () => patched } };
+      const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+      const app = express()
+        .use(express.json())
+        .use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+      const token = jwt.sign({ uuid: patched.uuid, username: patched.username, token_version: 0 }, "secret");
+      return request(app).patch(path).set("Authorization", `Bearer ${token}`).send({ url }).expect(200);
+    };
+
+    it("aren't mistaken for updating a user with the uuid @avatar or @banner", async () => {
+      for (const is_admin of [false, true]) {
+        expect((await patch(is_admin, "/users/@avatar")).body.avatar).to.equal(url);
+        expect((await patch(is_admin, "/users/@banner")).body.banner).to.equal(url);
+      }
+    });
+  });
+
+  describe("friends", () => {
+    const [mirai, nagato] = ["8bb3cf50-077a-4586-8567-58f596504a0e", "1c5b2b7e-5b0e-4c1f-9a3b-2f6f1f7f9d10"];
+    // Both users in memory with just enough of updateOne and updateMany to run the friend queries
+    const fake = () => {
+      const friends: { [uuid: string]: any[] } = { [mirai]: [], [nagato]: [] };
+      const matches = (record: any, query: any) => Object.keys(query).every((key) => record[key] === query[key]);
+      const db: any = {
+        find_user: async ({ uuid }: any) => (friends[uuid] ? new users({ uuid }) : Promise.reject("user.notFound")),
+        users: {
+          updateOne: async (filter: any, update: any) => {
+            const records = friends[filter.uuid];
+            const existing = filter["friends.uuid"]
+              ? records.find((record) => record.uuid === filter["friends.uuid"].$ne)
+              : undefined;
+            if (update.$push) {
+              existing || records.push(update.$push.friends);
+              return { modifiedCount: existing ? 0 : 1 };
+            }
+            const record = filter.friends && records.find((record) => matches(record, filter.friends.$elemMatch));
+            if (!record) return { modifiedCount: 0 };
+            record.status = update.$set["friends.$.status"];
+            return { modifiedCount: 1 };
+          },
+          updateMany: async (filter: any, update: any) => {
+            let modifiedCount = 0;
+            for (const uuid of filter.uuid.$in) {
+              const kept = friends[uuid].filter((record) => !update.$pull.friends.uuid.$in.includes(record.uuid));
+              modifiedCount += kept.length !== friends[uuid].length ? 1 : 0;
+              friends[uuid] = kept;
+            }
+            return { modifiedCount };
+          },
+        },
+      };
+      db.remove_friend = DatabaseManager.prototype.remove_friend;
+      const call = (method: "request_friend" | "accept_friend" | "remove_friend", uuid: string, friend_uuid: string) =>
+        DatabaseManager.prototype[method].call(db, uuid, friend_uuid).catch((error: string) => error);
+      return { friends, call };
+    };
+
+    it("can't befriend yourself", async () => {
+      expect(await fake().call("request_friend", mirai, mirai)).to.equal("invalid.friend");
+    });
+
+    it("gives both users a record of the request", async () => {
+      const { friends, call } = fake();
+      await call("request_friend", mirai, nagato);
+      expect(friends[mirai][0]).to.include({ uuid: nagato, status: "pending", incoming: false });
+      expect(friends[nagato][0]).to.include({ uuid: mirai, status: "pending", incoming: true });
+    });
+
+    it("rejects a request when there already is one either way", async () => {
+      const { call } = fake();
+      await call("request_friend", mirai, nagato);
+      expect(await call("request_friend", mirai, nagato)).to.equal("friend.exists");
+      expect(await call("request_friend", nagato, mirai)).to.equal("friend.exists");
+    });
+
+    it("accepts on both sides but only for who got the request", async () => {
+      const { friends, call } = fake();
+      await call("request_friend", mirai, nagato);
+      expect(await call("accept_friend", mirai, nagato)).to.equal("friend.notFound");
+      await call("accept_friend", nagato, mirai);
+      expect(friends[mirai][0].status).to.equal("accepted");
+      expect(friends[nagato][0].status).to.equal("accepted");
+    });
+
+    it("removes the friend from both sides", async () => {
+      const { friends, call } = fake();
+      await call("request_friend", mirai, nagato);
+      await call("accept_friend", nagato, mirai);
+      await call("remove_friend", nagato, mirai);
+      expect(friends).to.deep.equal({ [mirai]: [], [nagato]: [] });
+      expect(await call("remove_friend", nagato, mirai)).to.equal("friend.notFound");
+    });
+
+    it("lists the friends apart from the requests", async () => {
+      const db = { find_users_by_uuids: async (uuids: string[]) => uuids.map((uuid) => new users({ uuid })) };
+      const record = (uuid: string, status: string, incoming: boolean) => ({ uuid, status, incoming, created_at: 1 });
+      const owner = new users({
+        uuid: mirai,
+        friends: [record(nagato, "accepted", false), record(uuidv4(), "pending", true), record(uuidv4(), "pending", false)],
+      });
+      const list = await DatabaseManager.prototype.find_friends.call(db as any, owner);
+      expect(list.friends.map((friend) => friend.uuid)).to.deep.equal([nagato]);
+      expect(list.friends[0].since).to.equal(1);
+      expect(list.incoming).to.have.lengthOf(1);
+      expect(list.outgoing).to.have.lengthOf(1);
+    });
+  });
+});
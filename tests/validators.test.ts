@@ -97,4 +97,211 @@ describe("Validators", () => {
       }
     });
   });
+
+  describe("validate_machine_tag()", async () => {
+    const VALID_TAGS = ["prod", "eu-west-1", "a".repeat(24)];
+    const INVALID_TAGS = ["", "Prod", "eu_west", "-prod", "prod-", "eu--west", "a".repeat(25), 1];
+
+    describe(`should return true for valid tags`, async () => {
+      for (const tag of VALID_TAGS) {
+        it(`should return true for valid tag: ${tag}`, async () => {
+          expect(Validators.validate_machine_tag(tag)).to.be.true;
+        });
+      }
+    });
+
+    describe(`should return false for invalid tags`, async () => {
+      for (const tag of INVALID_TAGS) {
+        it(`should return false for invalid tag: ${tag}`, async () => {
+          expect(Validators.validate_machine_tag(tag)).to.be.false;
+        });
+      }
+    });
+  });
+
+  describe("validate_username()", async () => {
+    const VALID_USERNAMES = ["geo", "Geoxor", "user1234", "a".repeat(32)];
+    const INVALID_USERNAMES = ["ab", "a".repeat(33), "geo xor", "geo-xor", ""];
+
+    for (const username of VALID_USERNAMES) {
+      it(`should return true for valid username: ${username}`, async () => {
+        expect(Validators.validate_username(username)).to.be.true;
+      });
+    }
+
+    for (const username of INVALID_USERNAMES) {
+      it(`should return false for invalid username: ${username}`, async () => {
+        expect(Validators.validate_username(username)).to.be.false;
+      });
+    }
+  });
+
+  describe("validate_password()", async () => {
+    it("should return true for a password of 8 characters", async () => {
+      expect(Validators.validate_password("12345678")).to.be.true;
+    });
+
+    it("should return false for a password shorter than 8 characters", async () => {
+      expect(Validators.validate_password("1234567")).to.be.false;
+    });
+  });
+
+  describe("validate_signup()", async () => {
+    it("should return undefined for a valid form", async () => {
+      const fields = Validators.validate_signup({ username: "geoxor", email: "geo@xornet.cloud", password: "hunter2hunter2" });
+      expect(fields).to.be.undefined;
+    });
+
+    it("should return the reason for every invalid field", async () => {
+      const fields = Validators.validate_signup({ username: "a b", email: "not an email", password: "short" });
+      expect(fields).to.have.all.keys("username", "email", "password");
+    });
+
+    it("should only return the invalid fields", async () => {
+      const fields = Validators.validate_signup({ username: "geoxor", email: "geo@xornet.cloud", password: "short" });
+      expect(fields).to.have.all.keys("password");
+    });
+  });
+
+  describe("validate_body()", async () => {
+    it("should return the value for a valid body", async () => {
+      const body = { username: "geoxor", password: "hunter2hunter2" };
+      const { value, fields } = Validators.validate_body(Validators.LOGIN_BODY, body);
+      expect(fields).to.be.undefined;
+      expect(value).to.deep.equal(body);
+    });
+
+    it("should reject unknown fields", async () => {
+      const { fields } = Validators.validate_body(Validators.LOGIN_BODY, { usrname: "geoxor", password: "hunter2hunter2" });
+      expect(fields).to.have.all.keys("username", "usrname");
+      expect(fields!.usrname).to.equal("is not allowed");
+    });
+
+    it("should not prefix the reason with the field name", async () => {
+      const { fields } = Validators.validate_body(Validators.SIGNUP_BODY, { username: "geoxor", password: "hunter2hunter2" });
+      expect(fields).to.deep.equal({ email: "is required" });
+    });
+
+    it("should reject untrusted image urls", async () => {
+      const { fields } = Validators.validate_body(Validators.USER_UPDATE_BODY, { avatar: "http://evil.com/a.png" });
+      expect(fields).to.deep.equal({ avatar: "must be a trusted image url" });
+    });
+
+    it("should cap the batch lookup at 100 uuids", async () => {
+      const uuid = "8bb3cf50-077a-4586-8567-58f596504a0e";
+      const batch = (uuids: string[]) => Validators.validate_body(Validators.USER_BATCH_BODY, { uuids }).fields;
+      expect(batch([uuid, "nope"])).to.be.undefined;
+      expect(batch([])).to.have.key("uuids");
+      expect(batch(Array(101).fill(uuid))).to.have.key("uuids");
+    });
+
+    it("should enforce the signup rules on a new password", async () => {
+      const update = (new_password: string) =>
+        Validators.validate_body(Validators.PASSWORD_UPDATE_BODY, { old_password: "hunter2hunter2", new_password }).fields;
+      expect(update("hunter2")).to.have.key("new_password");
+      expect(update("a".repeat(65))).to.have.key("new_password");
+      expect(update("correct horse battery staple")).to.be.undefined;
+    });
+
+    it("should take the new password of a reset as password or new_password", async () => {
+      const reset = (body: object) => Validators.validate_body(Validators.PASSWORD_RESET_BODY, { token: "token", ...body });
+      expect(reset({ new_password: "hunter2hunter2" }).value).to.deep.equal({ token: "token", new_password: "hunter2hunter2" });
+      expect(reset({ password: "hunter2hunter2" }).value).to.deep.equal({ token: "token", new_password: "hunter2hunter2" });
+      expect(reset({ new_password: "hunter2" }).fields).to.have.key("new_password");
+    });
+
+    it("should reject a missing body", async () => {
+      const { fields } = Validators.validate_body(Validators.MACHINE_SIGNUP_BODY, undefined);
+      expect(fields).to.have.all.keys("two_factor_key", "hardware_uuid", "hostname");
+    });
+  });
+
+  describe("validate_dynamic_data()", async () => {
+    const VALID_FRAME = {
+      cpu: { usage: [12, 40], freq: [3600, 3600] },
+      ram: { total: 16000, used: 8000 },
+      swap: { total: 0, used: 0 },
+      disks: [],
+      process_count: 300,
+      network: [{ n: "eth0", tx: 1000, rx: 2000, s: 1000 }],
+      host_uptime: 1000,
+      reporter_uptime: 100,
+    };
+
+    it("should return true for a valid frame", async () => {
+      expect(Validators.validate_dynamic_data(VALID_FRAME)).to.be.true;
+    });
+
+    it("should return false when a required field is missing", async () => {
+      const { ram, ...frame } = VALID_FRAME;
+      expect(Validators.validate_dynamic_data(frame as any)).to.be.false;
+    });
+
+    it("should return false when the cpu usage is out of range", async () => {
+      expect(Validators.validate_dynamic_data({ ...VALID_FRAME, cpu: { usage: [120], freq: [3600] } })).to.be.false;
+    });
+
+    it("should take the processes when the reporter sends them", async () => {
+      const processes = [{ pid: 1, name: "init", cpu: 0.1, ram: 4096 }];
+      expect(Validators.validate_dynamic_data({ ...VALID_FRAME, processes })).to.be.true;
+      expect(Validators.validate_dynamic_data({ ...VALID_FRAME, processes: [{ name: "init" }] } as any)).to.be.false;
+    });
+  });
+
+  describe("validate_user_update()", async () => {
+    it("should only pick the fields that were provided", async () => {
+      const { update, fields } = Validators.validate_user_update({ bio: "I like servers too" });
+      expect(fields).to.be.undefined;
+      expect(update).to.deep.equal({ biography: "I like servers too" });
+    });
+
+    it("should leave everything untouched for an empty body", async () => {
+      const { update, fields } = Validators.validate_user_update({});
+      expect(fields).to.be.undefined;
+      expect(update).to.deep.equal({});
+    });
+
+    it("should ignore fields that aren't updatable", async () => {
+      const { update } = Validators.validate_user_update({ username: "geoxor", is_admin: true } as any);
+      expect(update).to.deep.equal({ username: "geoxor" });
+    });
+
+    it("should pick a valid email", async () => {
+      const { update, fields } = Validators.validate_user_update({ email: "geo@xornet.cloud" });
+      expect(fields).to.be.undefined;
+      expect(update).to.deep.equal({ email: "geo@xornet.cloud" });
+    });
+
+    it("should only take the profile visibilities there are", async () => {
+      expect(Validators.validate_user_update({ profile_visibility: "friends" }).update).to.deep.equal({
+        profile_visibility: "friends",
+      });
+      const { fields } = Validators.validate_user_update({ profile_visibility: "secret" } as any);
+      expect(fields).to.have.all.keys("profile_visibility");
+    });
+
+    it("should allow clearing the biography", async () => {
+      const { update } = Validators.validate_user_update({ bio: "" });
+      expect(update).to.deep.equal({ biography: "" });
+    });
+
+    it("should return the reason for every invalid field", async () => {
+      const { fields } = Validators.validate_user_update({
+        username: "a",
+        email: "geo@",
+        avatar: "http://evil.com/a.png",
+        bio: "a".repeat(301),
+      });
+      expect(fields).to.have.all.keys("username", "email", "avatar", "bio");
+    });
+
+    it("should say why each field failed with the same rules as the body", async () => {
+      const { update, fields } = Validators.validate_user_update({ username: "a", location: "a".repeat(65) });
+      expect(update).to.deep.equal({});
+      expect(fields).to.deep.equal({
+        username: "length must be at least 3 characters long",
+        location: "length must be less than or equal to 64 characters long",
+      });
+    });
+  });
 });
@@ -0,0 +1,271 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import crypto from "crypto";
+import express from "express";
+import http from "http";
+import { AddressInfo } from "net";
+import jwt from "jsonwebtoken";
+import request from "supertest";
+import { postWebhook, WebhookDispatcher } from "../src/classes/webhookDispatcher.class";
+import { WebsocketManager } from "../src/classes/websocketManager.class";
+import { Config } from "../src/config";
+import { DatabaseManager } from "../src/database/DatabaseManager";
+import {
+  generate_webhook_secret,
+  MAX_WEBHOOK_FAILURES,
+  sign_webhook,
+  WEBHOOK_SIGNATURE_PREFIX,
+  webhooks,
+} from "../src/database/schemas/webhook";
+import { WEBHOOK_RETRY_BASE, WEBHOOK_RETRY_WINDOW, webhook_retry_delay } from "../src/database/schemas/webhookDelivery";
+import { V1 } from "../src/routes/v1/v1";
+import { Time } from "../src/types";
+import { Mailer } from "../src/utils/mailer";
+
+const user = { uuid: "8bb3cf50-077a-4586-8567-58f596504a0e", is_token_current: () => true };
+
+// The deliveries collection keeping what's written so the tests can look at it
+const deliveries = () => {
+  const written: any[] = [];
+  return {
+    written,
+    insertMany: async (values: any[]) => (written.push(...values), values),
+    updateOne: async ({ uuid }: any, { $set }: any) => Object.assign(written.find((value) => value.uuid === uuid), $set),
+    deleteOne: async ({ uuid }: any) => written.splice(written.findIndex((value) => value.uuid === uuid), 1),
+  };
+};
+
+describe("Webhooks", () => {
+  describe("generate_webhook_secret()", () => {
+    it("generates a different secret every time", () => {
+      expect(generate_webhook_secret()).to.match(/^whsec_[0-9a-f]{48}$/);
+      expect(generate_webhook_secret()).to.not.equal(generate_webhook_secret());
+    });
+  });
+
+  describe("sign_webhook()", () => {
+    it("signs with an HMAC the receivers can compute themselves", () => {
+      const body = JSON.stringify({ event: "machine.online" });
+      const expected = crypto.createHmac("sha256", "whsec_test").update(body).digest("hex");
+      expect(sign_webhook("whsec_test", body)).to.equal(`${WEBHOOK_SIGNATURE_PREFIX}${expected}`);
+      expect(sign_webhook("whsec_other", body)).to.not.equal(sign_webhook("whsec_test", body));
+    });
+  });
+
+  describe("toJSON()", () => {
+    it("never sends the secret", () => {
+      const webhook = new webhooks({ user_uuid: user.uuid, url: "https://example.com", events: [], secret: "whsec_a" });
+      expect(webhook.toJSON()).to.not.have.any.keys("secret", "_id", "__v");
+    });
+  });
+
+  describe("webhook_retry_delay()", () => {
+    it("doubles the wait after every attempt", () => {
+      expect([1, 2, 3, 4].map(webhook_retry_delay)).to.deep.equal([1, 2, 4, 8].map((n) => n * WEBHOOK_RETRY_BASE));
+      expect(webhook_retry_delay(0)).to.equal(WEBHOOK_RETRY_BASE);
+    });
+  });
+
+  describe("queue_webhook_deliveries()", () => {
+    it("only queues for the subscribed webhooks of the owner of each machine", async () => {
+      let filter: any;
+      const db = {
+        machines: {
+          find: () => ({
+            setOptions: async () => [
+              { uuid: "mirai", name: "Mirai", owner_uuid: "geoxor" },
+              { uuid: "nagato", name: "Nagato", owner_uuid: "nagato" },
+            ],
+          }),
+        },
+        webhooks: {
+          find: async (value: any) => {
+            filter = value;
+            return [
+              { uuid: "a", user_uuid: "geoxor" },
+              { uuid: "b", user_uuid: "geoxor" },
+              { uuid: "c", user_uuid: "someone" },
+            ];
+          },
+        },
+        webhook_deliveries: deliveries(),
+        queue_deliveries: (DatabaseManager.prototype as any).queue_deliveries,
+      };
+      const queued = await DatabaseManager.prototype.queue_webhook_deliveries.call(
+        db as any,
+        "machine.offline",
+        ["mirai", "nagato"],
+        1000
+      );
+      expect(queued).to.equal(2);
+      expect(filter).to.deep.equal({ user_uuid: { $in: ["geoxor", "nagato"] }, events: "machine.offline", disabled_at: null });
+      expect(db.webhook_deliveries.written.map((delivery) => delivery.webhook_uuid)).to.deep.equal(["a", "b"]);
+      const payload = JSON.parse(db.webhook_deliveries.written[0].body);
+      expect(payload).to.deep.include({ event: "machine.offline", created_at: 1000 });
+      expect(payload.id).to.equal(db.webhook_deliveries.written[0].uuid);
+      expect(payload.data).to.deep.equal({ machine: { uuid: "mirai", name: "Mirai" } });
+    });
+
+    it("sends what else the event is about along with the machine", async () => {
+      const db = {
+        machines: { find: () => ({ setOptions: async () => [{ uuid: "mirai", name: "Mirai", owner_uuid: "geoxor" }] }) },
+        webhooks: { find: async () => [{ uuid: "a", user_uuid: "geoxor" }] },
+        webhook_deliveries: deliveries(),
+        queue_deliveries: (DatabaseManager.prototype as any).queue_deliveries,
+      };
+      const rule = { uuid: "rule", metric: "cpu", operator: ">", threshold: 90, duration: 0 };
+      const alert = { rule, observed: 95, fired_at: 1000 };
+      await DatabaseManager.prototype.queue_webhook_deliveries.call(db as any, "alert.fired", ["mirai"], 1000, {
+        alert: alert as any,
+      });
+      const payload = JSON.parse(db.webhook_deliveries.written[0].body);
+      expect(payload).to.deep.include({ event: "alert.fired", data: { alert, machine: { uuid: "mirai", name: "Mirai" } } });
+    });
+  });
+
+  describe("fail_webhook_delivery()", () => {
+    const setup = (failures: number) => {
+      const webhook = { uuid: "a", failures, disabled_at: undefined as number | undefined };
+      const db = {
+        webhook_deliveries: deliveries(),
+        webhooks: {
+          findOneAndUpdate: async (_: object, { $inc }: any) => ((webhook.failures += $inc.failures), webhook),
+          updateOne: async (_: object, { $set }: any) => Object.assign(webhook, $set),
+        },
+        drop_webhook_delivery: DatabaseManager.prototype.drop_webhook_delivery,
+      };
+      const delivery = { uuid: "d", webhook_uuid: "a", attempts: 1, created_at: new Date(0) };
+      db.webhook_deliveries.written.push(delivery);
+      const fail = (now: number) =>
+        DatabaseManager.prototype.fail_webhook_delivery.call(db as any, delivery as any, "500", now);
+      return { db, webhook, delivery, fail };
+    };
+
+    it("retries with a backoff until the window is over", async () => {
+      const { db, webhook, delivery, fail } = setup(0);
+      expect(await fail(Time.Minute)).to.be.true;
+      expect(delivery).to.deep.include({ next_attempt_at: new Date(Time.Minute + WEBHOOK_RETRY_BASE), last_error: "500" });
+      expect(db.webhook_deliveries.written).to.have.lengthOf(1);
+      expect(webhook.failures).to.equal(0);
+    });
+
+    it("gives up after the window and counts it against the webhook", async () => {
+      const { db, webhook, fail } = setup(0);
+      expect(await fail(WEBHOOK_RETRY_WINDOW)).to.be.false;
+      expect(db.webhook_deliveries.written).to.be.empty;
+      expect(webhook.failures).to.equal(1);
+      expect(webhook.disabled_at).to.be.undefined;
+    });
+
+    it("disables the webhook once too many deliveries in a row were given up on", async () => {
+      const { webhook, fail } = setup(MAX_WEBHOOK_FAILURES - 1);
+      await fail(WEBHOOK_RETRY_WINDOW);
+      expect(webhook.disabled_at).to.equal(WEBHOOK_RETRY_WINDOW);
+    });
+  });
+
+  describe("postWebhook()", () => {
+    it("sends the body it was signed over with the signature", async () => {
+      let received: { headers: http.IncomingHttpHeaders; body: string } | undefined;
+      const server = express()
+        .post("/hooks", express.text({ type: "*/*" }), (req, res) => {
+          received = { headers: req.headers, body: req.body };
+          res.send();
+        })
+        .listen(0);
+      const { port } = server.address() as AddressInfo;
+      const delivery = { uuid: "d", event: "machine.online", body: '{"id":"d"}' };
+      await postWebhook({ url: `http://localhost:${port}/hooks`, secret: "whsec_a" }, delivery as any).finally(() =>
+        server.close()
+      );
+      expect(received!.body).to.equal(delivery.body);
+      expect(received!.headers).to.deep.include({
+        "x-xornet-event": "machine.online",
+        "x-xornet-delivery": "d",
+        "x-xornet-signature": sign_webhook("whsec_a", delivery.body),
+      });
+    });
+  });
+
+  describe("WebhookDispatcher", () => {
+    const delivery = { uuid: "d", webhook_uuid: "a", event: "machine.online", body: '{"id":"d"}', attempts: 1 };
+    const setup = (webhook: object | null, post: (webhook: any, delivery: any) => Promise<unknown>) => {
+      const calls: string[] = [];
+      const db = {
+        find_delivery_webhook: async () => webhook,
+        drop_webhook_delivery: async () => calls.push("dropped"),
+        complete_webhook_delivery: async () => calls.push("completed"),
+        fail_webhook_delivery: async (_: object, error: string) => calls.push(`failed ${error}`),
+      };
+      return { dispatcher: new WebhookDispatcher(db as any, post as any), calls };
+    };
+
+    it("completes the deliveries that were received", async () => {
+      const { dispatcher, calls } = setup({ url: "https://example.com", secret: "whsec_a" }, async () => {});
+      await dispatcher.attempt(delivery as any);
+      expect(calls).to.deep.equal(["completed"]);
+    });
+
+    it("fails the deliveries that weren't answered with a 2xx with the status", async () => {
+      const { dispatcher, calls } = setup({ url: "https://example.com", secret: "whsec_a" }, () =>
+        Promise.reject({ response: { status: 503 } })
+      );
+      await dispatcher.attempt(delivery as any);
+      expect(calls).to.deep.equal(["failed 503"]);
+    });
+
+    it("drops the deliveries of webhooks that were deleted", async () => {
+      const { dispatcher, calls } = setup(null, () => Promise.reject(new Error("shouldn't be sent")));
+      await dispatcher.attempt(delivery as any);
+      expect(calls).to.deep.equal(["dropped"]);
+    });
+  });
+
+  describe("/v1/users/@me/webhooks", () => {
+    const config = { jwt: { secret: "secret", expiration: "15m" }, limits: { upload: 1024 } } as Config;
+    const login = jwt.sign({ uuid: user.uuid, username: "geoxor", token_version: 0 }, "secret");
+    const stored: any[] = [];
+    const db = {
+      users: { findOne: async () => user },
+      webhooks: {
+        countDocuments: async () => stored.length,
+        create: async (value: object) => {
+          const webhook = new webhooks({ uuid: `webhook-${stored.length}`, ...value });
+          stored.push(webhook);
+          return webhook;
+        },
+        find: () => ({ sort: () => stored }),
+      },
+      log_audit: () => {},
+      new_webhook: DatabaseManager.prototype.new_webhook,
+      find_webhooks: DatabaseManager.prototype.find_webhooks,
+    };
+    const app = express()
+      .use(express.json())
+      .use(new V1(db as any, {} as WebsocketManager, {} as Mailer, config).router);
+
+    it("shows the secret once when it's created", async () => {
+      const { body: created } = await request(app)
+        .post("/v1/users/@me/webhooks")
+        .set("Authorization", `Bearer ${login}`)
+        .send({ url: "https://example.com/hooks", events: ["machine.offline"] })
+        .expect(201);
+      expect(created.secret).to.match(/^whsec_/);
+      expect(created).to.deep.include({ url: "https://example.com/hooks", events: ["machine.offline"] });
+      const { body: listed } = await request(app)
+        .get("/v1/users/@me/webhooks")
+        .set("Authorization", `Bearer ${login}`)
+        .expect(200);
+      expect(listed).to.have.lengthOf(1);
+      expect(listed[0]).to.not.have.property("secret");
+    });
+
+    it("only takes https urls and the events there are", async () => {
+      const post = (body: object) =>
+        request(app).post("/v1/users/@me/webhooks").set("Authorization", `Bearer ${login}`).send(body).expect(400);
+      await post({ url: "http://example.com/hooks", events: ["machine.offline"] });
+      await post({ url: "https://example.com/hooks", events: ["machine.exploded"] });
+      await post({ url: "https://example.com/hooks", events: [] });
+    });
+  });
+});
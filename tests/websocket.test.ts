@@ -0,0 +1,122 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import { EventEmitter } from "events";
+import http from "http";
+import { MachineHub } from "../src/classes/machineHub.class";
+import { WebsocketManager } from "../src/classes/websocketManager.class";
+import { IComputedDynamicData, IDynamicData, MachineStatus } from "../src/database/schemas/machine";
+import { encodeMsgpack } from "../src/utils/msgpack";
+import { negotiateReporterProtocol, requestedReporterProtocol } from "../src/utils/reporterProtocol";
+import { FrameEncoding, WebsocketConnection } from "../src/utils/ws";
+
+const stats = (uuid: string, timestamp: number) => ({ uuid, timestamp } as IComputedDynamicData);
+
+describe("WebsocketManager", () => {
+  describe("snapshot()", () => {
+    it("prefers the stats this shard got over the stored ones", () => {
+      const manager = { latestStats: new Map([["mirai", stats("mirai", 2000)]]) };
+      const snapshot = WebsocketManager.prototype.snapshot.call(manager as any, [
+        { uuid: "mirai", dynamic_data: stats("mirai", 1000) },
+        { uuid: "nagato", dynamic_data: stats("nagato", 1000) },
+      ]);
+      expect(snapshot).to.deep.equal({ mirai: stats("mirai", 2000), nagato: stats("nagato", 1000) });
+    });
+
+    it("leaves out machines that never reported", () => {
+      const manager = { latestStats: new Map() };
+      expect(WebsocketManager.prototype.snapshot.call(manager as any, [{ uuid: "mirai" }])).to.deep.equal({});
+    });
+  });
+
+  describe("handleMachineRemoved()", () => {
+    it("tells the clients watching the machine it's gone and stops sending them its frames", () => {
+      const frames: [string, unknown][] = [];
+      const connection = { emit: (event: any, data: any) => frames.push([event, data]), onClose: () => {} };
+      let revoked: string | undefined;
+      const manager = { clientHub: new MachineHub<any>(), handleMachineRevoked: (uuid: string) => (revoked = uuid) };
+      manager.clientHub.register(connection, "geoxor", ["mirai", "nagato"]);
+      WebsocketManager.prototype.handleMachineRemoved.call(manager as any, "mirai");
+      manager.clientHub.publish("mirai", "dynamic-data", stats("mirai", 1000));
+      manager.clientHub.publish("nagato", "dynamic-data", stats("nagato", 1000));
+      expect(frames).to.deep.equal([
+        ["machine-removed", { uuid: "mirai" }],
+        ["dynamic-data", stats("nagato", 1000)],
+      ]);
+      expect(revoked).to.equal("mirai");
+    });
+  });
+
+  describe("reporter protocols", () => {
+    it("gives reporters that don't ask the first version", () => {
+      expect(negotiateReporterProtocol({}).protocol).to.deep.equal({ version: 1, encoding: "json" });
+      expect(requestedReporterProtocol("/reporter")).to.be.undefined;
+    });
+
+    it("gives reporters the protocol they asked for in the url or the protocol frame", () => {
+      const requested = requestedReporterProtocol("/reporter?version=2&encoding=msgpack")!;
+      expect(negotiateReporterProtocol(requested).protocol).to.deep.equal({ version: 2, encoding: "msgpack" });
+      expect(negotiateReporterProtocol({ version: 2 }).protocol).to.deep.equal({ version: 2, encoding: "json" });
+    });
+
+    it("tells reporters that asked for something that isn't supported what is", () => {
+      for (const requested of [{ version: 3 }, { version: 1, encoding: "msgpack" }, { version: "two" }, { encoding: "xml" }]) {
+        const { protocol, rejection } = negotiateReporterProtocol(requested);
+        expect(protocol).to.be.undefined;
+        expect(rejection).to.deep.include({ code: "unsupported.protocol" });
+        expect(rejection!.supported).to.deep.include({ version: 2, encoding: "msgpack" });
+      }
+    });
+  });
+
+  describe("ingestDynamicData()", () => {
+    const frame: IDynamicData = {
+      cpu: { usage: [12, 40], freq: [3600, 3600] },
+      ram: { total: 16000, used: 8000 },
+      swap: { total: 0, used: 0 },
+      disks: [{ fs: "/dev/sda1", type: "ext4", total: 512000, used: 128000.25, mount: "/" }],
+      process_count: 300,
+      network: [{ n: "eth0", tx: 1000.5, rx: 2000, s: 1000 }],
+      host_uptime: 1000,
+      reporter_uptime: 100,
+      processes: [{ pid: 1, name: "init", cpu: 0.1, ram: 4096 }],
+      temps: [{ label: "cpu", value: -5 }],
+    };
+
+    // What a frame in an encoding ends up writing to the database once it went through the socket
+    const stored = async (encoding: FrameEncoding, message: Buffer) => {
+      const socket = new EventEmitter();
+      const connection = new WebsocketConnection<any>(socket as any, {} as http.IncomingMessage);
+      connection.encoding = encoding;
+      const received = new Promise<IDynamicData>((resolve) => connection.on("dynamic-data", resolve));
+      socket.emit("message", message, encoding === "msgpack");
+      const writes: unknown[][] = [];
+      const record =
+        (name: string) =>
+        async (...args: any[]) => {
+          // The time it was received is the only thing that should differ
+          writes.push([name, ...args.map((arg) => (arg?.timestamp ? { ...arg, timestamp: 0 } : arg))].slice(0, 3));
+          return MachineStatus.Online;
+        };
+      const manager = {
+        db: {
+          update_machine_stats: record("update_machine_stats"),
+          insert_stat_point: record("insert_stat_point"),
+          update_machine_details: record("update_machine_details"),
+        },
+        pendingIngests: new Set(),
+        alerts: { observe: () => {} },
+        handleDynamicData: () => {},
+      };
+      await WebsocketManager.prototype.ingestDynamicData.call(manager as any, { uuid: "mirai" } as any, await received, 20);
+      return writes;
+    };
+
+    it("stores the same documents whether the frame was JSON or MessagePack", async () => {
+      const message = { e: "dynamic-data", d: frame };
+      const json = await stored("json", Buffer.from(JSON.stringify(message)));
+      const msgpack = await stored("msgpack", encodeMsgpack(message));
+      expect(json).to.have.lengthOf(3);
+      expect(msgpack).to.deep.equal(json);
+    });
+  });
+});
@@ -0,0 +1,141 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import { EventEmitter } from "events";
+import http from "http";
+import ws from "ws";
+import { MachineHub } from "../src/classes/machineHub.class";
+import { metrics } from "../src/utils/metrics";
+import { encodeMsgpack } from "../src/utils/msgpack";
+import { parseData, WEBSOCKET_IDLE_TIMEOUT, WEBSOCKET_MAX_QUEUE, WebsocketConnection } from "../src/utils/ws";
+
+/**
+ * A socket that counts what it was sent, stuck ones never finish writing like a client that stopped reading
+ */
+class FakeSocket extends EventEmitter {
+  public readyState = ws.OPEN;
+  public bufferedAmount = 0;
+  public sent: string[] = [];
+  public pings = 0;
+  public terminated = false;
+
+  constructor(private stuck = false) {
+    super();
+  }
+
+  send(frame: string, callback: () => void) {
+    this.bufferedAmount += frame.length;
+    if (this.stuck) return;
+    this.sent.push(frame);
+    setImmediate(() => ((this.bufferedAmount -= frame.length), callback()));
+  }
+
+  ping() {
+    this.pings++;
+  }
+
+  terminate() {
+    this.terminated = true;
+  }
+}
+
+const connect = (socket: FakeSocket) => new WebsocketConnection<any>(socket as any, {} as http.IncomingMessage);
+
+describe("WebsocketConnection", () => {
+  describe("send()", () => {
+    it("sends everything to a socket that keeps up", async () => {
+      const socket = new FakeSocket();
+      const connection = connect(socket);
+      for (let i = 0; i < WEBSOCKET_MAX_QUEUE * 2; i++) connection.emit("dynamic-data", { i });
+      await new Promise((resolve) => setTimeout(resolve, 50));
+      expect(socket.sent).to.have.lengthOf(WEBSOCKET_MAX_QUEUE * 2);
+      expect(connection.droppedFrames).to.equal(0);
+    });
+
+    it("drops the oldest frames of a socket that fell behind", () => {
+      const socket = new FakeSocket(true);
+      socket.bufferedAmount = Infinity;
+      const connection = connect(socket);
+      for (let i = 0; i < WEBSOCKET_MAX_QUEUE + 10; i++) connection.emit("dynamic-data", { i });
+      expect(connection.queued).to.equal(WEBSOCKET_MAX_QUEUE);
+      expect(connection.droppedFrames).to.equal(10);
+      expect(metrics.render()).to.match(/xornet_websocket_frames_dropped_total \d+/);
+    });
+
+    it("keeps the memory bounded with hundreds of stuck clients", function () {
+      this.timeout(20000);
+      const hub = new MachineHub<any>();
+      const sockets = Array.from({ length: 300 }, () => new FakeSocket(true));
+      sockets.forEach((socket) => hub.register(connect(socket), "mirai", ["nagato"]));
+      // Roughly the size of the stats of a machine with a few disks and interfaces
+      const stats = { uuid: "nagato", padding: "x".repeat(1024) };
+      const before = process.memoryUsage().heapUsed;
+      for (let i = 0; i < 1000; i++) hub.publish("nagato", "dynamic-data", { ...stats, timestamp: i });
+      const grown = process.memoryUsage().heapUsed - before;
+      // Keeping every frame would be around 300MB, the queues hold at most 64 frames each
+      expect(grown).to.be.below(150 * 1024 * 1024);
+      expect(Math.max(...sockets.map((socket) => socket.bufferedAmount))).to.be.below(512 * 1024);
+    });
+  });
+
+  describe("heartbeat()", () => {
+    it("pings sockets that were seen recently", () => {
+      const socket = new FakeSocket();
+      expect(connect(socket).heartbeat()).to.be.true;
+      expect(socket.pings).to.equal(1);
+    });
+
+    it("terminates sockets that stopped answering", () => {
+      const socket = new FakeSocket();
+      const connection = connect(socket);
+      expect(connection.heartbeat(Date.now() + WEBSOCKET_IDLE_TIMEOUT + 1)).to.be.false;
+      expect(socket.terminated).to.be.true;
+      expect(metrics.render()).to.match(/xornet_websocket_connections_reaped_total [1-9]/);
+    });
+
+    it("counts a pong as the socket being alive", () => {
+      const socket = new FakeSocket();
+      const connection = connect(socket);
+      connection.lastSeen = 0;
+      socket.emit("pong");
+      expect(connection.heartbeat()).to.be.true;
+    });
+  });
+
+  describe("binary frames", () => {
+    const frame = { e: "dynamic-data", d: { cpu: { usage: [12] } } };
+    const received = (connection: WebsocketConnection<any>) => {
+      const frames: unknown[] = [];
+      connection.on("dynamic-data", (data) => frames.push(data));
+      return frames;
+    };
+
+    it("reads them as MessagePack once the socket asked for it", () => {
+      const socket = new FakeSocket();
+      const connection = connect(socket);
+      const frames = received(connection);
+      connection.encoding = "msgpack";
+      socket.emit("message", encodeMsgpack(frame), true);
+      socket.emit("message", Buffer.from(JSON.stringify(frame)), false);
+      expect(frames).to.deep.equal([frame.d, frame.d]);
+    });
+
+    it("reads them as JSON like before for sockets that didn't", () => {
+      const socket = new FakeSocket();
+      const connection = connect(socket);
+      const frames = received(connection);
+      socket.emit("message", Buffer.from(JSON.stringify(frame)), true);
+      socket.emit("message", encodeMsgpack(frame), true);
+      expect(frames).to.deep.equal([frame.d]);
+      expect(connection.malformedFrames).to.equal(1);
+    });
+  });
+});
+
+describe("parseData()", () => {
+  it("only takes frames that are events", () => {
+    expect(parseData(Buffer.from('{"e": "login", "d": {}}'))).to.deep.equal({ e: "login", d: {} });
+    expect(parseData(Buffer.from('{"version": 2}'))).to.be.undefined;
+    expect(parseData(encodeMsgpack({ d: {} }), "msgpack")).to.be.undefined;
+    expect(parseData(Buffer.from([0xc1]), "msgpack")).to.be.undefined;
+  });
+});
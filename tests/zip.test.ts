@@ -0,0 +1,97 @@
+import { describe, it } from "mocha";
+import { expect } from "chai";
+import crypto from "crypto";
+import { PassThrough } from "stream";
+import zlib from "zlib";
+import { crc32, ZipWriter } from "../src/utils/zip";
+
+// Reads the files back out of an archive through its central directory like an unzipper would
+const unzip = (archive: Buffer) => {
+  const end = archive.length - 22;
+  expect(archive.readUInt32LE(end)).to.equal(0x06054b50);
+  const files: { [name: string]: string } = {};
+  let offset = archive.readUInt32LE(end + 16);
+  for (let i = 0; i < archive.readUInt16LE(end + 10); i++) {
+    expect(archive.readUInt32LE(offset)).to.equal(0x02014b50);
+    const [crc, compressed, size] = [16, 20, 24].map((at) => archive.readUInt32LE(offset + at));
+    const name = archive.subarray(offset + 46, offset + 46 + archive.readUInt16LE(offset + 28)).toString();
+    const header = archive.readUInt32LE(offset + 42);
+    const start = header + 30 + archive.readUInt16LE(header + 26) + archive.readUInt16LE(header + 28);
+    const content = zlib.inflateRawSync(archive.subarray(start, start + compressed));
+    expect(content).to.have.lengthOf(size);
+    expect(crc32(content)).to.equal(crc);
+    files[name] = content.toString();
+    offset += 46 + name.length;
+  }
+  return files;
+};
+
+const collect = (stream: PassThrough) => {
+  const chunks: Buffer[] = [];
+  stream.on("data", (chunk) => chunks.push(chunk));
+  return () => Buffer.concat(chunks);
+};
+
+describe("Zip", () => {
+  describe("crc32()", () => {
+    it("matches the checksum zip files use", () => {
+      expect(crc32(Buffer.from("123456789"))).to.equal(0xcbf43926);
+      expect(crc32(Buffer.alloc(0))).to.equal(0);
+    });
+
+    it("checksums in chunks the same as all at once", () => {
+      expect(crc32(Buffer.from("56789"), crc32(Buffer.from("1234")))).to.equal(0xcbf43926);
+    });
+  });
+
+  describe("ZipWriter", () => {
+    it("writes archives every file can be read back out of", async () => {
+      const output = new PassThrough();
+      const archive = collect(output);
+      const zip = new ZipWriter(output);
+      async function* lines() {
+        for (let i = 0; i < 1000; i++) yield `{"i":${i}}\n`;
+      }
+      await zip.add("profile.json", '{"username":"geoxor"}');
+      await zip.add("stats/mirai.ndjson", lines());
+      await zip.add("empty.json", Buffer.alloc(0));
+      const size = await zip.finish();
+
+      expect(archive()).to.have.lengthOf(size);
+      const files = unzip(archive());
+      expect(Object.keys(files)).to.deep.equal(["profile.json", "stats/mirai.ndjson", "empty.json"]);
+      expect(files["profile.json"]).to.equal('{"username":"geoxor"}');
+      expect(files["stats/mirai.ndjson"].split("\n")).to.have.lengthOf(1001);
+      expect(files["empty.json"]).to.equal("");
+    });
+
+    it("waits for the output to drain", async () => {
+      const output = new PassThrough({ highWaterMark: 16 });
+      const zip = new ZipWriter(output);
+      let written = false;
+      const adding = zip.add("random.bin", crypto.randomBytes(64 * 1024)).then(() => (written = true));
+      await new Promise((resolve) => setTimeout(resolve, 20));
+      expect(written).to.be.false;
+      const archive = collect(output);
+      await adding;
+      await zip.finish();
+      expect(Object.keys(unzip(archive()))).to.deep.equal(["random.bin"]);
+    });
+
+    it("stops once the output closes", async () => {
+      const output = new PassThrough({ highWaterMark: 16 });
+      const zip = new ZipWriter(output);
+      let read = 0;
+      async function* forever() {
+        for (;;) yield `${read++}\n`;
+      }
+      const adding = zip.add("forever.txt", forever());
+      setTimeout(() => output.destroy(), 20);
+      const error = await adding.catch((error) => error);
+      expect(error).to.be.an("error");
+      const stopped = read;
+      await new Promise((resolve) => setTimeout(resolve, 20));
+      expect(read).to.equal(stopped);
+    });
+  });
+});